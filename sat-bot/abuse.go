@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of abuse, and how many points each earns a client.
+const (
+	abuseRateLimited = "rate_limited"
+	abuseInjection   = "injection"
+	abuseModeration  = "moderation"
+)
+
+var abuseWeights = map[string]int{
+	abuseRateLimited: 1,
+	abuseInjection:   3,
+	abuseModeration:  3,
+}
+
+// Ban is a client IP temporarily refused service for abuse.
+type Ban struct {
+	IP        string    `json:"ip"`
+	Reason    string    `json:"reason"`
+	BannedAt  time.Time `json:"banned_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Offense counts the bans of this IP, which each last longer than the
+	// one before.
+	Offense int `json:"offense"`
+}
+
+// abuseRecord is what is known about one client IP.
+type abuseRecord struct {
+	events    []abuseEvent
+	ban       *Ban
+	offenses  int
+	lastBanAt time.Time
+}
+
+type abuseEvent struct {
+	kind string
+	at   time.Time
+}
+
+// abuseTracker scores clients on the abuse they are caught at, and bans
+// those scoring threshold points within window. Bans last durations[0],
+// then each following duration for repeat offenders, until forgiveAfter
+// has passed since the last ban. Bans are kept in memory; an IP to keep out
+// for good belongs on the blocklist.
+type abuseTracker struct {
+	threshold    int
+	window       time.Duration
+	durations    []time.Duration
+	forgiveAfter time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*abuseRecord
+}
+
+var (
+	// abuse is nil when automatic bans are off.
+	abuse *abuseTracker
+
+	abuseBans = expvar.NewMap("abuse_bans")
+)
+
+// loadAbuseConfig reads ABUSE_BAN_THRESHOLD, the points within ABUSE_WINDOW
+// (10m by default) that get a client IP banned, 0 (the default) turning
+// bans off: being rate limited earns a point, and a prompt injection attempt
+// or a message refused by moderation three. ABUSE_BAN_DURATIONS lists how
+// long the first and following bans last (10m,1h,24h by default), and
+// ABUSE_FORGIVE_AFTER how long after its last ban an IP starts over from the
+// first (24h by default).
+func loadAbuseConfig() {
+	threshold := getEnvInt("ABUSE_BAN_THRESHOLD", 0)
+	if threshold <= 0 {
+		return
+	}
+	tracker := &abuseTracker{
+		threshold:    threshold,
+		window:       getEnvDuration("ABUSE_WINDOW", 10*time.Minute),
+		forgiveAfter: getEnvDuration("ABUSE_FORGIVE_AFTER", 24*time.Hour),
+		clients:      map[string]*abuseRecord{},
+	}
+	for _, s := range strings.Split(getEnv("ABUSE_BAN_DURATIONS", "10m,1h,24h"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			configProblem("ABUSE_BAN_DURATIONS: %q is not a positive duration", s)
+			continue
+		}
+		tracker.durations = append(tracker.durations, d)
+	}
+	if len(tracker.durations) == 0 || tracker.window <= 0 {
+		configProblem("ABUSE_BAN_DURATIONS or ABUSE_WINDOW: must be positive")
+		return
+	}
+	abuse = tracker
+	go tracker.janitor(time.Minute)
+	slog.Info("Banning abusive clients", "threshold", threshold, "window", tracker.window)
+}
+
+// reportAbuse counts an instance of kind against the client that made r,
+// banning it if that takes it over the threshold. Admins are not counted.
+func reportAbuse(r *http.Request, kind string) {
+	if abuse == nil || isAdmin(r) {
+		return
+	}
+	ip := clientIP(r)
+	if ban := abuse.report(ip, kind, time.Now()); ban != nil {
+		abuseBans.Add(kind, 1)
+		slog.WarnContext(r.Context(), "Banned client", "ip", ip, "until", ban.ExpiresAt, "reason", ban.Reason, "offense", ban.Offense)
+		recordAudit("abuse-detector", "ban", ip, fmt.Sprintf("+ ban %s until %s: %s\n", ip, ban.ExpiresAt.Format(time.RFC3339), ban.Reason))
+	}
+}
+
+// report records the event and returns the ban it led to, if any.
+func (t *abuseTracker) report(ip, kind string, now time.Time) *Ban {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rec := t.clients[ip]
+	if rec == nil {
+		rec = &abuseRecord{}
+		t.clients[ip] = rec
+	}
+	if rec.ban != nil && now.Before(rec.ban.ExpiresAt) {
+		return nil
+	}
+	rec.prune(now.Add(-t.window))
+	rec.events = append(rec.events, abuseEvent{kind: kind, at: now})
+
+	score := 0
+	counts := map[string]int{}
+	for _, e := range rec.events {
+		score += abuseWeights[e.kind]
+		counts[e.kind]++
+	}
+	if score < t.threshold {
+		return nil
+	}
+
+	if !rec.lastBanAt.IsZero() && now.Sub(rec.lastBanAt) > t.forgiveAfter {
+		rec.offenses = 0
+	}
+	duration := t.durations[min(rec.offenses, len(t.durations)-1)]
+	rec.offenses++
+	rec.lastBanAt = now
+	rec.events = nil
+
+	kinds := make([]string, 0, len(counts))
+	for k, n := range counts {
+		kinds = append(kinds, fmt.Sprintf("%s x%d", k, n))
+	}
+	sort.Strings(kinds)
+	rec.ban = &Ban{
+		IP:        ip,
+		Reason:    strings.Join(kinds, ", "),
+		BannedAt:  now.UTC(),
+		ExpiresAt: now.Add(duration).UTC(),
+		Offense:   rec.offenses,
+	}
+	copied := *rec.ban
+	return &copied
+}
+
+func (rec *abuseRecord) prune(since time.Time) {
+	kept := rec.events[:0]
+	for _, e := range rec.events {
+		if e.at.After(since) {
+			kept = append(kept, e)
+		}
+	}
+	rec.events = kept
+}
+
+// banned returns the ban on ip in force, or nil.
+func (t *abuseTracker) banned(ip string) *Ban {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rec := t.clients[ip]; rec != nil && rec.ban != nil && time.Now().Before(rec.ban.ExpiresAt) {
+		copied := *rec.ban
+		return &copied
+	}
+	return nil
+}
+
+// bans returns the bans in force, ending soonest first.
+func (t *abuseTracker) bans() []Ban {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bans := []Ban{}
+	for _, rec := range t.clients {
+		if rec.ban != nil && now.Before(rec.ban.ExpiresAt) {
+			bans = append(bans, *rec.ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].ExpiresAt.Before(bans[j].ExpiresAt) })
+	return bans
+}
+
+// lift ends the ban on ip and reports whether there was one. The offense
+// count is kept, so a lifted client banned again gets the next duration.
+func (t *abuseTracker) lift(ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rec := t.clients[ip]
+	if rec == nil || rec.ban == nil || !time.Now().Before(rec.ban.ExpiresAt) {
+		return false
+	}
+	rec.ban = nil
+	rec.events = nil
+	return true
+}
+
+// janitor forgets the clients with no recent events, no ban in force and
+// no ban recent enough to escalate.
+func (t *abuseTracker) janitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now()
+		t.mu.Lock()
+		for ip, rec := range t.clients {
+			rec.prune(now.Add(-t.window))
+			if len(rec.events) == 0 && (rec.ban == nil || now.After(rec.ban.ExpiresAt)) && now.Sub(rec.lastBanAt) > t.forgiveAfter {
+				delete(t.clients, ip)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+// checkBan answers 403 with a Retry-After for a banned client and reports
+// whether r may go ahead.
+func checkBan(w http.ResponseWriter, ip string) bool {
+	if abuse == nil {
+		return true
+	}
+	ban := abuse.banned(ip)
+	if ban == nil {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(ban.ExpiresAt).Seconds())+1))
+	w.WriteHeader(http.StatusForbidden)
+	writeErrorBody(w, ErrorResponse{Error: "You have been temporarily blocked for abuse, please try again later", Code: "banned"})
+	return false
+}
+
+// bansHandler lists the bans in force.
+func bansHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	bans := []Ban{}
+	if abuse != nil {
+		bans = abuse.bans()
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(bans)
+}
+
+// liftBanHandler lifts the ban on an IP.
+func liftBanHandler(w http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	if prefix, err := parseIPPrefix(ip); err == nil && prefix.IsSingleIP() {
+		ip = prefix.Addr().String()
+	}
+	if abuse == nil || !abuse.lift(ip) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		writeErrorBody(w, ErrorResponse{Error: "Ban not found"})
+		return
+	}
+	slog.InfoContext(r.Context(), "Lifted ban", "ip", ip)
+	auditChange(r, "- ban "+ip+"\n")
+	w.WriteHeader(http.StatusNoContent)
+}
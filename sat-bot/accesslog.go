@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// accessLogEnabled is false when ACCESS_LOG is off.
+	accessLogEnabled = true
+	// accessLogExclude are the path prefixes left out of the access log.
+	accessLogExclude []string
+)
+
+// loadAccessLogConfig reads ACCESS_LOG (true by default), which logs every
+// request served, and ACCESS_LOG_EXCLUDE, comma-separated path prefixes to
+// leave out, /health and /metrics by default so probes and scrapes do not
+// drown out real traffic.
+func loadAccessLogConfig() {
+	accessLogEnabled = getEnv("ACCESS_LOG", "true") == "true"
+	accessLogExclude = nil
+	for _, prefix := range strings.Split(getEnv("ACCESS_LOG_EXCLUDE", "/health,/metrics"), ",") {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			accessLogExclude = append(accessLogExclude, prefix)
+		}
+	}
+}
+
+func accessLogExcluded(path string) bool {
+	for _, prefix := range accessLogExclude {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// accessLogMiddleware logs each request once it has been served: at info
+// level, warn for client errors and error for server errors. Only the info
+// lines are sampled, see loadLogSampling.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !accessLogEnabled || accessLogExcluded(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case rec.status >= 500:
+			level = slog.LevelError
+		case rec.status >= 400:
+			level = slog.LevelWarn
+		}
+		var sampleAttrs []any
+		if level == slog.LevelInfo {
+			category := "access"
+			if path := r.URL.Path; path == "/status" || path == "/health" || strings.HasPrefix(path, "/health/") {
+				category = "health"
+			}
+			var keep bool
+			if sampleAttrs, keep = sampleLog(category); !keep {
+				return
+			}
+		}
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", routeName(r),
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"ip", clientIP(r),
+			"origin", r.Header.Get("Origin"),
+			"user_agent", r.UserAgent(),
+		}
+		slog.Log(r.Context(), level, "HTTP request", append(attrs, sampleAttrs...)...)
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upstreamAlerter watches the model calls of each provider over a sliding
+// window and posts to a Slack or Discord webhook when the share of failed
+// calls or the 95th percentile latency crosses its threshold, and again
+// once the provider has recovered.
+type upstreamAlerter struct {
+	webhook   string
+	discord   bool
+	window    time.Duration
+	errorRate float64
+	latency   time.Duration
+	minCalls  int
+	cooldown  time.Duration
+	client    *http.Client
+
+	mu        sync.Mutex
+	providers map[string]*providerCalls
+}
+
+type providerCalls struct {
+	calls    []upstreamCall
+	alerting bool
+	lastSent time.Time
+}
+
+type upstreamCall struct {
+	at       time.Time
+	duration time.Duration
+	failed   bool
+}
+
+// alerts is nil when no webhook is configured.
+var alerts *upstreamAlerter
+
+// loadAlertConfig reads ALERT_WEBHOOK_URL, a Slack or Discord incoming
+// webhook, alerts being off when it is unset; ALERT_WINDOW, the span calls
+// are judged over (5m by default); ALERT_ERROR_RATE, the share of failed
+// calls that raises an alert (0.5); ALERT_LATENCY_P95, the 95th percentile
+// latency that does (30s, 0 turns it off); ALERT_MIN_CALLS, the calls needed
+// in the window before judging (10); and ALERT_COOLDOWN, how long a
+// provider already alerted on stays quiet if it gets worse again (30m).
+func loadAlertConfig() {
+	webhook := getEnv("ALERT_WEBHOOK_URL", "")
+	if webhook == "" {
+		return
+	}
+	a := &upstreamAlerter{
+		webhook:   webhook,
+		discord:   strings.Contains(webhook, "discord.com/") || strings.Contains(webhook, "discordapp.com/"),
+		window:    getEnvDuration("ALERT_WINDOW", 5*time.Minute),
+		errorRate: getEnvFloat("ALERT_ERROR_RATE", 0.5),
+		latency:   getEnvDuration("ALERT_LATENCY_P95", 30*time.Second),
+		minCalls:  getEnvInt("ALERT_MIN_CALLS", 10),
+		cooldown:  getEnvDuration("ALERT_COOLDOWN", 30*time.Minute),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		providers: map[string]*providerCalls{},
+	}
+	if a.window <= 0 || a.errorRate <= 0 || a.errorRate > 1 || a.latency < 0 {
+		configProblem("ALERT_WINDOW, ALERT_ERROR_RATE or ALERT_LATENCY_P95: the window must be positive and the error rate between 0 and 1")
+		return
+	}
+	alerts = a
+	go a.watch(min(30*time.Second, a.window/5))
+	slog.Info("Alerting on upstream failures", "window", a.window, "error_rate", a.errorRate, "latency_p95", a.latency)
+}
+
+// isUpstreamFailure reports whether err is the provider's fault rather than
+// ours, such as a shed call, or the client's for going away.
+func isUpstreamFailure(err error) bool {
+	return err != nil && (isProviderFailure(err) || errors.Is(err, errUpstreamTimeout))
+}
+
+// recordUpstreamCall adds a finished model call to the window of its
+// provider.
+func recordUpstreamCall(provider string, duration time.Duration, err error) {
+	if alerts == nil {
+		return
+	}
+	alerts.mu.Lock()
+	defer alerts.mu.Unlock()
+	p := alerts.providers[provider]
+	if p == nil {
+		p = &providerCalls{}
+		alerts.providers[provider] = p
+	}
+	// Calls refused by an open circuit count as failed too, or an outage
+	// would look like recovery as soon as the breaker trips.
+	failed := isUpstreamFailure(err) || errors.Is(err, errCircuitOpen)
+	p.calls = append(p.calls, upstreamCall{at: time.Now(), duration: duration, failed: failed})
+}
+
+// watch judges each provider every interval.
+func (a *upstreamAlerter) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, msg := range a.check(time.Now()) {
+			if err := a.send(msg); err != nil {
+				slog.Error("Failed to send alert", "err", err)
+			}
+		}
+	}
+}
+
+// check prunes the windows and returns the messages to send.
+func (a *upstreamAlerter) check(now time.Time) []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var messages []string
+	for _, name := range sortedKeys(a.providers) {
+		p := a.providers[name]
+		kept := p.calls[:0]
+		for _, c := range p.calls {
+			if now.Sub(c.at) <= a.window {
+				kept = append(kept, c)
+			}
+		}
+		p.calls = kept
+		if len(p.calls) < a.minCalls {
+			continue
+		}
+
+		failed := 0
+		durations := make([]time.Duration, len(p.calls))
+		for i, c := range p.calls {
+			if c.failed {
+				failed++
+			}
+			durations[i] = c.duration
+		}
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		rate := float64(failed) / float64(len(p.calls))
+		p95 := durations[(len(durations)*95-1)/100]
+		summary := fmt.Sprintf("%.0f%% of %d calls failed and the p95 latency was %s over the last %s",
+			rate*100, len(p.calls), p95.Round(100*time.Millisecond), a.window)
+
+		var problems []string
+		if rate >= a.errorRate {
+			problems = append(problems, fmt.Sprintf("error rate above %.0f%%", a.errorRate*100))
+		}
+		if a.latency > 0 && p95 >= a.latency {
+			problems = append(problems, fmt.Sprintf("p95 latency above %s", a.latency))
+		}
+
+		switch {
+		case len(problems) > 0 && !p.alerting && now.Sub(p.lastSent) >= a.cooldown:
+			p.alerting, p.lastSent = true, now
+			messages = append(messages, fmt.Sprintf(":rotating_light: SatBot: %s is unhealthy (%s): %s.", name, strings.Join(problems, ", "), summary))
+		case len(problems) == 0 && p.alerting:
+			p.alerting, p.lastSent = false, now
+			messages = append(messages, fmt.Sprintf(":white_check_mark: SatBot: %s has recovered: %s.", name, summary))
+		}
+	}
+	return messages
+}
+
+func (a *upstreamAlerter) send(message string) error {
+	payload := map[string]string{"text": message}
+	if a.discord {
+		payload = map[string]string{"content": message}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	slog.Info("Sent alert", "message", message)
+	return nil
+}
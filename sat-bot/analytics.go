@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The analytics endpoints answer from the stored interactions over a range
+// chosen with either last, a duration back from now such as 6h, or from and
+// to, each an RFC 3339 time or a YYYY-MM-DD date in USAGE_TIMEZONE, a to date
+// included. The last 24 hours are reported by default. channel keeps the
+// questions asked from one channel, see interactionChannel.
+const defaultAnalyticsRange = 24 * time.Hour
+
+// maxVolumeBuckets bounds the series of /admin/analytics/volume, about a
+// year of hours.
+const maxVolumeBuckets = 24 * 366
+
+type AnalyticsSummary struct {
+	From         time.Time      `json:"from"`
+	To           time.Time      `json:"to"`
+	Interactions int            `json:"interactions"`
+	Answered     int            `json:"answered"`
+	Errors       int            `json:"errors"`
+	ErrorRate    float64        `json:"error_rate"`
+	ErrorsByCode map[string]int `json:"errors_by_code,omitempty"`
+	// AvgLatencyMS and P95LatencyMS are over answered questions only.
+	AvgLatencyMS     int64   `json:"avg_latency_ms"`
+	P95LatencyMS     int64   `json:"p95_latency_ms"`
+	Sessions         int     `json:"sessions"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	EstimatedCost    float64 `json:"estimated_cost,omitempty"`
+	Currency         string  `json:"currency,omitempty"`
+	// Ratings counts the answers rated up and down by visitors, and
+	// SatisfactionRate is the share rated up, null without ratings.
+	Ratings          RatingCounts `json:"ratings"`
+	SatisfactionRate *float64     `json:"satisfaction_rate"`
+}
+
+type RatingCounts struct {
+	Up   int `json:"up"`
+	Down int `json:"down"`
+}
+
+func (c *RatingCounts) add(f *Feedback) {
+	switch {
+	case f == nil:
+	case f.Rating == ratingUp:
+		c.Up++
+	case f.Rating == ratingDown:
+		c.Down++
+	}
+}
+
+// TopQuestion groups the questions asked the same way, see
+// normalizeQuestion. Question is the latest wording.
+type TopQuestion struct {
+	Question  string       `json:"question"`
+	Count     int          `json:"count"`
+	Errors    int          `json:"errors"`
+	Ratings   RatingCounts `json:"ratings"`
+	LastAsked time.Time    `json:"last_asked"`
+}
+
+type TopQuestionsResponse struct {
+	From      time.Time     `json:"from"`
+	To        time.Time     `json:"to"`
+	Questions []TopQuestion `json:"questions"`
+}
+
+// VolumeBucket covers the hour or day from Start in USAGE_TIMEZONE.
+type VolumeBucket struct {
+	Start        time.Time `json:"start"`
+	Interactions int       `json:"interactions"`
+	Errors       int       `json:"errors"`
+	AvgLatencyMS int64     `json:"avg_latency_ms"`
+}
+
+type VolumeResponse struct {
+	From     time.Time      `json:"from"`
+	To       time.Time      `json:"to"`
+	Interval string         `json:"interval"`
+	Timezone string         `json:"timezone"`
+	Buckets  []VolumeBucket `json:"buckets"`
+}
+
+// parseAnalyticsRange reads the range of an analytics request.
+func parseAnalyticsRange(r *http.Request) (from, to time.Time, err error) {
+	q := r.URL.Query()
+	now := time.Now()
+	if s := q.Get("last"); s != "" {
+		if q.Get("from") != "" || q.Get("to") != "" {
+			return from, to, errors.New("last cannot be combined with from or to")
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return from, to, errors.New("last must be a positive duration")
+		}
+		return now.Add(-d), now, nil
+	}
+	from, to = now.Add(-defaultAnalyticsRange), now
+	if s := q.Get("from"); s != "" {
+		if from, err = parseAnalyticsTime(s, false); err != nil {
+			return from, to, errors.New("from must be an RFC 3339 time or a YYYY-MM-DD date")
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if to, err = parseAnalyticsTime(s, true); err != nil {
+			return from, to, errors.New("to must be an RFC 3339 time or a YYYY-MM-DD date")
+		}
+		if q.Get("from") == "" {
+			from = to.Add(-defaultAnalyticsRange)
+		}
+	}
+	if !from.Before(to) {
+		return from, to, errors.New("from must be before to")
+	}
+	return from, to, nil
+}
+
+// parseAnalyticsTime parses an RFC 3339 time or a date, which stands for
+// its start, or for its end when end is set.
+func parseAnalyticsTime(s string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation(time.DateOnly, s, usage.location)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if end {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+// analyticsInteractions loads the interactions in the range of r, writing
+// the error response and returning false when it cannot.
+func analyticsInteractions(w http.ResponseWriter, r *http.Request) (from, to time.Time, found []Interaction, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if interactions == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeErrorBody(w, ErrorResponse{Error: "Interactions are not stored, see INTERACTION_STORE"})
+		return from, to, nil, false
+	}
+	from, to, err := parseAnalyticsRange(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: err.Error()})
+		return from, to, nil, false
+	}
+	found, err = interactions.List(r.Context(), InteractionFilter{Since: from, Until: to})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list interactions", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Could not read interactions"})
+		return from, to, nil, false
+	}
+	if channel := r.URL.Query().Get("channel"); channel != "" {
+		kept := found[:0]
+		for _, i := range found {
+			if i.Channel == channel {
+				kept = append(kept, i)
+			}
+		}
+		found = kept
+	}
+	return from.UTC(), to.UTC(), found, true
+}
+
+// analyticsHandler sums up the questions asked over the range: how many
+// were answered or failed and with which error, how long answers took, how
+// many sessions asked them, and the tokens and cost spent.
+func analyticsHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, found, ok := analyticsInteractions(w, r)
+	if !ok {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(summarizeInteractions(from, to, found))
+}
+
+func summarizeInteractions(from, to time.Time, found []Interaction) AnalyticsSummary {
+	summary := AnalyticsSummary{From: from, To: to, Interactions: len(found), Currency: pricingCurrency}
+	sessions := map[string]bool{}
+	var latencies []int64
+	var totalLatency int64
+	for _, i := range found {
+		sessions[i.SessionID] = true
+		summary.Ratings.add(i.Feedback)
+		if i.Error != "" {
+			summary.Errors++
+			if summary.ErrorsByCode == nil {
+				summary.ErrorsByCode = map[string]int{}
+			}
+			summary.ErrorsByCode[i.Error]++
+			continue
+		}
+		summary.Answered++
+		latencies = append(latencies, i.LatencyMS)
+		totalLatency += i.LatencyMS
+		summary.PromptTokens += i.PromptTokens
+		summary.CompletionTokens += i.CompletionTokens
+		summary.EstimatedCost += i.EstimatedCost
+	}
+	summary.Sessions = len(sessions)
+	if len(found) > 0 {
+		summary.ErrorRate = float64(summary.Errors) / float64(len(found))
+	}
+	if rated := summary.Ratings.Up + summary.Ratings.Down; rated > 0 {
+		rate := float64(summary.Ratings.Up) / float64(rated)
+		summary.SatisfactionRate = &rate
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		summary.AvgLatencyMS = totalLatency / int64(len(latencies))
+		summary.P95LatencyMS = latencies[(len(latencies)*95-1)/100]
+	}
+	return summary
+}
+
+// topQuestionsHandler lists the questions asked most often over the range,
+// up to limit (20 by default).
+func topQuestionsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 20
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			writeErrorBody(w, ErrorResponse{Error: "limit must be a positive number"})
+			return
+		}
+		limit = n
+	}
+	from, to, found, ok := analyticsInteractions(w, r)
+	if !ok {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TopQuestionsResponse{From: from, To: to, Questions: topQuestions(found, limit)})
+}
+
+// topQuestions groups found by normalizeQuestion and returns the limit
+// groups asked most often.
+func topQuestions(found []Interaction, limit int) []TopQuestion {
+	groups := map[string]*TopQuestion{}
+	for _, i := range found {
+		key := normalizeQuestion(i.Question)
+		if key == "" {
+			continue
+		}
+		g := groups[key]
+		if g == nil {
+			g = &TopQuestion{}
+			groups[key] = g
+		}
+		g.Question, g.LastAsked = i.Question, i.Time
+		g.Count++
+		g.Ratings.add(i.Feedback)
+		if i.Error != "" {
+			g.Errors++
+		}
+	}
+	questions := make([]TopQuestion, 0, len(groups))
+	for _, g := range groups {
+		questions = append(questions, *g)
+	}
+	sort.Slice(questions, func(i, j int) bool {
+		if questions[i].Count != questions[j].Count {
+			return questions[i].Count > questions[j].Count
+		}
+		return questions[i].LastAsked.After(questions[j].LastAsked)
+	})
+	if len(questions) > limit {
+		questions = questions[:limit]
+	}
+	return questions
+}
+
+// volumeHandler counts the questions asked per hour or per day (interval,
+// hour by default) over the range, with their errors and average answer
+// latency. Hours and days are those of USAGE_TIMEZONE, and buckets without
+// questions are included so the series can be charted as is.
+func volumeHandler(w http.ResponseWriter, r *http.Request) {
+	interval := r.URL.Query().Get("interval")
+	if interval == "" {
+		interval = "hour"
+	}
+	if interval != "hour" && interval != "day" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: "interval must be hour or day"})
+		return
+	}
+	from, to, found, ok := analyticsInteractions(w, r)
+	if !ok {
+		return
+	}
+	loc := usage.location
+	var buckets []VolumeBucket
+	index := map[int64]int{}
+	for start := volumeBucketStart(from, interval, loc); start.Before(to); start = nextVolumeBucket(start, interval) {
+		if len(buckets) == maxVolumeBuckets {
+			w.WriteHeader(http.StatusBadRequest)
+			writeErrorBody(w, ErrorResponse{Error: "range is too long for the interval"})
+			return
+		}
+		index[start.Unix()] = len(buckets)
+		buckets = append(buckets, VolumeBucket{Start: start})
+	}
+	answered := make([]int64, len(buckets))
+	for _, i := range found {
+		n, ok := index[volumeBucketStart(i.Time, interval, loc).Unix()]
+		if !ok {
+			continue
+		}
+		b := &buckets[n]
+		b.Interactions++
+		if i.Error != "" {
+			b.Errors++
+			continue
+		}
+		b.AvgLatencyMS += i.LatencyMS
+		answered[n]++
+	}
+	for n := range buckets {
+		if answered[n] > 0 {
+			buckets[n].AvgLatencyMS /= answered[n]
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(VolumeResponse{
+		From:     from,
+		To:       to,
+		Interval: interval,
+		Timezone: loc.String(),
+		Buckets:  buckets,
+	})
+}
+
+func volumeBucketStart(t time.Time, interval string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	if interval == "day" {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+}
+
+func nextVolumeBucket(start time.Time, interval string) time.Time {
+	if interval == "day" {
+		return start.AddDate(0, 0, 1)
+	}
+	return start.Add(time.Hour)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// apiKeyCacheTTL is how long a key looked up in the database is trusted, or
+// remembered as unknown, before it is looked up again.
+const apiKeyCacheTTL = time.Minute
+
+const apiClientContextKey contextKey = "api_client"
+
+// Scopes an API key can have. public-chat calls the chat endpoints,
+// analytics-read reads the usage, analytics, knowledge gap and experiment
+// reports and exports the interactions, and admin-write uses the rest of the
+// admin API, the reports included.
+const (
+	scopePublicChat    = "public-chat"
+	scopeAnalyticsRead = "analytics-read"
+	scopeAdminWrite    = "admin-write"
+)
+
+// APIKey is a client allowed to call the chat endpoints, or with other
+// Scopes than the default public-chat, parts of the admin API. Keys in files
+// may be given as their hex SHA-256 instead, so the file holds no secrets.
+type APIKey struct {
+	Name      string   `json:"name"`
+	Key       string   `json:"key,omitempty"`
+	KeySHA256 string   `json:"key_sha256,omitempty"`
+	Scopes    []string `json:"scopes,omitempty"`
+}
+
+// apiKeyEntry is a known key; name is empty for one remembered as unknown.
+type apiKeyEntry struct {
+	name    string
+	scopes  []string
+	expires time.Time
+}
+
+// hasScope reports whether the key may be used for scope. admin-write
+// covers analytics-read.
+func (e apiKeyEntry) hasScope(scope string) bool {
+	for _, s := range e.scopes {
+		if s == scope || (s == scopeAdminWrite && scope == scopeAnalyticsRead) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScopes checks scopes, defaulting to public-chat.
+func parseScopes(scopes []string) ([]string, error) {
+	var parsed []string
+	for _, s := range scopes {
+		switch s = strings.ToLower(strings.TrimSpace(s)); s {
+		case "":
+		case scopePublicChat, scopeAnalyticsRead, scopeAdminWrite:
+			parsed = append(parsed, s)
+		default:
+			return nil, fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	if len(parsed) == 0 {
+		parsed = []string{scopePublicChat}
+	}
+	return parsed, nil
+}
+
+// apiKeyStore holds the keys from the environment and API_KEYS_FILE by
+// hash, and looks up other keys in the database when one is configured.
+type apiKeyStore struct {
+	keys map[string]apiKeyEntry
+	db   *sql.DB
+
+	mu     sync.Mutex
+	cached map[string]apiKeyEntry
+}
+
+// apiKeys is nil when the chat endpoints are open to anyone.
+var apiKeys *apiKeyStore
+
+const pgAPIKeySchema = `
+CREATE TABLE IF NOT EXISTS satbot_api_keys (
+	key_sha256 TEXT PRIMARY KEY,
+	name       TEXT NOT NULL,
+	revoked_at TIMESTAMPTZ,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE satbot_api_keys ADD COLUMN IF NOT EXISTS scopes TEXT NOT NULL DEFAULT 'public-chat';`
+
+// loadAPIKeys reads the API keys required on the chat endpoints: API_KEYS,
+// comma-separated name:key pairs, optionally followed by :scopes joined by
+// |, as in sponsors:s3cret:analytics-read; API_KEYS_FILE (api-keys.json by
+// default), a JSON array of APIKey; and the satbot_api_keys table of the
+// PostgreSQL database at API_KEYS_URL, whose scopes column is
+// comma-separated. With none of them configured the endpoints stay open.
+func loadAPIKeys() {
+	store := &apiKeyStore{keys: map[string]apiKeyEntry{}, cached: map[string]apiKeyEntry{}}
+
+	for i, pair := range strings.Split(getEnv("API_KEYS", ""), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, key, ok := strings.Cut(pair, ":")
+		if !ok {
+			name, key = fmt.Sprintf("key-%d", i+1), pair
+		}
+		key, scopeList, _ := strings.Cut(key, ":")
+		if strings.TrimSpace(key) == "" {
+			configProblem("API_KEYS: key %q is empty", name)
+			continue
+		}
+		scopes, err := parseScopes(strings.Split(scopeList, "|"))
+		if err != nil {
+			configProblem("API_KEYS: key %q has an %v", name, err)
+			continue
+		}
+		store.keys[hashAPIKey(strings.TrimSpace(key))] = apiKeyEntry{name: strings.TrimSpace(name), scopes: scopes}
+	}
+
+	path := getEnv("API_KEYS_FILE", "api-keys.json")
+	if data, err := os.ReadFile(path); err == nil {
+		var loaded []APIKey
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			configProblem("%s: %v", path, err)
+		}
+		for i, k := range loaded {
+			if k.Name == "" {
+				k.Name = fmt.Sprintf("%s-%d", path, i+1)
+			}
+			hash := strings.ToLower(k.KeySHA256)
+			if k.Key != "" {
+				hash = hashAPIKey(k.Key)
+			}
+			if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+				configProblem("%s: key %q needs a key or a hex key_sha256", path, k.Name)
+				continue
+			}
+			scopes, err := parseScopes(k.Scopes)
+			if err != nil {
+				configProblem("%s: key %q has an %v", path, k.Name, err)
+				continue
+			}
+			store.keys[hash] = apiKeyEntry{name: k.Name, scopes: scopes}
+		}
+	} else if !os.IsNotExist(err) {
+		slog.Error("Failed to read API keys", "path", path, "err", err)
+	}
+
+	if url := getEnv("API_KEYS_URL", ""); url != "" {
+		db, err := openPostgres(url)
+		if err != nil {
+			configProblem("API_KEYS_URL: %v", err)
+		} else {
+			store.db = db
+			registerHealthCheck("api_keys_db", pingCheck(sqlPinger{db}))
+			whenConfigValid(func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				if _, err := db.ExecContext(ctx, pgAPIKeySchema); err != nil {
+					log.Fatalf("Failed to prepare the API key table: %v", err)
+				}
+			})
+		}
+	}
+
+	if len(store.keys) == 0 && store.db == nil {
+		return
+	}
+	apiKeys = store
+	if store.db != nil {
+		slog.Info("Requiring API keys on chat endpoints", "configured", len(store.keys), "database", true)
+	} else {
+		slog.Info("Requiring API keys on chat endpoints", "configured", len(store.keys))
+	}
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// client returns the client key belongs to, with an empty name for unknown
+// and revoked keys. Keys are compared by hash, so lookups take the same time
+// whatever the key.
+func (s *apiKeyStore) client(ctx context.Context, key string) (apiKeyEntry, error) {
+	hash := hashAPIKey(key)
+	if entry, ok := s.keys[hash]; ok {
+		return entry, nil
+	}
+	if s.db == nil {
+		return apiKeyEntry{}, nil
+	}
+
+	s.mu.Lock()
+	entry, ok := s.cached[hash]
+	s.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry, nil
+	}
+
+	var name, scopeList string
+	err := s.db.QueryRowContext(ctx,
+		`SELECT name, scopes FROM satbot_api_keys WHERE key_sha256 = $1 AND revoked_at IS NULL`, hash).Scan(&name, &scopeList)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return apiKeyEntry{}, err
+	}
+	entry = apiKeyEntry{expires: time.Now().Add(apiKeyCacheTTL)}
+	if err == nil {
+		scopes, err := parseScopes(strings.Split(scopeList, ","))
+		if err != nil {
+			slog.WarnContext(ctx, "Ignoring API key in the database", "name", name, "err", err)
+			scopes = nil
+		}
+		entry.name, entry.scopes = name, scopes
+	}
+
+	s.mu.Lock()
+	for h, e := range s.cached {
+		if time.Now().After(e.expires) {
+			delete(s.cached, h)
+		}
+	}
+	s.cached[hash] = entry
+	s.mu.Unlock()
+	return entry, nil
+}
+
+// requireAPIKey rejects requests without a known X-API-Key with the
+// public-chat scope when API keys are configured, so that only the website
+// and approved partner apps spend the model quota. Admins need no key.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiKeys == nil || isAdmin(r) {
+			next(w, r)
+			return
+		}
+		client, ok := checkAPIKey(w, r, scopePublicChat, "API key required")
+		if !ok || !allowRequest(w, r, apiKeyLimiter.Get(), "key", client.name) {
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiClientContextKey, client.name)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// checkAPIKey looks up the request's X-API-Key and checks that it has
+// scope, answering 401 with missing when there is no key, 401 for an
+// unknown one and 403 for one without the scope.
+func checkAPIKey(w http.ResponseWriter, r *http.Request, scope, missing string) (apiKeyEntry, bool) {
+	fail := func(status int, message, code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		writeErrorBody(w, ErrorResponse{Error: message, Code: code})
+	}
+	key := strings.TrimSpace(r.Header.Get(apiKeyHeader))
+	if key == "" || apiKeys == nil {
+		fail(http.StatusUnauthorized, missing, "")
+		return apiKeyEntry{}, false
+	}
+	client, err := apiKeys.client(r.Context(), key)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to look up API key", "err", err)
+		fail(http.StatusServiceUnavailable, "Could not verify API key", "")
+		return apiKeyEntry{}, false
+	}
+	if client.name == "" {
+		fail(http.StatusUnauthorized, "Invalid API key", "")
+		return apiKeyEntry{}, false
+	}
+	if !client.hasScope(scope) {
+		fail(http.StatusForbidden, "API key lacks the "+scope+" scope", "insufficient_scope")
+		return apiKeyEntry{}, false
+	}
+	return client, true
+}
+
+// apiClientFromContext returns the name of the API key the request was
+// made with, or an empty string when none was needed.
+func apiClientFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(apiClientContextKey).(string)
+	return name
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditActorHeader names the committee member behind an admin request, as
+// they all share the admin key.
+const auditActorHeader = "X-Admin-Actor"
+
+// maxAuditDiff caps the diff kept in one audit entry.
+const maxAuditDiff = 64 << 10
+
+// AuditEntry records one admin operation.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	IP     string    `json:"ip,omitempty"`
+	Action string    `json:"action"`
+	Target string    `json:"target,omitempty"`
+	Status int       `json:"status,omitempty"`
+	// Diff is what the operation changed: a unified diff for documents, and
+	// + and - lines for list entries.
+	Diff string `json:"diff,omitempty"`
+}
+
+// auditLog appends entries, one JSON object per line, to a file that is
+// never rewritten.
+type auditLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// audit is nil when the audit log is off.
+var audit *auditLog
+
+const auditContextKey contextKey = "audit"
+
+// loadAuditLog opens AUDIT_LOG_FILE (audit.jsonl by default; empty turns
+// the audit log off) for appending.
+func loadAuditLog() {
+	path := getEnv("AUDIT_LOG_FILE", "audit.jsonl")
+	if path == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		configProblem("AUDIT_LOG_FILE: %v", err)
+		return
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		configProblem("AUDIT_LOG_FILE: %v", err)
+		return
+	}
+	audit = &auditLog{path: path, file: file}
+	slog.Info("Recording admin operations", "path", path)
+}
+
+func (a *auditLog) append(e AuditEntry) {
+	if len(e.Diff) > maxAuditDiff {
+		e.Diff = e.Diff[:maxAuditDiff] + "\n[diff truncated]"
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("Failed to encode audit entry", "err", err)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write audit entry", "action", e.Action, "err", err)
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		slog.Error("Failed to sync audit log", "path", a.path, "err", err)
+	}
+}
+
+// recordAudit logs an operation that no admin request asked for, such as an
+// automatic ban.
+func recordAudit(actor, action, target, diff string) {
+	if audit != nil {
+		audit.append(AuditEntry{Time: time.Now().UTC(), Actor: actor, Action: action, Target: target, Diff: diff})
+	}
+}
+
+// auditChange reports what an admin operation changed, to go in its audit
+// entry. Handlers call it before answering.
+func auditChange(r *http.Request, diff string) {
+	if e, ok := r.Context().Value(auditContextKey).(*AuditEntry); ok {
+		e.Diff += diff
+	}
+}
+
+// auditRequest runs an admin handler and, for the methods that change
+// something, appends what it did to the audit log. The action is the
+// method and route, such as "PUT /admin/context/{name:.+}".
+func auditRequest(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if audit == nil || r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+		next(w, r)
+		return
+	}
+
+	action := routeName(r)
+	actor := strings.TrimSpace(r.Header.Get(auditActorHeader))
+	if len(actor) > 64 {
+		actor = actor[:64]
+	}
+	if client := apiClientFromContext(r.Context()); actor == "" && client != "" {
+		actor = "api-key:" + client
+	}
+	if actor == "" {
+		actor = "admin"
+	}
+	entry := &AuditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  actor,
+		IP:     clientIP(r),
+		Action: r.Method + " " + action,
+		Target: r.URL.Path,
+	}
+	rec := &statusRecorder{ResponseWriter: w}
+	next(rec, r.WithContext(context.WithValue(r.Context(), auditContextKey, entry)))
+	entry.Status = rec.status
+	audit.append(*entry)
+}
+
+// auditHandler returns audit entries, newest first. It filters on the
+// actor and action query parameters, the latter matching a substring, and
+// on since, an RFC 3339 time; limit caps the entries returned (100 by
+// default).
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	query := r.URL.Query()
+	limit := 100
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			writeErrorBody(w, ErrorResponse{Error: "Invalid limit"})
+			return
+		}
+		limit = n
+	}
+	var since time.Time
+	if s := query.Get("since"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeErrorBody(w, ErrorResponse{Error: "Invalid since, use an RFC 3339 time"})
+			return
+		}
+		since = t
+	}
+	actor, action := query.Get("actor"), query.Get("action")
+
+	entries := []AuditEntry{}
+	if audit != nil {
+		var err error
+		entries, err = audit.read(func(e *AuditEntry) bool {
+			return (actor == "" || e.Actor == actor) &&
+				(action == "" || strings.Contains(e.Action, action)) &&
+				!e.Time.Before(since)
+		})
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to read audit log", "path", audit.path, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			writeErrorBody(w, ErrorResponse{Error: "Failed to read audit log"})
+			return
+		}
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
+
+// read returns the entries that match, oldest first.
+func (a *auditLog) read(match func(*AuditEntry) bool) ([]AuditEntry, error) {
+	file, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var e AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if match(&e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// auditDocumentChange reports the change of the document at file to
+// content, the empty string for a deletion. PDFs are compared by their text.
+func auditDocumentChange(r *http.Request, name, file, content string) {
+	var old string
+	if data, err := os.ReadFile(file); err == nil {
+		old = string(data)
+		if isPDF(name) {
+			old, _ = pdfToText(data)
+		}
+	}
+	if diff := unifiedDiff(old, content); diff != "" {
+		auditChange(r, "--- "+name+"\n+++ "+name+"\n"+diff)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// BM25 parameters, at the usual values: k1 controls how quickly repeated
+// terms stop adding to the score and b how much long chunks are penalized.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// bm25Index scores chunks against a question by keyword overlap, weighting
+// rare terms higher. It needs no embeddings, so small deployments still get
+// relevant chunks instead of the whole knowledge base.
+type bm25Index struct {
+	terms     []map[string]int
+	lengths   []int
+	avgLength float64
+	// docFreq is the number of chunks each term appears in.
+	docFreq map[string]int
+}
+
+// stopWords are too common to tell chunks apart.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true,
+	"be": true, "by": true, "can": true, "do": true, "does": true, "for": true,
+	"from": true, "how": true, "i": true, "in": true, "is": true, "it": true,
+	"me": true, "of": true, "on": true, "or": true, "the": true, "there": true,
+	"to": true, "was": true, "what": true, "when": true, "where": true,
+	"which": true, "who": true, "will": true, "with": true, "you": true,
+}
+
+// keywordTerms splits text into lowercase words and numbers, without stop
+// words. A trailing "s" is dropped from longer words so that "events"
+// matches "event".
+func keywordTerms(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := words[:0]
+	for _, w := range words {
+		if stopWords[w] {
+			continue
+		}
+		if len(w) > 3 && strings.HasSuffix(w, "s") && !strings.HasSuffix(w, "ss") {
+			w = w[:len(w)-1]
+		}
+		terms = append(terms, w)
+	}
+	return terms
+}
+
+func newBM25Index(chunks []Chunk) *bm25Index {
+	idx := &bm25Index{
+		terms:   make([]map[string]int, len(chunks)),
+		lengths: make([]int, len(chunks)),
+		docFreq: map[string]int{},
+	}
+	total := 0
+	for i, c := range chunks {
+		// Headings say what a chunk is about, so they are searched too.
+		terms := keywordTerms(c.Section + " " + c.Text)
+		counts := map[string]int{}
+		for _, t := range terms {
+			counts[t]++
+		}
+		for t := range counts {
+			idx.docFreq[t]++
+		}
+		idx.terms[i] = counts
+		idx.lengths[i] = len(terms)
+		total += len(terms)
+	}
+	if len(chunks) > 0 {
+		idx.avgLength = float64(total) / float64(len(chunks))
+	}
+	return idx
+}
+
+// scores returns the BM25 score of every chunk for question.
+func (idx *bm25Index) scores(question string) []float64 {
+	scores := make([]float64, len(idx.terms))
+	n := float64(len(idx.terms))
+	seen := map[string]bool{}
+	for _, term := range keywordTerms(question) {
+		df := idx.docFreq[term]
+		if df == 0 || seen[term] {
+			continue
+		}
+		seen[term] = true
+		idf := math.Log(1 + (n-float64(df)+0.5)/(float64(df)+0.5))
+		for i, counts := range idx.terms {
+			tf := float64(counts[term])
+			if tf == 0 {
+				continue
+			}
+			norm := 1 - bm25B + bm25B*float64(idx.lengths[i])/idx.avgLength
+			scores[i] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+	return scores
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// The build is described at build time, e.g.
+//
+//	go build -ldflags "-X main.buildVersion=1.4.0 -X main.buildCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// A commit left unset falls back to the one the Go toolchain stamps into
+// binaries built from a checkout.
+var (
+	buildVersion = "dev"
+	buildCommit  = ""
+	buildTime    = ""
+)
+
+type VersionResponse struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	// CommitTime is when the commit was made, as stamped by the toolchain.
+	CommitTime string `json:"commit_time,omitempty"`
+	GoVersion  string `json:"go_version"`
+	// Modified is set when the binary was built from a checkout with
+	// uncommitted changes.
+	Modified bool `json:"modified,omitempty"`
+}
+
+var buildInfo = readBuildInfo()
+
+func readBuildInfo() VersionResponse {
+	info := VersionResponse{
+		Version:   buildVersion,
+		Commit:    buildCommit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	vcs := map[string]string{}
+	for _, s := range bi.Settings {
+		vcs[s.Key] = s.Value
+	}
+	// The stamped commit time and state only describe the stamped commit.
+	if rev := vcs["vcs.revision"]; rev != "" && (info.Commit == "" || info.Commit == rev) {
+		info.Commit = rev
+		info.CommitTime = vcs["vcs.time"]
+		info.Modified = vcs["vcs.modified"] == "true"
+	}
+	return info
+}
+
+// versionHandler reports which build is running.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(buildInfo)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// responseCache holds answers to first questions of a conversation, keyed by
+// model and normalized question, so the same FAQ asked over and over is
+// answered without a model call.
+type responseCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]cachedResponse
+	hits    expvar.Int
+	misses  expvar.Int
+}
+
+type cachedResponse struct {
+	answer  CompletionResponse
+	expires time.Time
+}
+
+// semanticCache serves the answer to an earlier question when a new one is
+// close enough in meaning, judged by the cosine similarity of their
+// embeddings.
+type semanticCache struct {
+	mu        sync.Mutex
+	threshold float64
+	ttl       time.Duration
+	size      int
+	// entries are kept in insertion order, oldest first.
+	entries []semanticEntry
+	hits    expvar.Int
+	misses  expvar.Int
+	errors  expvar.Int
+}
+
+type semanticEntry struct {
+	model   string
+	vector  []float32
+	answer  CompletionResponse
+	expires time.Time
+}
+
+// semanticLookupTimeout bounds how long a question waits for its embedding
+// before being answered without the semantic cache.
+const semanticLookupTimeout = 2 * time.Second
+
+var (
+	responses = &responseCache{entries: map[string]cachedResponse{}}
+	semantic  = &semanticCache{}
+)
+
+func init() {
+	expvar.Publish("response_cache", expvar.Func(func() any {
+		return map[string]any{
+			"entries":  responses.Len(),
+			"hits":     responses.hits.Value(),
+			"misses":   responses.misses.Value(),
+			"hit_rate": hitRate(responses.hits.Value(), responses.misses.Value()),
+		}
+	}))
+	expvar.Publish("semantic_cache", expvar.Func(func() any {
+		return map[string]any{
+			"entries":  semantic.Len(),
+			"hits":     semantic.hits.Value(),
+			"misses":   semantic.misses.Value(),
+			"errors":   semantic.errors.Value(),
+			"hit_rate": hitRate(semantic.hits.Value(), semantic.misses.Value()),
+		}
+	}))
+}
+
+func hitRate(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// loadCacheConfig reads RESPONSE_CACHE_TTL (0 disables caching),
+// RESPONSE_CACHE_SIZE, and for the semantic cache, which also needs
+// embeddings, SEMANTIC_CACHE_THRESHOLD (0 disables it) and
+// SEMANTIC_CACHE_SIZE.
+func loadCacheConfig() {
+	ttl := getEnvDuration("RESPONSE_CACHE_TTL", 10*time.Minute)
+
+	responses.mu.Lock()
+	responses.ttl = ttl
+	responses.size = getEnvInt("RESPONSE_CACHE_SIZE", 1000)
+	responses.mu.Unlock()
+
+	semantic.mu.Lock()
+	semantic.ttl = ttl
+	semantic.threshold = getEnvFloat("SEMANTIC_CACHE_THRESHOLD", 0.92)
+	semantic.size = getEnvInt("SEMANTIC_CACHE_SIZE", 500)
+	semantic.mu.Unlock()
+}
+
+// lookupCache returns a cached answer to question, trying an exact match
+// first and then a semantic one. On a miss it returns instead a function that
+// caches the answer once it has been generated.
+func lookupCache(ctx context.Context, model, question string) (*CompletionResponse, func(*CompletionResponse)) {
+	key := cacheKey(model, question)
+	exact := responses.enabled()
+	if exact {
+		if answer, ok := responses.Get(key); ok {
+			answer.Provider = "cache"
+			answer.Usage = Usage{}
+			return answer, nil
+		}
+	}
+
+	var vector []float32
+	if semantic.enabled() {
+		ctx, cancel := context.WithTimeout(ctx, semanticLookupTimeout)
+		defer cancel()
+		vectors, err := embeddings.Embed(ctx, []string{question})
+		if err != nil {
+			slog.ErrorContext(ctx, "Semantic cache lookup failed", "err", err)
+			semantic.errors.Add(1)
+		} else {
+			vector = vectors[0]
+			if answer, ok := semantic.Find(model, vector); ok {
+				answer.Provider = "semantic-cache"
+				answer.Usage = Usage{}
+				return answer, nil
+			}
+		}
+	}
+
+	return nil, func(answer *CompletionResponse) {
+		if exact {
+			responses.Put(key, answer)
+		}
+		if vector != nil {
+			semantic.Put(model, vector, answer)
+		}
+	}
+}
+
+// normalizeQuestion lowercases q, drops punctuation and symbols and collapses
+// whitespace, so "When is Saturnalia?" and "when is saturnalia" share a key.
+func normalizeQuestion(q string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range strings.ToLower(q) {
+		switch {
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			continue
+		case unicode.IsSpace(r):
+			space = b.Len() > 0
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func cacheKey(model, question string) string {
+	return model + "\x00" + normalizeQuestion(question)
+}
+
+func (c *responseCache) enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ttl > 0 && c.size > 0
+}
+
+func (c *responseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Get returns a copy of the cached answer for key, if it has not expired.
+func (c *responseCache) Get(key string) (*CompletionResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	answer := entry.answer
+	return &answer, true
+}
+
+// Put stores answer under key. When the cache is full, expired entries are
+// dropped first, then the entry closest to expiring.
+func (c *responseCache) Put(key string, answer *CompletionResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl <= 0 || c.size <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		oldest := ""
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+				continue
+			}
+			if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(c.entries) >= c.size {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = cachedResponse{answer: *answer, expires: now.Add(c.ttl)}
+}
+
+// purgeCaches drops every cached answer, e.g. after the knowledge base
+// changed.
+func purgeCaches() {
+	responses.Purge()
+	semantic.Purge()
+}
+
+func (c *responseCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]cachedResponse{}
+}
+
+func (c *semanticCache) enabled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return embeddings != nil && c.threshold > 0 && c.ttl > 0 && c.size > 0
+}
+
+func (c *semanticCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// Find returns a copy of the answer whose question is most similar to
+// vector, if the similarity reaches the threshold.
+func (c *semanticCache) Find(model string, vector []float32) (*CompletionResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	best, bestScore := -1, c.threshold
+	for i, e := range c.entries {
+		if e.model != model || now.After(e.expires) {
+			continue
+		}
+		if score := cosine(vector, e.vector); score >= bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best < 0 {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	answer := c.entries[best].answer
+	return &answer, true
+}
+
+// Put stores answer for the question embedded as vector, dropping expired
+// entries and then the oldest ones to stay within size.
+func (c *semanticCache) Put(model string, vector []float32, answer *CompletionResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	live := c.entries[:0]
+	for _, e := range c.entries {
+		if now.Before(e.expires) {
+			live = append(live, e)
+		}
+	}
+	if extra := len(live) + 1 - c.size; extra > 0 {
+		live = append(live[:0], live[extra:]...)
+	}
+	c.entries = append(live, semanticEntry{
+		model:   model,
+		vector:  vector,
+		answer:  *answer,
+		expires: now.Add(c.ttl),
+	})
+}
+
+func (c *semanticCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
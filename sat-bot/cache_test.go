@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNormalizeQuestion(t *testing.T) {
+	for _, q := range []string{"When is Saturnalia?", "  when IS   saturnalia ", "When is Saturnalia!!"} {
+		if got := normalizeQuestion(q); got != "when is saturnalia" {
+			t.Errorf("normalizeQuestion(%q) = %q", q, got)
+		}
+	}
+	if cacheKey("a", "Hi") == cacheKey("b", "hi") {
+		t.Error("questions to different models share a cache key")
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	c := &responseCache{ttl: time.Minute, size: 2, entries: map[string]cachedResponse{}}
+	c.Put("a", &CompletionResponse{Content: "answer a"})
+	c.Put("b", &CompletionResponse{Content: "answer b"})
+
+	got, ok := c.Get("a")
+	if !ok || got.Content != "answer a" {
+		t.Fatalf("Get(a) = %+v, %v", got, ok)
+	}
+	got.Content = "changed"
+	if again, _ := c.Get("a"); again.Content != "answer a" {
+		t.Error("changing a returned answer changed the cached one")
+	}
+
+	// A full cache drops the entry closest to expiring.
+	c.Put("c", &CompletionResponse{Content: "answer c"})
+	if _, ok := c.Get("a"); ok || c.Len() != 2 {
+		t.Errorf("oldest entry kept in a full cache of %d entries", c.Len())
+	}
+
+	c.entries["b"] = cachedResponse{answer: CompletionResponse{Content: "answer b"}, expires: time.Now().Add(-time.Second)}
+	if _, ok := c.Get("b"); ok {
+		t.Error("expired entry served")
+	}
+
+	c.Purge()
+	if c.Len() != 0 {
+		t.Errorf("%d entries after Purge", c.Len())
+	}
+
+	disabled := &responseCache{entries: map[string]cachedResponse{}}
+	disabled.Put("a", &CompletionResponse{Content: "answer a"})
+	if disabled.enabled() || disabled.Len() != 0 {
+		t.Error("cache without a TTL stored an answer")
+	}
+}
+
+func TestSemanticCache(t *testing.T) {
+	// Embeddings are unit vectors, so their dot product is their similarity.
+	c := &semanticCache{threshold: 0.9, ttl: time.Minute, size: 2}
+	c.Put("m", []float32{1, 0}, &CompletionResponse{Content: "east"})
+	c.Put("m", []float32{0, 1}, &CompletionResponse{Content: "north"})
+
+	if got, ok := c.Find("m", []float32{0.99, 0.05}); !ok || got.Content != "east" {
+		t.Errorf("Find(close to east) = %+v, %v", got, ok)
+	}
+	if _, ok := c.Find("m", []float32{0.7071, 0.7071}); ok {
+		t.Error("answer served below the similarity threshold")
+	}
+	if _, ok := c.Find("other", []float32{1, 0}); ok {
+		t.Error("answer served for another model")
+	}
+
+	c.Put("m", []float32{-1, 0}, &CompletionResponse{Content: "west"})
+	if _, ok := c.Find("m", []float32{1, 0}); ok || c.Len() != 2 {
+		t.Errorf("oldest entry kept in a full cache of %d entries", c.Len())
+	}
+
+	c.entries[0].expires = time.Now().Add(-time.Second)
+	if _, ok := c.Find("m", []float32{0, 1}); ok {
+		t.Error("expired entry served")
+	}
+}
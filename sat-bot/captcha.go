@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const captchaHeader = "X-Captcha-Token"
+
+// captchaVerifyURLs are the siteverify endpoints of the supported widgets.
+// They share a request and response format.
+var captchaVerifyURLs = map[string]string{
+	"turnstile": "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	"recaptcha": "https://www.google.com/recaptcha/api/siteverify",
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+}
+
+// captchaVerifier checks the tokens the chat widget gets from a CAPTCHA
+// service. A visitor who passed one is trusted for passDuration, so only
+// the first message of a visit needs a token.
+type captchaVerifier struct {
+	provider     string
+	verifyURL    string
+	secret       string
+	minScore     float64
+	passDuration time.Duration
+	routes       map[string]bool
+	exempt       map[string]bool
+	client       *http.Client
+
+	mu     sync.Mutex
+	passed map[string]time.Time
+}
+
+// captcha is nil when no CAPTCHA is required.
+var captcha *captchaVerifier
+
+// loadCaptchaConfig reads CAPTCHA_PROVIDER (turnstile, recaptcha or
+// hcaptcha; empty turns the check off) and CAPTCHA_SECRET, its secret key;
+// CAPTCHA_VERIFY_URL overrides the provider's siteverify endpoint.
+// CAPTCHA_ROUTES lists the routes that need a token, out of chat,
+// regenerate and edit (chat by default). CAPTCHA_PASS_DURATION is how long a
+// solved CAPTCHA lets a visitor chat without another (30m by default, 0 asks
+// on every request), CAPTCHA_MIN_SCORE the lowest reCAPTCHA v3 score
+// accepted, and CAPTCHA_EXEMPT_API_KEYS the API key names of partner apps
+// calling from their servers, which cannot show a widget.
+func loadCaptchaConfig() {
+	provider := strings.ToLower(getEnv("CAPTCHA_PROVIDER", ""))
+	if provider == "" {
+		return
+	}
+	verifyURL, ok := captchaVerifyURLs[provider]
+	if !ok {
+		configProblem("CAPTCHA_PROVIDER: unknown provider %q", provider)
+		return
+	}
+	secret := getEnv("CAPTCHA_SECRET", "")
+	if secret == "" {
+		configProblem("CAPTCHA_SECRET: required by CAPTCHA_PROVIDER=%s", provider)
+		return
+	}
+
+	captcha = &captchaVerifier{
+		provider:     provider,
+		verifyURL:    getEnv("CAPTCHA_VERIFY_URL", verifyURL),
+		secret:       secret,
+		minScore:     getEnvFloat("CAPTCHA_MIN_SCORE", 0.5),
+		passDuration: getEnvDuration("CAPTCHA_PASS_DURATION", 30*time.Minute),
+		routes:       map[string]bool{},
+		exempt:       map[string]bool{},
+		client:       &http.Client{Timeout: 10 * time.Second},
+		passed:       map[string]time.Time{},
+	}
+	for _, route := range strings.Split(getEnv("CAPTCHA_ROUTES", "chat"), ",") {
+		switch route = strings.TrimSpace(route); route {
+		case "":
+		case "chat", "regenerate", "edit":
+			captcha.routes[route] = true
+		default:
+			configProblem("CAPTCHA_ROUTES: unknown route %q", route)
+		}
+	}
+	for _, name := range strings.Split(getEnv("CAPTCHA_EXEMPT_API_KEYS", ""), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			captcha.exempt[name] = true
+		}
+	}
+	slog.Info("Requiring CAPTCHA verification", "provider", provider, "routes", len(captcha.routes))
+}
+
+// requireCaptcha rejects requests to route that carry no valid X-Captcha-Token
+// from a visitor who has not recently passed one. Admins and exempt API key
+// clients are let through.
+func requireCaptcha(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if captcha == nil || !captcha.routes[route] || isAdmin(r) || captcha.exempt[apiClientFromContext(r.Context())] {
+			next(w, r)
+			return
+		}
+
+		visitorID := visitorIDFromContext(r.Context())
+		if captcha.hasPassed(visitorID) {
+			next(w, r)
+			return
+		}
+
+		fail := func(status int, message string) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			writeErrorBody(w, ErrorResponse{Error: message, Code: "captcha_required"})
+		}
+		token := strings.TrimSpace(r.Header.Get(captchaHeader))
+		if token == "" {
+			fail(http.StatusForbidden, "CAPTCHA verification required")
+			return
+		}
+		ok, err := captcha.verify(r.Context(), token, clientIP(r))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Failed to verify CAPTCHA token", "provider", captcha.provider, "err", err)
+			fail(http.StatusServiceUnavailable, "Could not verify CAPTCHA, please try again")
+			return
+		}
+		if !ok {
+			fail(http.StatusForbidden, "CAPTCHA verification failed")
+			return
+		}
+		captcha.pass(visitorID)
+		next(w, r)
+	}
+}
+
+func (v *captchaVerifier) hasPassed(visitorID string) bool {
+	if visitorID == "" || v.passDuration <= 0 {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return time.Now().Before(v.passed[visitorID])
+}
+
+func (v *captchaVerifier) pass(visitorID string) {
+	if visitorID == "" || v.passDuration <= 0 {
+		return
+	}
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for id, until := range v.passed {
+		if now.After(until) {
+			delete(v.passed, id)
+		}
+	}
+	v.passed[visitorID] = now.Add(v.passDuration)
+}
+
+// verify asks the provider whether token was issued for a solved
+// challenge. Scores, returned by reCAPTCHA v3, must reach minScore.
+func (v *captchaVerifier) verify(ctx context.Context, token, remoteIP string) (bool, error) {
+	form := url.Values{"secret": {v.secret}, "response": {token}, "remoteip": {remoteIP}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Success    bool     `json:"success"`
+		Score      *float64 `json:"score"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&result); err != nil {
+		return false, err
+	}
+	if !result.Success {
+		slog.InfoContext(ctx, "Rejected CAPTCHA token", "provider", v.provider, "errors", result.ErrorCodes)
+		return false, nil
+	}
+	if result.Score != nil && *result.Score < v.minScore {
+		slog.InfoContext(ctx, "Rejected CAPTCHA token", "provider", v.provider, "score", *result.Score, "min_score", v.minScore)
+		return false, nil
+	}
+	return true, nil
+}
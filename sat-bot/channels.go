@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const channelHeader = "X-Channel"
+
+// Channels an interaction is put in when its client did not say.
+const (
+	channelAPI    = "api"
+	channelWeb    = "web"
+	channelDirect = "direct"
+	channelOther  = "other"
+)
+
+// channels are the names clients may give in X-Channel.
+var channels = map[string]bool{}
+
+// loadChannels reads CHANNELS, the comma-separated channels clients may
+// declare in the X-Channel header ("widget,kiosk,telegram" by default).
+func loadChannels() {
+	for _, name := range strings.Split(getEnv("CHANNELS", "widget,kiosk,telegram"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			channels[name] = true
+		}
+	}
+}
+
+// interactionChannel returns where r came from: the channel its client
+// declared in X-Channel, other for one not in CHANNELS, or without one api
+// for partner apps calling with an API key, web for browsers, which send an
+// Origin, and direct for the rest. The header is the client's word for it;
+// the API key, kept apart, is what tells partner apps apart reliably.
+func interactionChannel(r *http.Request) string {
+	if name := strings.ToLower(strings.TrimSpace(r.Header.Get(channelHeader))); name != "" {
+		if channels[name] {
+			return name
+		}
+		return channelOther
+	}
+	switch {
+	case apiClientFromContext(r.Context()) != "":
+		return channelAPI
+	case r.Header.Get("Origin") != "":
+		return channelWeb
+	}
+	return channelDirect
+}
+
+// ChannelSummary sums up the questions asked from a channel, or with an API
+// key.
+type ChannelSummary struct {
+	Name         string  `json:"name"`
+	Interactions int     `json:"interactions"`
+	Share        float64 `json:"share"`
+	Sessions     int     `json:"sessions"`
+	Users        int     `json:"users"`
+	ErrorRate    float64 `json:"error_rate"`
+	AvgLatencyMS int64   `json:"avg_latency_ms"`
+	// SatisfactionRate is the share of the rated answers rated up, null
+	// without ratings.
+	SatisfactionRate *float64 `json:"satisfaction_rate"`
+	EstimatedCost    float64  `json:"estimated_cost,omitempty"`
+}
+
+type ChannelsResponse struct {
+	From     time.Time        `json:"from"`
+	To       time.Time        `json:"to"`
+	Currency string           `json:"currency,omitempty"`
+	Channels []ChannelSummary `json:"channels"`
+	// APIClients breaks the questions asked with an API key down by key.
+	APIClients []ChannelSummary `json:"api_clients"`
+}
+
+// channelsHandler breaks the questions asked over the range down by channel
+// and by API key, most asked first. Interactions stored before channels
+// were recorded are counted as unknown.
+func channelsHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, found, ok := analyticsInteractions(w, r)
+	if !ok {
+		return
+	}
+	byChannel := map[string][]Interaction{}
+	byClient := map[string][]Interaction{}
+	for _, i := range found {
+		channel := i.Channel
+		if channel == "" {
+			channel = "unknown"
+		}
+		byChannel[channel] = append(byChannel[channel], i)
+		if i.APIClient != "" {
+			byClient[i.APIClient] = append(byClient[i.APIClient], i)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ChannelsResponse{
+		From:       from,
+		To:         to,
+		Currency:   pricingCurrency,
+		Channels:   summarizeChannels(byChannel, len(found)),
+		APIClients: summarizeChannels(byClient, len(found)),
+	})
+}
+
+func summarizeChannels(groups map[string][]Interaction, total int) []ChannelSummary {
+	summaries := make([]ChannelSummary, 0, len(groups))
+	for name, found := range groups {
+		s := summarizeInteractions(found[0].Time, found[len(found)-1].Time, found)
+		users := map[string]bool{}
+		for _, i := range found {
+			if i.UserID != "" {
+				users[i.UserID] = true
+			}
+		}
+		summaries = append(summaries, ChannelSummary{
+			Name:             name,
+			Interactions:     s.Interactions,
+			Share:            float64(s.Interactions) / float64(total),
+			Sessions:         s.Sessions,
+			Users:            len(users),
+			ErrorRate:        s.ErrorRate,
+			AvgLatencyMS:     s.AvgLatencyMS,
+			SatisfactionRate: s.SatisfactionRate,
+			EstimatedCost:    s.EstimatedCost,
+		})
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Interactions != summaries[j].Interactions {
+			return summaries[i].Interactions > summaries[j].Interactions
+		}
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// circuitOpenMessage is served in place of a model answer while every
+// provider's circuit is open. Empty disables it and returns an error instead.
+var circuitOpenMessage = "SatBot is receiving a lot of questions right now. Saturnalia runs from 14th to 16th November 2025 at Thapar Institute, Patiala. Please try again in a minute for anything else."
+
+// serverWriteTimeout is the server's WriteTimeout. Answers that are not
+// streamed have to be generated within it.
+var serverWriteTimeout = 15 * time.Second
+
+// answerDeadlineMargin is kept back from serverWriteTimeout for writing the
+// response, so a timed out answer still gets its error through.
+const answerDeadlineMargin = time.Second
+
+func loadChatConfig() {
+	circuitOpenMessage = getEnv("CIRCUIT_OPEN_MESSAGE", circuitOpenMessage)
+	serverWriteTimeout = getEnvDuration("SERVER_WRITE_TIMEOUT", serverWriteTimeout)
+}
+
+// withAnswerDeadline returns r with a deadline that leaves time to write the
+// response before the server's write timeout. Model calls made for the
+// request, retries included, stop at this deadline.
+func withAnswerDeadline(r *http.Request) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(r.Context(), serverWriteTimeout-answerDeadlineMargin)
+	return r.WithContext(ctx), cancel
+}
+
+var errPromptTooLong = errors.New("Message is too long")
+var errModelNotAllowed = errors.New("Model not allowed")
+
+// GenerationParams are the sampling settings sent with each chat request.
+type GenerationParams struct {
+	Temperature float64  `json:"temperature"`
+	MaxTokens   int      `json:"max_tokens"`
+	TopP        float64  `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+// generation holds the configured defaults for GenerationParams.
+var generation atomic.Pointer[GenerationParams]
+
+// defaultGeneration is what generation starts from, and falls back to when
+// the settings are invalid.
+var defaultGeneration = GenerationParams{Temperature: 0.7, MaxTokens: 500}
+
+// currentGeneration returns the configured defaults for GenerationParams.
+func currentGeneration() GenerationParams {
+	return *generation.Load()
+}
+
+// loadGenerationConfig reads GEN_TEMPERATURE, GEN_MAX_TOKENS, GEN_TOP_P and
+// GEN_STOP, where stop sequences are separated by "|".
+func loadGenerationConfig() {
+	params, err := readGenerationConfig()
+	if err != nil {
+		configProblem("Generation parameters: %v", err)
+		params = defaultGeneration
+	}
+	generation.Store(&params)
+}
+
+func readGenerationConfig() (GenerationParams, error) {
+	params := GenerationParams{
+		Temperature: getEnvFloat("GEN_TEMPERATURE", defaultGeneration.Temperature),
+		MaxTokens:   getEnvInt("GEN_MAX_TOKENS", defaultGeneration.MaxTokens),
+		TopP:        getEnvFloat("GEN_TOP_P", defaultGeneration.TopP),
+	}
+	if stop := getEnv("GEN_STOP", ""); stop != "" {
+		params.Stop = strings.Split(stop, "|")
+	}
+	return params, params.validate()
+}
+
+func (g GenerationParams) validate() error {
+	switch {
+	case g.Temperature < 0 || g.Temperature > 2:
+		return errors.New("Temperature must be between 0 and 2")
+	case g.MaxTokens < 1:
+		return errors.New("max_tokens must be positive")
+	case g.TopP < 0 || g.TopP > 1:
+		return errors.New("top_p must be between 0 and 1")
+	case len(g.Stop) > 4:
+		return errors.New("At most 4 stop sequences are allowed")
+	}
+	return nil
+}
+
+// GenerationOverrides are optional per-request changes to the configured
+// GenerationParams. Only admins may send them on chat requests.
+type GenerationOverrides struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	MaxTokens   *int     `json:"max_tokens,omitempty"`
+	TopP        *float64 `json:"top_p,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+// apply returns params with the overrides applied.
+func (o *GenerationOverrides) apply(params GenerationParams) (GenerationParams, error) {
+	if o == nil {
+		return params, nil
+	}
+	if o.Temperature != nil {
+		params.Temperature = *o.Temperature
+	}
+	if o.MaxTokens != nil {
+		params.MaxTokens = *o.MaxTokens
+	}
+	if o.TopP != nil {
+		params.TopP = *o.TopP
+	}
+	if o.Stop != nil {
+		params.Stop = o.Stop
+	}
+	return params, params.validate()
+}
+
+// AnswerOptions are the per-request generation settings.
+type AnswerOptions struct {
+	GenerationParams
+	// Model is an entry of the model allowlist, or empty for the default
+	// provider.
+	Model string
+	// OnDelta, when set, streams the reply as it is generated.
+	OnDelta func(string) error
+	// SkipCache forces a fresh answer even if one is cached.
+	SkipCache bool
+	// Namespace restricts the knowledge used to one namespace and the
+	// shared documents. Empty leaves the choice to the classifier.
+	Namespace string
+	// ResponseSchema, when set, asks for a JSON reply conforming to it.
+	// Streaming is not supported in this mode.
+	ResponseSchema map[string]interface{}
+
+	// variants are the experiment variants assigned to the request, and
+	// prompt the system prompt template one of them replaces the default
+	// with.
+	variants []*Variant
+	prompt   *promptTemplate
+}
+
+func defaultAnswerOptions() AnswerOptions {
+	return AnswerOptions{GenerationParams: currentGeneration()}
+}
+
+// requestAnswerOptions returns the options for an answer from model in
+// namespace with overrides applied, as chat, edit and regenerate requests
+// send them. When one of them is not allowed it writes a 400 and returns
+// false.
+func requestAnswerOptions(w http.ResponseWriter, model, namespace string, overrides *GenerationOverrides) (AnswerOptions, bool) {
+	if _, ok := allowedModels[model]; model != "" && !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: errModelNotAllowed.Error()})
+		return AnswerOptions{}, false
+	}
+	if namespace != "" && !currentKnowledge().hasNamespace(namespace) {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: "Unknown namespace"})
+		return AnswerOptions{}, false
+	}
+
+	opts := defaultAnswerOptions()
+	opts.Model = model
+	opts.Namespace = namespace
+	params, err := overrides.apply(opts.GenerationParams)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: err.Error()})
+		return AnswerOptions{}, false
+	}
+	opts.GenerationParams = params
+	return opts, true
+}
+
+// generateAnswer builds the prompt for question on top of a conversation's
+// summary and history and asks the model for a reply, within the variants of
+// any running experiments the visitor is assigned to.
+func generateAnswer(r *http.Request, summary string, history []ChatMessage, question string, opts AnswerOptions) (*CompletionResponse, time.Duration, error) {
+	interactionID := startInteraction(r.Context())
+	applyExperiments(visitorIDFromContext(r.Context()), &opts)
+	answer, responseTime, err := completeAnswer(r, summary, history, question, opts)
+	recordVariants(opts.variants, answer, responseTime, err)
+	recordAnswer(answer, responseTime, err)
+	if err != nil {
+		return nil, 0, err
+	}
+	answer.Variant = variantTag(opts.variants)
+	answer.InteractionID = interactionID
+	if cost, ok := estimateCost(answer.Provider, answer.Model, answer.Usage); ok {
+		answer.Cost = &CostEstimate{
+			Amount:           cost,
+			Currency:         pricingCurrency,
+			PromptTokens:     answer.Usage.PromptTokens,
+			CompletionTokens: answer.Usage.CompletionTokens,
+		}
+	}
+	return answer, responseTime, nil
+}
+
+func completeAnswer(r *http.Request, summary string, history []ChatMessage, question string, opts AnswerOptions) (*CompletionResponse, time.Duration, error) {
+	question, refuse, warn := guardQuestion(r, question)
+	if refuse {
+		if opts.OnDelta != nil {
+			if err := opts.OnDelta(injectionRefusal); err != nil {
+				return nil, 0, err
+			}
+		}
+		return &CompletionResponse{Content: injectionRefusal, Provider: "guard"}, 0, nil
+	}
+
+	if !moderateQuestion(r, question) {
+		if opts.OnDelta != nil {
+			if err := opts.OnDelta(moderationMessage); err != nil {
+				return nil, 0, err
+			}
+		}
+		return &CompletionResponse{Content: moderationMessage, Provider: "moderation"}, 0, nil
+	}
+
+	// FAQ answers are free, so they are served even over budget. They are
+	// plain text and cannot satisfy a response schema.
+	if entry := matchFAQ(question); entry != nil && opts.ResponseSchema == nil {
+		if opts.OnDelta != nil {
+			if err := opts.OnDelta(entry.Answer); err != nil {
+				return nil, 0, err
+			}
+		}
+		return &CompletionResponse{Content: entry.Answer, Provider: "faq"}, 0, nil
+	}
+
+	if err := usage.applyBudget(&opts); err != nil {
+		return nil, 0, err
+	}
+
+	p := provider
+	var model string
+	if opts.Model != "" {
+		choice, ok := allowedModels[opts.Model]
+		if !ok {
+			return nil, 0, errModelNotAllowed
+		}
+		p, model = choice.provider, choice.model
+	}
+
+	userPrompt := fmt.Sprintf("User Query: %s\n\nAnswer:", question)
+	var memory string
+	if userID := userIDFromRequest(r); userID != "" {
+		memory = memories.Prompt(userID)
+	}
+	if summary != "" {
+		userPrompt = summaryPrompt(summary) + "\n" + userPrompt
+	}
+	if memory != "" {
+		// The visitor wrote the facts, so they go with the question rather
+		// than in a system message, as does the summary of what they said.
+		userPrompt = memory + "\n" + userPrompt
+	}
+	parts := PromptParts{
+		SystemPrompt: systemPrompt,
+		History:      history,
+		User:         ChatMessage{Role: "user", Content: userPrompt},
+	}
+	if opts.prompt != nil {
+		parts.SystemPrompt = opts.prompt.System
+	}
+	if opts.ResponseSchema != nil {
+		parts.Extra = append(parts.Extra, ChatMessage{Role: "system", Content: schemaInstruction(opts.ResponseSchema)})
+	}
+	if warn {
+		parts.Extra = append(parts.Extra, ChatMessage{Role: "system", Content: injectionNote})
+	}
+
+	// Only opening questions asked with the default settings are cached;
+	// anything else depends on the conversation or the user.
+	var storeAnswer func(*CompletionResponse)
+	if len(history) == 0 && len(parts.Extra) == 0 && memory == "" && summary == "" && !opts.SkipCache &&
+		reflect.DeepEqual(opts.GenerationParams, currentGeneration()) {
+		var answer *CompletionResponse
+		// Variants answer differently, so each gets its own entries.
+		scope := opts.Model
+		if opts.Namespace != "" {
+			scope += "@" + opts.Namespace
+		}
+		if len(opts.variants) > 0 {
+			scope += "#" + variantTag(opts.variants)
+		}
+		if answer, storeAnswer = lookupCache(r.Context(), scope, question); answer != nil {
+			noteKnowledgeGap(question, nil, answer.Content)
+			if opts.OnDelta != nil {
+				if err := opts.OnDelta(answer.Content); err != nil {
+					return nil, 0, err
+				}
+			}
+			return answer, 0, nil
+		}
+	}
+
+	// Retrieval is left until after the cache, which makes it unnecessary.
+	selection := retrieveKnowledge(r.Context(), question, opts.Namespace)
+	parts.Knowledge = selection.text
+	parts.FitKnowledge = selection.fit
+	messages, maxTokens, ok := fitContextWindow(parts, opts.MaxTokens)
+	if !ok {
+		return nil, 0, errPromptTooLong
+	}
+
+	req := CompletionRequest{
+		Model:       model,
+		Messages:    messages,
+		Temperature: opts.Temperature,
+		MaxTokens:   maxTokens,
+		TopP:        opts.TopP,
+		Stop:        opts.Stop,
+		Tools:       toolSpecs,
+	}
+
+	startTime := time.Now()
+	var answer *CompletionResponse
+	var err error
+	if opts.ResponseSchema != nil {
+		answer, err = completeStructured(r.Context(), p, req, opts.ResponseSchema)
+	} else {
+		answer, err = completeWithTools(r.Context(), p, req, opts.OnDelta)
+	}
+	if errors.Is(err, errCircuitOpen) && circuitOpenMessage != "" && opts.ResponseSchema == nil {
+		if opts.OnDelta != nil {
+			if err := opts.OnDelta(circuitOpenMessage); err != nil {
+				return nil, 0, err
+			}
+		}
+		return &CompletionResponse{Content: circuitOpenMessage, Provider: "circuit-breaker"}, time.Since(startTime), nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	// A streamed answer has already been sent, so a leak can only be
+	// logged.
+	if injectionGuard != guardOff && leaksPrompt(parts.SystemPrompt(""), answer.Content) {
+		injectionAttempts.Add("leak", 1)
+		slog.WarnContext(r.Context(), "Answer repeated the system prompt", "question", redactPII(question))
+		if opts.OnDelta == nil {
+			return &CompletionResponse{Content: injectionRefusal, Provider: "guard"}, time.Since(startTime), nil
+		}
+	}
+	var regenerate func() (*CompletionResponse, error)
+	if opts.OnDelta == nil {
+		regenerate = func() (*CompletionResponse, error) {
+			retry := req
+			retry.Messages = append(append([]ChatMessage(nil), req.Messages...), ChatMessage{Role: "system", Content: outputRetryNote})
+			if opts.ResponseSchema != nil {
+				return completeStructured(r.Context(), p, retry, opts.ResponseSchema)
+			}
+			return completeWithTools(r.Context(), p, retry, nil)
+		}
+	}
+	answer = moderateAnswer(r.Context(), question, answer, regenerate)
+	answer.Sources = selection.sources
+	noteKnowledgeGap(question, selection, answer.Content)
+	if storeAnswer != nil {
+		storeAnswer(answer)
+	}
+	return answer, time.Since(startTime), nil
+}
+
+// completeWithTools sends req, running any tools the model asks for and
+// sending their results back, until the model answers. After maxToolRounds
+// rounds the tools are withdrawn so that it has to. The returned usage covers
+// every round.
+func completeWithTools(ctx context.Context, p Provider, req CompletionRequest, onDelta func(string) error) (*CompletionResponse, error) {
+	var total Usage
+	for round := 0; ; round++ {
+		if round >= maxToolRounds {
+			req.Tools = nil
+		}
+
+		var answer *CompletionResponse
+		var err error
+		if onDelta != nil {
+			answer, err = p.Stream(ctx, req, onDelta)
+		} else {
+			answer, err = p.Complete(ctx, req)
+		}
+		if err != nil {
+			return nil, err
+		}
+		total.PromptTokens += answer.Usage.PromptTokens
+		total.CompletionTokens += answer.Usage.CompletionTokens
+		total.TotalTokens += answer.Usage.TotalTokens
+		if len(answer.ToolCalls) == 0 || len(req.Tools) == 0 {
+			answer.ToolCalls = nil
+			answer.Usage = total
+			return answer, nil
+		}
+
+		req.Messages = append(req.Messages, ChatMessage{Role: "assistant", Content: answer.Content, ToolCalls: answer.ToolCalls})
+		for _, call := range answer.ToolCalls {
+			result := truncateToTokens(runTool(call), maxToolResultTokens)
+			req.Messages = append(req.Messages, ChatMessage{Role: "tool", ToolCallID: call.ID, Content: result})
+		}
+		if room := modelContextWindow - messagesTokens(req.Messages); room < req.MaxTokens {
+			if room < minCompletionTokens {
+				return nil, errPromptTooLong
+			}
+			req.MaxTokens = room
+		}
+	}
+}
+
+func logInteraction(ctx context.Context, question, userID string, answer *CompletionResponse, responseTime time.Duration) {
+	sampleAttrs, keep := sampleLog("chat")
+	if !keep {
+		return
+	}
+	go func() {
+		attrs := []any{
+			"question", redactPII(question),
+			"provider", answer.Provider,
+			"model", answer.Model,
+			"latency_ms", responseTime.Milliseconds(),
+			"prompt_tokens", answer.Usage.PromptTokens,
+			"completion_tokens", answer.Usage.CompletionTokens,
+		}
+		if userID != "" {
+			attrs = append(attrs, "user", userID)
+		}
+		if answer.Cost != nil {
+			attrs = append(attrs, "cost", answer.Cost.Amount, "currency", answer.Cost.Currency)
+		}
+		if answer.Variant != "" {
+			attrs = append(attrs, "variant", answer.Variant)
+		}
+		slog.InfoContext(ctx, "Chat interaction", append(attrs, sampleAttrs...)...)
+	}()
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Chunk is a piece of a context document small enough to be retrieved on
+// its own, with where it came from.
+type Chunk struct {
+	// Source is the document name and Section the headings above the chunk,
+	// outermost first, joined with " > ".
+	Source  string
+	Section string
+	// URL is the document's URL, if it has one.
+	URL string
+	// Namespace is the document's namespace.
+	Namespace string
+	// Index is the chunk's position within its document.
+	Index int
+	Text  string
+}
+
+var (
+	// chunkTokens is the target size of a chunk.
+	chunkTokens = 300
+	// chunkOverlapTokens is how much of the end of a chunk is repeated at
+	// the start of the next one in the same section, so that a fact split
+	// across a boundary is still found whole.
+	chunkOverlapTokens = 50
+)
+
+// loadChunkConfig reads RETRIEVAL_CHUNK_TOKENS and CHUNK_OVERLAP_TOKENS. The
+// overlap is capped at half a chunk so that chunking always makes progress.
+func loadChunkConfig() {
+	chunkTokens = getEnvInt("RETRIEVAL_CHUNK_TOKENS", chunkTokens)
+	chunkOverlapTokens = getEnvInt("CHUNK_OVERLAP_TOKENS", chunkOverlapTokens)
+	if chunkOverlapTokens < 0 {
+		chunkOverlapTokens = 0
+	}
+	if chunkOverlapTokens > chunkTokens/2 {
+		chunkOverlapTokens = chunkTokens / 2
+	}
+}
+
+// Label is the header a chunk is introduced by in prompts and embeddings.
+func (c Chunk) Label() string {
+	if c.Section == "" {
+		return "Source: " + c.Source
+	}
+	return "Source: " + c.Source + " (" + c.Section + ")"
+}
+
+// section is a run of blocks under the same headings.
+type section struct {
+	headings []string
+	blocks   []string
+}
+
+// chunkDocument splits a document at its headings and packs each section's
+// blocks into chunks of up to chunkTokens, consecutive chunks overlapping by
+// about chunkOverlapTokens. Blocks that are too big are split into
+// sentences, and sentences that are still too big into words.
+func chunkDocument(doc Document) []Chunk {
+	var chunks []Chunk
+	for _, s := range splitSections(doc.Content) {
+		var units []string
+		for _, block := range s.blocks {
+			units = append(units, splitUnit(block, chunkTokens)...)
+		}
+		for _, text := range packUnits(units) {
+			chunks = append(chunks, Chunk{
+				Source:    doc.Name,
+				Section:   strings.Join(s.headings, " > "),
+				URL:       doc.URL,
+				Namespace: doc.Namespace,
+				Index:     len(chunks),
+				Text:      text,
+			})
+		}
+	}
+	return chunks
+}
+
+// splitSections divides text at Markdown headings and at the all-caps title
+// lines used in plain text context files. A block is a paragraph, or a list
+// item together with its indented continuation lines.
+func splitSections(text string) []section {
+	var sections []section
+	current := section{}
+	var block strings.Builder
+	endBlock := func() {
+		if b := strings.TrimSpace(block.String()); b != "" {
+			current.blocks = append(current.blocks, b)
+		}
+		block.Reset()
+	}
+	startSection := func(level int, title string) {
+		endBlock()
+		if len(current.blocks) > 0 {
+			sections = append(sections, current)
+		}
+		headings := append([]string(nil), current.headings...)
+		if level > len(headings) {
+			level = len(headings) + 1
+		}
+		current = section{headings: append(headings[:level-1], title)}
+	}
+
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			endBlock()
+		case strings.HasPrefix(trimmed, "#"):
+			level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+			if title := strings.TrimSpace(trimmed[level:]); title != "" && level <= 6 {
+				startSection(level, title)
+				continue
+			}
+			block.WriteString(line + "\n")
+		case isTitleLine(trimmed):
+			// Plain text has no heading levels, so each title replaces the
+			// previous one.
+			startSection(1, trimmed)
+		case isListItem(trimmed):
+			endBlock()
+			block.WriteString(trimmed + "\n")
+		default:
+			block.WriteString(line + "\n")
+		}
+	}
+	endBlock()
+	if len(current.blocks) > 0 {
+		sections = append(sections, current)
+	}
+	return sections
+}
+
+// isTitleLine reports whether a line is a short all-caps title such as
+// "TECHNICAL EVENTS".
+func isTitleLine(line string) bool {
+	if len(line) > 60 || isListItem(line) {
+		return false
+	}
+	letters := 0
+	for _, r := range line {
+		if unicode.IsLower(r) {
+			return false
+		}
+		if unicode.IsLetter(r) {
+			letters++
+		}
+	}
+	return letters >= 3
+}
+
+func isListItem(line string) bool {
+	return strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ")
+}
+
+// splitUnit returns text as pieces of at most limit tokens, splitting at
+// sentence ends where it can and between words where it must.
+func splitUnit(text string, limit int) []string {
+	if estimateTokens(text) <= limit {
+		return []string{text}
+	}
+	var units []string
+	for _, sentence := range splitSentences(text) {
+		if estimateTokens(sentence) <= limit {
+			units = append(units, sentence)
+			continue
+		}
+		var b strings.Builder
+		for _, word := range strings.Fields(sentence) {
+			if b.Len() > 0 && estimateTokens(b.String()+" "+word) > limit {
+				units = append(units, b.String())
+				b.Reset()
+			}
+			if b.Len() > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(word)
+		}
+		if b.Len() > 0 {
+			units = append(units, b.String())
+		}
+	}
+	return units
+}
+
+// splitSentences splits text after '.', '!' or '?' followed by white space,
+// and at line breaks.
+func splitSentences(text string) []string {
+	var sentences []string
+	start := 0
+	for i := 0; i < len(text); i++ {
+		end := -1
+		switch text[i] {
+		case '\n':
+			end = i
+		case '.', '!', '?':
+			if i+1 == len(text) || text[i+1] == ' ' || text[i+1] == '\n' {
+				end = i + 1
+			}
+		}
+		if end < 0 {
+			continue
+		}
+		if s := strings.TrimSpace(text[start:end]); s != "" {
+			sentences = append(sentences, s)
+		}
+		start = end
+	}
+	if s := strings.TrimSpace(text[start:]); s != "" {
+		sentences = append(sentences, s)
+	}
+	return sentences
+}
+
+// packUnits joins consecutive units into chunks of up to chunkTokens. Each
+// new chunk starts with the trailing units of the previous one that fit in
+// chunkOverlapTokens.
+func packUnits(units []string) []string {
+	var chunks []string
+	var current []string
+	used := 0
+	fresh := 0 // units in current that are not overlap
+	for _, unit := range units {
+		cost := estimateTokens(unit)
+		if fresh > 0 && used+cost > chunkTokens {
+			chunks = append(chunks, strings.Join(current, "\n"))
+
+			var overlap []string
+			used = 0
+			for i := len(current) - 1; i >= 0; i-- {
+				c := estimateTokens(current[i])
+				if used+c > chunkOverlapTokens || used+c+cost > chunkTokens {
+					break
+				}
+				overlap = append([]string{current[i]}, overlap...)
+				used += c
+			}
+			current, fresh = overlap, 0
+		}
+		current = append(current, unit)
+		used += cost
+		fresh++
+	}
+	if fresh > 0 {
+		chunks = append(chunks, strings.Join(current, "\n"))
+	}
+	return chunks
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// maxOmittedLogged is how many omitted chunks are named in the log line of
+// a compression; the rest are counted.
+const maxOmittedLogged = 10
+
+var contextCompressions expvar.Int
+
+func init() {
+	expvar.Publish("context_compressions", &contextCompressions)
+}
+
+// contextSelection is the knowledge chosen for a question, with citations
+// for it once it has been fitted into the prompt.
+type contextSelection struct {
+	kb        *KnowledgeBase
+	namespace string
+	question  string
+	// text is injected as is when it fits. chunks are the retrieved chunks
+	// it was rendered from, best first, or nil for a namespace's full
+	// context.
+	text   string
+	chunks []Chunk
+
+	// vector is the question's embedding, if it was embedded, and
+	// similarity how close the best chunk was to it. unmatched is set when
+	// retrieval found nothing relevant at all.
+	vector     []float32
+	similarity float64
+	unmatched  bool
+
+	sources []Citation
+}
+
+// fit returns the selected knowledge within limit tokens. When it is too
+// big, the least relevant chunks are dropped until the rest fits, and what
+// was left out is logged. The full context is ranked against the question
+// by keywords for this, so the answer still gets the parts that matter to
+// it rather than whatever comes first.
+func (s *contextSelection) fit(limit int) string {
+	s.sources = citations(s.chunks)
+	if estimateTokens(s.text) <= limit {
+		return s.text
+	}
+	if chunkTokens <= 0 {
+		s.sources = nil
+		return truncateToTokens(s.text, limit)
+	}
+
+	ranked := s.chunks
+	if ranked == nil {
+		idx := s.kb.keywordIndex()
+		ranked = idx.pick(idx.within(rank(idx.bm25.scores(s.question), false), s.namespace), len(idx.chunks))
+	}
+
+	var kept, omitted []Chunk
+	used := 0
+	for _, c := range ranked {
+		// Chunks are separated by a blank line, which is about one token.
+		cost := estimateTokens(c.Label()+"\n"+c.Text) + 1
+		if used+cost > limit {
+			omitted = append(omitted, c)
+			continue
+		}
+		used += cost
+		kept = append(kept, c)
+	}
+	if len(omitted) == 0 {
+		return s.text
+	}
+
+	contextCompressions.Add(1)
+	slog.Info("Context over budget", "question", redactPII(s.question), "tokens", estimateTokens(s.text), "limit", limit,
+		"kept", len(kept), "omitted", len(omitted), "omitted_chunks", describeChunks(omitted))
+	s.sources = citations(kept)
+	return truncateToTokens(renderChunks(kept), limit)
+}
+
+// describeChunks names chunks for logs, up to maxOmittedLogged of them.
+func describeChunks(chunks []Chunk) string {
+	names := make([]string, 0, min(len(chunks), maxOmittedLogged)+1)
+	for i, c := range chunks {
+		if i == maxOmittedLogged {
+			names = append(names, fmt.Sprintf("and %d more", len(chunks)-i))
+			break
+		}
+		name := c.Source
+		if c.Section != "" {
+			name += " (" + c.Section + ")"
+		}
+		names = append(names, fmt.Sprintf("%s #%d", name, c.Index))
+	}
+	return strings.Join(names, ", ")
+}
+
+// keywordIndex returns the chunks of kb with their keyword index, taken
+// from the retrieval index when it is of this snapshot and built on first
+// use otherwise.
+func (kb *KnowledgeBase) keywordIndex() *retrievalIndex {
+	if idx := index.Load(); idx != nil && idx.fingerprint == kb.fingerprint {
+		return idx
+	}
+	kb.chunkOnce.Do(func() {
+		kb.chunkIndex = newRetrievalIndex(kb)
+	})
+	return kb.chunkIndex
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/BurntSushi/toml"
+)
+
+// defaultConfigFile is read when CONFIG_FILE is not set, or .env when it
+// does not exist either.
+const defaultConfigFile = "satbot.toml"
+
+// settings holds the configuration file read at startup, by environment
+// variable name. The environment wins over it: getEnv and friends only fall
+// back on the file for variables that are unset or empty.
+var settings = &settingStore{values: map[string]string{}, used: map[string]bool{}}
+
+type settingStore struct {
+	mu     sync.Mutex
+	path   string
+	values map[string]string
+	// used are the settings looked up, to tell apart the misspelled ones.
+	used map[string]bool
+	// watching collects the settings looked up during watch.
+	watching map[string]bool
+}
+
+// lookup returns the value of the setting key, from the environment or
+// else the configuration file, trimmed.
+func (s *settingStore) lookup(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used[key] = true
+	if s.watching != nil {
+		s.watching[key] = true
+	}
+	if value := strings.TrimSpace(os.Getenv(key)); value != "" {
+		return value
+	}
+	return s.values[key]
+}
+
+// loadConfigFile reads the configuration file at CONFIG_FILE, satbot.toml by
+// default, or a .env file when there is neither. The file is TOML: sections
+// such as [server], [provider], [prompt], [cors], [limits] and [storage]
+// group the settings, whose keys are the names of the environment variables
+// they stand for, in any case, so
+//
+//	[cors]
+//	cors_allowed_origins = ["https://saturnalia.in", "https://*.saturnalia.in"]
+//
+// sets CORS_ALLOWED_ORIGINS. Arrays are joined with commas. The sections
+// are only for reading the file and may be named as convenient. A .env file,
+// one KEY=value per line, is read as a file without sections.
+func loadConfigFile() {
+	path, values, err := readSettings()
+	if err != nil {
+		configProblem("CONFIG_FILE: %v", err)
+		return
+	}
+	if path == "" {
+		slog.Info("No configuration file loaded, using the environment only")
+		return
+	}
+	settings.replace(path, values)
+	slog.Info("Loaded configuration file", "path", path, "settings", len(values))
+}
+
+// readSettings reads the configuration file loadConfigFile describes. The
+// path is empty when there is none, which is only an error when CONFIG_FILE
+// names it.
+func readSettings() (string, map[string]string, error) {
+	path, explicit := os.Getenv("CONFIG_FILE"), true
+	if path == "" {
+		path, explicit = defaultConfigFile, false
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			path = ".env"
+		}
+	}
+	values, err := readConfigFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return "", map[string]string{}, nil
+	}
+	return path, values, err
+}
+
+// replace puts values, read from path, in use and returns those they
+// replace.
+func (s *settingStore) replace(path string, values map[string]string) (string, map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	oldPath, oldValues := s.path, s.values
+	s.path, s.values = path, values
+	return oldPath, oldValues
+}
+
+// watch runs read and returns the settings it looked up.
+func (s *settingStore) watch(read func()) map[string]bool {
+	s.mu.Lock()
+	s.watching = map[string]bool{}
+	s.mu.Unlock()
+	read()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.watching
+	s.watching = nil
+	return keys
+}
+
+// lazySettings are read when needed rather than at startup, most so that a
+// rotated secret applies at once.
+var lazySettings = map[string]bool{
+	"ADMIN_API_KEY":        true,
+	"USER_TOKEN_SECRET":    true,
+	"METRICS_TOKEN":        true,
+	"HEALTH_PROBE_TIMEOUT": true,
+	"HEALTH_CACHE_TTL":     true,
+	"SMTP_ADDR":            true,
+	"SMTP_USERNAME":        true,
+	"SMTP_PASSWORD":        true,
+	"DIGEST_EMAIL_FROM":    true,
+}
+
+// warnUnusedSettings logs the settings of the configuration file nothing
+// looked up at startup, which are usually misspelled.
+func warnUnusedSettings() {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+	var unused []string
+	for key := range settings.values {
+		if !settings.used[key] && !lazySettings[key] {
+			unused = append(unused, key)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		slog.Warn("Configuration file has settings nothing uses, check their names", "path", settings.path, "settings", unused)
+	}
+}
+
+// readConfigFile reads the file at path into settings by environment
+// variable name: a TOML file, see loadConfigFile, or, for files not ending
+// in .toml, a .env file.
+func readConfigFile(path string) (map[string]string, error) {
+	if !strings.HasSuffix(path, ".toml") {
+		return readEnvFile(path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	values := map[string]string{}
+	if err := flattenConfig(doc, values); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return values, nil
+}
+
+// flattenConfig adds the settings of a TOML table, and of the tables in it,
+// to values.
+func flattenConfig(table map[string]any, values map[string]string) error {
+	keys := make([]string, 0, len(table))
+	for key := range table {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if section, ok := table[key].(map[string]any); ok {
+			if err := flattenConfig(section, values); err != nil {
+				return err
+			}
+			continue
+		}
+		name, err := parseConfigKey(key)
+		if err != nil {
+			return err
+		}
+		value, err := configValue(table[key])
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if _, dup := values[name]; dup {
+			return fmt.Errorf("%s is set twice", name)
+		}
+		values[name] = value
+	}
+	return nil
+}
+
+// parseConfigKey returns the environment variable name a key stands for.
+func parseConfigKey(key string) (string, error) {
+	if key == "" {
+		return "", errors.New("empty key")
+	}
+	for _, r := range key {
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return "", fmt.Errorf("invalid key %q, keys are environment variable names", key)
+		}
+	}
+	return strings.ToUpper(key), nil
+}
+
+// configValue formats a TOML value as the environment variable would hold
+// it, an array being joined with commas.
+func configValue(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			if _, ok := item.([]any); ok {
+				return "", errors.New("nested arrays are not supported")
+			}
+			s, err := configValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v, quote strings", value)
+}
+
+// readEnvFile reads a .env file, one KEY=value per line, optionally quoted
+// and preceded by export. Comment lines, and lines that set nothing, are
+// skipped.
+func readEnvFile(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			continue
+		}
+		name, err := parseConfigKey(strings.TrimSpace(strings.TrimPrefix(key, "export ")))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if _, dup := values[name]; dup {
+			return nil, fmt.Errorf("%s:%d: %s is set twice", path, line, name)
+		}
+		values[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return values, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "sections and types",
+			file: "satbot.toml",
+			content: `
+# comment
+[server]
+port = 9090
+log_level = "debug"
+
+[cors]
+cors_allowed_origins = [
+	"https://saturnalia.in", # the site
+	"https://*.saturnalia.in",
+]
+
+[limits]
+gen_temperature = 0.5
+PII_REDACTION = false
+`,
+			want: map[string]string{
+				"PORT":                 "9090",
+				"LOG_LEVEL":            "debug",
+				"CORS_ALLOWED_ORIGINS": "https://saturnalia.in,https://*.saturnalia.in",
+				"GEN_TEMPERATURE":      "0.5",
+				"PII_REDACTION":        "false",
+			},
+		},
+		{
+			name:    "nested tables only group",
+			file:    "satbot.toml",
+			content: "[storage.sqlite]\ninteractions_db = 'chat.db'\n",
+			want:    map[string]string{"INTERACTIONS_DB": "chat.db"},
+		},
+		{
+			name:    "set in two sections",
+			file:    "satbot.toml",
+			content: "[a]\nport = 1\n[b]\nPORT = 2\n",
+			wantErr: "PORT is set twice",
+		},
+		{
+			name:    "nested array",
+			file:    "satbot.toml",
+			content: "origins = [[\"a\"]]\n",
+			wantErr: "nested arrays are not supported",
+		},
+		{
+			name:    "key not a variable name",
+			file:    "satbot.toml",
+			content: "\"log-level\" = \"debug\"\n",
+			wantErr: "invalid key",
+		},
+		{
+			name:    "date",
+			file:    "satbot.toml",
+			content: "fest_dates = 2025-11-14\n",
+			wantErr: "unsupported value",
+		},
+		{
+			name:    "invalid TOML",
+			file:    "satbot.toml",
+			content: "port =\n",
+			wantErr: "line 1",
+		},
+		{
+			name:    "env file",
+			file:    ".env",
+			content: "# comment\nexport GROQ_API_KEY=\"k1,k2\"\nFEST_NAME='Saturnalia'\nPROMPT_DIR=prompts\nnot a setting\n",
+			want:    map[string]string{"GROQ_API_KEY": "k1,k2", "FEST_NAME": "Saturnalia", "PROMPT_DIR": "prompts"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readConfigFile(writeConfig(t, tt.file, tt.content))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("settings = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigFileMissing(t *testing.T) {
+	if _, err := readConfigFile(filepath.Join(t.TempDir(), "satbot.toml")); !os.IsNotExist(err) {
+		t.Errorf("error = %v, want not exist", err)
+	}
+}
+
+// useSettings puts the settings of a configuration file in use for the
+// test.
+func useSettings(t *testing.T, content string) {
+	t.Helper()
+	path := writeConfig(t, "satbot.toml", content)
+	values, err := readConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPath, oldValues := settings.replace(path, values)
+	t.Cleanup(func() { settings.replace(oldPath, oldValues) })
+}
+
+func TestEnvironmentOverridesConfigFile(t *testing.T) {
+	useSettings(t, `
+[server]
+port = 9090
+log_level = "debug"
+server_write_timeout = "20s"
+max_message_chars = 2000
+`)
+	t.Setenv("PORT", "7070")
+	t.Setenv("LOG_LEVEL", "  ")
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"PORT", "7070"},
+		{"LOG_LEVEL", "debug"},
+		{"LOG_FORMAT", "json"},
+	}
+	for _, tt := range tests {
+		if got := getEnv(tt.key, "json"); got != tt.want {
+			t.Errorf("getEnv(%s) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+	if got := getEnvInt("MAX_MESSAGE_CHARS", 4000); got != 2000 {
+		t.Errorf("getEnvInt(MAX_MESSAGE_CHARS) = %d, want 2000", got)
+	}
+	if got := getEnvDuration("SERVER_WRITE_TIMEOUT", 15*time.Second); got != 20*time.Second {
+		t.Errorf("getEnvDuration(SERVER_WRITE_TIMEOUT) = %v, want 20s", got)
+	}
+
+	t.Setenv("MAX_MESSAGE_CHARS", "many")
+	var got int
+	problems := collectConfigProblems(func() { got = getEnvInt("MAX_MESSAGE_CHARS", 4000) })
+	if got != 4000 || len(problems) != 1 || !strings.Contains(problems[0], "MAX_MESSAGE_CHARS") {
+		t.Errorf("invalid MAX_MESSAGE_CHARS read as %d with problems %q, want the default and one problem", got, problems)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxDocumentSize caps a text document uploaded through the admin API, and
+// maxPDFSize an uploaded PDF.
+const (
+	maxDocumentSize = 1 << 20
+	maxPDFSize      = 20 << 20
+)
+
+var errInvalidDocumentName = errors.New("Document name must be a relative .txt, .md or .pdf path without hidden or parent segments")
+
+type DocumentInfo struct {
+	Name      string    `json:"name"`
+	Namespace string    `json:"namespace,omitempty"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DocumentResponse carries a document's content as stored, or for a PDF
+// the text extracted from it.
+type DocumentResponse struct {
+	DocumentInfo
+	Content string `json:"content"`
+}
+
+type DocumentRequest struct {
+	// Name is only read when creating a document with POST.
+	Name    string `json:"name,omitempty"`
+	Content string `json:"content"`
+}
+
+// documentPath validates a document name from the API and returns its path
+// inside the context directory.
+func documentPath(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.Contains(name, "\\") || path.IsAbs(name) || path.Clean(name) != name {
+		return "", errInvalidDocumentName
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." || strings.HasPrefix(segment, ".") {
+			return "", errInvalidDocumentName
+		}
+	}
+	if !isDocumentFile(name) {
+		return "", errInvalidDocumentName
+	}
+	return filepath.Join(contextDir, filepath.FromSlash(name)), nil
+}
+
+// writeFileAtomic replaces path with data so that readers never see a
+// partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func decodeDocumentRequest(w http.ResponseWriter, r *http.Request) (DocumentRequest, bool) {
+	var req DocumentRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxDocumentSize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDecodeError(w, err)
+		return req, false
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: "Document content cannot be empty"})
+		return req, false
+	}
+	return req, true
+}
+
+func isPDF(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".pdf")
+}
+
+// readPDFUpload reads a PDF sent as the raw request body and returns it with
+// its text, rejecting files no text can be extracted from.
+func readPDFUpload(w http.ResponseWriter, r *http.Request) (data []byte, text string, ok bool) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPDFSize))
+	if err != nil {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		writeErrorBody(w, ErrorResponse{Error: "PDF is too large"})
+		return nil, "", false
+	}
+	if text, err = pdfToText(data); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: "Could not read PDF: " + err.Error()})
+		return nil, "", false
+	}
+	return data, text, true
+}
+
+// saveDocument writes a document and reloads the knowledge base so the
+// change is live before the response is sent. content is what the response
+// shows, which for a PDF is its text rather than data.
+func saveDocument(w http.ResponseWriter, name, file string, data []byte, content string, status int) {
+	if err := writeFileAtomic(file, data); err != nil {
+		slog.Error("Failed to save document", "name", name, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to save document"})
+		return
+	}
+	logContextReload("update of " + name)
+
+	info, err := os.Stat(file)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to save document"})
+		return
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(DocumentResponse{
+		DocumentInfo: DocumentInfo{Name: name, Namespace: namespaceOf(name), Size: info.Size(), UpdatedAt: info.ModTime().UTC()},
+		Content:      content,
+	})
+}
+
+// listDocumentsHandler lists the documents in the context directory.
+func listDocumentsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	docs := []DocumentInfo{}
+	err := walkDocuments(contextDir, func(_, name string, info fs.FileInfo) error {
+		docs = append(docs, DocumentInfo{Name: name, Namespace: namespaceOf(name), Size: info.Size(), UpdatedAt: info.ModTime().UTC()})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		slog.ErrorContext(r.Context(), "Failed to list documents", "dir", contextDir, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to list documents"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(docs)
+}
+
+func getDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := mux.Vars(r)["name"]
+	file, err := documentPath(name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	info, err := os.Stat(file)
+	content, readErr := os.ReadFile(file)
+	if err != nil || readErr != nil {
+		w.WriteHeader(http.StatusNotFound)
+		writeErrorBody(w, ErrorResponse{Error: "Document not found"})
+		return
+	}
+	if isPDF(name) {
+		text, err := pdfToText(content)
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			writeErrorBody(w, ErrorResponse{Error: "Could not read PDF: " + err.Error()})
+			return
+		}
+		content = []byte(text)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(DocumentResponse{
+		DocumentInfo: DocumentInfo{Name: name, Namespace: namespaceOf(name), Size: info.Size(), UpdatedAt: info.ModTime().UTC()},
+		Content:      string(content),
+	})
+}
+
+// createDocumentHandler adds a new document; it refuses to overwrite one.
+func createDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	req, ok := decodeDocumentRequest(w, r)
+	if !ok {
+		return
+	}
+	file, err := documentPath(req.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if isPDF(req.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: "Upload PDFs with PUT /admin/context/{name}"})
+		return
+	}
+	if _, err := os.Stat(file); err == nil {
+		w.WriteHeader(http.StatusConflict)
+		writeErrorBody(w, ErrorResponse{Error: "Document already exists"})
+		return
+	}
+
+	auditDocumentChange(r, strings.TrimSpace(req.Name), file, req.Content)
+	saveDocument(w, strings.TrimSpace(req.Name), file, []byte(req.Content), req.Content, http.StatusCreated)
+}
+
+// updateDocumentHandler replaces a document's content, creating it if needed.
+// PDFs are sent as the raw request body, other documents as JSON.
+func updateDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	name := mux.Vars(r)["name"]
+	file, err := documentPath(name)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: err.Error()})
+		return
+	}
+	var data []byte
+	var content string
+	if isPDF(name) {
+		var ok bool
+		if data, content, ok = readPDFUpload(w, r); !ok {
+			return
+		}
+	} else {
+		req, ok := decodeDocumentRequest(w, r)
+		if !ok {
+			return
+		}
+		data, content = []byte(req.Content), req.Content
+	}
+
+	status := http.StatusOK
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		status = http.StatusCreated
+	}
+	auditDocumentChange(r, name, file, content)
+	saveDocument(w, name, file, data, content, status)
+}
+
+func deleteDocumentHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	file, err := documentPath(name)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	auditDocumentChange(r, name, file, "")
+	if err := os.Remove(file); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+			writeErrorBody(w, ErrorResponse{Error: "Document not found"})
+			return
+		}
+		slog.ErrorContext(r.Context(), "Failed to delete document", "name", name, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to delete document"})
+		return
+	}
+	logContextReload("deletion of " + name)
+	w.WriteHeader(http.StatusNoContent)
+}
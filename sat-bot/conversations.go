@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+type ConversationSummary struct {
+	ID           string    `json:"id"`
+	Title        string    `json:"title"`
+	MessageCount int       `json:"message_count"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type ConversationExport struct {
+	ID         string            `json:"id"`
+	Title      string            `json:"title"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	Messages   []TranscriptEntry `json:"messages"`
+	ExportedAt time.Time         `json:"exported_at"`
+}
+
+// listConversationsHandler returns the calling visitor's conversations, most
+// recently active first.
+func listConversationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	list := []ConversationSummary{}
+	for _, session := range sessions.ListByVisitor(visitorIDFromContext(r.Context())) {
+		session.mu.Lock()
+		list = append(list, ConversationSummary{
+			ID:           session.ID,
+			Title:        session.Title,
+			MessageCount: len(session.Transcript),
+			CreatedAt:    session.CreatedAt.UTC(),
+			UpdatedAt:    session.UpdatedAt.UTC(),
+		})
+		session.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UpdatedAt.After(list[j].UpdatedAt) })
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"conversations": list})
+}
+
+// exportConversationHandler returns the full transcript of a session. The
+// default is JSON; format=text returns a plain-text attachment.
+func exportConversationHandler(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessions.Get(mux.Vars(r)["id"], visitorIDFromContext(r.Context()))
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		writeErrorBody(w, ErrorResponse{Error: "Conversation not found"})
+		return
+	}
+
+	session.mu.Lock()
+	export := ConversationExport{
+		ID:         session.ID,
+		Title:      session.Title,
+		CreatedAt:  session.CreatedAt.UTC(),
+		UpdatedAt:  session.UpdatedAt.UTC(),
+		Messages:   append([]TranscriptEntry{}, session.Transcript...),
+		ExportedAt: time.Now().UTC(),
+	}
+	session.mu.Unlock()
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(export)
+	case "text", "txt":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="satbot-conversation-%s.txt"`, export.ID))
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, formatTranscript(export))
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: "Unsupported export format"})
+	}
+}
+
+func formatTranscript(export ConversationExport) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "SatBot conversation %s\n", export.ID)
+	if export.Title != "" {
+		fmt.Fprintf(&b, "Title: %s\n", export.Title)
+	}
+	fmt.Fprintf(&b, "Started: %s\n", export.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(&b, "Exported: %s\n\n", export.ExportedAt.Format(time.RFC3339))
+
+	for _, m := range export.Messages {
+		speaker := "You"
+		if m.Role == "assistant" {
+			speaker = "SatBot"
+		}
+		fmt.Fprintf(&b, "[%s] %s:\n%s\n\n", m.CreatedAt.Format("2006-01-02 15:04:05"), speaker, m.Content)
+	}
+	return b.String()
+}
+
+type RegenerateRequest struct {
+	Temperature *float64 `json:"temperature,omitempty"`
+	Model       string   `json:"model,omitempty"`
+}
+
+// regenerateHandler asks the model again for the last question of a
+// conversation and replaces the previous answer, without adding a new user
+// turn.
+func regenerateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req RegenerateRequest
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&req); err != nil && err != io.EOF {
+			writeDecodeError(w, err)
+			return
+		}
+	}
+
+	opts, ok := requestAnswerOptions(w, req.Model, "", &GenerationOverrides{Temperature: req.Temperature})
+	if !ok {
+		return
+	}
+	opts.SkipCache = true
+
+	r, cancel := withAnswerDeadline(r)
+	defer cancel()
+
+	session, ok := sessions.Get(mux.Vars(r)["id"], visitorIDFromContext(r.Context()))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		writeErrorBody(w, ErrorResponse{Error: "Conversation not found"})
+		return
+	}
+	setLogSession(r.Context(), session.ID)
+	if !allowRequest(w, r, sessionLimiter.Get(), "session", session.ID) {
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	question, ok := session.LastTurn()
+	if !ok {
+		w.WriteHeader(http.StatusConflict)
+		writeErrorBody(w, ErrorResponse{Error: "Nothing to regenerate"})
+		return
+	}
+
+	answer, responseTime, err := generateAnswer(r, session.Summary, session.historyBeforeLastTurn(), question, opts)
+	if err != nil {
+		writeChatError(w, err)
+		storeInteraction(r, session, question, nil, 0, err)
+		return
+	}
+	recordRegeneration(session.Transcript[len(session.Transcript)-1].Variant)
+
+	session.ReplaceLastAnswer(answer, time.Now().UTC())
+	slog.InfoContext(r.Context(), "Regenerated answer", "latency_ms", responseTime.Milliseconds())
+	storeInteraction(r, session, question, answer, responseTime, nil)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ChatResponse{
+		Response:      answer.Content,
+		ResponseTime:  fmt.Sprintf("%.4f seconds", responseTime.Seconds()),
+		SessionID:     session.ID,
+		MessageID:     session.LastQuestionID(),
+		InteractionID: answer.InteractionID,
+		Sources:       answer.Sources,
+	})
+}
+
+// EditMessageRequest takes the model, namespace and options fields of a
+// chat request, which apply to the edited question's answer.
+type EditMessageRequest struct {
+	Message   string               `json:"message"`
+	Model     string               `json:"model,omitempty"`
+	Namespace string               `json:"namespace,omitempty"`
+	Options   *GenerationOverrides `json:"options,omitempty"`
+}
+
+// editMessageHandler replaces a previous user message, discards everything
+// after it and answers the edited question on the summary and history that
+// preceded it.
+func editMessageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req EditMessageRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+
+	if strings.TrimSpace(req.Message) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: "Message cannot be empty"})
+		return
+	}
+	if !checkMessageLength(w, req.Message) {
+		return
+	}
+	if req.Options != nil && !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		writeErrorBody(w, ErrorResponse{Error: "Generation options require admin access"})
+		return
+	}
+	opts, ok := requestAnswerOptions(w, req.Model, req.Namespace, req.Options)
+	if !ok {
+		return
+	}
+
+	r, cancel := withAnswerDeadline(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	session, ok := sessions.Get(vars["id"], visitorIDFromContext(r.Context()))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		writeErrorBody(w, ErrorResponse{Error: "Conversation not found"})
+		return
+	}
+	setLogSession(r.Context(), session.ID)
+	if !allowRequest(w, r, sessionLimiter.Get(), "session", session.ID) {
+		return
+	}
+
+	session.mu.Lock()
+	defer session.mu.Unlock()
+
+	i := session.transcriptIndex(vars["msgID"])
+	if i < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		writeErrorBody(w, ErrorResponse{Error: "Message not found"})
+		return
+	}
+	if session.Transcript[i].Role != "user" {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: "Only user messages can be edited"})
+		return
+	}
+
+	summary, history := session.contextBefore(i)
+	answer, responseTime, err := generateAnswer(r, summary, history, req.Message, opts)
+	if err != nil {
+		writeChatError(w, err)
+		storeInteraction(r, session, req.Message, nil, 0, err)
+		return
+	}
+
+	session.ReplayFrom(i, req.Message, answer, time.Now().UTC())
+	maybeGenerateTitle(session)
+	maybeSummarizeSession(session)
+	slog.InfoContext(r.Context(), "Edited message", "latency_ms", responseTime.Milliseconds())
+	storeInteraction(r, session, req.Message, answer, responseTime, nil)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ChatResponse{
+		Response:      answer.Content,
+		ResponseTime:  fmt.Sprintf("%.4f seconds", responseTime.Seconds()),
+		SessionID:     session.ID,
+		MessageID:     session.LastQuestionID(),
+		InteractionID: answer.InteractionID,
+		Sources:       answer.Sources,
+	})
+}
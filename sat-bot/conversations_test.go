@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// useSession makes session reachable through the session store for the
+// test. It is given a title, so none is generated in the background.
+func useSession(t *testing.T, session *Session) {
+	t.Helper()
+	session.Title = "Test conversation"
+	sessions.mu.Lock()
+	sessions.sessions[session.ID] = session
+	sessions.mu.Unlock()
+	t.Cleanup(func() {
+		sessions.mu.Lock()
+		delete(sessions.sessions, session.ID)
+		sessions.mu.Unlock()
+	})
+}
+
+// useChatDefaults answers from an empty knowledge base with the default
+// prompts and generation parameters and no token budget for the test.
+func useChatDefaults(t *testing.T) {
+	t.Helper()
+	oldKnowledge, oldGeneration, oldUsage := knowledge.Swap(&KnowledgeBase{}), generation.Load(), usage
+	oldVars, oldTemplate := promptVars.Load(), systemTemplate.Load()
+	params := defaultGeneration
+	generation.Store(&params)
+	usage = &UsageTracker{}
+	if problems := collectConfigProblems(loadPromptConfig); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	t.Cleanup(func() {
+		knowledge.Store(oldKnowledge)
+		generation.Store(oldGeneration)
+		usage = oldUsage
+		promptVars.Store(oldVars)
+		systemTemplate.Store(oldTemplate)
+	})
+}
+
+// recordingProvider returns a provider answering "new answer" and the
+// requests it was sent.
+func recordingProvider() (*fakeProvider, *[]CompletionRequest) {
+	var requests []CompletionRequest
+	return &fakeProvider{name: "fake", complete: func(_ context.Context, req CompletionRequest) (*CompletionResponse, error) {
+		requests = append(requests, req)
+		return &CompletionResponse{Content: "new answer", Provider: "fake", Model: req.Model}, nil
+	}}, &requests
+}
+
+// serveConversation serves a request to handler with the route variables
+// vars.
+func serveConversation(handler http.HandlerFunc, method, path, body string, vars map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r = mux.SetURLVars(r, vars)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// lastUserMessage returns the content of the final message of req.
+func lastUserMessage(req CompletionRequest) string {
+	return req.Messages[len(req.Messages)-1].Content
+}
+
+func TestEditMessageHandler(t *testing.T) {
+	useChatDefaults(t)
+	p, requests := recordingProvider()
+	useProvider(t, p)
+
+	tests := []struct {
+		name string
+		// summarized folds this many messages into the summary first.
+		summarized  int
+		edit        int
+		wantSummary bool
+		wantHistory int
+	}{
+		{name: "without a summary", edit: 2, wantHistory: 2},
+		{name: "after the summarized turns", summarized: 2, edit: 4, wantSummary: true, wantHistory: 2},
+		{name: "within the summarized turns", summarized: 4, edit: 2, wantHistory: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*requests = nil
+			session := sessionWithTurns("one", "two", "three")
+			session.ID = "edit-" + strings.ReplaceAll(tt.name, " ", "-")
+			if tt.summarized > 0 {
+				session.Summary = "They asked about one."
+				session.History = session.History[tt.summarized:]
+			}
+			useSession(t, session)
+
+			w := serveConversation(editMessageHandler, http.MethodPut, "/", `{"message":"edited"}`,
+				map[string]string{"id": session.ID, "msgID": session.Transcript[tt.edit].ID})
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			if len(*requests) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(*requests))
+			}
+			req := (*requests)[0]
+			prompt := lastUserMessage(req)
+			if got := strings.Contains(prompt, "They asked about one."); got != tt.wantSummary {
+				t.Errorf("summary in the prompt = %v, want %v: %q", got, tt.wantSummary, prompt)
+			}
+			if !strings.Contains(prompt, "edited") {
+				t.Errorf("prompt %q lacks the edited question", prompt)
+			}
+			var history []string
+			for _, m := range req.Messages[1 : len(req.Messages)-1] {
+				history = append(history, m.Content)
+			}
+			if len(history) != tt.wantHistory || strings.Contains(strings.Join(history, "|"), "three") {
+				t.Errorf("history %q, want the %d messages before the edited one", history, tt.wantHistory)
+			}
+
+			session.mu.Lock()
+			defer session.mu.Unlock()
+			if (session.Summary != "") != tt.wantSummary {
+				t.Errorf("session summary %q, want it kept = %v", session.Summary, tt.wantSummary)
+			}
+			if n := len(session.Transcript); n != tt.edit+2 || session.Transcript[n-1].Content != "new answer" {
+				t.Errorf("transcript ends with %d entries, want the edit answered", n)
+			}
+		})
+	}
+}
+
+func TestEditMessageHandlerOptions(t *testing.T) {
+	useChatDefaults(t)
+	p, requests := recordingProvider()
+	useProvider(t, p)
+	oldModels := allowedModels
+	allowedModels = map[string]modelChoice{"small": {provider: p, model: "small-model"}}
+	t.Cleanup(func() { allowedModels = oldModels })
+	t.Setenv("ADMIN_API_KEY", "admin-secret")
+
+	session := sessionWithTurns("one")
+	session.ID = "edit-options"
+	useSession(t, session)
+	vars := map[string]string{"id": session.ID, "msgID": session.Transcript[0].ID}
+
+	tests := []struct {
+		name       string
+		body       string
+		admin      bool
+		wantStatus int
+		wantModel  string
+	}{
+		{name: "allowed model", body: `{"message":"edited","model":"small"}`, wantStatus: http.StatusOK, wantModel: "small-model"},
+		{name: "model not allowed", body: `{"message":"edited","model":"huge"}`, wantStatus: http.StatusBadRequest},
+		{name: "unknown namespace", body: `{"message":"edited","namespace":"nope"}`, wantStatus: http.StatusBadRequest},
+		{name: "options without admin", body: `{"message":"edited","options":{"temperature":0}}`, wantStatus: http.StatusForbidden},
+		{name: "options as admin", body: `{"message":"edited","options":{"temperature":0.1}}`, admin: true, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*requests = nil
+			r := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(tt.body))
+			if tt.admin {
+				r.Header.Set("X-Admin-Key", "admin-secret")
+			}
+			w := httptest.NewRecorder()
+			editMessageHandler(w, mux.SetURLVars(r, vars))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if len(*requests) > 0 {
+					t.Error("model called for a rejected edit")
+				}
+				return
+			}
+			if req := (*requests)[0]; req.Model != tt.wantModel {
+				t.Errorf("model = %q, want %q", req.Model, tt.wantModel)
+			}
+			if tt.admin {
+				if req := (*requests)[0]; req.Temperature != 0.1 {
+					t.Errorf("temperature = %v, want the override", req.Temperature)
+				}
+			}
+			var resp ChatResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Response != "new answer" {
+				t.Errorf("response %+v, %v", resp, err)
+			}
+		})
+	}
+}
+
+func TestSessionContextBefore(t *testing.T) {
+	session := sessionWithTurns("one", "two", "three")
+	session.Summary = "They asked about one."
+	session.History = session.History[2:]
+
+	summary, history := session.contextBefore(4)
+	if summary != session.Summary || len(history) != 2 || history[0].Content != "two" {
+		t.Errorf("contextBefore(4) = %q, %v, want the summary and turn two", summary, history)
+	}
+	summary, history = session.contextBefore(0)
+	if summary != "" || len(history) != 0 {
+		t.Errorf("contextBefore(0) = %q, %v, want nothing", summary, history)
+	}
+
+	session.ReplayFrom(4, "edited", &CompletionResponse{Content: "answer to edited"}, time.Now())
+	if session.Summary == "" || len(session.History) != 4 || session.History[2].Content != "edited" {
+		t.Errorf("after the edit summary %q and history %v", session.Summary, session.History)
+	}
+}
+
+func TestRegenerateHandler(t *testing.T) {
+	useChatDefaults(t)
+	p, requests := recordingProvider()
+	useProvider(t, p)
+	oldModels := allowedModels
+	allowedModels = map[string]modelChoice{"small": {provider: p, model: "small-model"}}
+	t.Cleanup(func() { allowedModels = oldModels })
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantModel  string
+	}{
+		{name: "default model", body: "", wantStatus: http.StatusOK},
+		{name: "allowed model", body: `{"model":"small","temperature":0.2}`, wantStatus: http.StatusOK, wantModel: "small-model"},
+		{name: "model not allowed", body: `{"model":"huge"}`, wantStatus: http.StatusBadRequest},
+		{name: "temperature out of range", body: `{"temperature":3}`, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*requests = nil
+			session := sessionWithTurns("one", "two")
+			session.ID = "regenerate-" + strings.ReplaceAll(tt.name, " ", "-")
+			useSession(t, session)
+
+			w := serveConversation(regenerateHandler, http.MethodPost, "/", tt.body, map[string]string{"id": session.ID})
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			session.mu.Lock()
+			defer session.mu.Unlock()
+			last := session.Transcript[len(session.Transcript)-1].Content
+			if tt.wantStatus != http.StatusOK {
+				if len(*requests) > 0 || last != "answer to two" {
+					t.Errorf("rejected request called the model or replaced the answer with %q", last)
+				}
+				return
+			}
+			req := (*requests)[0]
+			if req.Model != tt.wantModel || !strings.Contains(lastUserMessage(req), "two") {
+				t.Errorf("asked %q of model %q, want the last question of %q", lastUserMessage(req), req.Model, tt.wantModel)
+			}
+			if last != "new answer" || len(session.Transcript) != 4 {
+				t.Errorf("transcript of %d entries ends with %q, want the answer replaced", len(session.Transcript), last)
+			}
+		})
+	}
+}
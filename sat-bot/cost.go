@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Pricing is what a model charges per million tokens.
+type Pricing struct {
+	InputPerMillion  float64
+	OutputPerMillion float64
+}
+
+var (
+	modelPricing    = map[string]Pricing{}
+	pricingCurrency = "USD"
+	// costInResponse adds the estimated cost to chat responses.
+	costInResponse = false
+)
+
+// CostEstimate is the estimated cost of one answer.
+type CostEstimate struct {
+	Amount           float64 `json:"amount"`
+	Currency         string  `json:"currency"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+}
+
+// loadPricing reads MODEL_PRICING, a comma-separated list of
+// "[provider:]model=input/output" prices per million tokens, e.g.
+// "groq:moonshotai/kimi-k2-instruct-0905=1.00/3.00,gpt-4o-mini=0.15/0.60".
+// A bare provider name prices every model of that provider. Models without
+// a price are not costed.
+func loadPricing() {
+	pricingCurrency = getEnv("PRICING_CURRENCY", pricingCurrency)
+	costInResponse = getEnv("COST_IN_RESPONSE", "") == "true"
+
+	for _, item := range strings.Split(getEnv("MODEL_PRICING", ""), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, prices, ok := strings.Cut(item, "=")
+		in, out, ok2 := strings.Cut(prices, "/")
+		input, err1 := strconv.ParseFloat(strings.TrimSpace(in), 64)
+		output, err2 := strconv.ParseFloat(strings.TrimSpace(out), 64)
+		if !ok || !ok2 || err1 != nil || err2 != nil || input < 0 || output < 0 {
+			slog.Warn("Ignoring invalid MODEL_PRICING entry", "entry", item)
+			continue
+		}
+		modelPricing[strings.TrimSpace(name)] = Pricing{InputPerMillion: input, OutputPerMillion: output}
+	}
+}
+
+// priceFor finds the price of a model, trying "provider:model", then the
+// model, then the provider.
+func priceFor(provider, model string) (Pricing, bool) {
+	for _, key := range []string{provider + ":" + model, model, provider} {
+		if p, ok := modelPricing[key]; ok {
+			return p, true
+		}
+	}
+	return Pricing{}, false
+}
+
+// estimateCost prices the usage of a reply. ok is false when the model has
+// no configured price.
+func estimateCost(provider, model string, used Usage) (cost float64, ok bool) {
+	p, ok := priceFor(provider, model)
+	if !ok {
+		return 0, false
+	}
+	return (float64(used.PromptTokens)*p.InputPerMillion + float64(used.CompletionTokens)*p.OutputPerMillion) / 1e6, true
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+	"net/http"
+)
+
+// dashboardFiles is the admin dashboard, a static page that signs in with
+// the admin key and reads everything it shows from the admin API.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardCSP lets the dashboard load its own script, style and API
+// responses, in place of the API's policy that allows nothing.
+const dashboardCSP = "default-src 'none'; script-src 'self'; style-src 'self'; connect-src 'self'; img-src 'self'; frame-ancestors 'none'"
+
+// dashboardHandler serves the dashboard at /admin and its assets under
+// /admin/dashboard/. The files hold no data, so they are served without the
+// admin key; the page asks for it and sends it with its API calls, which
+// are checked as usual.
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		log.Fatalf("Invalid dashboard files: %v", err)
+	}
+	assets := http.StripPrefix("/admin/dashboard/", http.FileServerFS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if w.Header().Get("Content-Security-Policy") == defaultSecurityHeaders["Content-Security-Policy"] {
+			w.Header().Set("Content-Security-Policy", dashboardCSP)
+		}
+		w.Header().Set("Cache-Control", "no-cache")
+		if r.URL.Path == "/admin" {
+			http.ServeFileFS(w, r, files, "index.html")
+			return
+		}
+		assets.ServeHTTP(w, r)
+	})
+}
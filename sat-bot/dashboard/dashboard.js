@@ -0,0 +1,381 @@
+// The SatBot admin dashboard. Everything shown comes from the admin API,
+// called with the key entered at sign in, which is kept for the browser tab
+// only.
+"use strict";
+
+const keyStorage = "satbot-admin-key";
+const liveRefreshMS = 15000;
+const knowledgeRefreshMS = 60000;
+const liveRetryMS = 5000;
+
+let timers = [];
+let liveStream = null;
+
+class APIError extends Error {
+  constructor(status, message) {
+    super(message);
+    this.status = status;
+  }
+}
+
+async function api(path) {
+  const resp = await fetch(path, {
+    headers: { Authorization: "Bearer " + sessionStorage.getItem(keyStorage) },
+    cache: "no-store",
+  });
+  let body = null;
+  try {
+    body = await resp.json();
+  } catch (e) {
+    // Errors without a JSON body keep the status text.
+  }
+  if (!resp.ok) {
+    throw new APIError(resp.status, (body && body.error) || resp.statusText);
+  }
+  return body;
+}
+
+// panel runs load and shows what went wrong in the section, signing out
+// when the key is refused.
+async function panel(id, load) {
+  const error = document.querySelector("#" + id + " [data-error]");
+  try {
+    await load();
+    error.textContent = "";
+  } catch (e) {
+    if (e.status === 401) {
+      signOut("The key was not accepted.");
+      return;
+    }
+    error.textContent = e.message;
+  }
+}
+
+function el(tag, text, className) {
+  const node = document.createElement(tag);
+  if (text !== undefined && text !== null) node.textContent = text;
+  if (className) node.className = className;
+  return node;
+}
+
+function stat(label, value) {
+  const box = el("div", null, "stat");
+  box.append(el("strong", value), el("span", label));
+  return box;
+}
+
+function row(cells) {
+  const tr = el("tr");
+  for (const cell of cells) {
+    if (cell instanceof Node) {
+      const td = el("td");
+      td.append(cell);
+      tr.append(td);
+    } else {
+      tr.append(el("td", cell, "text"));
+    }
+  }
+  return tr;
+}
+
+function emptyRow(tbody, columns, text) {
+  const td = el("td", text, "empty");
+  td.colSpan = columns;
+  const tr = el("tr");
+  tr.append(td);
+  tbody.append(tr);
+}
+
+function percent(rate) {
+  return rate === null || rate === undefined ? "–" : (rate * 100).toFixed(1) + "%";
+}
+
+function time(iso) {
+  return iso ? new Date(iso).toLocaleString() : "never";
+}
+
+function shorten(text, max) {
+  text = (text || "").trim();
+  return text.length > max ? text.slice(0, max - 1) + "…" : text;
+}
+
+function outcome(i) {
+  if (i.error) return el("span", i.error, "tag bad");
+  if (i.unanswered) return el("span", i.unanswered.replace("_", " "), "tag warn");
+  if (i.feedback) return rating(i.feedback.rating);
+  return el("span", "answered", "tag");
+}
+
+function rating(value) {
+  return value === "up" ? el("span", "👍 up", "tag good") : el("span", "👎 down", "tag bad");
+}
+
+async function loadTraffic() {
+  const [status, health, summary, volume, channels] = await Promise.all([
+    api("/status"),
+    api("/health"),
+    api("/admin/analytics?last=1h"),
+    api("/admin/analytics/volume?last=24h&interval=hour"),
+    api("/admin/analytics/channels?last=24h"),
+  ]);
+  document.getElementById("traffic-stats").replaceChildren(
+    stat("status", status.mode),
+    stat("active sessions", health.active_sessions),
+    stat("questions, last hour", summary.interactions),
+    stat("sessions, last hour", summary.sessions),
+    stat("error rate", percent(summary.error_rate)),
+    stat("avg latency", summary.avg_latency_ms + " ms"),
+    stat("p95 latency", summary.p95_latency_ms + " ms"),
+  );
+
+  const peak = Math.max(1, ...volume.buckets.map((b) => b.interactions));
+  const bars = volume.buckets.map((b) => {
+    const bar = el("div", null, b.errors > 0 ? "failing" : "");
+    bar.style.height = (100 * b.interactions / peak) + "%";
+    bar.title = new Date(b.start).toLocaleString() + ": " + b.interactions + " questions, " + b.errors + " failed";
+    return bar;
+  });
+  document.getElementById("traffic-volume").replaceChildren(...bars);
+
+  const channelRows = document.getElementById("channels-rows");
+  channelRows.replaceChildren(...channels.channels.map((c) =>
+    row([c.name, c.interactions, percent(c.share), c.sessions, percent(c.error_rate), percent(c.satisfaction_rate)])));
+  if (channels.channels.length === 0) emptyRow(channelRows, 6, "No questions in the last 24 hours.");
+}
+
+function seconds(value) {
+  return value < 60 ? Math.round(value) + " s" : (value / 60).toFixed(1) + " min";
+}
+
+async function loadSessions() {
+  const report = await api("/admin/analytics/sessions?last=168h");
+  const abandoned = (a) => percent(a.rate) + " of " + a.sessions;
+  document.getElementById("sessions-stats").replaceChildren(
+    stat("sessions", report.sessions),
+    stat("avg questions", report.avg_turns.toFixed(1)),
+    stat("one question only", percent(report.single_turn_rate)),
+    stat("median duration", seconds(report.median_duration_seconds)),
+    stat("left after an error", abandoned(report.after_error)),
+    stat("left after a bad answer", abandoned(report.after_bad_answer)),
+  );
+  const tbody = document.getElementById("sessions-rows");
+  tbody.replaceChildren(...report.turn_buckets.map((b) => row([b.turns, b.sessions])));
+}
+
+// conversationsQuery is the search shown in the conversations panel, the
+// last 24 hours when nothing is searched for.
+function conversationsQuery() {
+  const params = new URLSearchParams({ limit: "25" });
+  const q = document.getElementById("search-q").value.trim();
+  const session = document.getElementById("search-session").value.trim();
+  const rated = document.getElementById("search-rating").value;
+  if (q) params.set("q", q);
+  if (session) params.set("session_id", session);
+  if (rated) params.set("rating", rated);
+  if (document.getElementById("search-errors").checked) params.set("error", "true");
+  const searching = params.size > 1;
+  if (!searching) params.set("last", "24h");
+  return { params, searching };
+}
+
+// sessionLink shows the whole conversation of a session when clicked.
+function sessionLink(id) {
+  const link = el("a", shorten(id, 10));
+  link.href = "#";
+  link.title = id;
+  link.addEventListener("click", (event) => {
+    event.preventDefault();
+    document.getElementById("search-session").value = id;
+    panel("conversations", loadConversations);
+  });
+  return link;
+}
+
+async function loadConversations() {
+  const { params, searching } = conversationsQuery();
+  const recent = await api("/admin/interactions?" + params);
+  document.getElementById("search-summary").textContent = searching
+    ? recent.total + " matching, newest " + recent.interactions.length + " shown"
+    : "";
+  const tbody = document.getElementById("conversations-rows");
+  tbody.replaceChildren();
+  for (const i of recent.interactions) {
+    tbody.append(row([
+      time(i.time),
+      sessionLink(i.session_id),
+      shorten(i.question, 200),
+      shorten(i.answer, 200),
+      outcome(i),
+    ]));
+  }
+  if (recent.interactions.length === 0) {
+    emptyRow(tbody, 5, searching ? "Nothing matches the search." : "No questions in the last 24 hours.");
+  }
+}
+
+async function loadFeedback() {
+  const [summary, recent] = await Promise.all([
+    api("/admin/analytics?last=168h"),
+    api("/admin/interactions?last=168h&limit=1000"),
+  ]);
+  document.getElementById("feedback-stats").replaceChildren(
+    stat("rated up", summary.ratings.up),
+    stat("rated down", summary.ratings.down),
+    stat("satisfaction", percent(summary.satisfaction_rate)),
+  );
+  const rated = recent.interactions.filter((i) => i.feedback);
+  rated.sort((a, b) => new Date(b.feedback.created_at) - new Date(a.feedback.created_at));
+  const tbody = document.getElementById("feedback-rows");
+  tbody.replaceChildren();
+  for (const i of rated.slice(0, 20)) {
+    tbody.append(row([time(i.feedback.created_at), rating(i.feedback.rating), shorten(i.question, 200), i.feedback.comment || ""]));
+  }
+  if (rated.length === 0) emptyRow(tbody, 4, "No ratings in the last 7 days.");
+}
+
+async function loadKnowledge() {
+  const [documents, lint, sources] = await Promise.all([
+    api("/admin/context"),
+    api("/admin/context-lint"),
+    api("/admin/sources"),
+  ]);
+  const size = documents.reduce((sum, d) => sum + d.size, 0);
+  const updated = documents.reduce((latest, d) => (d.updated_at > latest ? d.updated_at : latest), "");
+  const issues = lint.issues || [];
+  const errors = issues.filter((issue) => issue.severity === "error").length;
+  document.getElementById("knowledge-stats").replaceChildren(
+    stat("documents loaded", lint.documents),
+    stat("tokens", lint.tokens),
+    stat("files on disk", documents.length),
+    stat("bytes on disk", size),
+    stat("last edited", time(updated)),
+    stat("lint errors", errors),
+    stat("lint warnings", issues.length - errors),
+  );
+
+  const sourceRows = document.getElementById("sources-rows");
+  sourceRows.replaceChildren();
+  for (const s of sources.sources) {
+    sourceRows.append(row([s.name, time(s.last_success), s.size, s.last_error || ""]));
+  }
+  if (sources.sources.length === 0) emptyRow(sourceRows, 4, "No remote sources are configured.");
+
+  const lintRows = document.getElementById("lint-rows");
+  lintRows.replaceChildren();
+  for (const issue of issues.slice(0, 20)) {
+    const where = issue.document ? issue.document + (issue.line ? ":" + issue.line : "") : "";
+    lintRows.append(row([el("span", issue.severity, issue.severity === "error" ? "tag bad" : "tag warn"), where, issue.message]));
+  }
+  if (issues.length === 0) emptyRow(lintRows, 3, "No issues found.");
+}
+
+function refreshLive() {
+  Promise.all([
+    panel("traffic", loadTraffic),
+    panel("sessions", loadSessions),
+    panel("conversations", loadConversations),
+    panel("feedback", loadFeedback),
+  ]).then(() => {
+    document.getElementById("updated").textContent = "Updated " + new Date().toLocaleTimeString();
+  });
+}
+
+function showLive(stats) {
+  document.getElementById("live-stats").replaceChildren(
+    stat("chats per minute", stats.chats_per_minute),
+    stat("errors per minute", stats.errors_per_minute),
+    stat("active sessions", stats.active_sessions),
+    stat("top question", stats.trending.length ? shorten(stats.trending[0].question, 80) : "–"),
+  );
+  document.getElementById("live-trending").replaceChildren(
+    ...stats.trending.map((t) => el("li", shorten(t.question, 200) + " (" + t.count + ")")),
+  );
+}
+
+// streamLive follows the server-sent live stats, read with fetch rather than
+// EventSource so the key can go in the Authorization header, and reconnects
+// when the stream drops.
+async function streamLive() {
+  const controller = new AbortController();
+  liveStream = controller;
+  const error = document.querySelector("#live [data-error]");
+  try {
+    const resp = await fetch("/admin/live", {
+      headers: { Authorization: "Bearer " + sessionStorage.getItem(keyStorage) },
+      cache: "no-store",
+      signal: controller.signal,
+    });
+    if (resp.status === 401) {
+      signOut("The key was not accepted.");
+      return;
+    }
+    if (!resp.ok) throw new Error(resp.statusText);
+    error.textContent = "";
+    const reader = resp.body.pipeThrough(new TextDecoderStream()).getReader();
+    let buffer = "";
+    for (;;) {
+      const { value, done } = await reader.read();
+      if (done) break;
+      buffer += value;
+      let end;
+      while ((end = buffer.indexOf("\n\n")) >= 0) {
+        const data = buffer.slice(0, end).split("\n").find((line) => line.startsWith("data: "));
+        buffer = buffer.slice(end + 2);
+        if (data) showLive(JSON.parse(data.slice(6)));
+      }
+    }
+    error.textContent = "The live stream ended, reconnecting.";
+  } catch (e) {
+    if (controller.signal.aborted) return;
+    error.textContent = "Live stats unavailable: " + e.message;
+  }
+  if (liveStream === controller) setTimeout(() => liveStream === controller && streamLive(), liveRetryMS);
+}
+
+function refreshKnowledge() {
+  panel("knowledge", loadKnowledge);
+}
+
+function signIn() {
+  document.getElementById("sign-in").hidden = true;
+  document.getElementById("dashboard").hidden = false;
+  document.getElementById("sign-out").hidden = false;
+  refreshLive();
+  refreshKnowledge();
+  streamLive();
+  timers = [setInterval(refreshLive, liveRefreshMS), setInterval(refreshKnowledge, knowledgeRefreshMS)];
+}
+
+function signOut(message) {
+  timers.forEach(clearInterval);
+  timers = [];
+  if (liveStream) liveStream.abort();
+  liveStream = null;
+  sessionStorage.removeItem(keyStorage);
+  document.getElementById("dashboard").hidden = true;
+  document.getElementById("sign-out").hidden = true;
+  document.getElementById("sign-in").hidden = false;
+  document.getElementById("sign-in-error").textContent = message || "";
+  document.getElementById("updated").textContent = "";
+}
+
+document.getElementById("sign-in").addEventListener("submit", (event) => {
+  event.preventDefault();
+  const input = document.getElementById("key");
+  sessionStorage.setItem(keyStorage, input.value.trim());
+  input.value = "";
+  signIn();
+});
+
+document.getElementById("sign-out").addEventListener("click", () => signOut());
+
+document.getElementById("search").addEventListener("submit", (event) => {
+  event.preventDefault();
+  panel("conversations", loadConversations);
+});
+
+if (sessionStorage.getItem(keyStorage)) {
+  signIn();
+} else {
+  signOut();
+}
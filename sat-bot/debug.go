@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/hmac"
+	"expvar"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+)
+
+// startDebugServer serves the pprof profiles and the expvar counters on
+// DEBUG_ADDR, a listener of its own so they are never reachable through the
+// public port. It is off unless DEBUG_ADDR is set, e.g. to 127.0.0.1:6060.
+// DEBUG_TOKEN, when set, must be sent as a bearer token; an address other
+// than loopback requires it.
+func startDebugServer() {
+	addr := getEnv("DEBUG_ADDR", "")
+	if addr == "" {
+		return
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		configProblem("DEBUG_ADDR: %v", err)
+		return
+	}
+	token := getEnv("DEBUG_TOKEN", "")
+	if ip := net.ParseIP(host); token == "" && host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		configProblem("DEBUG_ADDR: listening on %s other than loopback needs DEBUG_TOKEN", addr)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           requireDebugToken(token, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			slog.Error("Debug server stopped", "addr", addr, "err", err)
+		}
+	}()
+	slog.Info("Serving pprof and expvar", "addr", addr, "token", token != "")
+}
+
+func requireDebugToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !hmac.Equal([]byte(strings.TrimSpace(given)), []byte(token)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
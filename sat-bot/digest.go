@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// digestTopQuestions is how many questions the digest lists.
+const digestTopQuestions = 10
+
+// dailyDigest sends a summary of a day of the fest to a Slack or Discord
+// webhook, by email, or both.
+type dailyDigest struct {
+	schedule schedule
+	webhook  string
+	discord  bool
+	emailTo  []string
+	client   *http.Client
+}
+
+// digest is nil when no destination is configured.
+var digest *dailyDigest
+
+// loadDigest reads DIGEST_WEBHOOK_URL, a Slack or Discord incoming webhook,
+// and DIGEST_EMAIL_TO, comma-separated addresses mailed through the SMTP
+// server at SMTP_ADDR (host:port) as DIGEST_EMAIL_FROM, logging in with
+// SMTP_USERNAME and SMTP_PASSWORD when set. The digest is off without
+// either destination. It is sent on DIGEST_SCHEDULE, a cron expression in
+// USAGE_TIMEZONE ("0 9 * * *" by default), and covers the day before.
+func loadDigest() {
+	d := &dailyDigest{
+		webhook: getEnv("DIGEST_WEBHOOK_URL", ""),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	for _, addr := range strings.Split(getEnv("DIGEST_EMAIL_TO", ""), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			d.emailTo = append(d.emailTo, addr)
+		}
+	}
+	if d.webhook == "" && len(d.emailTo) == 0 {
+		return
+	}
+	d.discord = strings.Contains(d.webhook, "discord.com/") || strings.Contains(d.webhook, "discordapp.com/")
+	if len(d.emailTo) > 0 && (getEnv("SMTP_ADDR", "") == "" || getEnv("DIGEST_EMAIL_FROM", "") == "") {
+		configProblem("DIGEST_EMAIL_TO: SMTP_ADDR and DIGEST_EMAIL_FROM are needed to send email")
+		return
+	}
+	spec := getEnv("DIGEST_SCHEDULE", "0 9 * * *")
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		configProblem("DIGEST_SCHEDULE: %v", err)
+		return
+	}
+	d.schedule = sched
+	digest = d
+	slog.Info("Sending daily digest", "schedule", spec, "webhook", d.webhook != "", "email_to", len(d.emailTo))
+	go d.loop(spec)
+}
+
+func (d *dailyDigest) loop(spec string) {
+	for {
+		next := d.schedule.Next(time.Now().In(usage.location))
+		if next.IsZero() {
+			slog.Warn("Schedule never runs again, stopping the daily digest", "schedule", spec)
+			return
+		}
+		time.Sleep(time.Until(next))
+		day := time.Now().In(usage.location).AddDate(0, 0, -1)
+		if err := d.Send(context.Background(), day); err != nil {
+			slog.Error("Failed to send daily digest", "err", err)
+		}
+	}
+}
+
+// Send builds the digest of the calendar day of day in USAGE_TIMEZONE and
+// sends it to every destination.
+func (d *dailyDigest) Send(ctx context.Context, day time.Time) error {
+	message, err := buildDigest(ctx, day)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	if d.webhook != "" {
+		if err := d.post(message); err != nil {
+			errs = append(errs, fmt.Errorf("webhook: %w", err))
+		}
+	}
+	if len(d.emailTo) > 0 {
+		subject := "SatBot daily digest for " + day.Format(time.DateOnly)
+		if err := d.mail(subject, message); err != nil {
+			errs = append(errs, fmt.Errorf("email: %w", err))
+		}
+	}
+	if len(errs) == 0 {
+		slog.Info("Sent daily digest", "date", day.Format(time.DateOnly))
+	}
+	return errors.Join(errs...)
+}
+
+// buildDigest renders the numbers of a day as plain text. The questions
+// come from the stored interactions, and the tokens and cost from the usage
+// counters, which include the model calls made outside chats.
+func buildDigest(ctx context.Context, day time.Time) (string, error) {
+	from := time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, usage.location)
+	to := from.AddDate(0, 0, 1)
+	date := from.Format(time.DateOnly)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "SatBot daily digest for %s\n\n", date)
+	var top []TopQuestion
+	if interactions != nil {
+		ctx, cancel := context.WithTimeout(ctx, interactionStoreTimeout)
+		defer cancel()
+		found, err := interactions.List(ctx, InteractionFilter{Since: from, Until: to})
+		if err != nil {
+			return "", err
+		}
+		summary := summarizeInteractions(from, to, found)
+		fmt.Fprintf(&b, "Chats: %d from %d sessions\n", summary.Interactions, summary.Sessions)
+		fmt.Fprintf(&b, "Error rate: %.1f%% (%d failed)\n", summary.ErrorRate*100, summary.Errors)
+		if summary.SatisfactionRate != nil {
+			fmt.Fprintf(&b, "Rated helpful: %.0f%% of %d ratings\n", *summary.SatisfactionRate*100, summary.Ratings.Up+summary.Ratings.Down)
+		}
+		top = topQuestions(found, digestTopQuestions)
+	}
+	for _, u := range usage.Days() {
+		if u.Date == date {
+			fmt.Fprintf(&b, "Tokens: %d (%d prompt, %d completion)\n", u.TotalTokens, u.PromptTokens, u.CompletionTokens)
+			if u.EstimatedCost > 0 {
+				fmt.Fprintf(&b, "Estimated cost: %.2f %s\n", u.EstimatedCost, pricingCurrency)
+			}
+		}
+	}
+	if len(top) > 0 {
+		b.WriteString("\nTop questions:\n")
+		for i, q := range top {
+			fmt.Fprintf(&b, "%d. %s (%d)\n", i+1, q.Question, q.Count)
+		}
+	}
+	return b.String(), nil
+}
+
+func (d *dailyDigest) post(message string) error {
+	payload := map[string]string{"text": message}
+	if d.discord {
+		payload = map[string]string{"content": message}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := d.client.Post(d.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// mail sends message through SMTP_ADDR. The SMTP settings are read on each
+// send so refreshed secrets are used.
+func (d *dailyDigest) mail(subject, message string) error {
+	addr := getEnv("SMTP_ADDR", "")
+	from := getEnv("DIGEST_EMAIL_FROM", "")
+	var auth smtp.Auth
+	if user := getEnv("SMTP_USERNAME", ""); user != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		auth = smtp.PlainAuth("", user, getEnv("SMTP_PASSWORD", ""), host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", from, strings.Join(d.emailTo, ", "), subject, time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(message, "\n", "\r\n"))
+	return smtp.SendMail(addr, auth, from, d.emailTo, msg.Bytes())
+}
+
+// sendDigestHandler sends the digest now, of date (YYYY-MM-DD) or by
+// default yesterday, to check the destinations.
+func sendDigestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if digest == nil {
+		w.WriteHeader(http.StatusConflict)
+		writeErrorBody(w, ErrorResponse{Error: "No digest destination is set, see DIGEST_WEBHOOK_URL and DIGEST_EMAIL_TO"})
+		return
+	}
+	day := time.Now().In(usage.location).AddDate(0, 0, -1)
+	if s := r.URL.Query().Get("date"); s != "" {
+		var err error
+		if day, err = time.ParseInLocation(time.DateOnly, s, usage.location); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeErrorBody(w, ErrorResponse{Error: "date must be a YYYY-MM-DD date"})
+			return
+		}
+	}
+	if err := digest.Send(r.Context(), day); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to send daily digest", "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to send the digest"})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
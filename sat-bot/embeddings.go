@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+)
+
+// embedder turns text into vectors using an OpenAI-compatible embeddings API,
+// such as OpenAI's or Ollama's /v1/embeddings. Groq does not offer one, so it
+// is configured separately from the chat provider.
+type embedder struct {
+	baseURL string
+	model   string
+	// keys is nil for local servers that do not check API keys.
+	keys   *keyPool
+	client *http.Client
+}
+
+type embeddingsResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+// embeddings is nil unless EMBEDDINGS_BASE_URL is set.
+var embeddings *embedder
+
+func loadEmbeddings() {
+	baseURL := getEnv("EMBEDDINGS_BASE_URL", "")
+	if baseURL == "" {
+		return
+	}
+	embeddings = &embedder{
+		baseURL: baseURL,
+		model:   getEnv("EMBEDDINGS_MODEL", "text-embedding-3-small"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if key := getEnv("EMBEDDINGS_API_KEY", ""); key != "" {
+		embeddings.keys = newKeyPool("embeddings", key)
+	}
+	slog.Info("Using embeddings model", "model", embeddings.model)
+}
+
+// Embed returns one unit-length vector per text, in order.
+func (e *embedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	body := map[string]interface{}{"model": e.model, "input": texts}
+	send := func(key string) (*http.Response, error) {
+		var headers map[string]string
+		if key != "" {
+			headers = map[string]string{"Authorization": fmt.Sprintf("Bearer %s", key)}
+		}
+		return postJSON(ctx, e.client, "embeddings", e.baseURL+"/embeddings", headers, body)
+	}
+
+	var resp *http.Response
+	var err error
+	if e.keys == nil {
+		resp, err = send("")
+	} else {
+		resp, err = e.keys.do(send)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result embeddingsResponse
+	if err := readJSON(resp, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Data) != len(texts) {
+		return nil, errParseResponse
+	}
+
+	vectors := make([][]float32, len(texts))
+	for _, d := range result.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			return nil, errParseResponse
+		}
+		vectors[d.Index] = normalizeVector(d.Embedding)
+	}
+	return vectors, nil
+}
+
+func normalizeVector(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := float32(math.Sqrt(sum))
+	out := make([]float32, len(v))
+	for i, x := range v {
+		out[i] = x / norm
+	}
+	return out
+}
+
+// cosine returns the cosine similarity of two unit-length vectors.
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+	}
+	return dot
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// getEnv returns the setting key, from the environment or the configuration
+// file, or fallback when it is not set.
+func getEnv(key, fallback string) string {
+	if value := settings.lookup(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func getEnvInt(key string, fallback int) int {
+	value := settings.lookup(key)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		configProblem("%s: %q is not an integer", key, value)
+		return fallback
+	}
+	return n
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	value := settings.lookup(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		configProblem("%s: %q is not a number", key, value)
+		return fallback
+	}
+	return f
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := settings.lookup(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		configProblem("%s: %q is not a duration such as 30s or 5m", key, value)
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// chatError maps a failed answer to the status and body returned to the
+// client. Codes let clients and monitoring tell the failures apart:
+//
+//	prompt_too_long             413  question plus context do not fit the model
+//	model_not_allowed           400  model is not in the allowlist
+//	budget_exhausted            503  daily token budget used up
+//	invalid_structured_output   502  reply never matched the response schema
+//	rate_limited                429  provider rate limit, with Retry-After
+//	upstream_auth_failed        502  provider rejected the API key
+//	upstream_bad_request        400  provider rejected the request
+//	upstream_unavailable        503  provider outage (5xx) or circuit open
+//	upstream_timeout            504  provider did not answer in time
+//	upstream_error              502  any other provider failure, or an empty reply
+//	provider_not_configured     503  no API key for the provider
+//	overloaded                  503  too many model calls in flight, with Retry-After
+func chatError(err error) (int, ErrorResponse) {
+	status, code, message := classifyError(err)
+	chatErrors.WithLabelValues(code).Inc()
+	return status, ErrorResponse{Error: message, Code: code}
+}
+
+func classifyError(err error) (status int, code, message string) {
+	var upstream *UpstreamError
+	switch {
+	case errors.Is(err, errPromptTooLong):
+		return http.StatusRequestEntityTooLarge, "prompt_too_long", err.Error()
+	case errors.Is(err, errModelNotAllowed):
+		return http.StatusBadRequest, "model_not_allowed", err.Error()
+	case errors.Is(err, errTokenBudgetExhausted):
+		return http.StatusServiceUnavailable, "budget_exhausted", err.Error()
+	case errors.Is(err, errInvalidStructuredOutput):
+		return http.StatusBadGateway, "invalid_structured_output", err.Error()
+	case errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable, "upstream_unavailable", err.Error()
+	case errors.Is(err, errMissingAPIKey):
+		return http.StatusServiceUnavailable, "provider_not_configured", err.Error()
+	case errors.Is(err, errOverloaded):
+		return http.StatusServiceUnavailable, "overloaded", err.Error()
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, errUpstreamTimeout):
+		return http.StatusGatewayTimeout, "upstream_timeout", "Model provider took too long to answer"
+	case errors.As(err, &upstream):
+		switch {
+		case upstream.StatusCode == http.StatusTooManyRequests:
+			return http.StatusTooManyRequests, "rate_limited", "Model provider rate limit reached, please try again later"
+		case upstream.StatusCode == http.StatusUnauthorized || upstream.StatusCode == http.StatusForbidden:
+			return http.StatusBadGateway, "upstream_auth_failed", "Model provider rejected the API key"
+		case upstream.StatusCode == http.StatusBadRequest || upstream.StatusCode == http.StatusUnprocessableEntity ||
+			upstream.StatusCode == http.StatusRequestEntityTooLarge:
+			return http.StatusBadRequest, "upstream_bad_request", "Model provider rejected the request"
+		case upstream.StatusCode == http.StatusGatewayTimeout:
+			return http.StatusGatewayTimeout, "upstream_timeout", "Model provider took too long to answer"
+		case upstream.StatusCode >= 500:
+			return http.StatusServiceUnavailable, "upstream_unavailable", "Model provider is unavailable, please try again later"
+		}
+		return http.StatusBadGateway, "upstream_error", errCallUpstream.Error()
+	case errors.Is(err, errCallUpstream), errors.Is(err, errReadResponse),
+		errors.Is(err, errParseResponse), errors.Is(err, errEmptyResponse):
+		return http.StatusBadGateway, "upstream_error", err.Error()
+	}
+	return http.StatusInternalServerError, "internal_error", err.Error()
+}
+
+// writeChatError writes the JSON error response for a failed answer. Rate
+// limits pass on the provider's Retry-After, and shed calls get the
+// configured one.
+func writeChatError(w http.ResponseWriter, err error) {
+	status, resp := chatError(err)
+	var upstream *UpstreamError
+	if status == http.StatusTooManyRequests && errors.As(err, &upstream) && upstream.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int((upstream.RetryAfter+time.Second-1)/time.Second)))
+	}
+	if errors.Is(err, errOverloaded) && upstreamSlots != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int((upstreamSlots.retryAfter+time.Second-1)/time.Second)))
+	}
+	w.WriteHeader(status)
+	writeErrorBody(w, resp)
+}
+
+// writeErrorBody encodes e with the ID of the request, taken from the
+// response headers, so that an error a user reports can be found in the logs.
+func writeErrorBody(w http.ResponseWriter, e ErrorResponse) {
+	e.RequestID = w.Header().Get(requestIDHeader)
+	json.NewEncoder(w).Encode(e)
+}
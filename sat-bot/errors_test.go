@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"rate limit", &UpstreamError{Provider: "groq", StatusCode: http.StatusTooManyRequests}, http.StatusTooManyRequests, "rate_limited"},
+		{"empty reply", errEmptyResponse, http.StatusBadGateway, "upstream_error"},
+		{"unparsable reply", errParseResponse, http.StatusBadGateway, "upstream_error"},
+		{"server error", &UpstreamError{Provider: "groq", StatusCode: http.StatusBadGateway}, http.StatusServiceUnavailable, "upstream_unavailable"},
+		{"bad key", &UpstreamError{Provider: "groq", StatusCode: http.StatusUnauthorized}, http.StatusBadGateway, "upstream_auth_failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, code, message := classifyError(tt.err)
+			if status != tt.wantStatus || code != tt.wantCode {
+				t.Errorf("classifyError() = %d %s, want %d %s", status, code, tt.wantStatus, tt.wantCode)
+			}
+			if strings.Contains(strings.ToLower(message), "free tier") {
+				t.Errorf("message %q names a provider plan", message)
+			}
+		})
+	}
+}
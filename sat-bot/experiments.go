@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// controlVariant is the share of traffic that no variant claims; it gets the
+// default prompt and model.
+const controlVariant = "control"
+
+// Experiment splits traffic between variants of the prompt or model. Visitors
+// are assigned by hashing their ID, so each one keeps seeing the same
+// variant for as long as the experiment runs.
+type Experiment struct {
+	Name     string     `json:"name"`
+	Variants []*Variant `json:"variants"`
+
+	control *Variant
+}
+
+// Variant changes the system prompt template (a file in PROMPT_DIR), the
+// model (an allowlist entry) or the temperature for Percent of visitors.
+type Variant struct {
+	Name        string   `json:"name"`
+	Percent     float64  `json:"percent"`
+	Prompt      string   `json:"prompt,omitempty"`
+	Model       string   `json:"model,omitempty"`
+	Temperature *float64 `json:"temperature,omitempty"`
+
+	experiment string
+	template   *promptTemplate
+	stats      variantStats
+}
+
+type variantStats struct {
+	mu               sync.Mutex
+	interactions     int64
+	errors           int64
+	responseTime     time.Duration
+	completionTokens int64
+	regenerations    int64
+}
+
+// VariantStats compares the variants of an experiment. Regenerations count
+// answers the visitor asked to have redone, a rough signal of poor answers.
+type VariantStats struct {
+	Name                string  `json:"name"`
+	Percent             float64 `json:"percent"`
+	Prompt              string  `json:"prompt,omitempty"`
+	Model               string  `json:"model,omitempty"`
+	Interactions        int64   `json:"interactions"`
+	Errors              int64   `json:"errors"`
+	ErrorRate           float64 `json:"error_rate"`
+	AvgResponseSeconds  float64 `json:"avg_response_seconds"`
+	AvgCompletionTokens float64 `json:"avg_completion_tokens"`
+	Regenerations       int64   `json:"regenerations"`
+	RegenerationRate    float64 `json:"regeneration_rate"`
+}
+
+type ExperimentStats struct {
+	Name     string         `json:"name"`
+	Variants []VariantStats `json:"variants"`
+}
+
+var experiments []*Experiment
+
+// loadExperiments reads EXPERIMENTS_FILE (experiments.json by default), a
+// JSON array of experiments such as
+//
+//	[{"name": "persona", "variants": [
+//	  {"name": "friendly", "percent": 20, "prompt": "system-friendly.tmpl"}]}]
+//
+// Whatever percentage the variants leave over stays on the control. It must
+// run after the prompt config and the model allowlist are loaded.
+func loadExperiments() {
+	path := getEnv("EXPERIMENTS_FILE", "experiments.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to read experiments", "path", path, "err", err)
+		}
+		return
+	}
+
+	var loaded []*Experiment
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		configProblem("%s: %v", path, err)
+		return
+	}
+	promptDir := getEnv("PROMPT_DIR", "prompts")
+	for _, e := range loaded {
+		if err := e.init(promptDir); err != nil {
+			configProblem("%s: experiment %q: %v", path, e.Name, err)
+			return
+		}
+		slog.Info("Running experiment", "name", e.Name, "variants", e.variantNames())
+	}
+	experiments = loaded
+}
+
+func (e *Experiment) init(promptDir string) error {
+	if e.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+
+	total := 0.0
+	seen := map[string]bool{controlVariant: true}
+	for _, v := range e.Variants {
+		if v.Name == "" || seen[v.Name] {
+			return fmt.Errorf("variant names must be unique and not %q", controlVariant)
+		}
+		seen[v.Name] = true
+		if v.Percent <= 0 {
+			return fmt.Errorf("variant %s needs a positive percent", v.Name)
+		}
+		total += v.Percent
+		if v.Model != "" {
+			if _, ok := allowedModels[v.Model]; !ok {
+				return fmt.Errorf("variant %s uses model %s, which is not in MODEL_ALLOWLIST", v.Name, v.Model)
+			}
+		}
+		if v.Prompt != "" {
+			path := filepath.Join(promptDir, v.Prompt)
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("variant %s: %v", v.Name, err)
+			}
+			v.template = newPromptTemplate(path, defaultSystemTemplate)
+		}
+		v.experiment = e.Name
+	}
+	if total > 100 {
+		return fmt.Errorf("variants add up to %.1f%%", total)
+	}
+
+	e.control = &Variant{Name: controlVariant, Percent: 100 - total, experiment: e.Name}
+	return nil
+}
+
+func (e *Experiment) variantNames() string {
+	names := []string{fmt.Sprintf("%s (%.1f%%)", controlVariant, e.control.Percent)}
+	for _, v := range e.Variants {
+		names = append(names, fmt.Sprintf("%s (%.1f%%)", v.Name, v.Percent))
+	}
+	return strings.Join(names, ", ")
+}
+
+// assign picks the visitor's variant: the hash of experiment and visitor
+// places them at a fixed point in [0, 100).
+func (e *Experiment) assign(visitorID string) *Variant {
+	sum := sha256.Sum256([]byte(e.Name + ":" + visitorID))
+	point := float64(binary.BigEndian.Uint64(sum[:8])%10000) / 100
+
+	for _, v := range e.Variants {
+		if point < v.Percent {
+			return v
+		}
+		point -= v.Percent
+	}
+	return e.control
+}
+
+// applyExperiments assigns the visitor to a variant of every experiment and
+// applies the variants to opts. A model picked explicitly for the request
+// takes precedence over a variant's model.
+func applyExperiments(visitorID string, opts *AnswerOptions) {
+	for _, e := range experiments {
+		v := e.assign(visitorID)
+		opts.variants = append(opts.variants, v)
+		if v.template != nil {
+			opts.prompt = v.template
+		}
+		if v.Model != "" && opts.Model == "" {
+			opts.Model = v.Model
+		}
+		if v.Temperature != nil {
+			opts.Temperature = *v.Temperature
+		}
+	}
+}
+
+// variantTag renders assigned variants as "experiment=variant,...", the form
+// used in logs and transcripts.
+func variantTag(variants []*Variant) string {
+	tags := make([]string, len(variants))
+	for i, v := range variants {
+		tags[i] = v.experiment + "=" + v.Name
+	}
+	return strings.Join(tags, ",")
+}
+
+func recordVariants(variants []*Variant, answer *CompletionResponse, responseTime time.Duration, err error) {
+	for _, v := range variants {
+		v.stats.mu.Lock()
+		v.stats.interactions++
+		if err != nil {
+			v.stats.errors++
+		} else {
+			v.stats.responseTime += responseTime
+			v.stats.completionTokens += int64(answer.Usage.CompletionTokens)
+		}
+		v.stats.mu.Unlock()
+	}
+}
+
+// recordRegeneration counts a regenerated answer against the variants named
+// in its tag.
+func recordRegeneration(tag string) {
+	if tag == "" {
+		return
+	}
+	for _, part := range strings.Split(tag, ",") {
+		name, variant, _ := strings.Cut(part, "=")
+		for _, e := range experiments {
+			if e.Name != name {
+				continue
+			}
+			for _, v := range append([]*Variant{e.control}, e.Variants...) {
+				if v.Name == variant {
+					v.stats.mu.Lock()
+					v.stats.regenerations++
+					v.stats.mu.Unlock()
+				}
+			}
+		}
+	}
+}
+
+func (v *Variant) Stats() VariantStats {
+	v.stats.mu.Lock()
+	defer v.stats.mu.Unlock()
+
+	s := VariantStats{
+		Name:          v.Name,
+		Percent:       v.Percent,
+		Prompt:        v.Prompt,
+		Model:         v.Model,
+		Interactions:  v.stats.interactions,
+		Errors:        v.stats.errors,
+		Regenerations: v.stats.regenerations,
+	}
+	if s.Interactions > 0 {
+		s.ErrorRate = float64(s.Errors) / float64(s.Interactions)
+		s.RegenerationRate = float64(s.Regenerations) / float64(s.Interactions)
+	}
+	if ok := s.Interactions - s.Errors; ok > 0 {
+		s.AvgResponseSeconds = v.stats.responseTime.Seconds() / float64(ok)
+		s.AvgCompletionTokens = float64(v.stats.completionTokens) / float64(ok)
+	}
+	return s
+}
+
+// experimentsHandler reports per-variant stats for every running experiment.
+func experimentsHandler(w http.ResponseWriter, r *http.Request) {
+	result := []ExperimentStats{}
+	for _, e := range experiments {
+		stats := ExperimentStats{Name: e.Name, Variants: []VariantStats{e.control.Stats()}}
+		for _, v := range e.Variants {
+			stats.Variants = append(stats.Variants, v.Stats())
+		}
+		result = append(result, stats)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
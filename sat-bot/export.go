@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFlushEvery is how many rows are written between flushes, so a large
+// export reaches the client as it is written.
+const exportFlushEvery = 500
+
+var interactionCSVHeader = []string{
+	"id", "time", "session_id", "user_id", "origin", "channel", "api_client", "question", "answer", "provider",
+	"model", "variant", "latency_ms", "prompt_tokens", "completion_tokens", "estimated_cost", "error",
+	"unanswered", "rating", "feedback_comment", "quality_score", "quality_grounded",
+}
+
+// exportInteractionsHandler streams the stored interactions, oldest first,
+// as CSV (format=csv, the default) or as one JSON object per line
+// (format=ndjson). Without last, from or to, read like the analytics range,
+// every interaction is exported; from or to alone leave the other end open.
+func exportInteractionsHandler(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, message string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		writeErrorBody(w, ErrorResponse{Error: message})
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		fail(http.StatusBadRequest, "format must be csv or ndjson")
+		return
+	}
+	if interactions == nil {
+		fail(http.StatusServiceUnavailable, "Interactions are not stored, see INTERACTION_STORE")
+		return
+	}
+	filter, err := parseExportRange(r)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	found, err := interactions.List(r.Context(), filter)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list interactions", "err", err)
+		fail(http.StatusInternalServerError, "Could not read interactions")
+		return
+	}
+
+	filename := "satbot-interactions-" + time.Now().In(usage.location).Format("2006-01-02-150405")
+	rc := http.NewResponseController(w)
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.ndjson"`, filename))
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+		for n, i := range found {
+			if err := enc.Encode(i); err != nil {
+				return
+			}
+			if (n+1)%exportFlushEvery == 0 {
+				rc.Flush()
+			}
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, filename))
+	w.WriteHeader(http.StatusOK)
+	cw := csv.NewWriter(w)
+	cw.Write(interactionCSVHeader)
+	for n, i := range found {
+		var rating, comment string
+		if i.Feedback != nil {
+			rating, comment = i.Feedback.Rating, spreadsheetSafe(i.Feedback.Comment)
+		}
+		var score, grounded string
+		if i.Quality != nil {
+			score, grounded = strconv.Itoa(i.Quality.Score), strconv.FormatBool(i.Quality.Grounded)
+		}
+		cw.Write([]string{
+			i.ID,
+			i.Time.UTC().Format(time.RFC3339),
+			i.SessionID,
+			i.UserID,
+			spreadsheetSafe(i.Origin),
+			i.Channel,
+			spreadsheetSafe(i.APIClient),
+			spreadsheetSafe(i.Question),
+			spreadsheetSafe(i.Answer),
+			i.Provider,
+			i.Model,
+			i.Variant,
+			strconv.FormatInt(i.LatencyMS, 10),
+			strconv.Itoa(i.PromptTokens),
+			strconv.Itoa(i.CompletionTokens),
+			strconv.FormatFloat(i.EstimatedCost, 'f', -1, 64),
+			i.Error,
+			i.Unanswered,
+			rating,
+			comment,
+			score,
+			grounded,
+		})
+		if (n+1)%exportFlushEvery == 0 {
+			cw.Flush()
+			if cw.Error() != nil {
+				return
+			}
+			rc.Flush()
+		}
+	}
+	cw.Flush()
+}
+
+// parseExportRange reads the range of an export, open ended unless asked.
+func parseExportRange(r *http.Request) (InteractionFilter, error) {
+	q := r.URL.Query()
+	if q.Get("last") != "" {
+		from, to, err := parseAnalyticsRange(r)
+		return InteractionFilter{Since: from, Until: to}, err
+	}
+	var filter InteractionFilter
+	var err error
+	if s := q.Get("from"); s != "" {
+		if filter.Since, err = parseAnalyticsTime(s, false); err != nil {
+			return filter, errors.New("from must be an RFC 3339 time or a YYYY-MM-DD date")
+		}
+	}
+	if s := q.Get("to"); s != "" {
+		if filter.Until, err = parseAnalyticsTime(s, true); err != nil {
+			return filter, errors.New("to must be an RFC 3339 time or a YYYY-MM-DD date")
+		}
+	}
+	if !filter.Since.IsZero() && !filter.Until.IsZero() && !filter.Since.Before(filter.Until) {
+		return filter, errors.New("from must be before to")
+	}
+	return filter, nil
+}
+
+// spreadsheetSafe keeps text typed by visitors from being run as a formula
+// when the CSV is opened in a spreadsheet.
+func spreadsheetSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
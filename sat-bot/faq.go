@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// FAQEntry is a canned answer and the questions it answers. Patterns and
+// questions are compared word by word, ignoring case and punctuation, and
+// "*" in a pattern stands for any number of words: "when is * saturnalia"
+// matches "When is Saturnalia?" and "when is the next Saturnalia".
+type FAQEntry struct {
+	ID       string   `json:"id"`
+	Patterns []string `json:"patterns"`
+	Answer   string   `json:"answer"`
+
+	patterns [][]string
+}
+
+var (
+	faq []*FAQEntry
+
+	// faqHits counts the questions each entry answered.
+	faqHits = expvar.NewMap("faq_hits")
+)
+
+// loadFAQ reads FAQ_FILE (faq.json by default), a JSON array of entries
+// such as
+//
+//	[{"id": "dates", "patterns": ["dates", "when is * saturnalia"],
+//	  "answer": "Saturnalia runs from 14th to 16th November 2025."}]
+//
+// A question matching one of them is answered without calling the model.
+func loadFAQ() {
+	path := getEnv("FAQ_FILE", "faq.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to read FAQ", "path", path, "err", err)
+		}
+		return
+	}
+
+	var loaded []*FAQEntry
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		configProblem("%s: %v", path, err)
+		return
+	}
+	seen := map[string]bool{}
+	for i, e := range loaded {
+		if e.ID == "" {
+			e.ID = fmt.Sprintf("faq-%d", i+1)
+		}
+		if seen[e.ID] {
+			configProblem("%s: duplicate entry %q", path, e.ID)
+			return
+		}
+		seen[e.ID] = true
+		if strings.TrimSpace(e.Answer) == "" || len(e.Patterns) == 0 {
+			configProblem("%s: entry %q needs patterns and an answer", path, e.ID)
+			return
+		}
+		for _, p := range e.Patterns {
+			words := faqWords(p)
+			if len(words) == 0 {
+				configProblem("%s: entry %q has an empty pattern", path, e.ID)
+				return
+			}
+			e.patterns = append(e.patterns, words)
+		}
+	}
+	faq = loaded
+	slog.Info("Loaded FAQ answers", "count", len(faq), "path", path)
+}
+
+// matchFAQ returns the first entry with a pattern matching question.
+func matchFAQ(question string) *FAQEntry {
+	e := findFAQ(question)
+	if e != nil {
+		faqHits.Add(e.ID, 1)
+	}
+	return e
+}
+
+// findFAQ is matchFAQ without counting the hit.
+func findFAQ(question string) *FAQEntry {
+	if len(faq) == 0 {
+		return nil
+	}
+	words := faqWords(question)
+	for _, e := range faq {
+		for _, p := range e.patterns {
+			if globWords(p, words) {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+// faqWords lowercases s and splits it into words, dropping punctuation but
+// keeping "*" as a word of its own.
+func faqWords(s string) []string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		switch {
+		case r == '*':
+			b.WriteString(" * ")
+		case r == '\'' || r == '’':
+			// "what's" and "whats" are the same word.
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte(' ')
+		}
+	}
+	return strings.Fields(b.String())
+}
+
+// globWords reports whether words match pattern, where "*" matches any run
+// of words, including none.
+func globWords(pattern, words []string) bool {
+	// match[j] reports whether the pattern so far matches words[:j].
+	match := make([]bool, len(words)+1)
+	match[0] = true
+	for _, p := range pattern {
+		next := make([]bool, len(words)+1)
+		for j := range next {
+			switch {
+			case p == "*":
+				next[j] = match[j] || (j > 0 && next[j-1])
+			case j > 0:
+				next[j] = match[j-1] && words[j-1] == p
+			}
+		}
+		match = next
+	}
+	return match[len(words)]
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const faqDraftPrompt = `You write entries for the FAQ of Saturnalia, the fest SatBot answers questions about.
+Attendees keep asking the question below, or were unhappy with the answers they got. Using only the event information given, write a short, direct answer suitable for the FAQ.
+If the information does not answer the question, reply with exactly NEEDS_INFO.`
+
+const (
+	// faqDraftKnowledgeTokens bounds the knowledge given to the model for a
+	// draft.
+	faqDraftKnowledgeTokens = 2000
+	// maxFAQSuggestionComments is how many feedback comments a suggestion
+	// lists.
+	maxFAQSuggestionComments = 5
+)
+
+// FAQSuggestion is a group of similar questions that could use an FAQ
+// entry, because they keep being asked or their answers were rated down.
+// Entry is ready to be added to FAQ_FILE once its answer has been checked;
+// its answer is empty when the knowledge base had nothing to draft it from.
+type FAQSuggestion struct {
+	Entry      FAQEntry  `json:"entry"`
+	Asked      int       `json:"asked"`
+	ThumbsDown int       `json:"thumbs_down"`
+	Errors     int       `json:"errors"`
+	Comments   []string  `json:"comments,omitempty"`
+	FirstAsked time.Time `json:"first_asked"`
+	LastAsked  time.Time `json:"last_asked"`
+	// ExistingEntry is the FAQ entry already answering these questions,
+	// whose answer was rated down.
+	ExistingEntry string `json:"existing_entry,omitempty"`
+}
+
+type FAQSuggestionsReport struct {
+	GeneratedAt *time.Time      `json:"generated_at"`
+	Since       *time.Time      `json:"since,omitempty"`
+	Suggestions []FAQSuggestion `json:"suggestions"`
+}
+
+// faqSuggester rebuilds the suggestions from the stored interactions every
+// interval, keeping the latest report in memory.
+type faqSuggester struct {
+	interval   time.Duration
+	window     time.Duration
+	minRepeats int
+	max        int
+
+	// running serializes the rebuilds, which call the model.
+	running sync.Mutex
+	mu      sync.Mutex
+	report  FAQSuggestionsReport
+}
+
+var faqSuggestions = &faqSuggester{
+	interval:   6 * time.Hour,
+	window:     7 * 24 * time.Hour,
+	minRepeats: 3,
+	max:        20,
+}
+
+// loadFAQSuggestions reads FAQ_SUGGESTIONS_INTERVAL, how often suggestions
+// are rebuilt (6h by default, 0 only rebuilds them on request);
+// FAQ_SUGGESTIONS_WINDOW, how far back questions are looked at (168h);
+// FAQ_SUGGESTIONS_MIN_REPEATS, how many times a question not rated down has
+// to be asked (3); and FAQ_SUGGESTIONS_MAX, how many suggestions are drafted
+// (20). It needs the interactions to be stored.
+func loadFAQSuggestions() {
+	faqSuggestions.interval = getEnvDuration("FAQ_SUGGESTIONS_INTERVAL", faqSuggestions.interval)
+	faqSuggestions.window = getEnvDuration("FAQ_SUGGESTIONS_WINDOW", faqSuggestions.window)
+	faqSuggestions.minRepeats = max(getEnvInt("FAQ_SUGGESTIONS_MIN_REPEATS", faqSuggestions.minRepeats), 1)
+	faqSuggestions.max = getEnvInt("FAQ_SUGGESTIONS_MAX", faqSuggestions.max)
+	if faqSuggestions.window <= 0 {
+		configProblem("FAQ_SUGGESTIONS_WINDOW: must be positive")
+		return
+	}
+	if faqSuggestions.max < 1 {
+		configProblem("FAQ_SUGGESTIONS_MAX: must be positive")
+		return
+	}
+	if interactions == nil || faqSuggestions.interval <= 0 {
+		return
+	}
+	go faqSuggestions.loop()
+}
+
+func (s *faqSuggester) loop() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := s.Refresh(context.Background()); err != nil {
+			slog.Error("Failed to build FAQ suggestions", "err", err)
+		}
+	}
+}
+
+func (s *faqSuggester) Report() FAQSuggestionsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.report
+}
+
+// faqCandidate is a group of similar questions, named after the latest.
+type faqCandidate struct {
+	FAQSuggestion
+	examples []string
+	terms    map[string]bool
+	answer   string
+}
+
+// Refresh rebuilds the suggestions from the questions of the window: those
+// the FAQ does not answer yet that were asked at least minRepeats times, and
+// any whose answer was rated down, the FAQ's own included. Groups are
+// ranked by how often they were asked, a rating down counting as three
+// askings, and the first max get an answer drafted by the model.
+func (s *faqSuggester) Refresh(ctx context.Context) (FAQSuggestionsReport, error) {
+	s.running.Lock()
+	defer s.running.Unlock()
+
+	since := time.Now().Add(-s.window).UTC()
+	listCtx, cancel := context.WithTimeout(ctx, interactionStoreTimeout)
+	found, err := interactions.List(listCtx, InteractionFilter{Since: since})
+	cancel()
+	if err != nil {
+		return FAQSuggestionsReport{}, err
+	}
+
+	var groups []*faqCandidate
+	for i := len(found) - 1; i >= 0; i-- {
+		in := found[i]
+		question := strings.TrimSpace(in.Question)
+		if question == "" {
+			continue
+		}
+		terms := termSet(question)
+		var group *faqCandidate
+		for _, g := range groups {
+			if similarQuestions(g, question, terms) {
+				group = g
+				break
+			}
+		}
+		if group == nil {
+			group = &faqCandidate{terms: terms}
+			group.LastAsked = in.Time
+			group.examples = []string{question}
+			groups = append(groups, group)
+		}
+		group.Asked++
+		group.FirstAsked = in.Time
+		if !containsFold(group.examples, question) && len(group.examples) < maxGapExamples {
+			group.examples = append(group.examples, question)
+		}
+		switch {
+		case in.Error != "":
+			group.Errors++
+		case in.Feedback != nil && in.Feedback.Rating == ratingDown:
+			group.ThumbsDown++
+			if in.Feedback.Comment != "" && len(group.Comments) < maxFAQSuggestionComments {
+				group.Comments = append(group.Comments, in.Feedback.Comment)
+			}
+		case group.answer == "" && in.Provider != "circuit-breaker" && (gaps == nil || !gaps.saysUnknown(in.Answer)):
+			group.answer = in.Answer
+		}
+	}
+
+	var picked []*faqCandidate
+	for _, g := range groups {
+		existing := findFAQ(g.examples[0])
+		if existing != nil {
+			g.ExistingEntry = existing.ID
+		}
+		if g.ThumbsDown > 0 || (existing == nil && g.Asked >= s.minRepeats) {
+			picked = append(picked, g)
+		}
+	}
+	sort.SliceStable(picked, func(i, j int) bool {
+		return picked[i].Asked+3*picked[i].ThumbsDown > picked[j].Asked+3*picked[j].ThumbsDown
+	})
+	if len(picked) > s.max {
+		picked = picked[:s.max]
+	}
+
+	report := FAQSuggestionsReport{Since: &since, Suggestions: make([]FAQSuggestion, 0, len(picked))}
+	for n, g := range picked {
+		answer, err := draftFAQAnswer(ctx, g)
+		if err != nil {
+			slog.Error("Failed to draft FAQ answer", "question", g.examples[0], "err", err)
+		}
+		g.Entry = FAQEntry{ID: fmt.Sprintf("suggested-%d", n+1), Answer: answer}
+		for _, q := range g.examples {
+			if p := strings.Join(faqWords(q), " "); p != "" && !slices.Contains(g.Entry.Patterns, p) {
+				g.Entry.Patterns = append(g.Entry.Patterns, p)
+			}
+		}
+		report.Suggestions = append(report.Suggestions, g.FAQSuggestion)
+	}
+	now := time.Now().UTC()
+	report.GeneratedAt = &now
+
+	s.mu.Lock()
+	s.report = report
+	s.mu.Unlock()
+	slog.Info("Built FAQ suggestions", "questions", len(found), "groups", len(groups), "suggestions", len(report.Suggestions))
+	return report, nil
+}
+
+func similarQuestions(g *faqCandidate, question string, terms map[string]bool) bool {
+	if len(terms) == 0 || len(g.terms) == 0 {
+		return strings.EqualFold(g.examples[0], question)
+	}
+	return similarTerms(terms, g.terms)
+}
+
+// draftFAQAnswer asks the model for an answer to the group from the
+// knowledge base, pointing it at what went wrong with the earlier answers.
+// It returns "" when the knowledge base does not have an answer.
+func draftFAQAnswer(ctx context.Context, g *faqCandidate) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	selection := retrieveKnowledge(ctx, g.examples[0], "")
+	var prompt strings.Builder
+	fmt.Fprintf(&prompt, "Event information:\n%s\n\nQuestion: %s\n", selection.fit(faqDraftKnowledgeTokens), g.examples[0])
+	if len(g.examples) > 1 {
+		fmt.Fprintf(&prompt, "Also asked as: %s\n", strings.Join(g.examples[1:], " | "))
+	}
+	if g.answer != "" {
+		fmt.Fprintf(&prompt, "An earlier answer: %s\n", g.answer)
+	}
+	if len(g.Comments) > 0 {
+		fmt.Fprintf(&prompt, "Attendees said about the answers they got: %s\n", strings.Join(g.Comments, " | "))
+	}
+
+	answer, err := callModel(ctx, []ChatMessage{
+		{Role: "system", Content: faqDraftPrompt},
+		{Role: "user", Content: prompt.String()},
+	}, 0.2, 300)
+	if err != nil {
+		return "", err
+	}
+	answer = strings.TrimSpace(answer)
+	if strings.Contains(answer, "NEEDS_INFO") {
+		return "", nil
+	}
+	return answer, nil
+}
+
+// faqSuggestionsHandler serves the latest FAQ suggestions, with a null
+// generated_at until they are first built.
+func faqSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if interactions == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeErrorBody(w, ErrorResponse{Error: "Interactions are not stored, see INTERACTION_STORE"})
+		return
+	}
+	writeFAQSuggestions(w, faqSuggestions.Report())
+}
+
+// refreshFAQSuggestionsHandler rebuilds the FAQ suggestions now, which calls
+// the model once per suggestion, and returns them.
+func refreshFAQSuggestionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if interactions == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		writeErrorBody(w, ErrorResponse{Error: "Interactions are not stored, see INTERACTION_STORE"})
+		return
+	}
+	report, err := faqSuggestions.Refresh(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to build FAQ suggestions", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Could not build FAQ suggestions"})
+		return
+	}
+	writeFAQSuggestions(w, report)
+}
+
+func writeFAQSuggestions(w http.ResponseWriter, report FAQSuggestionsReport) {
+	if report.Suggestions == nil {
+		report.Suggestions = []FAQSuggestion{}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxFeedbackCommentLength caps the comment sent with a rating, in
+// characters.
+const maxFeedbackCommentLength = 1000
+
+// Ratings of an answer.
+const (
+	ratingUp   = "up"
+	ratingDown = "down"
+)
+
+// Feedback is a visitor's rating of an answer.
+type Feedback struct {
+	Rating    string    `json:"rating"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type FeedbackRequest struct {
+	SessionID     string `json:"session_id"`
+	InteractionID string `json:"interaction_id"`
+	// Rating is "up" or "down".
+	Rating  string `json:"rating"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// feedbackHandler records a visitor's thumbs up or down on an answer of one
+// of their conversations, with an optional comment. Rating an answer again
+// replaces the earlier rating. The feedback is kept on the answer in the
+// transcript and, masked like the question, with the stored interaction for
+// the analytics.
+func feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var req FeedbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if req.SessionID == "" || req.InteractionID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: "session_id and interaction_id are required"})
+		return
+	}
+	if req.Rating != ratingUp && req.Rating != ratingDown {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: "rating must be up or down"})
+		return
+	}
+	comment := strings.TrimSpace(req.Comment)
+	if utf8.RuneCountInString(comment) > maxFeedbackCommentLength {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: "Comment must be at most 1000 characters"})
+		return
+	}
+
+	session, ok := sessions.Get(req.SessionID, visitorIDFromContext(r.Context()))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		writeErrorBody(w, ErrorResponse{Error: "Conversation not found"})
+		return
+	}
+	setLogSession(r.Context(), session.ID)
+
+	feedback := Feedback{Rating: req.Rating, Comment: comment, CreatedAt: time.Now().UTC()}
+	session.mu.Lock()
+	found := false
+	for i := range session.Transcript {
+		if entry := &session.Transcript[i]; entry.Role == "assistant" && entry.InteractionID == req.InteractionID {
+			entry.Feedback = &feedback
+			found = true
+			break
+		}
+	}
+	session.mu.Unlock()
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		writeErrorBody(w, ErrorResponse{Error: "Answer not found"})
+		return
+	}
+
+	if interactions != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), interactionStoreTimeout)
+		defer cancel()
+		stored := feedback
+		stored.Comment = redactPII(stored.Comment)
+		if err := interactions.SaveFeedback(ctx, req.InteractionID, stored); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to store feedback", "interaction_id", req.InteractionID, "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			writeErrorBody(w, ErrorResponse{Error: "Failed to save feedback"})
+			return
+		}
+	}
+	feedbackRatings.WithLabelValues(feedback.Rating).Inc()
+	slog.InfoContext(r.Context(), "Answer feedback",
+		"interaction_id", req.InteractionID,
+		"rating", feedback.Rating,
+		"has_comment", comment != "",
+	)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(feedback)
+}
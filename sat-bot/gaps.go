@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons a question is recorded as a knowledge gap.
+const (
+	gapLowConfidence = "low_confidence"
+	gapNoAnswer      = "no_answer"
+)
+
+const (
+	// maxKnowledgeGaps is how many gaps are kept; older ones are dropped.
+	maxKnowledgeGaps = 2000
+	// maxGapExamples is how many distinct wordings a group lists.
+	maxGapExamples = 5
+	// gapGroupSimilarity and gapGroupOverlap are how close two questions'
+	// embeddings, or failing those their keywords, have to be for them to
+	// be grouped together.
+	gapGroupSimilarity = 0.8
+	gapGroupOverlap    = 0.5
+)
+
+// defaultGapPhrases are what the model tends to say when the context does
+// not have the answer, lowercased.
+var defaultGapPhrases = []string{
+	"i don't know", "i do not know", "i don't have", "i do not have",
+	"i'm not sure", "i am not sure", "not mentioned in", "no information",
+	"not available in", "couldn't find", "could not find", "don't have details",
+	"not in the provided context", "not provided in",
+}
+
+// KnowledgeGap is a question the knowledge base did not answer well.
+type KnowledgeGap struct {
+	Question  string    `json:"question"`
+	Reason    string    `json:"reason"`
+	Namespace string    `json:"namespace,omitempty"`
+	At        time.Time `json:"at"`
+	// Similarity is how close the best chunk was, for questions ranked by
+	// embeddings.
+	Similarity float64 `json:"similarity,omitempty"`
+
+	vector []float32
+}
+
+// GapGroup is a set of similar gap questions, named after the latest.
+type GapGroup struct {
+	Question  string         `json:"question"`
+	Count     int            `json:"count"`
+	Reasons   map[string]int `json:"reasons"`
+	Examples  []string       `json:"examples"`
+	FirstSeen time.Time      `json:"first_seen"`
+	LastSeen  time.Time      `json:"last_seen"`
+
+	terms  map[string]bool
+	vector []float32
+}
+
+type GapReport struct {
+	Since  *time.Time `json:"since,omitempty"`
+	Total  int        `json:"total"`
+	Groups []GapGroup `json:"groups"`
+}
+
+// gapTracker collects knowledge gaps and flushes them to a JSON file like
+// UsageTracker. Question embeddings only live in memory, so gaps from before
+// a restart are grouped by keywords.
+type gapTracker struct {
+	mu    sync.Mutex
+	path  string
+	gaps  []KnowledgeGap
+	dirty bool
+
+	// minSimilarity is the best-chunk similarity below which an answer is
+	// treated as low confidence.
+	minSimilarity float64
+	phrases       []string
+}
+
+var gaps *gapTracker
+
+// loadGapConfig reads KNOWLEDGE_GAPS_FILE (knowledge-gaps.json by default,
+// empty keeps gaps in memory), GAP_MIN_SIMILARITY and GAP_PHRASES, the
+// "|"-separated phrases that mark an answer as not knowing.
+func loadGapConfig() {
+	gaps = &gapTracker{
+		path:          getEnv("KNOWLEDGE_GAPS_FILE", "knowledge-gaps.json"),
+		minSimilarity: getEnvFloat("GAP_MIN_SIMILARITY", 0.35),
+		phrases:       defaultGapPhrases,
+	}
+	if phrases := getEnv("GAP_PHRASES", ""); phrases != "" {
+		gaps.phrases = strings.Split(strings.ToLower(phrases), "|")
+	}
+	if gaps.path == "" {
+		return
+	}
+
+	data, err := os.ReadFile(gaps.path)
+	if err == nil {
+		if err := json.Unmarshal(data, &gaps.gaps); err != nil {
+			slog.Error("Failed to parse knowledge gaps file", "path", gaps.path, "err", err)
+		}
+	} else if !os.IsNotExist(err) {
+		slog.Error("Failed to read knowledge gaps file", "path", gaps.path, "err", err)
+	}
+	go gaps.flushLoop(10 * time.Second)
+}
+
+// noteKnowledgeGap records question if retrieval found little for it or the
+// answer says it does not know. selection is nil for cached answers.
+func noteKnowledgeGap(question string, selection *contextSelection, answer string) {
+	if gaps == nil {
+		return
+	}
+	gap := KnowledgeGap{Question: strings.TrimSpace(redactPII(question)), At: time.Now().UTC()}
+	if selection != nil {
+		gap.Namespace, gap.vector = selection.namespace, selection.vector
+		if selection.chunks != nil && selection.vector != nil {
+			gap.Similarity = selection.similarity
+		}
+	}
+
+	switch {
+	case gaps.saysUnknown(answer):
+		gap.Reason = gapNoAnswer
+	case selection != nil && selection.unmatched:
+		gap.Reason = gapLowConfidence
+	case selection != nil && selection.chunks != nil && selection.vector != nil && selection.similarity < gaps.minSimilarity:
+		gap.Reason = gapLowConfidence
+	default:
+		return
+	}
+	gaps.add(gap)
+}
+
+func (t *gapTracker) saysUnknown(answer string) bool {
+	answer = strings.ToLower(strings.ReplaceAll(answer, "’", "'"))
+	for _, phrase := range t.phrases {
+		if phrase != "" && strings.Contains(answer, phrase) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *gapTracker) add(gap KnowledgeGap) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.gaps = append(t.gaps, gap)
+	if over := len(t.gaps) - maxKnowledgeGaps; over > 0 {
+		t.gaps = append([]KnowledgeGap(nil), t.gaps[over:]...)
+	}
+	t.dirty = true
+}
+
+// Purge drops the gaps recorded before before and returns how many there
+// were; dryRun only counts them.
+func (t *gapTracker) Purge(before time.Time, dryRun bool) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	kept := make([]KnowledgeGap, 0, len(t.gaps))
+	for _, gap := range t.gaps {
+		if !gap.At.Before(before) {
+			kept = append(kept, gap)
+		}
+	}
+	purged := len(t.gaps) - len(kept)
+	if purged > 0 && !dryRun {
+		t.gaps = kept
+		t.dirty = true
+	}
+	return purged
+}
+
+// Report groups the gaps recorded since since, most asked first. Each gap
+// joins the first group, newest first, whose latest question is close
+// enough to it.
+func (t *gapTracker) Report(since time.Time) GapReport {
+	t.mu.Lock()
+	recent := make([]KnowledgeGap, 0, len(t.gaps))
+	for _, gap := range t.gaps {
+		if !gap.At.Before(since) {
+			recent = append(recent, gap)
+		}
+	}
+	t.mu.Unlock()
+
+	var groups []*GapGroup
+	for i := len(recent) - 1; i >= 0; i-- {
+		gap := recent[i]
+		terms := termSet(gap.Question)
+		var group *GapGroup
+		for _, g := range groups {
+			if similarGaps(g, gap, terms) {
+				group = g
+				break
+			}
+		}
+		if group == nil {
+			group = &GapGroup{
+				Question: gap.Question, Reasons: map[string]int{}, LastSeen: gap.At,
+				terms: terms, vector: gap.vector,
+			}
+			groups = append(groups, group)
+		}
+		group.Count++
+		group.Reasons[gap.Reason]++
+		group.FirstSeen = gap.At
+		if len(group.Examples) < maxGapExamples && !containsFold(group.Examples, gap.Question) {
+			group.Examples = append(group.Examples, gap.Question)
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Count > groups[j].Count })
+	report := GapReport{Total: len(recent), Groups: make([]GapGroup, len(groups))}
+	for i, g := range groups {
+		report.Groups[i] = *g
+	}
+	return report
+}
+
+func similarGaps(g *GapGroup, gap KnowledgeGap, terms map[string]bool) bool {
+	if g.vector != nil && gap.vector != nil {
+		return cosine(g.vector, gap.vector) >= gapGroupSimilarity
+	}
+	if len(terms) == 0 || len(g.terms) == 0 {
+		return strings.EqualFold(g.Question, gap.Question)
+	}
+	return similarTerms(terms, g.terms)
+}
+
+// similarTerms reports whether two questions share enough keywords to be
+// grouped. Questions are short, so the shared keywords are measured against
+// the shorter one.
+func similarTerms(a, b map[string]bool) bool {
+	shared := 0
+	for term := range a {
+		if b[term] {
+			shared++
+		}
+	}
+	return float64(shared)/float64(min(len(a), len(b))) >= gapGroupOverlap
+}
+
+func termSet(text string) map[string]bool {
+	set := map[string]bool{}
+	for _, term := range keywordTerms(text) {
+		set[term] = true
+	}
+	return set
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *gapTracker) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := t.Flush(); err != nil {
+			slog.Error("Failed to save knowledge gaps", "path", t.path, "err", err)
+		}
+	}
+}
+
+// Flush writes the gaps to disk if they changed since the last flush.
+func (t *gapTracker) Flush() error {
+	t.mu.Lock()
+	if !t.dirty {
+		t.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(t.gaps, "", "  ")
+	t.dirty = false
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(t.path, data)
+}
+
+// knowledgeGapsHandler serves the gap report. since limits it to recent
+// gaps, as a duration such as 24h or an RFC 3339 time, and limit caps the
+// number of groups.
+func knowledgeGapsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var since time.Time
+	if s := r.URL.Query().Get("since"); s != "" {
+		if d, err := time.ParseDuration(s); err == nil {
+			since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, s); err == nil {
+			since = t
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+			writeErrorBody(w, ErrorResponse{Error: "since must be a duration or an RFC 3339 time"})
+			return
+		}
+	}
+	limit := 0
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			writeErrorBody(w, ErrorResponse{Error: "limit must be a positive number"})
+			return
+		}
+		limit = n
+	}
+
+	report := gaps.Report(since)
+	if !since.IsZero() {
+		report.Since = &since
+	}
+	if limit > 0 && len(report.Groups) > limit {
+		report.Groups = report.Groups[:limit]
+	}
+	if report.Groups == nil {
+		report.Groups = []GapGroup{}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
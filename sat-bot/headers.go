@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSecurityHeaders suit the JSON API: nothing in a response is meant
+// to be sniffed, framed or run as a page.
+var defaultSecurityHeaders = map[string]string{
+	"X-Content-Type-Options":  "nosniff",
+	"X-Frame-Options":         "DENY",
+	"Content-Security-Policy": "default-src 'none'; frame-ancestors 'none'",
+	"Referrer-Policy":         "no-referrer",
+}
+
+// routeHeaders are the headers for the paths starting with prefix.
+type routeHeaders struct {
+	prefix  string
+	headers map[string]string
+}
+
+var (
+	// securityHeaders are set on every response, and headerRoutes override
+	// them for some paths, longest prefix first. securityHeaders is nil when
+	// the middleware is off.
+	securityHeaders = defaultSecurityHeaders
+	headerRoutes    []routeHeaders
+)
+
+// loadSecurityHeaders reads SECURITY_HEADERS (true by default) and
+// SECURITY_HEADERS_FILE (security-headers.json by default), which maps path
+// prefixes to the headers to use on them instead of the defaults, such as
+//
+//	{"/widget/": {"X-Frame-Options": "", "Content-Security-Policy": "frame-ancestors https://fest.example.org"}}
+//
+// for a widget embedded in the fest website; an empty value drops the
+// header. Strict-Transport-Security is added over TLS, with HSTS_MAX_AGE
+// (a year by default, 0 turns it off).
+func loadSecurityHeaders() {
+	if getEnv("SECURITY_HEADERS", "true") != "true" {
+		securityHeaders = nil
+		return
+	}
+	securityHeaders = map[string]string{}
+	for name, value := range defaultSecurityHeaders {
+		securityHeaders[name] = value
+	}
+	if maxAge := getEnvDuration("HSTS_MAX_AGE", 365*24*time.Hour); certManager != nil && maxAge > 0 {
+		securityHeaders["Strict-Transport-Security"] = "max-age=" + strconv.Itoa(int(maxAge.Seconds())) + "; includeSubDomains"
+	}
+
+	path := getEnv("SECURITY_HEADERS_FILE", "security-headers.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to read security headers", "path", path, "err", err)
+		}
+		return
+	}
+	var routes map[string]map[string]string
+	if err := json.Unmarshal(data, &routes); err != nil {
+		configProblem("%s: %v", path, err)
+		return
+	}
+	headerRoutes = nil
+	for prefix, headers := range routes {
+		if !strings.HasPrefix(prefix, "/") {
+			configProblem("%s: route %q must start with /", path, prefix)
+			continue
+		}
+		canonical := map[string]string{}
+		for name, value := range headers {
+			canonical[http.CanonicalHeaderKey(name)] = value
+		}
+		headerRoutes = append(headerRoutes, routeHeaders{prefix: prefix, headers: canonical})
+	}
+	sort.Slice(headerRoutes, func(i, j int) bool { return len(headerRoutes[i].prefix) > len(headerRoutes[j].prefix) })
+	slog.Info("Loaded security headers", "routes", len(headerRoutes), "path", path)
+}
+
+// securityHeadersMiddleware sets the security headers for the request path.
+func securityHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if securityHeaders != nil {
+			var overrides map[string]string
+			for _, route := range headerRoutes {
+				if strings.HasPrefix(r.URL.Path, route.prefix) {
+					overrides = route.headers
+					break
+				}
+			}
+			for name, value := range securityHeaders {
+				if override, ok := overrides[name]; ok {
+					value = override
+				}
+				if value != "" {
+					w.Header().Set(name, value)
+				}
+			}
+			for name, value := range overrides {
+				if _, ok := securityHeaders[name]; !ok && value != "" {
+					w.Header().Set(name, value)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
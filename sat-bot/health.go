@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// pinger is implemented by providers and stores that can check they are
+// reachable cheaply, without spending tokens or touching data.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// DependencyHealth is the outcome of probing one dependency.
+type DependencyHealth struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+type DeepHealthResponse struct {
+	Status       string                      `json:"status"`
+	Timestamp    string                      `json:"timestamp"`
+	Dependencies map[string]DependencyHealth `json:"dependencies"`
+}
+
+// healthCheck probes one dependency. detail, when not empty, is reported
+// alongside a successful probe.
+type healthCheck func(ctx context.Context) (detail string, err error)
+
+var (
+	healthMu     sync.Mutex
+	healthChecks = map[string]healthCheck{}
+
+	deepHealthMu     sync.Mutex
+	deepHealthCached *DeepHealthResponse
+	deepHealthAt     time.Time
+)
+
+func init() {
+	registerHealthCheck("context", func(context.Context) (string, error) {
+		kb := currentKnowledge()
+		if kb == nil || len(kb.Documents) == 0 {
+			return "", fmt.Errorf("no context documents loaded")
+		}
+		return fmt.Sprintf("%d documents, loaded %s", len(kb.Documents), kb.LoadedAt.UTC().Format(time.RFC3339)), nil
+	})
+}
+
+// registerHealthCheck adds a dependency to /health/deep, replacing the
+// check of the same name. Loaders register the dependencies they set up.
+func registerHealthCheck(name string, check healthCheck) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	healthChecks[name] = check
+}
+
+// unregisterHealthChecks drops the checks whose names start with prefix,
+// for loaders that replace their dependencies.
+func unregisterHealthChecks(prefix string) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	for name := range healthChecks {
+		if strings.HasPrefix(name, prefix) {
+			delete(healthChecks, name)
+		}
+	}
+}
+
+// pingCheck adapts a pinger to a healthCheck.
+func pingCheck(p pinger) healthCheck {
+	return func(ctx context.Context) (string, error) {
+		return "", p.Ping(ctx)
+	}
+}
+
+// runHealthChecks probes every dependency at once, each within
+// HEALTH_PROBE_TIMEOUT (3s by default).
+func runHealthChecks(ctx context.Context) *DeepHealthResponse {
+	healthMu.Lock()
+	checks := make(map[string]healthCheck, len(healthChecks))
+	for name, check := range healthChecks {
+		checks[name] = check
+	}
+	healthMu.Unlock()
+
+	timeout := getEnvDuration("HEALTH_PROBE_TIMEOUT", 3*time.Second)
+	resp := &DeepHealthResponse{
+		Status:       "healthy",
+		Timestamp:    time.Now().UTC().Format(time.RFC3339),
+		Dependencies: map[string]DependencyHealth{},
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			detail, err := check(ctx)
+			dep := DependencyHealth{Status: "ok", LatencyMS: time.Since(start).Milliseconds(), Detail: detail}
+			if err != nil {
+				dep.Status, dep.Error = "down", err.Error()
+			}
+			mu.Lock()
+			resp.Dependencies[name] = dep
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	// The bot still answers while any provider does, so losing some of a
+	// fallback chain only degrades it.
+	providers, providersUp := 0, 0
+	for name, dep := range resp.Dependencies {
+		switch {
+		case strings.HasPrefix(name, "provider:"):
+			providers++
+			if dep.Status == "ok" {
+				providersUp++
+			}
+		case dep.Status != "ok":
+			resp.Status = "unhealthy"
+		}
+	}
+	if providers > 0 && providersUp == 0 {
+		resp.Status = "unhealthy"
+	} else if providersUp < providers && resp.Status == "healthy" {
+		resp.Status = "degraded"
+	}
+	return resp
+}
+
+// deepHealthHandler reports the health of each dependency: the model
+// providers, the context and the stores. It answers 503 when the bot
+// cannot answer, so an uptime monitor notices a server that is up but
+// broken, and reports "degraded" when only some providers are down.
+// Results are reused for HEALTH_CACHE_TTL (10s by default), so frequent
+// polling does not turn into calls to the providers.
+func deepHealthHandler(w http.ResponseWriter, r *http.Request) {
+	ttl := getEnvDuration("HEALTH_CACHE_TTL", 10*time.Second)
+	deepHealthMu.Lock()
+	if deepHealthCached == nil || time.Since(deepHealthAt) > ttl {
+		deepHealthCached = runHealthChecks(context.Background())
+		deepHealthAt = time.Now()
+	}
+	resp := deepHealthCached
+	deepHealthMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Status == "unhealthy" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// probeGet sends a GET to url and fails on any status but 2xx, returning
+// the failure as *UpstreamError like postJSON does.
+func probeGet(ctx context.Context, client *http.Client, providerName, url string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errCreateRequest
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &UpstreamError{
+			Provider:   providerName,
+			StatusCode: resp.StatusCode,
+			Body:       string(data),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	return resp, nil
+}
+
+// Ping lists the models, which checks both reachability and the API key.
+func (p *openAIProvider) Ping(ctx context.Context) error {
+	if p.keys == nil {
+		_, err := probeGet(ctx, p.client, p.name, p.baseURL+"/models", nil)
+		return err
+	}
+	_, err := p.keys.do(func(key string) (*http.Response, error) {
+		return probeGet(ctx, p.client, p.name, p.baseURL+"/models", map[string]string{"Authorization": "Bearer " + key})
+	})
+	return err
+}
+
+func (p *anthropicProvider) Ping(ctx context.Context) error {
+	_, err := p.keys.do(func(key string) (*http.Response, error) {
+		return probeGet(ctx, p.client, p.Name(), p.baseURL+"/models", map[string]string{
+			"x-api-key":         key,
+			"anthropic-version": anthropicVersion,
+		})
+	})
+	return err
+}
+
+func (p *ollamaProvider) Ping(ctx context.Context) error {
+	_, err := probeGet(ctx, p.client, p.Name(), p.baseURL+"/api/tags", nil)
+	return err
+}
+
+// redisPinger checks a Redis client with a PING.
+type redisPinger struct {
+	client *redis.Client
+}
+
+func (p redisPinger) Ping(ctx context.Context) error {
+	return p.client.Ping(ctx).Err()
+}
+
+// sqlPinger checks a database/sql pool with a round trip to the server.
+type sqlPinger struct {
+	db *sql.DB
+}
+
+func (p sqlPinger) Ping(ctx context.Context) error {
+	return p.db.PingContext(ctx)
+}
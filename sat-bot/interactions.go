@@ -0,0 +1,737 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Interaction is one question and its answer, or the error it failed with,
+// as kept for analysing the fest afterwards. Question and Answer are stored
+// with personal details masked, like the log line of the interaction.
+type Interaction struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"session_id"`
+	UserID    string    `json:"user_id,omitempty"`
+	Origin    string    `json:"origin,omitempty"`
+	// Channel is where the question was asked from, see
+	// interactionChannel, and APIClient the API key it was asked with.
+	Channel          string  `json:"channel,omitempty"`
+	APIClient        string  `json:"api_client,omitempty"`
+	Question         string  `json:"question"`
+	Answer           string  `json:"answer"`
+	Provider         string  `json:"provider"`
+	Model            string  `json:"model,omitempty"`
+	Variant          string  `json:"variant,omitempty"`
+	LatencyMS        int64   `json:"latency_ms"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	EstimatedCost    float64 `json:"estimated_cost,omitempty"`
+	// Error is the error code sent back when no answer could be given.
+	Error string `json:"error,omitempty"`
+	// Unanswered is why the answer did not answer the question, off_topic
+	// or no_answer, see unansweredReason.
+	Unanswered string `json:"unanswered,omitempty"`
+	// Feedback is the visitor's latest rating of the answer, if any.
+	Feedback *Feedback `json:"feedback,omitempty"`
+	// Quality is the judge's score of the answer, for sampled answers, see
+	// qualityJudge.
+	Quality *QualityScore `json:"quality,omitempty"`
+}
+
+// InteractionFilter selects stored interactions. Zero fields match
+// everything.
+type InteractionFilter struct {
+	// Since and Until bound the time of the interaction, Until excluded.
+	Since, Until time.Time
+	// Limit caps the interactions returned, keeping the oldest.
+	Limit int
+	// UserID keeps the interactions of a logged-in attendee.
+	UserID string
+	// SessionIDs keeps the interactions of these sessions.
+	SessionIDs []string
+}
+
+func (f InteractionFilter) match(i Interaction) bool {
+	return (f.Since.IsZero() || !i.Time.Before(f.Since)) && (f.Until.IsZero() || i.Time.Before(f.Until)) &&
+		(f.UserID == "" || i.UserID == f.UserID) &&
+		(f.SessionIDs == nil || slices.Contains(f.SessionIDs, i.SessionID))
+}
+
+// InteractionStore keeps the interactions across restarts.
+type InteractionStore interface {
+	// Save stores interactions.
+	Save(ctx context.Context, interactions []Interaction) error
+	// List returns the interactions matching filter, oldest first, with
+	// their feedback and quality scores.
+	List(ctx context.Context, filter InteractionFilter) ([]Interaction, error)
+	// SaveFeedback stores the rating of an interaction, replacing any
+	// earlier one. The interaction itself may not be saved yet.
+	SaveFeedback(ctx context.Context, interactionID string, feedback Feedback) error
+	// SaveQuality stores the quality score of an interaction, replacing any
+	// earlier one.
+	SaveQuality(ctx context.Context, interactionID string, score QualityScore) error
+	// Delete removes the interactions matching filter, whatever its Limit,
+	// with their feedback and quality scores, and returns how many it
+	// removed.
+	Delete(ctx context.Context, filter InteractionFilter) (int, error)
+}
+
+// interactionStoreTimeout bounds each save or listing.
+const interactionStoreTimeout = 30 * time.Second
+
+// interactions is nil when interactions are only logged.
+var interactions InteractionStore
+
+// loadInteractionStore reads INTERACTION_STORE: sqlite, the default, keeps
+// the interactions, their feedback and quality scores in the
+// satbot_interactions, satbot_feedback and satbot_quality tables of the
+// SQLite database INTERACTIONS_DB (interactions.db), which needs no
+// database server for a single instance; postgres keeps them in the same
+// tables of the PostgreSQL database at INTERACTION_STORE_URL, shared by
+// replicas; file appends them to INTERACTIONS_FILE (interactions.jsonl),
+// one JSON object per line, FEEDBACK_FILE (feedback.jsonl) and
+// QUALITY_FILE (quality.jsonl); and off only logs them. They are saved
+// through the queue of startInteractionWriter.
+func loadInteractionStore() {
+	switch kind := getEnv("INTERACTION_STORE", "sqlite"); kind {
+	case "off", "none":
+		interactions = nil
+	case "sqlite", "":
+		path := getEnv("INTERACTIONS_DB", "interactions.db")
+		db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)")
+		if err != nil {
+			configProblem("INTERACTIONS_DB: %v", err)
+			return
+		}
+		// SQLite takes one writer at a time, and the queue writes alone.
+		db.SetMaxOpenConns(1)
+		ctx, cancel := context.WithTimeout(context.Background(), interactionStoreTimeout)
+		defer cancel()
+		if _, err := db.ExecContext(ctx, sqliteInteractionSchema); err != nil {
+			configProblem("INTERACTIONS_DB: %s cannot be written: %v", path, err)
+			return
+		}
+		interactions = &sqlInteractionStore{db: db, sqlite: true}
+		slog.Info("Storing interactions", "path", path)
+	case "file":
+		path := getEnv("INTERACTIONS_FILE", "interactions.jsonl")
+		store, err := newFileInteractionStore(path, getEnv("FEEDBACK_FILE", "feedback.jsonl"), getEnv("QUALITY_FILE", "quality.jsonl"))
+		if err != nil {
+			configProblem("INTERACTIONS_FILE, FEEDBACK_FILE or QUALITY_FILE: %v", err)
+			return
+		}
+		interactions = store
+		slog.Info("Storing interactions", "path", path)
+	case "postgres":
+		db, err := openPostgres(getEnv("INTERACTION_STORE_URL", ""))
+		if err != nil {
+			configProblem("INTERACTION_STORE_URL: %v", err)
+			return
+		}
+		whenConfigValid(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), interactionStoreTimeout)
+			defer cancel()
+			if _, err := db.ExecContext(ctx, pgInteractionSchema); err != nil {
+				log.Fatalf("Failed to prepare the interaction table: %v", err)
+			}
+		})
+		interactions = &sqlInteractionStore{db: db}
+		registerHealthCheck("interaction_store", pingCheck(sqlPinger{db}))
+		slog.Info("Storing interactions in PostgreSQL")
+	default:
+		configProblem("INTERACTION_STORE: unknown store %q", kind)
+	}
+	if interactions != nil {
+		startInteractionWriter()
+	}
+}
+
+// storeInteraction queues the answer to a question of session, or the error
+// it failed with, to be saved in the background, and counts it in the live
+// stats. Questions the client gave up on are left out. The caller must hold
+// session.mu.
+func storeInteraction(r *http.Request, session *Session, question string, answer *CompletionResponse, responseTime time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	live.record(question, err != nil)
+	if interactions == nil {
+		return
+	}
+	i := Interaction{
+		ID:        interactionIDFromContext(r.Context()),
+		Time:      time.Now().UTC(),
+		SessionID: session.ID,
+		UserID:    session.UserID,
+		Origin:    r.Header.Get("Origin"),
+		Channel:   interactionChannel(r),
+		APIClient: apiClientFromContext(r.Context()),
+		Question:  redactPII(question),
+		LatencyMS: responseTime.Milliseconds(),
+	}
+	if err != nil {
+		_, i.Error, _ = classifyError(err)
+	} else {
+		i.ID = answer.InteractionID
+		i.Answer = redactPII(answer.Content)
+		i.Unanswered = unansweredReason(answer)
+		i.Provider, i.Model, i.Variant = answer.Provider, answer.Model, answer.Variant
+		i.PromptTokens, i.CompletionTokens = answer.Usage.PromptTokens, answer.Usage.CompletionTokens
+		if answer.Cost != nil {
+			i.EstimatedCost = answer.Cost.Amount
+		}
+	}
+	if i.ID == "" {
+		i.ID = newID()
+	}
+	interactionQueue.enqueue(i)
+}
+
+// fileInteractionStore appends interactions to a JSON lines file, and their
+// feedback and quality scores to others, and reads the whole files back for
+// listings, which is fine for the few tens of thousands of questions of a
+// fest.
+type fileInteractionStore struct {
+	mu           sync.Mutex
+	path         string
+	file         *os.File
+	feedbackPath string
+	feedbackFile *os.File
+	qualityPath  string
+	qualityFile  *os.File
+}
+
+// feedbackLine is a line of the feedback file; later lines for an
+// interaction replace earlier ones.
+type feedbackLine struct {
+	InteractionID string `json:"interaction_id"`
+	Feedback
+}
+
+// qualityLine is a line of the quality file; later lines for an interaction
+// replace earlier ones.
+type qualityLine struct {
+	InteractionID string `json:"interaction_id"`
+	QualityScore
+}
+
+func newFileInteractionStore(path, feedbackPath, qualityPath string) (*fileInteractionStore, error) {
+	open := func(path string) (*os.File, error) {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, err
+		}
+		return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	}
+	file, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	feedbackFile, err := open(feedbackPath)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	qualityFile, err := open(qualityPath)
+	if err != nil {
+		file.Close()
+		feedbackFile.Close()
+		return nil, err
+	}
+	return &fileInteractionStore{
+		path: path, file: file,
+		feedbackPath: feedbackPath, feedbackFile: feedbackFile,
+		qualityPath: qualityPath, qualityFile: qualityFile,
+	}, nil
+}
+
+func (s *fileInteractionStore) Save(_ context.Context, batch []Interaction) error {
+	var b strings.Builder
+	for _, i := range batch {
+		i.Feedback, i.Quality = nil, nil
+		line, err := json.Marshal(i)
+		if err != nil {
+			return err
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.file.WriteString(b.String())
+	return err
+}
+
+func (s *fileInteractionStore) SaveFeedback(_ context.Context, interactionID string, feedback Feedback) error {
+	line, err := json.Marshal(feedbackLine{InteractionID: interactionID, Feedback: feedback})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.feedbackFile.Write(append(line, '\n'))
+	return err
+}
+
+func (s *fileInteractionStore) SaveQuality(_ context.Context, interactionID string, score QualityScore) error {
+	line, err := json.Marshal(qualityLine{InteractionID: interactionID, QualityScore: score})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.qualityFile.Write(append(line, '\n'))
+	return err
+}
+
+// Delete rewrites the files without the interactions matching filter, their
+// feedback and their quality scores. Lines that cannot be read are kept as
+// they are.
+func (s *fileInteractionStore) Delete(_ context.Context, filter InteractionFilter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := map[string]bool{}
+	err := rewriteJSONLines(s.path, &s.file, func(line []byte) bool {
+		var i Interaction
+		if json.Unmarshal(line, &i) == nil && filter.match(i) {
+			removed[i.ID] = true
+			return false
+		}
+		return true
+	})
+	if err != nil || len(removed) == 0 {
+		return len(removed), err
+	}
+	err = rewriteJSONLines(s.feedbackPath, &s.feedbackFile, func(line []byte) bool {
+		var f feedbackLine
+		return json.Unmarshal(line, &f) != nil || !removed[f.InteractionID]
+	})
+	if err != nil {
+		return len(removed), err
+	}
+	err = rewriteJSONLines(s.qualityPath, &s.qualityFile, func(line []byte) bool {
+		var q qualityLine
+		return json.Unmarshal(line, &q) != nil || !removed[q.InteractionID]
+	})
+	return len(removed), err
+}
+
+// rewriteJSONLines replaces the file at path with the lines keep returns
+// true for, and reopens *file, its append handle, on the new file. Nothing
+// is written when every line is kept.
+func rewriteJSONLines(path string, file **os.File, keep func(line []byte) bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var kept bytes.Buffer
+	dropped := false
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 && !keep(bytes.TrimSpace(line)) {
+			dropped = true
+			continue
+		}
+		kept.Write(line)
+	}
+	if !dropped {
+		return nil
+	}
+	if err := writeFileAtomic(path, kept.Bytes()); err != nil {
+		return err
+	}
+	reopened, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	(*file).Close()
+	*file = reopened
+	return nil
+}
+
+// List reads the files while they may still be appended to; a line being
+// written is skipped like one cut short by a crash.
+func (s *fileInteractionStore) List(ctx context.Context, filter InteractionFilter) ([]Interaction, error) {
+	feedback := map[string]Feedback{}
+	err := scanJSONLines(ctx, s.feedbackPath, func(line []byte) bool {
+		var f feedbackLine
+		if json.Unmarshal(line, &f) == nil {
+			feedback[f.InteractionID] = f.Feedback
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	quality := map[string]QualityScore{}
+	err = scanJSONLines(ctx, s.qualityPath, func(line []byte) bool {
+		var q qualityLine
+		if json.Unmarshal(line, &q) == nil {
+			quality[q.InteractionID] = q.QualityScore
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var found []Interaction
+	err = scanJSONLines(ctx, s.path, func(line []byte) bool {
+		var i Interaction
+		if json.Unmarshal(line, &i) != nil || !filter.match(i) {
+			return true
+		}
+		if f, ok := feedback[i.ID]; ok {
+			i.Feedback = &f
+		}
+		if q, ok := quality[i.ID]; ok {
+			i.Quality = &q
+		}
+		found = append(found, i)
+		return filter.Limit <= 0 || len(found) < filter.Limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// scanJSONLines calls fn with each line of the file at path until it
+// returns false.
+func scanJSONLines(ctx context.Context, path string, fn func(line []byte) bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		if !fn(scanner.Bytes()) {
+			break
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return scanner.Err()
+}
+
+// sqlInteractionStore keeps interactions, their feedback and quality
+// scores in the satbot_interactions, satbot_feedback and satbot_quality
+// tables of an SQLite or PostgreSQL database. SQLite has no time type, so
+// it is given the times as milliseconds since the epoch.
+type sqlInteractionStore struct {
+	db     *sql.DB
+	sqlite bool
+}
+
+const sqliteInteractionSchema = `
+PRAGMA journal_mode = WAL;
+CREATE TABLE IF NOT EXISTS satbot_interactions (
+	id                TEXT PRIMARY KEY,
+	created_at        INTEGER NOT NULL,
+	session_id        TEXT NOT NULL,
+	user_id           TEXT NOT NULL DEFAULT '',
+	origin            TEXT NOT NULL DEFAULT '',
+	question          TEXT NOT NULL,
+	answer            TEXT NOT NULL,
+	provider          TEXT NOT NULL DEFAULT '',
+	model             TEXT NOT NULL DEFAULT '',
+	variant           TEXT NOT NULL DEFAULT '',
+	latency_ms        INTEGER NOT NULL,
+	prompt_tokens     INTEGER NOT NULL,
+	completion_tokens INTEGER NOT NULL,
+	estimated_cost    REAL NOT NULL DEFAULT 0,
+	error             TEXT NOT NULL DEFAULT '',
+	unanswered        TEXT NOT NULL DEFAULT '',
+	channel           TEXT NOT NULL DEFAULT '',
+	api_client        TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS satbot_interactions_created_at ON satbot_interactions (created_at);
+CREATE INDEX IF NOT EXISTS satbot_interactions_session_id ON satbot_interactions (session_id);
+CREATE TABLE IF NOT EXISTS satbot_feedback (
+	interaction_id TEXT PRIMARY KEY,
+	rating         TEXT NOT NULL,
+	comment        TEXT NOT NULL DEFAULT '',
+	rated_at       INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS satbot_quality (
+	interaction_id TEXT PRIMARY KEY,
+	score          INTEGER NOT NULL,
+	grounded       INTEGER NOT NULL,
+	reason         TEXT NOT NULL DEFAULT '',
+	judge          TEXT NOT NULL DEFAULT '',
+	judged_at      INTEGER NOT NULL
+);`
+
+const pgInteractionSchema = `
+CREATE TABLE IF NOT EXISTS satbot_interactions (
+	id                TEXT PRIMARY KEY,
+	created_at        TIMESTAMPTZ NOT NULL,
+	session_id        TEXT NOT NULL,
+	user_id           TEXT NOT NULL DEFAULT '',
+	origin            TEXT NOT NULL DEFAULT '',
+	question          TEXT NOT NULL,
+	answer            TEXT NOT NULL,
+	provider          TEXT NOT NULL DEFAULT '',
+	model             TEXT NOT NULL DEFAULT '',
+	variant           TEXT NOT NULL DEFAULT '',
+	latency_ms        BIGINT NOT NULL,
+	prompt_tokens     INTEGER NOT NULL,
+	completion_tokens INTEGER NOT NULL,
+	estimated_cost    DOUBLE PRECISION NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS satbot_interactions_created_at ON satbot_interactions (created_at);
+CREATE INDEX IF NOT EXISTS satbot_interactions_session_id ON satbot_interactions (session_id);
+ALTER TABLE satbot_interactions ADD COLUMN IF NOT EXISTS error TEXT NOT NULL DEFAULT '';
+ALTER TABLE satbot_interactions ADD COLUMN IF NOT EXISTS unanswered TEXT NOT NULL DEFAULT '';
+ALTER TABLE satbot_interactions ADD COLUMN IF NOT EXISTS channel TEXT NOT NULL DEFAULT '';
+ALTER TABLE satbot_interactions ADD COLUMN IF NOT EXISTS api_client TEXT NOT NULL DEFAULT '';
+CREATE TABLE IF NOT EXISTS satbot_feedback (
+	interaction_id TEXT PRIMARY KEY,
+	rating         TEXT NOT NULL,
+	comment        TEXT NOT NULL DEFAULT '',
+	rated_at       TIMESTAMPTZ NOT NULL
+);
+CREATE TABLE IF NOT EXISTS satbot_quality (
+	interaction_id TEXT PRIMARY KEY,
+	score          INTEGER NOT NULL,
+	grounded       BOOLEAN NOT NULL,
+	reason         TEXT NOT NULL DEFAULT '',
+	judge          TEXT NOT NULL DEFAULT '',
+	judged_at      TIMESTAMPTZ NOT NULL
+);`
+
+const sqlInteractionColumns = `id, created_at, session_id, user_id, origin, question, answer, provider,
+	model, variant, latency_ms, prompt_tokens, completion_tokens, estimated_cost, error, unanswered,
+	channel, api_client`
+
+// sqlInsertBatch caps the rows of one INSERT, well under the 32766
+// parameters of SQLite and the 65535 of the PostgreSQL protocol.
+const sqlInsertBatch = 500
+
+// at is t as the database takes it.
+func (s *sqlInteractionStore) at(t time.Time) any {
+	if s.sqlite {
+		return t.UnixMilli()
+	}
+	return t
+}
+
+// Save inserts the batch with one statement per sqlInsertBatch rows.
+func (s *sqlInteractionStore) Save(ctx context.Context, batch []Interaction) error {
+	for len(batch) > 0 {
+		rows := batch[:min(len(batch), sqlInsertBatch)]
+		batch = batch[len(rows):]
+		values := make([]string, len(rows))
+		args := make([]any, 0, len(rows)*18)
+		for n, i := range rows {
+			placeholders := make([]string, 18)
+			for p := range placeholders {
+				placeholders[p] = "$" + strconv.Itoa(len(args)+p+1)
+			}
+			values[n] = "(" + strings.Join(placeholders, ", ") + ")"
+			args = append(args,
+				i.ID, s.at(i.Time), i.SessionID, i.UserID, i.Origin, i.Question, i.Answer, i.Provider,
+				i.Model, i.Variant, i.LatencyMS, i.PromptTokens, i.CompletionTokens, i.EstimatedCost, i.Error, i.Unanswered,
+				i.Channel, i.APIClient)
+		}
+		_, err := s.db.ExecContext(ctx,
+			`INSERT INTO satbot_interactions (`+sqlInteractionColumns+`)
+			VALUES `+strings.Join(values, ", ")+`
+			ON CONFLICT (id) DO NOTHING`, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlInteractionStore) SaveFeedback(ctx context.Context, interactionID string, feedback Feedback) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO satbot_feedback (interaction_id, rating, comment, rated_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (interaction_id) DO UPDATE SET rating = EXCLUDED.rating, comment = EXCLUDED.comment, rated_at = EXCLUDED.rated_at`,
+		interactionID, feedback.Rating, feedback.Comment, s.at(feedback.CreatedAt))
+	return err
+}
+
+func (s *sqlInteractionStore) SaveQuality(ctx context.Context, interactionID string, score QualityScore) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO satbot_quality (interaction_id, score, grounded, reason, judge, judged_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (interaction_id) DO UPDATE SET score = EXCLUDED.score, grounded = EXCLUDED.grounded,
+			reason = EXCLUDED.reason, judge = EXCLUDED.judge, judged_at = EXCLUDED.judged_at`,
+		interactionID, score.Score, score.Grounded, score.Reason, score.Judge, s.at(score.JudgedAt))
+	return err
+}
+
+// where renders filter as a WHERE clause, empty when it matches
+// everything, with its arguments.
+func (s *sqlInteractionStore) where(filter InteractionFilter) (string, []any) {
+	var where []string
+	var args []any
+	if !filter.Since.IsZero() {
+		args = append(args, s.at(filter.Since))
+		where = append(where, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !filter.Until.IsZero() {
+		args = append(args, s.at(filter.Until))
+		where = append(where, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+	if filter.UserID != "" {
+		args = append(args, filter.UserID)
+		where = append(where, fmt.Sprintf("user_id = $%d", len(args)))
+	}
+	if filter.SessionIDs != nil {
+		placeholders := make([]string, len(filter.SessionIDs))
+		for n, id := range filter.SessionIDs {
+			args = append(args, id)
+			placeholders[n] = fmt.Sprintf("$%d", len(args))
+		}
+		if len(placeholders) == 0 {
+			placeholders = []string{"NULL"}
+		}
+		where = append(where, "session_id IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if len(where) == 0 {
+		return "", nil
+	}
+	return ` WHERE ` + strings.Join(where, " AND "), args
+}
+
+func (s *sqlInteractionStore) Delete(ctx context.Context, filter InteractionFilter) (int, error) {
+	where, args := s.where(filter)
+	if !s.sqlite {
+		var deleted int
+		err := s.db.QueryRowContext(ctx,
+			`WITH deleted AS (DELETE FROM satbot_interactions`+where+` RETURNING id),
+			deleted_feedback AS (DELETE FROM satbot_feedback WHERE interaction_id IN (SELECT id FROM deleted)),
+			deleted_quality AS (DELETE FROM satbot_quality WHERE interaction_id IN (SELECT id FROM deleted))
+			SELECT count(*) FROM deleted`, args...).Scan(&deleted)
+		return deleted, err
+	}
+
+	// SQLite runs no DELETE in a WITH clause: the feedback and quality
+	// scores go first, in the same transaction.
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"satbot_feedback", "satbot_quality"} {
+		_, err := tx.ExecContext(ctx,
+			`DELETE FROM `+table+` WHERE interaction_id IN (SELECT id FROM satbot_interactions`+where+`)`, args...)
+		if err != nil {
+			return 0, err
+		}
+	}
+	result, err := tx.ExecContext(ctx, `DELETE FROM satbot_interactions`+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(deleted), tx.Commit()
+}
+
+func (s *sqlInteractionStore) List(ctx context.Context, filter InteractionFilter) ([]Interaction, error) {
+	where, args := s.where(filter)
+	query := `SELECT ` + sqlInteractionColumns + `, rating, comment, rated_at, score, grounded, reason, judge, judged_at
+		FROM satbot_interactions
+		LEFT JOIN satbot_feedback f ON f.interaction_id = id
+		LEFT JOIN satbot_quality q ON q.interaction_id = id` + where + ` ORDER BY created_at`
+	if filter.Limit > 0 {
+		query += ` LIMIT ` + strconv.Itoa(filter.Limit)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var found []Interaction
+	for rows.Next() {
+		i, err := scanInteraction(rows)
+		if err != nil {
+			return nil, err
+		}
+		found = append(found, i)
+	}
+	return found, rows.Err()
+}
+
+// scanInteraction reads a row of List: the interaction columns, then the
+// feedback and the quality score, NULL when there are none.
+func scanInteraction(rows *sql.Rows) (Interaction, error) {
+	var (
+		i        Interaction
+		at       dbTime
+		feedback struct {
+			rating, comment sql.NullString
+			at              dbTime
+		}
+		quality struct {
+			score         sql.NullInt64
+			grounded      sql.NullBool
+			reason, judge sql.NullString
+			at            dbTime
+		}
+	)
+	err := rows.Scan(&i.ID, &at, &i.SessionID, &i.UserID, &i.Origin, &i.Question, &i.Answer, &i.Provider,
+		&i.Model, &i.Variant, &i.LatencyMS, &i.PromptTokens, &i.CompletionTokens, &i.EstimatedCost, &i.Error, &i.Unanswered,
+		&i.Channel, &i.APIClient,
+		&feedback.rating, &feedback.comment, &feedback.at,
+		&quality.score, &quality.grounded, &quality.reason, &quality.judge, &quality.at)
+	if err != nil {
+		return Interaction{}, err
+	}
+	i.Time = at.Time
+	if feedback.rating.Valid {
+		i.Feedback = &Feedback{Rating: feedback.rating.String, Comment: feedback.comment.String, CreatedAt: feedback.at.Time}
+	}
+	if quality.at.Valid {
+		i.Quality = &QualityScore{Score: int(quality.score.Int64), Grounded: quality.grounded.Bool, Reason: quality.reason.String,
+			Judge: quality.judge.String, JudgedAt: quality.at.Time}
+	}
+	return i, nil
+}
+
+// dbTime scans a timestamp, or milliseconds since the epoch as SQLite
+// keeps them, in UTC. NULL is the zero time.
+type dbTime struct {
+	Time  time.Time
+	Valid bool
+}
+
+func (t *dbTime) Scan(value any) error {
+	switch v := value.(type) {
+	case nil:
+		*t = dbTime{}
+	case time.Time:
+		*t = dbTime{Time: v.UTC(), Valid: true}
+	case int64:
+		*t = dbTime{Time: time.UnixMilli(v).UTC(), Valid: true}
+	default:
+		return fmt.Errorf("unexpected time %T", value)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// interactionWriter saves interactions in the background, in batches, so a
+// slow store never holds up an answer. When the store falls so far behind
+// that the queue is full, new interactions are dropped and counted rather
+// than making the chat wait. What is still queued is lost if the process is
+// killed.
+type interactionWriter struct {
+	queue         chan Interaction
+	batchSize     int
+	flushInterval time.Duration
+	// flushes asks for the queue to be saved at once, see flush.
+	flushes chan chan struct{}
+
+	// lastWarned is when a full queue was last logged, in Unix seconds.
+	lastWarned atomic.Int64
+}
+
+var interactionQueue *interactionWriter
+
+func init() {
+	expvar.Publish("interaction_queue_length", expvar.Func(func() any {
+		if interactionQueue == nil {
+			return 0
+		}
+		return len(interactionQueue.queue)
+	}))
+}
+
+// startInteractionWriter reads INTERACTION_QUEUE_SIZE, how many interactions
+// may wait to be saved (10000 by default); INTERACTION_BATCH_SIZE, how many
+// are saved at once (100); and INTERACTION_FLUSH_INTERVAL, how long a
+// partial batch waits for more (1s).
+func startInteractionWriter() {
+	w := &interactionWriter{
+		batchSize:     getEnvInt("INTERACTION_BATCH_SIZE", 100),
+		flushInterval: getEnvDuration("INTERACTION_FLUSH_INTERVAL", time.Second),
+	}
+	size := getEnvInt("INTERACTION_QUEUE_SIZE", 10000)
+	if size < 1 {
+		configProblem("INTERACTION_QUEUE_SIZE: must be positive")
+		size = 10000
+	}
+	if w.batchSize < 1 {
+		configProblem("INTERACTION_BATCH_SIZE: must be positive")
+		w.batchSize = 100
+	}
+	if w.flushInterval <= 0 {
+		configProblem("INTERACTION_FLUSH_INTERVAL: must be positive")
+		w.flushInterval = time.Second
+	}
+	w.queue = make(chan Interaction, size)
+	w.flushes = make(chan chan struct{})
+	interactionQueue = w
+	go w.loop()
+}
+
+// enqueue queues i to be saved, or drops it when the queue is full.
+func (w *interactionWriter) enqueue(i Interaction) {
+	select {
+	case w.queue <- i:
+	default:
+		interactionsDropped.WithLabelValues("queue_full").Inc()
+		if now := time.Now().Unix(); w.lastWarned.Load() < now-60 {
+			w.lastWarned.Store(now)
+			slog.Warn("Interaction queue is full, dropping interactions until the store catches up", "queue_size", cap(w.queue))
+		}
+	}
+}
+
+func (w *interactionWriter) loop() {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+	batch := make([]Interaction, 0, w.batchSize)
+	for {
+		select {
+		case i := <-w.queue:
+			if batch = append(batch, i); len(batch) < w.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-w.flushes:
+			for n := len(w.queue); n > 0; n-- {
+				if batch = append(batch, <-w.queue); len(batch) == w.batchSize {
+					w.save(batch)
+					batch = batch[:0]
+				}
+			}
+			if len(batch) > 0 {
+				w.save(batch)
+				batch = batch[:0]
+			}
+			close(done)
+			continue
+		}
+		w.save(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush returns once the interactions queued before it are saved, or failed
+// to be, or when ctx is done.
+func (w *interactionWriter) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case w.flushes <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *interactionWriter) save(batch []Interaction) {
+	ctx, cancel := context.WithTimeout(context.Background(), interactionStoreTimeout)
+	defer cancel()
+	if err := interactions.Save(ctx, batch); err != nil {
+		interactionsDropped.WithLabelValues("store_error").Add(float64(len(batch)))
+		slog.Error("Failed to store interactions", "interactions", len(batch), "first_interaction_id", batch[0].ID, "err", err)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// memoryInteractionStore keeps interactions in memory and records the
+// batches they were saved in.
+type memoryInteractionStore struct {
+	mu      sync.Mutex
+	saved   []Interaction
+	batches []int
+	// block, when set, holds each Save until it is closed.
+	block chan struct{}
+}
+
+func (s *memoryInteractionStore) Save(_ context.Context, batch []Interaction) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved = append(s.saved, batch...)
+	s.batches = append(s.batches, len(batch))
+	return nil
+}
+
+func (s *memoryInteractionStore) List(_ context.Context, filter InteractionFilter) ([]Interaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matched []Interaction
+	for _, i := range s.saved {
+		if filter.match(i) {
+			matched = append(matched, i)
+		}
+	}
+	return matched, nil
+}
+
+func (s *memoryInteractionStore) SaveFeedback(context.Context, string, Feedback) error { return nil }
+
+func (s *memoryInteractionStore) SaveQuality(context.Context, string, QualityScore) error { return nil }
+
+func (s *memoryInteractionStore) Delete(_ context.Context, filter InteractionFilter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.saved[:0]
+	for _, i := range s.saved {
+		if !filter.match(i) {
+			kept = append(kept, i)
+		}
+	}
+	n := len(s.saved) - len(kept)
+	s.saved = kept
+	return n, nil
+}
+
+// useInteractionWriter saves interactions to store through a writer started
+// with the given settings for the test.
+func useInteractionWriter(t *testing.T, store InteractionStore, queueSize, batchSize int, flushInterval time.Duration) {
+	t.Helper()
+	oldStore, oldQueue := interactions, interactionQueue
+	interactions = store
+	t.Setenv("INTERACTION_QUEUE_SIZE", fmt.Sprint(queueSize))
+	t.Setenv("INTERACTION_BATCH_SIZE", fmt.Sprint(batchSize))
+	t.Setenv("INTERACTION_FLUSH_INTERVAL", flushInterval.String())
+	if problems := collectConfigProblems(startInteractionWriter); len(problems) > 0 {
+		t.Fatal(problems)
+	}
+	t.Cleanup(func() {
+		interactions, interactionQueue = oldStore, oldQueue
+	})
+}
+
+// waitFor waits until cond holds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition still false after 5s")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInteractionWriterBatches(t *testing.T) {
+	store := &memoryInteractionStore{}
+	useInteractionWriter(t, store, 100, 3, time.Hour)
+
+	for i := 0; i < 7; i++ {
+		interactionQueue.enqueue(Interaction{ID: fmt.Sprint(i)})
+	}
+	if err := interactionQueue.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.saved) != 7 {
+		t.Fatalf("saved %d interactions, want 7", len(store.saved))
+	}
+	for i, saved := range store.saved {
+		if saved.ID != fmt.Sprint(i) {
+			t.Errorf("interaction %d saved as %q, want them in order", i, saved.ID)
+		}
+	}
+	for _, n := range store.batches {
+		if n > 3 {
+			t.Errorf("batches %v, want at most 3 at once", store.batches)
+		}
+	}
+}
+
+func TestInteractionWriterFlushInterval(t *testing.T) {
+	store := &memoryInteractionStore{}
+	useInteractionWriter(t, store, 100, 50, 10*time.Millisecond)
+	interactionQueue.enqueue(Interaction{ID: "partial"})
+	waitFor(t, func() bool {
+		list, _ := store.List(context.Background(), InteractionFilter{})
+		return len(list) == 1
+	})
+}
+
+func TestInteractionWriterDropsWhenFull(t *testing.T) {
+	store := &memoryInteractionStore{block: make(chan struct{})}
+	useInteractionWriter(t, store, 2, 1, time.Hour)
+	dropped := interactionsDropped.WithLabelValues("queue_full")
+	before := testutil.ToFloat64(dropped)
+
+	// The first interaction holds the writer in Save, two more fill the
+	// queue and the rest are dropped.
+	for i := 0; i < 10; i++ {
+		interactionQueue.enqueue(Interaction{ID: fmt.Sprint(i)})
+		if i == 0 {
+			waitFor(t, func() bool { return len(interactionQueue.queue) == 0 })
+		}
+	}
+	if got := testutil.ToFloat64(dropped) - before; got != 7 {
+		t.Errorf("dropped %v interactions, want 7", got)
+	}
+	close(store.block)
+	if err := interactionQueue.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := store.List(context.Background(), InteractionFilter{}); len(list) != 3 {
+		t.Errorf("saved %d interactions, want the 3 queued", len(list))
+	}
+}
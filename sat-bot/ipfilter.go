@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// The two IP lists.
+const (
+	ipAllow = "allow"
+	ipBlock = "block"
+)
+
+// IPListEntry is an address or CIDR range on the allow or block list.
+type IPListEntry struct {
+	CIDR    string    `json:"cidr"`
+	Reason  string    `json:"reason,omitempty"`
+	AddedAt time.Time `json:"added_at"`
+	// ExpiresAt is when a temporary entry stops applying.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Config marks entries from IP_ALLOWLIST or IP_BLOCKLIST, which can only
+	// be removed there.
+	Config bool `json:"config,omitempty"`
+
+	prefix netip.Prefix
+}
+
+func (e *IPListEntry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// ipFilter holds the allow and block lists. When the allowlist has entries
+// only the clients on it are served; the blocklist applies either way.
+// Entries added at runtime are saved to path so they outlive a restart.
+type ipFilter struct {
+	mu    sync.RWMutex
+	path  string
+	lists map[string][]*IPListEntry
+}
+
+var (
+	ipFilters = &ipFilter{lists: map[string][]*IPListEntry{}}
+
+	ipRejected = expvar.NewMap("ip_rejected")
+)
+
+// loadIPFilterConfig reads IP_ALLOWLIST and IP_BLOCKLIST, comma-separated
+// addresses or CIDR ranges, and the entries added through the admin API from
+// IP_LISTS_FILE (ip-lists.json by default).
+func loadIPFilterConfig() {
+	f := &ipFilter{path: getEnv("IP_LISTS_FILE", "ip-lists.json"), lists: map[string][]*IPListEntry{}}
+	for list, env := range map[string]string{ipAllow: "IP_ALLOWLIST", ipBlock: "IP_BLOCKLIST"} {
+		for _, s := range strings.Split(getEnv(env, ""), ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			prefix, err := parseIPPrefix(s)
+			if err != nil {
+				configProblem("%s: %v", env, err)
+				continue
+			}
+			f.lists[list] = append(f.lists[list], &IPListEntry{CIDR: prefix.String(), AddedAt: time.Now().UTC(), prefix: prefix, Config: true})
+		}
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil && !os.IsNotExist(err) {
+		configProblem("IP_LISTS_FILE: %v", err)
+	}
+	if err == nil {
+		var saved map[string][]*IPListEntry
+		if err := json.Unmarshal(data, &saved); err != nil {
+			configProblem("IP_LISTS_FILE: %s: %v", f.path, err)
+		}
+		for _, list := range []string{ipAllow, ipBlock} {
+			for _, e := range saved[list] {
+				prefix, err := parseIPPrefix(e.CIDR)
+				if err != nil {
+					configProblem("IP_LISTS_FILE: %s: %v", f.path, err)
+					continue
+				}
+				e.CIDR, e.prefix, e.Config = prefix.String(), prefix, false
+				f.lists[list] = append(f.lists[list], e)
+			}
+		}
+	}
+
+	ipFilters = f
+	if n := len(f.lists[ipAllow]); n > 0 {
+		slog.Info("Only serving allowed IP ranges", "ranges", n)
+	}
+	if n := len(f.lists[ipBlock]); n > 0 {
+		slog.Info("Blocking IP ranges", "ranges", n)
+	}
+}
+
+// parseIPPrefix parses an address or CIDR range, masking the host bits.
+func parseIPPrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		if addr := prefix.Addr(); addr.Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an IP address or CIDR range", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// match returns the live entry of list containing addr, or nil.
+func (f *ipFilter) match(list string, addr netip.Addr) *IPListEntry {
+	now := time.Now()
+	for _, e := range f.lists[list] {
+		if e.prefix.Contains(addr) && !e.expired(now) {
+			return e
+		}
+	}
+	return nil
+}
+
+// allowed reports whether the client at ip may be served and, if not, why.
+func (f *ipFilter) allowed(ip string) (bool, string) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return true, ""
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if e := f.match(ipBlock, addr); e != nil {
+		return false, ipBlock
+	}
+	if len(f.lists[ipAllow]) > 0 && f.match(ipAllow, addr) == nil {
+		return false, ipAllow
+	}
+	return true, ""
+}
+
+// add puts an entry for prefix on list, replacing any entry for the same
+// range, and saves the lists.
+func (f *ipFilter) add(list string, prefix netip.Prefix, reason string, ttl time.Duration) (*IPListEntry, error) {
+	entry := &IPListEntry{CIDR: prefix.String(), Reason: reason, AddedAt: time.Now().UTC(), prefix: prefix}
+	if ttl > 0 {
+		expires := entry.AddedAt.Add(ttl)
+		entry.ExpiresAt = &expires
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries := f.lists[list][:0:0]
+	for _, e := range f.lists[list] {
+		if e.prefix != prefix || e.Config {
+			entries = append(entries, e)
+		}
+	}
+	f.lists[list] = append(entries, entry)
+	return entry, f.save()
+}
+
+// remove takes the runtime entry for prefix off list. It reports whether
+// there was one; entries from the config cannot be removed.
+func (f *ipFilter) remove(list string, prefix netip.Prefix) (found, config bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	entries := f.lists[list][:0:0]
+	for _, e := range f.lists[list] {
+		switch {
+		case e.prefix != prefix:
+			entries = append(entries, e)
+		case e.Config:
+			config = true
+			entries = append(entries, e)
+		default:
+			found = true
+		}
+	}
+	if !found {
+		return false, config, nil
+	}
+	f.lists[list] = entries
+	return true, config, f.save()
+}
+
+// save writes the runtime entries that have not expired to f.path, dropping
+// the expired ones. f.mu must be held.
+func (f *ipFilter) save() error {
+	now := time.Now()
+	saved := map[string][]*IPListEntry{ipAllow: {}, ipBlock: {}}
+	for list, entries := range f.lists {
+		live := entries[:0:0]
+		for _, e := range entries {
+			if e.expired(now) {
+				continue
+			}
+			live = append(live, e)
+			if !e.Config {
+				saved[list] = append(saved[list], e)
+			}
+		}
+		f.lists[list] = live
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(f.path, data)
+}
+
+// snapshot returns the live entries of both lists, ordered by range.
+func (f *ipFilter) snapshot() map[string][]IPListEntry {
+	now := time.Now()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	out := map[string][]IPListEntry{ipAllow: {}, ipBlock: {}}
+	for list, entries := range f.lists {
+		for _, e := range entries {
+			if !e.expired(now) {
+				out[list] = append(out[list], *e)
+			}
+		}
+		sort.Slice(out[list], func(i, j int) bool { return out[list][i].CIDR < out[list][j].CIDR })
+	}
+	return out
+}
+
+// ipFilterMiddleware rejects clients on the blocklist, missing from a
+// non-empty allowlist or banned for abuse, with 403. Admins are let through so that they cannot
+// lock themselves out, and so is /health for load balancer probes.
+func ipFilterMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || isAdmin(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := clientIP(r)
+		if ok, list := ipFilters.allowed(ip); !ok {
+			ipRejected.Add(list, 1)
+			slog.InfoContext(r.Context(), "Rejected request by IP", "method", r.Method, "path", r.URL.Path, "ip", ip, "list", list)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusForbidden)
+			writeErrorBody(w, ErrorResponse{Error: "Access from your network is not allowed", Code: "ip_blocked"})
+			return
+		}
+		if !checkBan(w, ip) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// IPListRequest adds an entry through the admin API. TTL, such as "2h",
+// makes the entry temporary.
+type IPListRequest struct {
+	CIDR   string `json:"cidr"`
+	Reason string `json:"reason,omitempty"`
+	TTL    string `json:"ttl,omitempty"`
+}
+
+// ipListName returns the {list} route variable, answering 404 for an
+// unknown list.
+func ipListName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	list := mux.Vars(r)["list"]
+	if list != ipAllow && list != ipBlock {
+		w.WriteHeader(http.StatusNotFound)
+		writeErrorBody(w, ErrorResponse{Error: "Unknown IP list, use allow or block"})
+		return "", false
+	}
+	return list, true
+}
+
+// ipListsHandler returns both lists.
+func ipListsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ipFilters.snapshot())
+}
+
+// addIPListHandler adds an address or range to the allow or block list.
+func addIPListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	list, ok := ipListName(w, r)
+	if !ok {
+		return
+	}
+	var req IPListRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	prefix, err := parseIPPrefix(req.CIDR)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: err.Error()})
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		if ttl, err = time.ParseDuration(req.TTL); err != nil || ttl <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			writeErrorBody(w, ErrorResponse{Error: "Invalid ttl, use a positive duration such as 2h"})
+			return
+		}
+	}
+
+	entry, err := ipFilters.add(list, prefix, strings.TrimSpace(req.Reason), ttl)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save IP lists", "path", ipFilters.path, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to save IP lists"})
+		return
+	}
+	slog.InfoContext(r.Context(), "Added IP range", "cidr", entry.CIDR, "list", list, "reason", entry.Reason)
+	auditChange(r, strings.TrimSpace(fmt.Sprintf("+ %s %s %s", list, entry.CIDR, entry.Reason))+"\n")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(entry)
+}
+
+// deleteIPListHandler removes an address or range added through the admin
+// API from the allow or block list.
+func deleteIPListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	list, ok := ipListName(w, r)
+	if !ok {
+		return
+	}
+	prefix, err := parseIPPrefix(mux.Vars(r)["cidr"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	found, config, err := ipFilters.remove(list, prefix)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to save IP lists", "path", ipFilters.path, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to save IP lists"})
+		return
+	}
+	if !found {
+		if config {
+			w.WriteHeader(http.StatusConflict)
+			writeErrorBody(w, ErrorResponse{Error: fmt.Sprintf("%s is set by IP_%sLIST and can only be removed there", prefix, strings.ToUpper(list))})
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		writeErrorBody(w, ErrorResponse{Error: "IP list entry not found"})
+		return
+	}
+	slog.InfoContext(r.Context(), "Removed IP range", "cidr", prefix.String(), "list", list)
+	auditChange(r, fmt.Sprintf("- %s %s\n", list, prefix))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// jwksRefreshInterval is how often the key set is fetched again, and
+	// jwksMinRefresh how soon a token signed by an unknown key may trigger
+	// an early fetch.
+	jwksRefreshInterval = time.Hour
+	jwksMinRefresh      = 5 * time.Minute
+)
+
+// jwtMethods are the signing algorithms accepted. The library checks that
+// the algorithm matches the key's type, so a token cannot pick a weaker
+// check than the key was published for.
+var jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// jwtVerifier checks tokens issued by the fest website against the public
+// keys it publishes as a JSON Web Key Set.
+type jwtVerifier struct {
+	jwksURL   string
+	issuer    string
+	audience  string
+	userClaim string
+	leeway    time.Duration
+
+	// keys holds the key set, fetched again every jwksRefreshInterval and
+	// when a token names an unknown key. It is nil until first fetched.
+	keys keyfunc.Keyfunc
+}
+
+// jwtAuth is nil when JWTs are not accepted.
+var jwtAuth *jwtVerifier
+
+// loadJWTConfig reads JWT_JWKS_URL, the website's key set; JWT_ISSUER and
+// JWT_AUDIENCE, which tokens must carry when set; JWT_USER_CLAIM, the claim
+// holding the user ID (sub by default); and JWT_LEEWAY, the clock skew
+// allowed on expiry. Without a key set only X-User-Token identifies users.
+func loadJWTConfig() {
+	jwksURL := getEnv("JWT_JWKS_URL", "")
+	if jwksURL == "" {
+		return
+	}
+	if u, err := url.Parse(jwksURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		configProblem("JWT_JWKS_URL: %q is not an http or https URL", jwksURL)
+		return
+	}
+	v := &jwtVerifier{
+		jwksURL:   jwksURL,
+		issuer:    getEnv("JWT_ISSUER", ""),
+		audience:  getEnv("JWT_AUDIENCE", ""),
+		userClaim: getEnv("JWT_USER_CLAIM", "sub"),
+		leeway:    getEnvDuration("JWT_LEEWAY", time.Minute),
+	}
+	jwtAuth = v
+	whenConfigValid(func() {
+		// A key set that cannot be fetched yet is retried in the
+		// background and on the first token.
+		keys, err := keyfunc.NewDefaultOverrideCtx(context.Background(), []string{jwksURL}, keyfunc.Override{
+			Client:            &http.Client{Timeout: 10 * time.Second},
+			RefreshInterval:   jwksRefreshInterval,
+			RefreshUnknownKID: rate.NewLimiter(rate.Every(jwksMinRefresh), 1),
+			RefreshErrorHandlerFunc: func(url string) func(context.Context, error) {
+				return func(ctx context.Context, err error) {
+					slog.ErrorContext(ctx, "Failed to refresh JWKS", "url", url, "err", err)
+				}
+			},
+		})
+		if err != nil {
+			slog.Error("Failed to set up JWKS, not accepting JWTs", "url", jwksURL, "err", err)
+			return
+		}
+		v.keys = keys
+		slog.Info("Accepting JWTs", "url", jwksURL)
+	})
+}
+
+// userIDFromJWT returns the user a bearer token was issued to, or an empty
+// string if it is not a valid token from the website.
+func userIDFromJWT(ctx context.Context, token string) string {
+	if jwtAuth == nil || strings.Count(token, ".") != 2 {
+		return ""
+	}
+	userID, err := jwtAuth.verify(ctx, token)
+	if err != nil {
+		slog.InfoContext(ctx, "Rejected JWT", "err", err)
+		return ""
+	}
+	return userID
+}
+
+// verify checks the token's signature and claims and returns its user ID.
+func (v *jwtVerifier) verify(ctx context.Context, token string) (string, error) {
+	if v.keys == nil {
+		return "", errors.New("key set not fetched")
+	}
+	opts := []jwt.ParserOption{jwt.WithValidMethods(jwtMethods), jwt.WithLeeway(v.leeway), jwt.WithExpirationRequired()}
+	if v.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.issuer))
+	}
+	if v.audience != "" {
+		opts = append(opts, jwt.WithAudience(v.audience))
+	}
+	claims := jwt.MapClaims{}
+	if _, err := jwt.NewParser(opts...).ParseWithClaims(token, claims, v.keys.KeyfuncCtx(ctx)); err != nil {
+		return "", err
+	}
+	userID, _ := claims[v.userClaim].(string)
+	if userID == "" {
+		return "", fmt.Errorf("no %s claim", v.userClaim)
+	}
+	return userID, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MicahParks/jwkset"
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// signJWT signs claims with key as alg under kid.
+func signJWT(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(alg), jwt.MapClaims(claims))
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// testKeySet returns a key set holding the public half of each key, by ID.
+func testKeySet(t *testing.T, keys map[string]crypto.Signer) keyfunc.Keyfunc {
+	t.Helper()
+	storage := jwkset.NewMemoryStorage()
+	for kid, key := range keys {
+		jwk, err := jwkset.NewJWKFromKey(key.Public(), jwkset.JWKOptions{Metadata: jwkset.JWKMetadataOptions{KID: kid}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.KeyWrite(context.Background(), jwk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set, err := keyfunc.New(keyfunc.Options{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestJWTVerify(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &jwtVerifier{
+		issuer:    "https://saturnalia.in",
+		audience:  "satbot",
+		userClaim: "sub",
+		leeway:    time.Minute,
+		keys:      testKeySet(t, map[string]crypto.Signer{"ed": edKey, "ec": ecKey}),
+	}
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{"sub": "attendee-42", "iss": "https://saturnalia.in", "aud": "satbot", "exp": now + 3600}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	errNoUser := errors.New("no sub claim")
+	tests := []struct {
+		name    string
+		token   string
+		want    string
+		wantErr error
+	}{
+		{name: "EdDSA", token: signJWT(t, "EdDSA", "ed", edKey, claims(nil)), want: "attendee-42"},
+		{name: "ES256", token: signJWT(t, "ES256", "ec", ecKey, claims(nil)), want: "attendee-42"},
+		{name: "audience list", token: signJWT(t, "EdDSA", "ed", edKey, claims(map[string]any{"aud": []string{"site", "satbot"}})), want: "attendee-42"},
+		{name: "expired within leeway", token: signJWT(t, "EdDSA", "ed", edKey, claims(map[string]any{"exp": now - 30})), want: "attendee-42"},
+		{name: "expired", token: signJWT(t, "EdDSA", "ed", edKey, claims(map[string]any{"exp": now - 3600})), wantErr: jwt.ErrTokenExpired},
+		{name: "no expiry", token: signJWT(t, "EdDSA", "ed", edKey, claims(map[string]any{"exp": nil})), wantErr: jwt.ErrTokenRequiredClaimMissing},
+		{name: "not valid yet", token: signJWT(t, "EdDSA", "ed", edKey, claims(map[string]any{"nbf": now + 3600})), wantErr: jwt.ErrTokenNotValidYet},
+		{name: "wrong issuer", token: signJWT(t, "EdDSA", "ed", edKey, claims(map[string]any{"iss": "https://evil.example"})), wantErr: jwt.ErrTokenInvalidIssuer},
+		{name: "wrong audience", token: signJWT(t, "EdDSA", "ed", edKey, claims(map[string]any{"aud": "other"})), wantErr: jwt.ErrTokenInvalidAudience},
+		{name: "no user", token: signJWT(t, "EdDSA", "ed", edKey, claims(map[string]any{"sub": nil})), wantErr: errNoUser},
+		{name: "signed by another key", token: signJWT(t, "EdDSA", "ed", otherKey, claims(nil)), wantErr: jwt.ErrTokenSignatureInvalid},
+		{name: "algorithm not the key's", token: signJWT(t, "ES256", "ed", ecKey, claims(nil)), wantErr: jwt.ErrTokenUnverifiable},
+		{name: "unknown key", token: signJWT(t, "EdDSA", "rotated", edKey, claims(nil)), wantErr: jwt.ErrTokenUnverifiable},
+		{name: "unsigned", token: unsignedJWT(t, claims(nil)), wantErr: jwt.ErrTokenSignatureInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.verify(context.Background(), tt.token)
+			if tt.wantErr != nil {
+				if err == nil || (!errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error()) {
+					t.Fatalf("verify = %q, %v, want %v", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("verify = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// unsignedJWT returns a token with the none algorithm.
+func unsignedJWT(t *testing.T, claims map[string]any) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims(claims)).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTVerifyTampered(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &jwtVerifier{userClaim: "sub", keys: testKeySet(t, map[string]crypto.Signer{"ed": key})}
+	token := signJWT(t, "EdDSA", "ed", key, map[string]any{"sub": "attendee-42", "exp": time.Now().Add(time.Hour).Unix()})
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(map[string]any{"sub": "admin", "exp": time.Now().Add(time.Hour).Unix()})
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	if got, err := v.verify(context.Background(), strings.Join(parts, ".")); err == nil {
+		t.Errorf("verify accepted a tampered token for %q", got)
+	}
+}
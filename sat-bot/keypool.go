@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultThrottleCooldown is how long a key is skipped after a 429 that did
+// not say when to retry.
+const defaultThrottleCooldown = 10 * time.Second
+
+type poolKey struct {
+	value         string
+	requests      int64
+	throttled     int64
+	lastThrottled time.Time
+	cooldownUntil time.Time
+}
+
+// keyPool rotates requests across several API keys for one provider so
+// free-tier rate limits can be stacked. With the round-robin strategy keys
+// are used in turn; with least-throttled the key that was rate limited
+// longest ago (or never) is preferred. Keys cooling down after a 429 are
+// skipped while any other key is available.
+type keyPool struct {
+	name     string
+	strategy string
+
+	mu   sync.Mutex
+	keys []*poolKey
+	next int
+}
+
+type keyStats struct {
+	Key           string     `json:"key"`
+	Requests      int64      `json:"requests"`
+	Throttled     int64      `json:"throttled"`
+	LastThrottled *time.Time `json:"last_throttled,omitempty"`
+	CoolingDown   bool       `json:"cooling_down"`
+}
+
+var (
+	keyPoolsMu sync.Mutex
+	keyPools   = map[string]*keyPool{}
+)
+
+func init() {
+	expvar.Publish("api_key_pools", expvar.Func(func() any {
+		keyPoolsMu.Lock()
+		defer keyPoolsMu.Unlock()
+		stats := make(map[string][]keyStats, len(keyPools))
+		for name, pool := range keyPools {
+			stats[name] = pool.Stats()
+		}
+		return stats
+	}))
+}
+
+// newKeyPool builds a pool from a comma-separated list of keys, e.g. the
+// value of GROQ_API_KEY. The strategy is read from <NAME>_KEY_STRATEGY.
+// Providers created under the same name share one pool.
+func newKeyPool(name, keys string) *keyPool {
+	keyPoolsMu.Lock()
+	defer keyPoolsMu.Unlock()
+	if pool, ok := keyPools[name]; ok {
+		return pool
+	}
+
+	pool := &keyPool{
+		name:     name,
+		strategy: strings.ToLower(getEnv(strings.ToUpper(name)+"_KEY_STRATEGY", "round-robin")),
+	}
+	for _, key := range strings.Split(keys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			pool.keys = append(pool.keys, &poolKey{value: key})
+		}
+	}
+
+	keyPools[name] = pool
+	return pool
+}
+
+// refreshKeyPools reloads each pool from <NAME>_API_KEY, after the secrets
+// backend changed it.
+func refreshKeyPools() {
+	keyPoolsMu.Lock()
+	defer keyPoolsMu.Unlock()
+	for name, pool := range keyPools {
+		if keys := getEnv(strings.ToUpper(name)+"_API_KEY", ""); keys != "" {
+			if err := pool.replace(keys); err != nil {
+				slog.Warn("Ignoring refreshed API keys, keeping the current ones", "provider", name, "err", err)
+			}
+		}
+	}
+}
+
+// errNoKeys is returned by replace for a list without any key, which would
+// leave the pool empty.
+var errNoKeys = errors.New("no API keys in the list")
+
+// replace swaps the pool's keys for a comma-separated list, keeping the
+// counters of the keys that stay.
+func (p *keyPool) replace(keys string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := make(map[string]*poolKey, len(p.keys))
+	for _, k := range p.keys {
+		old[k.value] = k
+	}
+	var fresh []*poolKey
+	for _, key := range strings.Split(keys, ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		if k, ok := old[key]; ok {
+			fresh = append(fresh, k)
+		} else {
+			fresh = append(fresh, &poolKey{value: key})
+		}
+	}
+	if len(fresh) == 0 {
+		return errNoKeys
+	}
+	p.keys = fresh
+	p.next = 0
+	return nil
+}
+
+// size returns how many keys the pool holds.
+func (p *keyPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.keys)
+}
+
+// pick returns the key to use for the next request, or false when the pool
+// is empty.
+func (p *keyPool) pick() (*poolKey, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.keys) == 0 {
+		return nil, false
+	}
+
+	now := time.Now()
+	var chosen *poolKey
+	switch p.strategy {
+	case "least-throttled", "least-recently-throttled":
+		for _, k := range p.keys {
+			if chosen == nil || k.lastThrottled.Before(chosen.lastThrottled) ||
+				(k.lastThrottled.Equal(chosen.lastThrottled) && k.requests < chosen.requests) {
+				chosen = k
+			}
+		}
+	default:
+		for i := range p.keys {
+			k := p.keys[(p.next+i)%len(p.keys)]
+			if now.After(k.cooldownUntil) {
+				chosen = k
+				p.next = (p.next + i + 1) % len(p.keys)
+				break
+			}
+		}
+		if chosen == nil {
+			// Every key is cooling down; use the one that recovers first.
+			for _, k := range p.keys {
+				if chosen == nil || k.cooldownUntil.Before(chosen.cooldownUntil) {
+					chosen = k
+				}
+			}
+		}
+	}
+
+	chosen.requests++
+	return chosen, true
+}
+
+// throttled records a 429 for key and reports whether another key is
+// available right now.
+func (p *keyPool) throttled(key *poolKey, retryAfter time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if retryAfter <= 0 {
+		retryAfter = defaultThrottleCooldown
+	}
+	now := time.Now()
+	key.throttled++
+	key.lastThrottled = now
+	key.cooldownUntil = now.Add(retryAfter)
+
+	for _, k := range p.keys {
+		if now.After(k.cooldownUntil) {
+			return true
+		}
+	}
+	return false
+}
+
+// do calls send with a key from the pool, moving on to another key when the
+// provider rate limits the current one and a fresh key is available.
+func (p *keyPool) do(send func(key string) (*http.Response, error)) (*http.Response, error) {
+	keys := p.size()
+	if keys == 0 {
+		return nil, errMissingAPIKey
+	}
+
+	var err error
+	for attempt := 0; attempt < keys; attempt++ {
+		key, ok := p.pick()
+		if !ok {
+			return nil, errMissingAPIKey
+		}
+		var resp *http.Response
+		resp, err = send(key.value)
+
+		var upstream *UpstreamError
+		if !errors.As(err, &upstream) || upstream.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+		if !p.throttled(key, upstream.RetryAfter) {
+			break
+		}
+	}
+	return nil, err
+}
+
+// Stats reports per-key usage with the keys masked.
+func (p *keyPool) Stats() []keyStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]keyStats, len(p.keys))
+	for i, k := range p.keys {
+		stats[i] = keyStats{
+			Key:         maskKey(k.value),
+			Requests:    k.requests,
+			Throttled:   k.throttled,
+			CoolingDown: now.Before(k.cooldownUntil),
+		}
+		if !k.lastThrottled.IsZero() {
+			t := k.lastThrottled.UTC()
+			stats[i].LastThrottled = &t
+		}
+	}
+	return stats
+}
+
+func maskKey(key string) string {
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKeyPool(strategy string, keys ...string) *keyPool {
+	pool := &keyPool{name: "test", strategy: strategy}
+	for _, key := range keys {
+		pool.keys = append(pool.keys, &poolKey{value: key})
+	}
+	return pool
+}
+
+func pickN(t *testing.T, pool *keyPool, n int) []string {
+	t.Helper()
+	var picked []string
+	for range n {
+		key, ok := pool.pick()
+		if !ok {
+			t.Fatal("pick found no key")
+		}
+		picked = append(picked, key.value)
+	}
+	return picked
+}
+
+func TestKeyPoolPick(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		// throttle cools down keys before picking, by index.
+		throttle map[int]time.Duration
+		want     []string
+	}{
+		{
+			name:     "round robin",
+			strategy: "round-robin",
+			want:     []string{"a", "b", "c", "a", "b"},
+		},
+		{
+			name:     "round robin skips keys cooling down",
+			strategy: "round-robin",
+			throttle: map[int]time.Duration{1: time.Minute},
+			want:     []string{"a", "c", "a", "c"},
+		},
+		{
+			name:     "every key cooling down",
+			strategy: "round-robin",
+			throttle: map[int]time.Duration{0: time.Hour, 1: time.Minute, 2: 2 * time.Minute},
+			want:     []string{"b", "b"},
+		},
+		{
+			name:     "least throttled prefers the fewest requests",
+			strategy: "least-throttled",
+			want:     []string{"a", "b", "c", "a"},
+		},
+		{
+			name:     "least throttled avoids the latest 429",
+			strategy: "least-throttled",
+			throttle: map[int]time.Duration{0: time.Minute},
+			want:     []string{"b", "c", "b", "c"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := testKeyPool(tt.strategy, "a", "b", "c")
+			for i := range len(pool.keys) {
+				if d, ok := tt.throttle[i]; ok {
+					pool.throttled(pool.keys[i], d)
+				}
+			}
+			if got := pickN(t, pool, len(tt.want)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("picked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyPoolThrottled(t *testing.T) {
+	pool := testKeyPool("round-robin", "a", "b")
+	if !pool.throttled(pool.keys[0], 0) {
+		t.Error("throttled = false with b still available")
+	}
+	if until := time.Until(pool.keys[0].cooldownUntil); until <= 0 || until > defaultThrottleCooldown {
+		t.Errorf("cooling down for %v without Retry-After, want up to %v", until, defaultThrottleCooldown)
+	}
+	if pool.throttled(pool.keys[1], time.Minute) {
+		t.Error("throttled = true with every key cooling down")
+	}
+}
+
+func TestKeyPoolDo(t *testing.T) {
+	rateLimited := &UpstreamError{Provider: "test", StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute}
+	tests := []struct {
+		name string
+		// replies are the errors send returns, by key.
+		replies  map[string]error
+		wantKeys []string
+		wantErr  error
+	}{
+		{
+			name:     "first key answers",
+			wantKeys: []string{"a"},
+		},
+		{
+			name:     "moves on after a 429",
+			replies:  map[string]error{"a": rateLimited},
+			wantKeys: []string{"a", "b"},
+		},
+		{
+			name:     "every key rate limited",
+			replies:  map[string]error{"a": rateLimited, "b": rateLimited, "c": rateLimited},
+			wantKeys: []string{"a", "b", "c"},
+			wantErr:  rateLimited,
+		},
+		{
+			name:     "other errors are not retried",
+			replies:  map[string]error{"a": errors.New("connection reset")},
+			wantKeys: []string{"a"},
+			wantErr:  errors.New("connection reset"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := testKeyPool("round-robin", "a", "b", "c")
+			var used []string
+			_, err := pool.do(func(key string) (*http.Response, error) {
+				used = append(used, key)
+				return nil, tt.replies[key]
+			})
+			if !reflect.DeepEqual(used, tt.wantKeys) {
+				t.Errorf("used keys %v, want %v", used, tt.wantKeys)
+			}
+			if (err == nil) != (tt.wantErr == nil) || (err != nil && err.Error() != tt.wantErr.Error()) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyPoolEmpty(t *testing.T) {
+	pool := testKeyPool("round-robin")
+	if _, ok := pool.pick(); ok {
+		t.Error("pick found a key in an empty pool")
+	}
+	if _, err := pool.do(func(string) (*http.Response, error) { return nil, nil }); !errors.Is(err, errMissingAPIKey) {
+		t.Errorf("do on an empty pool = %v, want %v", err, errMissingAPIKey)
+	}
+}
+
+func TestKeyPoolReplace(t *testing.T) {
+	pool := testKeyPool("round-robin", "a", "b")
+	pool.throttled(pool.keys[1], time.Minute)
+	if err := pool.replace(" b, c ,"); err != nil {
+		t.Fatal(err)
+	}
+	var values []string
+	for _, k := range pool.keys {
+		values = append(values, k.value)
+	}
+	if got := strings.Join(values, ","); got != "b,c" {
+		t.Errorf("keys = %s, want b,c", got)
+	}
+	if pool.keys[0].throttled != 1 {
+		t.Error("replace lost the counters of a key that stayed")
+	}
+	if err := pool.replace(" , "); !errors.Is(err, errNoKeys) {
+		t.Errorf("replace with no keys = %v, want %v", err, errNoKeys)
+	}
+	if pool.size() != 2 {
+		t.Errorf("pool has %d keys after a rejected replace, want 2", pool.size())
+	}
+}
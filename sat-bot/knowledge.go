@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// noContext is sent to the model when no knowledge could be loaded.
+const noContext = "No context available"
+
+// Document is one knowledge file, named by its path relative to the
+// context directory, or a remote source named in CONTEXT_SOURCES_FILE.
+type Document struct {
+	Name    string
+	Content string
+	// URL is where a remote document was fetched from, or the url: given
+	// in a Markdown document's front matter.
+	URL string
+	// Namespace is the topic the document belongs to, see namespaceOf.
+	// Documents without one are shared by every namespace.
+	Namespace string
+}
+
+// KnowledgeBase is a snapshot of the context documents. Snapshots are
+// immutable; a reload builds a new one and swaps it in, so a request always
+// sees one consistent version.
+type KnowledgeBase struct {
+	Documents []Document
+	// Text is what gets injected into prompts: all documents, each
+	// introduced by a "Source:" line naming its file.
+	Text     string
+	LoadedAt time.Time
+	// Namespaces lists the namespaces of the documents, sorted.
+	Namespaces []string
+
+	fingerprint string
+	// namespaceText is Text scoped to each namespace and the shared
+	// documents, and namespaceIndex ranks namespaces for the keyword
+	// classifier.
+	namespaceText  map[string]string
+	namespaceIndex *bm25Index
+
+	// chunkIndex ranks the chunks of the snapshot when the context has to
+	// be compressed without a retrieval index, see contextSelection.fit.
+	chunkOnce  sync.Once
+	chunkIndex *retrievalIndex
+}
+
+var (
+	knowledge  atomic.Pointer[KnowledgeBase]
+	contextDir = "context"
+	// reloadMu serializes reloads from the watcher and SIGHUP.
+	reloadMu sync.Mutex
+)
+
+// currentKnowledge returns the knowledge base in use.
+func currentKnowledge() *KnowledgeBase {
+	return knowledge.Load()
+}
+
+// loadContext reads every .txt and .md file under CONTEXT_DIR (context by
+// default) so that teams can maintain events, sponsors and logistics in
+// separate files or namespaces, and adds the remote sources fetched by
+// loadSources.
+// Deployments that still have a single context.txt and no directory keep
+// working.
+func loadContext() {
+	contextDir = getEnv("CONTEXT_DIR", contextDir)
+	if _, err := reloadContext("startup"); err != nil {
+		slog.Warn("Failed to load context", "err", err)
+	}
+	if len(currentKnowledge().Documents) == 0 {
+		slog.Warn("No context documents found", "dir", contextDir)
+		return
+	}
+	slog.Info("Context loaded", "documents", len(currentKnowledge().Documents))
+}
+
+// reloadContext reads the documents again and swaps them in if anything
+// changed, dropping cached answers built on the old ones and recording the
+// new version with reason. On error the current knowledge stays in use.
+func reloadContext(reason string) (changed bool, err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	kb, err := readKnowledge(contextDir)
+	if err != nil {
+		if knowledge.Load() == nil {
+			knowledge.Store(&KnowledgeBase{Text: noContext, LoadedAt: time.Now()})
+		}
+		return false, err
+	}
+	if old := knowledge.Load(); old != nil && old.fingerprint == kb.fingerprint {
+		return false, nil
+	}
+
+	knowledge.Store(kb)
+	purgeCaches()
+	rebuildIndex(kb)
+	if err := snapshotContext(reason); err != nil {
+		slog.Error("Failed to record context version", "err", err)
+	}
+	return true, nil
+}
+
+func readKnowledge(dir string) (*KnowledgeBase, error) {
+	docs, err := readDocuments(dir)
+	if os.IsNotExist(err) {
+		docs, err = nil, nil
+		if content, readErr := os.ReadFile("context.txt"); readErr == nil {
+			docs = []Document{{Name: "context.txt", Content: strings.TrimSpace(string(content))}}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read context directory %s: %v", dir, err)
+	}
+	docs = append(docs, remoteDocuments()...)
+
+	kb := &KnowledgeBase{Documents: docs, Text: renderContext(docs), LoadedAt: time.Now()}
+	if kb.Text == "" {
+		kb.Text = noContext
+	}
+	indexNamespaces(kb)
+	var fp strings.Builder
+	for _, doc := range docs {
+		fmt.Fprintf(&fp, "%s\x00%s\x00", doc.Name, doc.Content)
+	}
+	kb.fingerprint = fp.String()
+	return kb, nil
+}
+
+// isDocumentFile reports whether a file name has one of the extensions the
+// knowledge base reads.
+func isDocumentFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".txt", ".md", ".pdf":
+		return true
+	}
+	return false
+}
+
+// readDocuments returns the non-empty documents under dir, sorted by name.
+// Hidden files and directories are skipped, as are PDFs without
+// extractable text, which are logged instead of failing the whole load.
+func readDocuments(dir string) ([]Document, error) {
+	var docs []Document
+	err := walkDocuments(dir, func(path, name string, _ fs.FileInfo) error {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		text, err := documentText(name, content)
+		if err != nil {
+			slog.Warn("Skipping context document", "name", name, "err", err)
+			return nil
+		}
+		if text != "" {
+			doc := Document{Name: name, Content: text, Namespace: namespaceOf(name)}
+			if strings.EqualFold(filepath.Ext(name), ".md") {
+				doc.URL = frontMatterURL(string(content))
+			}
+			docs = append(docs, doc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Name < docs[j].Name })
+	return docs, nil
+}
+
+// documentText returns the text of a document file: PDFs are extracted and
+// Markdown has any front matter removed.
+func documentText(name string, content []byte) (string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".pdf":
+		return pdfToText(content)
+	case ".md":
+		return strings.TrimSpace(stripFrontMatter(string(content))), nil
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// stripFrontMatter removes a leading YAML front matter block, which static
+// site generators and CMS exports add to Markdown files.
+func stripFrontMatter(s string) string {
+	_, body := splitFrontMatter(s)
+	return body
+}
+
+func splitFrontMatter(s string) (front, body string) {
+	rest, ok := strings.CutPrefix(strings.TrimLeft(s, "\ufeff"), "---\n")
+	if !ok {
+		return "", s
+	}
+	if i := strings.Index(rest, "\n---\n"); i >= 0 {
+		return rest[:i], rest[i+len("\n---\n"):]
+	}
+	if front, ok := strings.CutSuffix(rest, "\n---"); ok {
+		return front, ""
+	}
+	return "", s
+}
+
+// frontMatterURL returns the url: field of a Markdown document's front
+// matter, the page citations of the document link to.
+func frontMatterURL(s string) string {
+	front, _ := splitFrontMatter(s)
+	for _, line := range strings.Split(front, "\n") {
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "url:"); ok {
+			return strings.Trim(strings.TrimSpace(v), `"'`)
+		}
+	}
+	return ""
+}
+
+// walkDocuments calls fn for each document file under dir with its path and
+// its name relative to dir.
+func walkDocuments(dir string, fn func(path, name string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if !isDocumentFile(path) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		return fn(path, filepath.ToSlash(name), info)
+	})
+}
+
+// renderContext joins documents, labelling each with its file name.
+func renderContext(docs []Document) string {
+	parts := make([]string, len(docs))
+	for i, doc := range docs {
+		parts[i] = "Source: " + doc.Name + "\n" + doc.Content
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// directoryStamp summarizes names, sizes and modification times of the
+// documents under dir, which is enough to notice edits without reading them.
+func directoryStamp(dir string) string {
+	var b strings.Builder
+	err := walkDocuments(dir, func(_, name string, info fs.FileInfo) error {
+		fmt.Fprintf(&b, "%s:%d:%d;", name, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "error:" + err.Error()
+	}
+	return b.String()
+}
+
+// watchContext polls the context directory every interval (set by
+// CONTEXT_WATCH_INTERVAL, 0 disables it) and reloads it when a document is
+// added, removed or modified, so corrections go live without a restart.
+func watchContext() {
+	interval := getEnvDuration("CONTEXT_WATCH_INTERVAL", 5*time.Second)
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		stamp := directoryStamp(contextDir)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			next := directoryStamp(contextDir)
+			if next == stamp {
+				continue
+			}
+			stamp = next
+			logContextReload("file change")
+		}
+	}()
+}
+
+func logContextReload(reason string) {
+	changed, err := reloadContext(reason)
+	switch {
+	case err != nil:
+		slog.Error("Context reload failed, keeping the current version", "reason", reason, "err", err)
+	case changed:
+		slog.Info("Context reloaded", "reason", reason, "documents", len(currentKnowledge().Documents))
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// maxRequestBytes caps the body of requests outside the admin API,
+	// whose documents and PDFs have their own limits, see
+	// bodyLimitMiddleware.
+	maxRequestBytes int64 = 64 << 10
+	// maxMessageChars and maxMessageTokens cap a chat message; 0 turns a
+	// cap off.
+	maxMessageChars  = 4000
+	maxMessageTokens = 1000
+)
+
+// loadLimitConfig reads MAX_REQUEST_BYTES, MAX_MESSAGE_CHARS and
+// MAX_MESSAGE_TOKENS.
+func loadLimitConfig() {
+	bytes := int64(getEnvInt("MAX_REQUEST_BYTES", int(maxRequestBytes)))
+	chars := getEnvInt("MAX_MESSAGE_CHARS", maxMessageChars)
+	tokens := getEnvInt("MAX_MESSAGE_TOKENS", maxMessageTokens)
+	if bytes <= 0 || chars < 0 || tokens < 0 {
+		configProblem("MAX_REQUEST_BYTES, MAX_MESSAGE_CHARS or MAX_MESSAGE_TOKENS: must be positive")
+		return
+	}
+	maxRequestBytes, maxMessageChars, maxMessageTokens = bytes, chars, tokens
+}
+
+// bodyLimitMiddleware stops reading request bodies past maxRequestBytes, so
+// an oversized message is rejected before it is decoded. Admin requests may
+// be as large as the largest upload, maxPDFSize, and the upload handlers
+// apply their own limit within it.
+func bodyLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			limit := maxRequestBytes
+			if strings.HasPrefix(r.URL.Path, "/admin/") {
+				limit = max(limit, maxPDFSize)
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeDecodeError answers a request whose JSON body could not be decoded,
+// with 413 when it was cut off by the size limit.
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		writeErrorBody(w, ErrorResponse{
+			Error: fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit),
+			Code:  "request_too_large",
+		})
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	writeErrorBody(w, ErrorResponse{Error: "Invalid request format"})
+}
+
+// checkMessageLength rejects a chat message over the configured length with
+// 400 and reports whether it is within it.
+func checkMessageLength(w http.ResponseWriter, message string) bool {
+	var problem string
+	switch {
+	case maxMessageChars > 0 && utf8.RuneCountInString(message) > maxMessageChars:
+		problem = fmt.Sprintf("Message is longer than %d characters", maxMessageChars)
+	case maxMessageTokens > 0 && estimateTokens(message) > maxMessageTokens:
+		problem = fmt.Sprintf("Message is longer than %d tokens", maxMessageTokens)
+	default:
+		return true
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	writeErrorBody(w, ErrorResponse{Error: problem, Code: "message_too_long"})
+	return false
+}
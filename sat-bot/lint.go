@@ -0,0 +1,385 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of context lint issues.
+const (
+	lintStaleDate         = "stale_date"
+	lintConflictingTiming = "conflicting_timing"
+	lintEmptySection      = "empty_section"
+	lintOversizedDocument = "oversized_document"
+	lintOversizedContext  = "oversized_context"
+)
+
+// maxExcerptLength caps the line quoted with an issue.
+const maxExcerptLength = 120
+
+// LintIssue is one problem found in the knowledge base. Line numbers count
+// from 1 in the document's text, after PDF extraction and front matter
+// removal.
+type LintIssue struct {
+	Kind     string `json:"kind"`
+	Severity string `json:"severity"`
+	Document string `json:"document,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Section  string `json:"section,omitempty"`
+	Message  string `json:"message"`
+	Excerpt  string `json:"excerpt,omitempty"`
+}
+
+type LintReport struct {
+	CheckedAt time.Time      `json:"checked_at"`
+	Documents int            `json:"documents"`
+	Tokens    int            `json:"tokens"`
+	Counts    map[string]int `json:"counts"`
+	Issues    []LintIssue    `json:"issues"`
+}
+
+var (
+	yearPattern = regexp.MustCompile(`\b(19|20)\d{2}\b`)
+	// clockPattern matches 12-hour times such as "10 am" or "4:30 P.M.",
+	// and hourPattern 24-hour ones such as "16:30".
+	clockPattern = regexp.MustCompile(`(?i)\b(\d{1,2})(?::([0-5]\d))?\s*([ap])\.?m\b\.?`)
+	hourPattern  = regexp.MustCompile(`\b([01]?\d|2[0-3]):([0-5]\d)\b`)
+	// dayMonthPattern matches "15 November" or "15th Nov", and
+	// monthDayPattern "November 15".
+	dayMonthPattern = regexp.MustCompile(`(?i)\b(\d{1,2})(?:st|nd|rd|th)?\s+(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\b`)
+	monthDayPattern = regexp.MustCompile(`(?i)\b(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\.?\s+(\d{1,2})(?:st|nd|rd|th)?\b`)
+)
+
+var monthNumbers = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+// lintDocumentTokens is the size above which a document is flagged.
+var lintDocumentTokens = 4000
+
+func loadLintConfig() {
+	lintDocumentTokens = getEnvInt("LINT_MAX_DOCUMENT_TOKENS", lintDocumentTokens)
+}
+
+// lintContext checks kb for years before the fest's, events given different
+// dates or times in different places, headings with nothing under them,
+// oversized documents, and a whole context too big to send with every
+// question when retrieval is off.
+func lintContext(kb *KnowledgeBase) LintReport {
+	report := LintReport{CheckedAt: time.Now().UTC(), Documents: len(kb.Documents), Counts: map[string]int{}}
+	festYear := festYear()
+	timings := map[string][]eventTiming{}
+
+	for _, doc := range kb.Documents {
+		tokens := estimateTokens(doc.Content)
+		report.Tokens += tokens
+		if tokens > lintDocumentTokens {
+			report.Issues = append(report.Issues, LintIssue{
+				Kind: lintOversizedDocument, Severity: "warning", Document: doc.Name,
+				Message: fmt.Sprintf("about %d tokens, more than %d; consider splitting it", tokens, lintDocumentTokens),
+			})
+		}
+		report.Issues = append(report.Issues, lintDocument(doc, festYear, timings)...)
+	}
+	report.Issues = append(report.Issues, timingConflicts(timings)...)
+
+	limit := contextTokenLimit
+	if limit <= 0 {
+		limit = modelContextWindow / 2
+	}
+	if !retrievalEnabled() && report.Tokens > limit {
+		report.Issues = append(report.Issues, LintIssue{
+			Kind: lintOversizedContext, Severity: "warning",
+			Message: fmt.Sprintf("the whole context, about %d tokens, is sent with every question and is over %d; enable retrieval or it will be compressed", report.Tokens, limit),
+		})
+	}
+
+	for _, issue := range report.Issues {
+		report.Counts[issue.Kind]++
+	}
+	if report.Issues == nil {
+		report.Issues = []LintIssue{}
+	}
+	return report
+}
+
+// festYear is the latest year in FEST_DATES, or the current year if it has
+// none.
+func festYear() int {
+	year := 0
+	for _, m := range yearPattern.FindAllString(currentPromptVars().Dates, -1) {
+		if y, _ := strconv.Atoi(m); y > year {
+			year = y
+		}
+	}
+	if year == 0 {
+		year = time.Now().Year()
+	}
+	return year
+}
+
+// eventTiming is where an event was given dates or times.
+type eventTiming struct {
+	document string
+	line     int
+	name     string
+	dates    []string
+	times    []string
+}
+
+// lintDocument checks one document's lines for stale years and empty
+// sections, and collects the timings of the events it describes.
+func lintDocument(doc Document, festYear int, timings map[string][]eventTiming) []LintIssue {
+	var issues []LintIssue
+	lines := strings.Split(doc.Content, "\n")
+
+	// heading is the open section; its level is 0 for plain text titles.
+	type heading struct {
+		title      string
+		level      int
+		line       int
+		hasContent bool
+	}
+	var headings []heading
+	closeEmpty := func(level int) {
+		for len(headings) > 0 {
+			h := headings[len(headings)-1]
+			if h.level != 0 && h.level < level {
+				return
+			}
+			headings = headings[:len(headings)-1]
+			// A title on the first line names the document rather than a
+			// section.
+			if !h.hasContent && h.line > 1 {
+				issues = append(issues, LintIssue{
+					Kind: lintEmptySection, Severity: "warning", Document: doc.Name, Line: h.line,
+					Section: h.title, Message: "heading has no content under it",
+				})
+			}
+			if h.level == 0 {
+				return
+			}
+		}
+	}
+	sectionName := func() string {
+		if len(headings) == 0 {
+			return ""
+		}
+		return headings[len(headings)-1].title
+	}
+
+	var block []string
+	blockLine := 0
+	endBlock := func() {
+		if len(block) > 0 {
+			collectTiming(doc.Name, blockLine, sectionName(), block, timings)
+		}
+		block, blockLine = nil, 0
+	}
+
+	for i, line := range lines {
+		n := i + 1
+		trimmed := strings.TrimSpace(line)
+		level := len(trimmed) - len(strings.TrimLeft(trimmed, "#"))
+		switch {
+		case trimmed == "":
+			endBlock()
+		case level > 0 && level <= 6 && strings.TrimSpace(trimmed[level:]) != "":
+			endBlock()
+			closeEmpty(level)
+			headings = append(headings, heading{title: strings.TrimSpace(trimmed[level:]), level: level, line: n})
+		case isTitleLine(trimmed):
+			endBlock()
+			closeEmpty(0)
+			headings = append(headings, heading{title: trimmed, line: n})
+		default:
+			for j := range headings {
+				headings[j].hasContent = true
+			}
+			if isListItem(trimmed) {
+				endBlock()
+			}
+			if blockLine == 0 {
+				blockLine = n
+			}
+			block = append(block, trimmed)
+		}
+
+		for _, y := range yearPattern.FindAllString(trimmed, -1) {
+			if year, _ := strconv.Atoi(y); year < festYear {
+				issues = append(issues, LintIssue{
+					Kind: lintStaleDate, Severity: "warning", Document: doc.Name, Line: n, Section: sectionName(),
+					Message: fmt.Sprintf("mentions %d, before the fest's year %d", year, festYear), Excerpt: excerpt(trimmed),
+				})
+				break
+			}
+		}
+	}
+	endBlock()
+	for len(headings) > 0 {
+		closeEmpty(0)
+	}
+	return issues
+}
+
+// collectTiming records the dates and times a block gives for the event it
+// is about: the title of a list item or "Name:" line, or else the section.
+func collectTiming(document string, line int, section string, block []string, timings map[string][]eventTiming) {
+	text := strings.Join(block, " ")
+	dates, times := extractTimings(text)
+	if len(dates) == 0 && len(times) == 0 {
+		return
+	}
+
+	name := section
+	if title := blockTitle(block[0]); title != "" {
+		name = title
+	}
+	key := strings.Join(faqWords(name), " ")
+	if key == "" {
+		return
+	}
+	timings[key] = append(timings[key], eventTiming{document: document, line: line, name: name, dates: dates, times: times})
+}
+
+// blockTitle returns what a block's first line names: the text of a list
+// item up to any separator, or the part of a line before "Name:" style
+// separators. Titles over 60 bytes are taken to be prose.
+func blockTitle(first string) string {
+	title, isItem := strings.CutPrefix(first, "- ")
+	if !isItem {
+		title, isItem = strings.CutPrefix(first, "* ")
+	}
+	// The first separator ends the title, so that a time such as 6:00
+	// after it does not.
+	cut := -1
+	for _, sep := range []string{":", " | ", " - ", " – ", " — "} {
+		if i := strings.Index(title, sep); i > 0 && (cut < 0 || i < cut) {
+			cut = i
+		}
+	}
+	found := cut > 0
+	if found {
+		title = title[:cut]
+	}
+	title = strings.TrimSpace(title)
+	if (!isItem && !found) || len(title) > 60 {
+		return ""
+	}
+	return title
+}
+
+// extractTimings returns the distinct dates (as MM-DD) and times (as 24-hour
+// HH:MM) in text, sorted.
+func extractTimings(text string) (dates, times []string) {
+	dateSet, timeSet := map[string]bool{}, map[string]bool{}
+	for _, m := range dayMonthPattern.FindAllStringSubmatch(text, -1) {
+		if day, _ := strconv.Atoi(m[1]); day >= 1 && day <= 31 {
+			dateSet[fmt.Sprintf("%02d-%02d", monthNumbers[strings.ToLower(m[2])], day)] = true
+		}
+	}
+	for _, m := range monthDayPattern.FindAllStringSubmatch(text, -1) {
+		if day, _ := strconv.Atoi(m[2]); day >= 1 && day <= 31 {
+			dateSet[fmt.Sprintf("%02d-%02d", monthNumbers[strings.ToLower(m[1])], day)] = true
+		}
+	}
+
+	rest := clockPattern.ReplaceAllStringFunc(text, func(s string) string {
+		m := clockPattern.FindStringSubmatch(s)
+		hour, _ := strconv.Atoi(m[1])
+		minute, _ := strconv.Atoi(m[2])
+		if hour >= 1 && hour <= 12 {
+			hour %= 12
+			if strings.EqualFold(m[3], "p") {
+				hour += 12
+			}
+			timeSet[fmt.Sprintf("%02d:%02d", hour, minute)] = true
+		}
+		return " "
+	})
+	for _, m := range hourPattern.FindAllStringSubmatch(rest, -1) {
+		hour, _ := strconv.Atoi(m[1])
+		timeSet[fmt.Sprintf("%02d:%s", hour, m[2])] = true
+	}
+
+	for d := range dateSet {
+		dates = append(dates, d)
+	}
+	for t := range timeSet {
+		times = append(times, t)
+	}
+	sort.Strings(dates)
+	sort.Strings(times)
+	return dates, times
+}
+
+// timingConflicts reports events given different dates, or different
+// times, in two places.
+func timingConflicts(timings map[string][]eventTiming) []LintIssue {
+	keys := make([]string, 0, len(timings))
+	for key := range timings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var issues []LintIssue
+	for _, key := range keys {
+		places := timings[key]
+		for _, kind := range []string{"dates", "times"} {
+			values := func(t eventTiming) []string {
+				if kind == "dates" {
+					return t.dates
+				}
+				return t.times
+			}
+			var first *eventTiming
+			for i := range places {
+				t := &places[i]
+				if len(values(*t)) == 0 {
+					continue
+				}
+				if first == nil {
+					first = t
+					continue
+				}
+				if strings.Join(values(*t), ",") != strings.Join(values(*first), ",") {
+					issues = append(issues, LintIssue{
+						Kind: lintConflictingTiming, Severity: "error", Document: t.document, Line: t.line, Section: t.name,
+						Message: fmt.Sprintf("%s gives %s %s here but %s in %s line %d", t.name, kind,
+							strings.Join(values(*t), ", "), strings.Join(values(*first), ", "), first.document, first.line),
+					})
+				}
+			}
+		}
+	}
+	return issues
+}
+
+func excerpt(line string) string {
+	if len(line) <= maxExcerptLength {
+		return line
+	}
+	cut := maxExcerptLength
+	for cut > 0 && !isRuneStart(line[cut]) {
+		cut--
+	}
+	return line[:cut] + "…"
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+// contextLintHandler validates the loaded knowledge base.
+func contextLintHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(lintContext(currentKnowledge()))
+}
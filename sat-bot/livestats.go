@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// liveStatsInterval is how often the live stats stream sends the
+	// counters.
+	liveStatsInterval = 2 * time.Second
+	// liveTrendingWindow is how far back trending questions are counted.
+	liveTrendingWindow = 15 * time.Minute
+	// maxLiveQuestions bounds the questions kept for trending, the latest
+	// ones winning.
+	maxLiveQuestions = 20000
+	// liveTrendingLimit is how many trending questions are sent.
+	liveTrendingLimit = 5
+)
+
+// LiveStats is what the organizers' screen shows of the bot right now.
+type LiveStats struct {
+	Time time.Time `json:"time"`
+	// ChatsPerMinute and ErrorsPerMinute are over the last minute.
+	ChatsPerMinute  int `json:"chats_per_minute"`
+	ErrorsPerMinute int `json:"errors_per_minute"`
+	ActiveSessions  int `json:"active_sessions"`
+	// Trending are the questions asked most over the last 15 minutes, the
+	// first one the top trending question.
+	Trending []TrendingQuestion `json:"trending"`
+}
+
+type TrendingQuestion struct {
+	Question string `json:"question"`
+	Count    int    `json:"count"`
+}
+
+type liveQuestion struct {
+	at       time.Time
+	key      string
+	question string
+}
+
+// liveCounters keeps the chats of the last minute and the questions of the
+// trending window in memory, so the live stats need no interaction store.
+// Each replica counts its own chats.
+type liveCounters struct {
+	mu sync.Mutex
+	// chats and errors count the chats per second of the last minute, in a
+	// ring indexed by Unix second; seconds holds the second each slot is for.
+	chats, errors [60]int
+	seconds       [60]int64
+	// questions are oldest first.
+	questions []liveQuestion
+}
+
+var live = &liveCounters{}
+
+// record counts a chat, and its question toward trending when it was
+// answered.
+func (c *liveCounters) record(question string, failed bool) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	slot := c.slot(now.Unix())
+	c.chats[slot]++
+	if failed {
+		c.errors[slot]++
+		return
+	}
+	key := normalizeQuestion(question)
+	if key == "" {
+		return
+	}
+	c.prune(now)
+	if len(c.questions) >= maxLiveQuestions {
+		c.questions = c.questions[1:]
+	}
+	c.questions = append(c.questions, liveQuestion{at: now, key: key, question: redactPII(question)})
+}
+
+// slot returns the ring slot of second, clearing it when it last held an
+// older second. The caller must hold c.mu.
+func (c *liveCounters) slot(second int64) int {
+	slot := int(second % 60)
+	if c.seconds[slot] != second {
+		c.seconds[slot], c.chats[slot], c.errors[slot] = second, 0, 0
+	}
+	return slot
+}
+
+// prune drops the questions older than the trending window. The caller must
+// hold c.mu.
+func (c *liveCounters) prune(now time.Time) {
+	cutoff := now.Add(-liveTrendingWindow)
+	n := sort.Search(len(c.questions), func(i int) bool { return c.questions[i].at.After(cutoff) })
+	c.questions = c.questions[n:]
+}
+
+func (c *liveCounters) Stats() LiveStats {
+	now := time.Now()
+	stats := LiveStats{Time: now.UTC(), ActiveSessions: sessions.Count(), Trending: []TrendingQuestion{}}
+
+	c.mu.Lock()
+	second := now.Unix()
+	for slot := range c.seconds {
+		if c.seconds[slot] > second-60 {
+			stats.ChatsPerMinute += c.chats[slot]
+			stats.ErrorsPerMinute += c.errors[slot]
+		}
+	}
+	c.prune(now)
+	counts := map[string]*TrendingQuestion{}
+	for _, q := range c.questions {
+		t := counts[q.key]
+		if t == nil {
+			t = &TrendingQuestion{}
+			counts[q.key] = t
+		}
+		t.Question = q.question
+		t.Count++
+	}
+	c.mu.Unlock()
+
+	for _, t := range counts {
+		stats.Trending = append(stats.Trending, *t)
+	}
+	sort.Slice(stats.Trending, func(i, j int) bool {
+		if stats.Trending[i].Count != stats.Trending[j].Count {
+			return stats.Trending[i].Count > stats.Trending[j].Count
+		}
+		return stats.Trending[i].Question < stats.Trending[j].Question
+	})
+	if len(stats.Trending) > liveTrendingLimit {
+		stats.Trending = stats.Trending[:liveTrendingLimit]
+	}
+	return stats
+}
+
+// liveStatsHandler streams LiveStats as server-sent "stats" events, one
+// now and then one every two seconds until the client goes away, for the
+// control-room screen to show without polling. The counters are this
+// replica's own.
+func liveStatsHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(liveStatsInterval)
+	defer ticker.Stop()
+	for {
+		if err := writeSSE(w, rc, "stats", live.Stats()); err != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatingFile is a log file that is renamed aside and started afresh once
+// it reaches maxSize bytes or, when every is set, at each multiple of every
+// (midnight UTC for 24h). Rotated files are named after the time they were
+// rotated, e.g. satbot-20260101-000000.000.log, and the oldest are deleted so at
+// most maxBackups remain, none older than maxAge.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	every      time.Duration
+	maxBackups int
+	maxAge     time.Duration
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	rotate time.Time
+}
+
+// openLogFile reads LOG_FILE, a file to write the logs to as well as
+// stderr, for hosts without a log collector; LOG_FILE_MAX_SIZE, the size in
+// megabytes at which it is rotated (100 by default); LOG_FILE_ROTATE_EVERY,
+// rotating it on a schedule too (24h by default, 0 for size only);
+// LOG_FILE_MAX_BACKUPS, the rotated files kept (7, 0 for all); and
+// LOG_FILE_MAX_AGE, the age past which they are deleted (0 keeps them until
+// there are too many). It returns nil when LOG_FILE is unset.
+func openLogFile() (*rotatingFile, error) {
+	path := getEnv("LOG_FILE", "")
+	if path == "" {
+		return nil, nil
+	}
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    int64(getEnvInt("LOG_FILE_MAX_SIZE", 100)) << 20,
+		every:      getEnvDuration("LOG_FILE_ROTATE_EVERY", 24*time.Hour),
+		maxBackups: getEnvInt("LOG_FILE_MAX_BACKUPS", 7),
+		maxAge:     getEnvDuration("LOG_FILE_MAX_AGE", 0),
+	}
+	if f.maxSize <= 0 || f.every < 0 || f.maxBackups < 0 || f.maxAge < 0 {
+		return nil, fmt.Errorf("LOG_FILE_MAX_SIZE must be positive and the other LOG_FILE_ settings must not be negative")
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	if f.every > 0 {
+		f.rotate = time.Now().Truncate(f.every).Add(f.every)
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && (f.size+int64(len(p)) > f.maxSize || (f.every > 0 && !time.Now().Before(f.rotate))) {
+		if err := f.rotateLocked(); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to rotate %s: %v\n", f.path, err)
+		}
+	}
+	if f.file == nil {
+		return len(p), nil
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotateLocked() error {
+	f.file.Close()
+	f.file = nil
+	ext := filepath.Ext(f.path)
+	rotated := strings.TrimSuffix(f.path, ext) + "-" + time.Now().UTC().Format("20060102-150405.000") + ext
+	if err := os.Rename(f.path, rotated); err != nil && !os.IsNotExist(err) {
+		f.open()
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	go f.prune()
+	return nil
+}
+
+// prune deletes the rotated files beyond maxBackups or older than maxAge.
+func (f *rotatingFile) prune() {
+	ext := filepath.Ext(f.path)
+	backups, err := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-[0-9]*-[0-9]*" + ext)
+	if err != nil {
+		return
+	}
+	// The names sort by the time they were rotated; newest first.
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	for i, name := range backups {
+		expired := false
+		if f.maxAge > 0 {
+			if info, err := os.Stat(name); err == nil && time.Since(info.ModTime()) > f.maxAge {
+				expired = true
+			}
+		}
+		if (f.maxBackups > 0 && i >= f.maxBackups) || expired {
+			os.Remove(name)
+		}
+	}
+}
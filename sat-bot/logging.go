@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// requestLog holds what every log line about a request carries. The session
+// is only known once the handler has looked it up, so it is filled in
+// later through setLogSession, and the interaction once an answer is
+// started, see startInteraction.
+type requestLog struct {
+	id string
+
+	mu            sync.Mutex
+	sessionID     string
+	interactionID string
+}
+
+const requestLogContextKey contextKey = "request_log"
+
+// loadLogging sets up the structured logger from LOG_FORMAT, json or text,
+// and LOG_LEVEL, debug, info (the default), warn or error. The format is
+// json unless APP_ENV is development, so the log aggregator can filter on
+// fields in production while a terminal stays readable. Lines written
+// through the log package go to the same handler. Logs go to stderr and, if
+// LOG_FILE is set, to a rotating file as well, see openLogFile.
+func loadLogging() {
+	format := "json"
+	if env := strings.ToLower(getEnv("APP_ENV", "production")); env == "development" || env == "dev" {
+		format = "text"
+	}
+	format = strings.ToLower(getEnv("LOG_FORMAT", format))
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(getEnv("LOG_LEVEL", "info"))); err != nil {
+		configProblem("LOG_LEVEL: %v", err)
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	var out io.Writer = os.Stderr
+	file, err := openLogFile()
+	if err != nil {
+		configProblem("LOG_FILE: %v", err)
+	}
+	if file != nil {
+		out = io.MultiWriter(os.Stderr, file)
+	}
+
+	var handler slog.Handler
+	switch format {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	default:
+		if format != "json" {
+			configProblem("LOG_FORMAT: must be json or text")
+		}
+		handler = slog.NewJSONHandler(out, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	// What still goes through the log package is the fatal startup
+	// errors.
+	slog.SetLogLoggerLevel(slog.LevelError)
+}
+
+// contextHandler adds the request ID, session ID and trace ID in the
+// context to each record logged with one.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if l, ok := ctx.Value(requestLogContextKey).(*requestLog); ok {
+		rec.AddAttrs(slog.String("request_id", l.id))
+		l.mu.Lock()
+		if l.sessionID != "" {
+			rec.AddAttrs(slog.String("session_id", l.sessionID))
+		}
+		if l.interactionID != "" {
+			rec.AddAttrs(slog.String("interaction_id", l.interactionID))
+		}
+		l.mu.Unlock()
+	}
+	if id := traceIDFromContext(ctx); id != "" {
+		rec.AddAttrs(slog.String("trace_id", id))
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestIDHeader carries the request ID both ways: a proxy or client may
+// send one, and every response echoes it.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits the IDs accepted from clients to ones safe to log
+// and echo.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestIDMiddleware gives each request an ID, the caller's X-Request-ID
+// when it is valid or a new one, and echoes it in the response headers. The
+// ID appears in the request's log lines and its error payloads.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		l := &requestLog{id: id}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestLogContextKey, l)))
+	})
+}
+
+// requestIDFromContext returns the ID of the request in ctx, or an empty
+// string.
+func requestIDFromContext(ctx context.Context) string {
+	if l, ok := ctx.Value(requestLogContextKey).(*requestLog); ok {
+		return l.id
+	}
+	return ""
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// setLogSession records the session a request belongs to, for the log
+// lines that follow.
+func setLogSession(ctx context.Context, sessionID string) {
+	if l, ok := ctx.Value(requestLogContextKey).(*requestLog); ok {
+		l.mu.Lock()
+		l.sessionID = sessionID
+		l.mu.Unlock()
+	}
+}
+
+// startInteraction gives the answer about to be generated for the request
+// in ctx its interaction ID. The ID is returned to the client and kept with
+// the answer in the transcript, and the log lines and spans that follow
+// carry it, so an answer can be traced back to its prompt and model calls.
+func startInteraction(ctx context.Context) string {
+	id := newID()
+	if l, ok := ctx.Value(requestLogContextKey).(*requestLog); ok {
+		l.mu.Lock()
+		l.interactionID = id
+		l.mu.Unlock()
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("satbot.interaction_id", id))
+	return id
+}
+
+// interactionIDFromContext returns the ID of the interaction started for
+// the request in ctx, or an empty string.
+func interactionIDFromContext(ctx context.Context) string {
+	if l, ok := ctx.Value(requestLogContextKey).(*requestLog); ok {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.interactionID
+	}
+	return ""
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// logSampleCategories are the kinds of routine log lines that can be
+// sampled. Warnings and errors are never sampled, whatever their category.
+var logSampleCategories = map[string]string{
+	"chat":   "the Chat interaction line of each successful answer",
+	"access": "access log lines of successful requests",
+	"health": "access log lines of /health, /health/deep and /status",
+}
+
+var (
+	// logSampleRates holds the share of lines kept per category; categories
+	// not in it are always logged.
+	logSampleRates = map[string]float64{}
+
+	logLinesSampledOut = expvar.NewMap("log_lines_sampled_out")
+)
+
+// loadLogSampling reads LOG_SAMPLE_RATES, comma-separated category=rate
+// pairs such as chat=0.1,health=0.01, where rate is the share of lines
+// kept. Lines that are kept carry sample_rate so counts can be scaled back
+// up.
+func loadLogSampling() {
+	rates, err := parseLogSampleRates(getEnv("LOG_SAMPLE_RATES", ""))
+	if err != nil {
+		configProblem("LOG_SAMPLE_RATES: %v", err)
+		return
+	}
+	logSampleRates = rates
+}
+
+func parseLogSampleRates(s string) (map[string]float64, error) {
+	rates := map[string]float64{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		category, value, ok := strings.Cut(pair, "=")
+		category = strings.ToLower(strings.TrimSpace(category))
+		if !ok {
+			return nil, fmt.Errorf("%q is not category=rate", pair)
+		}
+		if _, known := logSampleCategories[category]; !known {
+			return nil, fmt.Errorf("unknown category %q, want one of %s", category, strings.Join(sortedKeys(logSampleCategories), ", "))
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("rate of %s must be between 0 and 1", category)
+		}
+		rates[category] = rate
+	}
+	return rates, nil
+}
+
+// sampleLog decides whether to write a routine line of category. When the
+// line is kept it returns the attributes to add to it, none when the
+// category is not sampled.
+func sampleLog(category string) (attrs []any, keep bool) {
+	rate, ok := logSampleRates[category]
+	if !ok || rate >= 1 {
+		return nil, true
+	}
+	if rand.Float64() >= rate {
+		logLinesSampledOut.Add(category, 1)
+		return nil, false
+	}
+	return []any{"sample_rate", rate}, true
+}
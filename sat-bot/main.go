@@ -1,124 +1,174 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
-var Context string
-
 type Message struct {
-	Message string `json:"message"`
-}
-
-type ChatCompletion struct {
-	Choices []struct {
-		Message struct {
-			Content string `json:"content"`
-		} `json:"message"`
-	} `json:"choices"`
+	Message   string `json:"message"`
+	SessionID string `json:"session_id,omitempty"`
+	// NewSession starts a fresh conversation instead of resuming the
+	// visitor's most recent one.
+	NewSession bool `json:"new_session,omitempty"`
+	// Model picks an entry of the configured model allowlist.
+	Model string `json:"model,omitempty"`
+	// Namespace answers from one topic of the knowledge base, such as
+	// sponsors, for widgets embedded on that topic's pages.
+	Namespace string `json:"namespace,omitempty"`
+	// Options overrides generation parameters; admin only.
+	Options *GenerationOverrides `json:"options,omitempty"`
+	// Stream returns the answer as server-sent events while it is generated.
+	Stream bool `json:"stream,omitempty"`
+	// ResponseSchema asks for the answer as JSON conforming to this JSON
+	// schema, returned parsed in the data field.
+	ResponseSchema json.RawMessage `json:"response_schema,omitempty"`
 }
 
 type HealthResponse struct {
-	Status    string `json:"status"`
-	Timestamp string `json:"timestamp"`
-	Version   string `json:"version"`
+	Status         string `json:"status"`
+	Timestamp      string `json:"timestamp"`
+	Version        string `json:"version"`
+	ActiveSessions int    `json:"active_sessions"`
 }
 
 type ChatResponse struct {
 	Response     string `json:"response"`
 	ResponseTime string `json:"response_time"`
+	SessionID    string `json:"session_id"`
+	MessageID    string `json:"message_id,omitempty"`
+	// InteractionID identifies this answer in the logs, traces and
+	// transcript, and is what feedback on it refers to.
+	InteractionID string `json:"interaction_id,omitempty"`
+	// Data is the answer as JSON when a response schema was given.
+	Data json.RawMessage `json:"data,omitempty"`
+	// Cost is included when COST_IN_RESPONSE is enabled.
+	Cost *CostEstimate `json:"cost,omitempty"`
+	// Sources cites the documents retrieved to answer, when retrieval is
+	// enabled.
+	Sources []Citation `json:"sources,omitempty"`
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// Code is a stable identifier for failed model calls, see chatError.
+	Code string `json:"code,omitempty"`
+	// RequestID identifies the request in the logs, see requestIDMiddleware.
+	RequestID string `json:"request_id,omitempty"`
 }
 
-func loadEnv() {
-	file, err := os.Open(".env")
-	if err != nil {
-		log.Printf("Could not open .env file: %v", err)
-		return
-	}
-	defer file.Close()
+// systemPrompt renders the system prompt template with knowledge as its
+// context.
+func systemPrompt(knowledge string) string {
+	return systemTemplate.Load().System(knowledge)
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
-			continue
-		}
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
-		if (strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"")) ||
-			(strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'")) {
-			value = value[1 : len(value)-1]
-		}
-		if os.Getenv(key) == "" {
-			os.Setenv(key, value)
+// reloadOnSIGHUP reloads the settings that can change while running, see
+// reloadSettings, and the context documents when the process receives
+// SIGHUP.
+func reloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if _, diff := reloadSettings("SIGHUP"); diff != "" {
+				recordAudit("sighup", "reload", "", diff)
+			}
+			logContextReload("SIGHUP")
 		}
+	}()
+}
+
+// defaultOrigins are allowed when CORS_ALLOWED_ORIGINS is not set.
+var defaultOrigins = []string{
+	"http://localhost:3000",
+	"https://saturnalia.in",
+}
+
+// allowedOrigins are the origins browsers may call the API from. An entry
+// may start with "*." to allow every subdomain, as in *.saturnalia.in or
+// https://*.saturnalia.in, and "*" allows any origin.
+var allowedOrigins atomic.Pointer[[]string]
+
+// loadCORSConfig reads CORS_ALLOWED_ORIGINS, a comma-separated list of
+// allowed origins.
+func loadCORSConfig() {
+	origins := readCORSConfig()
+	allowedOrigins.Store(&origins)
+	slog.Info("Allowing CORS requests", "origins", origins)
+}
+
+func readCORSConfig() []string {
+	list := getEnv("CORS_ALLOWED_ORIGINS", "")
+	if list == "" {
+		return defaultOrigins
 	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading .env file: %v", err)
+	var origins []string
+	for _, origin := range strings.Split(list, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			origins = append(origins, strings.ToLower(origin))
+		}
 	}
+	return origins
 }
 
-func loadContext() {
-	content, err := os.ReadFile("context.txt")
-	if err != nil {
-		log.Printf("Warning: Could not read context.txt: %v", err)
-		Context = "No context available"
-		return
+// originAllowed reports whether origin matches an entry of allowedOrigins.
+// A pattern without a scheme matches any.
+func originAllowed(origin string) bool {
+	if origin == "" {
+		return false
 	}
-
-	Context = strings.TrimSpace(string(content))
-	if Context == "" {
-		Context = "No context available"
+	origin = strings.ToLower(origin)
+	scheme, host, ok := strings.Cut(origin, "://")
+	if !ok {
+		return false
 	}
-
-	log.Println("Context loaded successfully from context.txt")
+	for _, pattern := range *allowedOrigins.Load() {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		patternScheme, patternHost, ok := strings.Cut(pattern, "://")
+		if !ok {
+			patternScheme, patternHost = "", pattern
+		} else if patternScheme != scheme {
+			continue
+		}
+		if suffix, ok := strings.CutPrefix(patternHost, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if patternScheme == "" && patternHost == host {
+			return true
+		}
+	}
+	return false
 }
 
 func corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		origin := r.Header.Get("Origin")
 
-		// List of allowed origins
-		allowedOrigins := []string{
-			"http://localhost:3000",
-			"https://saturnalia.in",
-		}
-
-		// Check if the origin is in the allowed list
-		isAllowed := false
-		for _, allowedOrigin := range allowedOrigins {
-			if origin == allowedOrigin {
-				isAllowed = true
-				break
-			}
-		}
-
 		// Set CORS headers only if the origin is allowed
-		if isAllowed {
+		if originAllowed(origin) {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
 		}
 
 		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Requested-With, X-Admin-Key, X-User-ID, X-User-Token, X-Visitor-Token, X-Admin-Actor, X-API-Key, X-Channel, X-Captcha-Token, X-Signature, X-Signature-Timestamp, X-Request-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Visitor-Token, X-Request-ID")
 		w.Header().Set("Access-Control-Max-Age", "86400")
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 
@@ -136,9 +186,10 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	response := HealthResponse{
-		Status:    "healthy",
-		Timestamp: time.Now().UTC().Format(time.RFC3339),
-		Version:   "1.0.0",
+		Status:         "healthy",
+		Timestamp:      time.Now().UTC().Format(time.RFC3339),
+		Version:        buildInfo.Version,
+		ActiveSessions: sessions.Count(),
 	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
@@ -149,7 +200,7 @@ func chatCompletionHandler(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Method not allowed"})
+		writeErrorBody(w, ErrorResponse{Error: "Method not allowed"})
 		return
 	}
 
@@ -157,155 +208,267 @@ func chatCompletionHandler(w http.ResponseWriter, r *http.Request) {
 	decoder := json.NewDecoder(r.Body)
 	decoder.DisallowUnknownFields()
 	if err := decoder.Decode(&msg); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Invalid request format"})
+		writeDecodeError(w, err)
 		return
 	}
 
 	if strings.TrimSpace(msg.Message) == "" {
 		w.WriteHeader(http.StatusBadRequest)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Message cannot be empty"})
+		writeErrorBody(w, ErrorResponse{Error: "Message cannot be empty"})
 		return
 	}
-
-	apiKey := os.Getenv("GROQ_API_KEY")
-	if apiKey == "" {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "GROQ API key not configured"})
+	if !checkMessageLength(w, msg.Message) {
 		return
 	}
 
-	groqPrompt := fmt.Sprintf("User Query: %s\n\nAnswer:", msg.Message)
-	apiURL := "https://api.groq.com/openai/v1/chat/completions"
-	requestData := map[string]interface{}{
-		"messages": []map[string]interface{}{
-			{
-				"role": "system",
-				"content": fmt.Sprintf(`You are SatBot, the friendly and knowledgeable AI assistant for the Thapar Institute of Engineering and Technology's annual techno cultural fest i.e Saturnalia.Keep responses concise but informative.
-
-- Saturnalia is a celebration of technology, culture, and creativity
--It is golden jubilee year of Saturnalia
-- Keep responses concise but informative
-- Answer questions based on the provided context
-- Keep responses concise but informative
-- If asked about topics outside the context, politely explain that you can only discuss Saturnalia Centre related matters
-- Always maintain a helpful and positive attitude
-- The Saturnalia is happening from 14th to 16th November 2025. 
-- The saturnalia/ SAT is being conducted from 14th to 16th Novemeber 2025. 
-
-`, Context),
-			},
-			{
-				"role":    "user",
-				"content": groqPrompt,
-			},
-		},
-		"model":       "moonshotai/kimi-k2-instruct-0905",
-		"temperature": 0.7,
-		"max_tokens":  500,
-	}
-
-	jsonData, err := json.Marshal(requestData)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to prepare request"})
+	if msg.Options != nil && !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		writeErrorBody(w, ErrorResponse{Error: "Generation options require admin access"})
 		return
 	}
-
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonData))
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to create request"})
+	opts, ok := requestAnswerOptions(w, msg.Model, msg.Namespace, msg.Options)
+	if !ok {
 		return
 	}
 
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", apiKey))
-	req.Header.Set("Content-Type", "application/json")
-
-	startTime := time.Now()
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-	resp, err := client.Do(req)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to call GROQ API"})
-		return
+	if len(msg.ResponseSchema) > 0 {
+		if msg.Stream {
+			w.WriteHeader(http.StatusBadRequest)
+			writeErrorBody(w, ErrorResponse{Error: "response_schema cannot be combined with stream"})
+			return
+		}
+		schema, err := parseResponseSchema(msg.ResponseSchema)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeErrorBody(w, ErrorResponse{Error: err.Error()})
+			return
+		}
+		opts.ResponseSchema = schema
 	}
-	defer resp.Body.Close()
 
-	reader := io.LimitReader(resp.Body, 10*1024*1024)
-	body, err := io.ReadAll(reader)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to read response"})
-		return
+	// Streams push their write deadline out as they go; everything else has
+	// to be done before the server's write timeout.
+	if !msg.Stream {
+		var cancel context.CancelFunc
+		r, cancel = withAnswerDeadline(r)
+		defer cancel()
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("GROQ API error: Status %d, Body: %s", resp.StatusCode, string(body))
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Limit reached for free tier"})
+	sessionID := msg.SessionID
+	if msg.NewSession && sessionID == "" {
+		sessionID = newID()
+	}
+	session := sessions.GetOrCreate(sessionID, visitorIDFromContext(r.Context()))
+	setLogSession(r.Context(), session.ID)
+	if !allowRequest(w, r, sessionLimiter.Get(), "session", session.ID) {
 		return
 	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if userID := userIDFromRequest(r); userID != "" {
+		session.UserID = userID
+	}
 
-	var chatCompletion ChatCompletion
-	if err := json.Unmarshal(body, &chatCompletion); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Failed to parse response"})
+	if msg.Stream {
+		streamAnswer(w, r, session, msg.Message, opts)
 		return
 	}
 
-	if len(chatCompletion.Choices) == 0 {
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(ErrorResponse{Error: "Limit reached for free tier"})
+	answer, responseTime, err := generateAnswer(r, session.Summary, session.History, msg.Message, opts)
+	if err != nil {
+		writeChatError(w, err)
+		storeInteraction(r, session, msg.Message, nil, 0, err)
 		return
 	}
 
-	endTime := time.Now()
-	responseTime := endTime.Sub(startTime)
+	session.AddTurn(msg.Message, answer, time.Now().UTC())
+	maybeGenerateTitle(session)
+	maybeSummarizeSession(session)
 
-	go func() {
-		log.Printf("Chat interaction - Question: %s, Response Time: %.4f seconds", msg.Message, responseTime.Seconds())
-	}()
+	logInteraction(r.Context(), msg.Message, session.UserID, answer, responseTime)
+	storeInteraction(r, session, msg.Message, answer, responseTime, nil)
 
 	response := ChatResponse{
-		Response:     chatCompletion.Choices[0].Message.Content,
-		ResponseTime: fmt.Sprintf("%.4f seconds", responseTime.Seconds()),
+		Response:      answer.Content,
+		ResponseTime:  fmt.Sprintf("%.4f seconds", responseTime.Seconds()),
+		SessionID:     session.ID,
+		MessageID:     session.LastQuestionID(),
+		InteractionID: answer.InteractionID,
+		Data:          answer.Data,
+		Sources:       answer.Sources,
+	}
+	if costInResponse {
+		response.Cost = answer.Cost
 	}
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
 }
 
 func main() {
-	loadEnv()
+	loadConfigFile()
+	loadLogging()
+	loadAccessLogConfig()
+	loadLogSampling()
+	loadSlowRequestConfig()
+	loadSecrets()
+	loadAuditLog()
+	loadTracingConfig()
+	loadSentryConfig()
+	loadCORSConfig()
+	loadContextHistory()
+	loadSources()
 	loadContext()
+	loadPromptConfig()
+	loadHistoryConfig()
+	loadTokenConfig()
+	loadLimitConfig()
+	loadPIIConfig()
+	loadLintConfig()
+	loadPricing()
+	loadUsage()
+	loadGapConfig()
+	loadUnansweredConfig()
+	loadUpstreamLimit()
+	loadAlertConfig()
+	loadStatusConfig()
+	loadProvider()
+	loadChatConfig()
+	loadGenerationConfig()
+	loadModelAllowlist()
+	loadExperiments()
+	loadFAQ()
+	loadInjectionConfig()
+	loadModerationConfig()
+	loadOutputModerationConfig()
+	loadTools()
+	loadStructuredConfig()
+	loadEmbeddings()
+	loadVectorStore()
+	loadChannels()
+	loadInteractionStore()
+	loadFAQSuggestions()
+	loadRetention()
+	loadDigest()
+	loadQuality()
+	loadRetrievalConfig()
+	loadNamespaceConfig()
+	loadCacheConfig()
+	loadMemory()
+	loadSessionConfig()
+	loadVisitorConfig()
+	loadAPIKeys()
+	loadJWTConfig()
+	loadSigningConfig()
+	loadRateLimitConfig()
+	loadIPFilterConfig()
+	loadAbuseConfig()
+	loadCaptchaConfig()
+	loadTLSConfig()
+	loadSecurityHeaders()
+	sessions.StartJanitor(getEnvDuration("SESSION_CLEANUP_INTERVAL", time.Minute))
+	watchContext()
+	watchSources()
+	reloadOnSIGHUP()
+	startDebugServer()
+	validateConfig()
 
 	r := mux.NewRouter()
-
+	// Requests matching no route skip the router's middleware; log them
+	// all the same.
+	r.NotFoundHandler = requestIDMiddleware(accessLogMiddleware(http.NotFoundHandler()))
+	r.MethodNotAllowedHandler = requestIDMiddleware(accessLogMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	})))
+
+	r.Use(requestIDMiddleware)
+	r.Use(tracingMiddleware)
+	r.Use(accessLogMiddleware)
+	r.Use(slowRequestMiddleware)
+	r.Use(metricsMiddleware)
+	r.Use(recoverMiddleware)
+	r.Use(securityHeadersMiddleware)
 	r.Use(corsMiddleware)
+	r.Use(ipFilterMiddleware)
+	r.Use(visitorMiddleware)
+	r.Use(bodyLimitMiddleware)
 
 	r.HandleFunc("/health", healthCheckHandler).Methods("GET", "OPTIONS")
-	r.HandleFunc("/chat", chatCompletionHandler).Methods("POST", "OPTIONS")
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	r.HandleFunc("/health/deep", deepHealthHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/status", statusHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/version", versionHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	r.HandleFunc("/chat", rateLimit(requireAPIKey(requireCaptcha("chat", chatCompletionHandler)))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/v1/models", listModelsHandler).Methods("GET", "OPTIONS")
+	dashboard := dashboardHandler()
+	r.Handle("/admin", dashboard).Methods("GET")
+	r.PathPrefix("/admin/dashboard/").Handler(dashboard).Methods("GET")
+	r.HandleFunc("/admin/usage", requireScope(scopeAnalyticsRead, usageHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/live", requireScope(scopeAnalyticsRead, liveStatsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/analytics", requireScope(scopeAnalyticsRead, analyticsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/analytics/top-questions", requireScope(scopeAnalyticsRead, topQuestionsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/analytics/volume", requireScope(scopeAnalyticsRead, volumeHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/analytics/channels", requireScope(scopeAnalyticsRead, channelsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/analytics/sessions", requireScope(scopeAnalyticsRead, sessionAnalyticsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/analytics/unanswered", requireScope(scopeAnalyticsRead, unansweredHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/interactions", requireScope(scopeAnalyticsRead, searchInteractionsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/interactions/export", requireScope(scopeAnalyticsRead, exportInteractionsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/faq-suggestions", requireScope(scopeAnalyticsRead, faqSuggestionsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/faq-suggestions/refresh", requireAdmin(refreshFAQSuggestionsHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/retention/purge", requireAdmin(retentionPurgeHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/digest", requireAdmin(sendDigestHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/analytics/quality", requireScope(scopeAnalyticsRead, qualityHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/quality/run", requireAdmin(runQualityHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/knowledge-gaps", requireScope(scopeAnalyticsRead, knowledgeGapsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/experiments", requireScope(scopeAnalyticsRead, experimentsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/sources", requireAdmin(sourcesHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/sources/sync", requireAdmin(syncSourcesHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/context-lint", requireAdmin(contextLintHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/context-versions", requireAdmin(versionsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/context-versions/{id}/diff", requireAdmin(versionDiffHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/context-versions/{id}/rollback", requireAdmin(rollbackHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/context", requireAdmin(listDocumentsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/context", requireAdmin(createDocumentHandler)).Methods("POST")
+	r.HandleFunc("/admin/context/{name:.+}", requireAdmin(getDocumentHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/context/{name:.+}", requireAdmin(updateDocumentHandler)).Methods("PUT")
+	r.HandleFunc("/admin/context/{name:.+}", requireAdmin(deleteDocumentHandler)).Methods("DELETE")
+	r.HandleFunc("/admin/ip-lists", requireAdmin(ipListsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/ip-lists/{list}", requireAdmin(addIPListHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/ip-lists/{list}/{cidr:.+}", requireAdmin(deleteIPListHandler)).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/admin/audit", requireAdmin(auditHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/reload", requireAdmin(reloadSettingsHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/bans", requireAdmin(bansHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/bans/{ip}", requireAdmin(liftBanHandler)).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/v1/conversations", listConversationsHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/v1/conversations/{id}/export", exportConversationHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/v1/conversations/{id}/regenerate", rateLimit(requireAPIKey(requireCaptcha("regenerate", regenerateHandler)))).Methods("POST", "OPTIONS")
+	r.HandleFunc("/v1/conversations/{id}/messages/{msgID}", rateLimit(requireAPIKey(requireCaptcha("edit", editMessageHandler)))).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/v1/feedback", feedbackHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/v1/memory", getMemoryHandler).Methods("GET", "OPTIONS")
+	r.HandleFunc("/v1/memory", addMemoryHandler).Methods("POST")
+	r.HandleFunc("/v1/memory/opt-in", memoryOptInHandler).Methods("PUT", "OPTIONS")
+	r.HandleFunc("/v1/memory/{factID}", deleteMemoryHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/v1/users/{id}/data", deleteUserDataHandler).Methods("DELETE", "OPTIONS")
+	r.HandleFunc("/v1/me/data", deleteMyDataHandler).Methods("DELETE", "OPTIONS")
+
+	port := getEnv("PORT", "8080")
+	scheme := "http"
+	if certManager != nil {
+		port, scheme = tlsPort, "https"
 	}
 
 	server := &http.Server{
 		Addr:         ":" + port,
 		Handler:      r,
 		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
+		WriteTimeout: serverWriteTimeout,
 		IdleTimeout:  60 * time.Second,
 	}
 
-	log.Printf("Server starting on port %s", port)
-	log.Printf("Health check endpoint: http://localhost:%s/health", port)
-	log.Printf("Chat completion endpoint: http://localhost:%s/chat", port)
+	warnUnusedSettings()
+	slog.Info("Server starting", "port", port,
+		"health", scheme+"://localhost:"+port+"/health", "chat", scheme+"://localhost:"+port+"/chat")
 
-	if err := server.ListenAndServe(); err != nil {
+	if err := serve(server); err != nil {
 		log.Fatal("Server failed to start:", err)
 	}
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/hmac"
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds the metrics metricsHandler serves.
+var metricsRegistry = prometheus.NewRegistry()
+
+var metricsFactory = promauto.With(metricsRegistry)
+
+// httpBuckets and upstreamBuckets are in seconds; answers take long, so
+// they reach further than the usual web defaults.
+var (
+	httpBuckets     = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60}
+	upstreamBuckets = []float64{0.1, 0.25, 0.5, 1, 2, 3, 5, 8, 13, 20, 30, 60}
+)
+
+var (
+	httpRequests = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "satbot_http_requests_total",
+		Help: "HTTP requests served, by route, method and status.",
+	}, []string{"route", "method", "status"})
+	httpDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "satbot_http_request_duration_seconds",
+		Help:    "Time to serve HTTP requests, by route.",
+		Buckets: httpBuckets,
+	}, []string{"route"})
+	upstreamRequests = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "satbot_upstream_requests_total",
+		Help: "Model provider calls, by provider, model and outcome, ok or the error code.",
+	}, []string{"provider", "model", "outcome"})
+	upstreamDuration = metricsFactory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "satbot_upstream_request_duration_seconds",
+		Help:    "Time model provider calls took, by provider and model.",
+		Buckets: upstreamBuckets,
+	}, []string{"provider", "model"})
+	fallbackAnswers = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "satbot_fallback_answers_total",
+		Help: "Answers served by a later entry of the fallback chain, by provider and model.",
+	}, []string{"provider", "model"})
+	chatErrors = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "satbot_chat_errors_total",
+		Help: "Failed answers, by error code.",
+	}, []string{"code"})
+	feedbackRatings = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "satbot_feedback_total",
+		Help: "Ratings of answers by visitors, by rating, up or down.",
+	}, []string{"rating"})
+	interactionsDropped = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "satbot_interactions_dropped_total",
+		Help: "Interactions not stored, by reason, queue_full or store_error.",
+	}, []string{"reason"})
+	tokensUsed = metricsFactory.NewCounterVec(prometheus.CounterOpts{
+		Name: "satbot_tokens_total",
+		Help: "Tokens used by model calls, by provider, model and type, prompt or completion.",
+	}, []string{"provider", "model", "type"})
+)
+
+// The cache counters are kept by the caches and read at scrape time.
+func init() {
+	caches := map[string]struct{ hits, misses *expvar.Int }{
+		"response": {&responses.hits, &responses.misses},
+		"semantic": {&semantic.hits, &semantic.misses},
+	}
+	for name, c := range caches {
+		metricsFactory.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "satbot_cache_hits_total",
+			Help:        "Answers served from a cache, by cache.",
+			ConstLabels: prometheus.Labels{"cache": name},
+		}, func() float64 { return float64(c.hits.Value()) })
+		metricsFactory.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "satbot_cache_misses_total",
+			Help:        "Questions not found in a cache, by cache.",
+			ConstLabels: prometheus.Labels{"cache": name},
+		}, func() float64 { return float64(c.misses.Value()) })
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var metricsExporter = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+// metricsHandler serves the metrics in the Prometheus exposition format.
+// When METRICS_TOKEN is set, scrapers must send it as a bearer token.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if token := getEnv("METRICS_TOKEN", ""); token != "" {
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !hmac.Equal([]byte(strings.TrimSpace(given)), []byte(token)) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	metricsExporter.ServeHTTP(w, r)
+}
+
+// statusRecorder remembers the status and size of a response. It unwraps
+// to the original writer, so streaming handlers can still flush through
+// http.ResponseController.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// routeName returns the route template r matched, such as
+// /v1/conversations/{id}/export, so that metrics are not split per ID.
+func routeName(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tmpl, err := route.GetPathTemplate(); err == nil {
+			return tmpl
+		}
+	}
+	return "unmatched"
+}
+
+// metricsMiddleware counts requests and times them by route.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := routeName(r)
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(rec.status)).Inc()
+		httpDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// observeUpstream records a call to name's model that started at start.
+func observeUpstream(name, model string, start time.Time, resp *CompletionResponse, err error) {
+	upstreamDuration.WithLabelValues(name, model).Observe(time.Since(start).Seconds())
+	recordUpstreamCall(name, time.Since(start), err)
+	if err != nil {
+		_, code, _ := classifyError(err)
+		upstreamRequests.WithLabelValues(name, model, code).Inc()
+		return
+	}
+	upstreamRequests.WithLabelValues(name, model, "ok").Inc()
+	tokensUsed.WithLabelValues(resp.Provider, resp.Model, "prompt").Add(float64(resp.Usage.PromptTokens))
+	tokensUsed.WithLabelValues(resp.Provider, resp.Model, "completion").Add(float64(resp.Usage.CompletionTokens))
+}
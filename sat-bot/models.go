@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// modelChoice is a model clients may pick per request, bound to the
+// provider that serves it.
+type modelChoice struct {
+	provider Provider
+	model    string
+}
+
+var (
+	// allowedModels maps the names clients may send in the model field to
+	// the provider and model that serve them.
+	allowedModels = map[string]modelChoice{}
+	// allowedModelNames keeps the configured order for listing.
+	allowedModelNames []string
+)
+
+// loadModelAllowlist reads MODEL_ALLOWLIST, a comma-separated list of
+// [provider:]model entries. Entries without a provider use LLM_PROVIDER.
+// Models picked this way are called directly, without the fallback chain, so
+// answers can be compared model against model.
+func loadModelAllowlist() {
+	defaultProvider := strings.ToLower(getEnv("LLM_PROVIDER", "groq"))
+
+	for _, entry := range strings.Split(getEnv("MODEL_ALLOWLIST", ""), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, model, ok := strings.Cut(entry, ":")
+		if !ok {
+			name, model = defaultProvider, entry
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		p, err := newProvider(name)
+		if err != nil {
+			configProblem("MODEL_ALLOWLIST: entry %q: %v", entry, err)
+			continue
+		}
+
+		allowedModels[entry] = modelChoice{provider: p, model: strings.TrimSpace(model)}
+		allowedModelNames = append(allowedModelNames, entry)
+	}
+
+	if len(allowedModelNames) > 0 {
+		slog.Info("Per-request models allowed", "models", allowedModelNames)
+	}
+}
+
+func listModelsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default": provider.Name(),
+		"models":  append([]string{}, allowedModelNames...),
+	})
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// moderationTimeout bounds a call to the moderation API. When it fails the
+// message is let through on the keyword check alone.
+const moderationTimeout = 5 * time.Second
+
+// contentFilter flags text containing a blocked term, or judged harmful by
+// a moderation API.
+type contentFilter struct {
+	// terms are the blocked words and phrases, each split into words.
+	terms [][]string
+	api   *moderationAPI
+}
+
+// moderationAPI is an OpenAI-compatible moderation endpoint.
+type moderationAPI struct {
+	url    string
+	key    string
+	model  string
+	client *http.Client
+}
+
+// Actions on a flagged answer, from OUTPUT_MODERATION_ACTION.
+const (
+	outputBlock      = "block"
+	outputRedact     = "redact"
+	outputRegenerate = "regenerate"
+)
+
+// outputRetryNote is added to the prompt when a flagged answer is
+// regenerated.
+const outputRetryNote = "Your previous reply was withheld because it contained inappropriate language. " +
+	"Answer again politely, without profanity or offensive content."
+
+var (
+	inputFilter       *contentFilter
+	moderationMessage = "I'd rather keep things friendly. Ask me anything about the fest!"
+
+	outputFilter     *contentFilter
+	outputAction     = outputBlock
+	outputModeration = "Sorry, I can't share that answer. Please ask me something else about the fest!"
+
+	moderationFlags = expvar.NewMap("moderation_flags")
+)
+
+// loadModerationConfig reads the filter that incoming messages must pass
+// before they are answered: MODERATION_BLOCKLIST, comma-separated words and
+// phrases, and MODERATION_BLOCKLIST_FILE (moderation-blocklist.txt by
+// default), one per line. MODERATION_API_URL, such as
+// https://api.openai.com/v1/moderations, adds a check by that API with
+// MODERATION_API_KEY and MODERATION_MODEL. Flagged messages are answered with
+// MODERATION_MESSAGE.
+func loadModerationConfig() {
+	moderationMessage = getEnv("MODERATION_MESSAGE", moderationMessage)
+	filter := &contentFilter{}
+	if err := filter.addTerms(getEnv("MODERATION_BLOCKLIST", ""), getEnv("MODERATION_BLOCKLIST_FILE", "moderation-blocklist.txt")); err != nil {
+		configProblem("MODERATION_BLOCKLIST_FILE: %v", err)
+	}
+	if url := getEnv("MODERATION_API_URL", ""); url != "" {
+		filter.api = &moderationAPI{
+			url:    url,
+			key:    getEnv("MODERATION_API_KEY", ""),
+			model:  getEnv("MODERATION_MODEL", "omni-moderation-latest"),
+			client: &http.Client{Timeout: moderationTimeout},
+		}
+	}
+	if len(filter.terms) == 0 && filter.api == nil {
+		return
+	}
+	inputFilter = filter
+	slog.Info("Moderating incoming messages", "blocked_terms", len(filter.terms), "api", filter.apiURL())
+}
+
+// loadOutputModerationConfig reads the filter answers pass before they are
+// returned: OUTPUT_MODERATION_BLOCKLIST and OUTPUT_MODERATION_BLOCKLIST_FILE
+// (output-blocklist.txt by default) list blocked terms as for incoming
+// messages, and OUTPUT_MODERATION_API=true also checks answers with the
+// moderation API. OUTPUT_MODERATION_ACTION is what happens to a flagged
+// answer: block (the default) replaces it with OUTPUT_MODERATION_MESSAGE,
+// redact masks the blocked terms and regenerate asks the model once more,
+// blocking the second answer if it is flagged too.
+func loadOutputModerationConfig() {
+	outputModeration = getEnv("OUTPUT_MODERATION_MESSAGE", outputModeration)
+	switch action := strings.ToLower(getEnv("OUTPUT_MODERATION_ACTION", outputBlock)); action {
+	case outputBlock, outputRedact, outputRegenerate:
+		outputAction = action
+	default:
+		configProblem("OUTPUT_MODERATION_ACTION: unknown action %q", action)
+	}
+
+	filter := &contentFilter{}
+	if err := filter.addTerms(getEnv("OUTPUT_MODERATION_BLOCKLIST", ""), getEnv("OUTPUT_MODERATION_BLOCKLIST_FILE", "output-blocklist.txt")); err != nil {
+		configProblem("OUTPUT_MODERATION_BLOCKLIST_FILE: %v", err)
+	}
+	if getEnv("OUTPUT_MODERATION_API", "false") == "true" {
+		if inputFilter == nil || inputFilter.api == nil {
+			configProblem("OUTPUT_MODERATION_API: needs MODERATION_API_URL")
+		} else {
+			filter.api = inputFilter.api
+		}
+	}
+	if len(filter.terms) == 0 && filter.api == nil {
+		return
+	}
+	outputFilter = filter
+	slog.Info("Moderating answers", "blocked_terms", len(filter.terms), "api", filter.apiURL(), "action", outputAction)
+}
+
+func (f *contentFilter) apiURL() string {
+	if f.api == nil {
+		return ""
+	}
+	return f.api.url
+}
+
+// addTerms adds the comma-separated terms in list and the lines of the file
+// at path, which may be missing. Lines starting with # are comments.
+func (f *contentFilter) addTerms(list, path string) error {
+	add := func(term string) {
+		if words := faqWords(term); len(words) > 0 {
+			f.terms = append(f.terms, words)
+		}
+	}
+	for _, term := range strings.Split(list, ",") {
+		add(term)
+	}
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			add(line)
+		}
+	}
+	return scanner.Err()
+}
+
+// blockedTerm returns the first blocked term in text, matched on whole
+// words regardless of case and punctuation.
+func (f *contentFilter) blockedTerm(text string) string {
+	padded := " " + strings.Join(faqWords(text), " ") + " "
+	for _, term := range f.terms {
+		if phrase := strings.Join(term, " "); strings.Contains(padded, " "+phrase+" ") {
+			return phrase
+		}
+	}
+	return ""
+}
+
+// redact masks the blocked terms in text and reports whether any were
+// found. Matching is on words, like blockedTerm, so the rest of the text is
+// kept as written.
+func (f *contentFilter) redact(text string) (string, bool) {
+	words := wordSpans(text)
+	lower := make([]string, len(words))
+	for i, w := range words {
+		lower[i] = strings.ToLower(text[w[0]:w[1]])
+	}
+	masked := make([]bool, len(words))
+	found := false
+	for _, term := range f.terms {
+		for i := 0; i+len(term) <= len(words); i++ {
+			if equalWords(lower[i:i+len(term)], term) {
+				for j := i; j < i+len(term); j++ {
+					masked[j] = true
+				}
+				found = true
+			}
+		}
+	}
+	if !found {
+		return text, false
+	}
+	var b strings.Builder
+	last := 0
+	for i, w := range words {
+		if masked[i] {
+			b.WriteString(text[last:w[0]])
+			b.WriteString(strings.Repeat("*", utf8.RuneCountInString(text[w[0]:w[1]])))
+			last = w[1]
+		}
+	}
+	b.WriteString(text[last:])
+	return b.String(), true
+}
+
+// wordSpans returns the byte offsets of the words of text, split like
+// faqWords except that apostrophes end a word.
+func wordSpans(text string) [][2]int {
+	var spans [][2]int
+	start := -1
+	for i, r := range text {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r)
+		switch {
+		case inWord && start < 0:
+			start = i
+		case !inWord && start >= 0:
+			spans = append(spans, [2]int{start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		spans = append(spans, [2]int{start, len(text)})
+	}
+	return spans
+}
+
+func equalWords(a, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// check returns why text was flagged, or an empty string if it passed.
+func (f *contentFilter) check(ctx context.Context, text string) string {
+	if term := f.blockedTerm(text); term != "" {
+		moderationFlags.Add("blocklist", 1)
+		return "blocked term " + term
+	}
+	if f.api == nil {
+		return ""
+	}
+	categories, err := f.api.classify(ctx, text)
+	if err != nil {
+		slog.ErrorContext(ctx, "Moderation API failed, allowing the message", "err", err)
+		return ""
+	}
+	for _, c := range categories {
+		moderationFlags.Add(c, 1)
+	}
+	if len(categories) == 0 {
+		return ""
+	}
+	return "flagged as " + strings.Join(categories, ", ")
+}
+
+// classify returns the categories text was flagged for.
+func (a *moderationAPI) classify(ctx context.Context, text string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, moderationTimeout)
+	defer cancel()
+
+	headers := map[string]string{}
+	if a.key != "" {
+		headers["Authorization"] = "Bearer " + a.key
+	}
+	resp, err := postJSON(ctx, a.client, "moderation", a.url, headers, map[string]string{"model": a.model, "input": text})
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Results []struct {
+			Flagged    bool            `json:"flagged"`
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	if err := readJSON(resp, &result); err != nil {
+		return nil, err
+	}
+	if len(result.Results) == 0 {
+		return nil, fmt.Errorf("no moderation result")
+	}
+	var categories []string
+	for _, r := range result.Results {
+		if !r.Flagged {
+			continue
+		}
+		for name, flagged := range r.Categories {
+			if flagged && !containsFold(categories, name) {
+				categories = append(categories, name)
+			}
+		}
+		if len(categories) == 0 {
+			categories = append(categories, "flagged")
+		}
+	}
+	sort.Strings(categories)
+	return categories, nil
+}
+
+// moderateAnswer applies the output filter to answer. regenerate asks the
+// model again; it is nil when the answer has been streamed and can no
+// longer be replaced by another.
+func moderateAnswer(ctx context.Context, question string, answer *CompletionResponse, regenerate func() (*CompletionResponse, error)) *CompletionResponse {
+	if outputFilter == nil {
+		return answer
+	}
+	reason := outputFilter.check(ctx, answer.Content)
+	if reason == "" {
+		return answer
+	}
+	slog.WarnContext(ctx, "Moderated answer", "question", redactPII(question), "reason", reason, "action", outputAction)
+
+	switch outputAction {
+	case outputRedact:
+		// Flags by the API cannot be redacted, so the redacted answer has to
+		// pass the check again.
+		if redacted, ok := outputFilter.redact(answer.Content); ok && outputFilter.check(ctx, redacted) == "" {
+			answer.Content = redacted
+			answer.Data = nil
+			return answer
+		}
+	case outputRegenerate:
+		if regenerate != nil {
+			retry, err := regenerate()
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to regenerate moderated answer", "err", err)
+			} else if reason := outputFilter.check(ctx, retry.Content); reason == "" {
+				retry.Usage.PromptTokens += answer.Usage.PromptTokens
+				retry.Usage.CompletionTokens += answer.Usage.CompletionTokens
+				retry.Usage.TotalTokens += answer.Usage.TotalTokens
+				return retry
+			} else {
+				slog.WarnContext(ctx, "Regenerated answer was moderated too", "question", redactPII(question), "reason", reason)
+			}
+		}
+	}
+	answer.Content = outputModeration
+	answer.Data = nil
+	return answer
+}
+
+// moderateQuestion reports whether question may be answered, logging the
+// messages that may not.
+func moderateQuestion(r *http.Request, question string) bool {
+	if inputFilter == nil {
+		return true
+	}
+	reason := inputFilter.check(r.Context(), question)
+	if reason == "" {
+		return true
+	}
+	slog.WarnContext(r.Context(), "Refused message", "ip", clientIP(r), "visitor", visitorIDFromContext(r.Context()),
+		"reason", reason, "question", redactPII(question))
+	reportAbuse(r, abuseModeration)
+	return false
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Namespace classifiers, which route a question to a namespace when the
+// request does not name one.
+const (
+	classifierOff      = "off"
+	classifierKeywords = "keywords"
+	classifierModel    = "model"
+)
+
+const namespacePrompt = `Which topic does this question to SatBot, the Saturnalia fest assistant, belong to?
+Reply with the topic name only, or "none" if it fits none or several of them.
+
+Topics:
+%s`
+
+const (
+	namespaceClassifyTimeout = 3 * time.Second
+	// namespaceMargin is how far the best namespace's keyword score has to
+	// be ahead of the next one to route a question there; closer calls use
+	// every namespace.
+	namespaceMargin = 1.5
+)
+
+var (
+	namespaceClassifier = classifierOff
+
+	// namespaceRoutes counts the questions the classifier routed to each
+	// namespace, and to none.
+	namespaceRoutes = expvar.NewMap("namespace_routes")
+)
+
+// loadNamespaceConfig reads NAMESPACE_CLASSIFIER: off (the default) uses a
+// namespace only when a request names one, keywords picks the namespace
+// whose documents share the most rare words with the question, and model
+// asks the model.
+func loadNamespaceConfig() {
+	namespaceClassifier = strings.ToLower(getEnv("NAMESPACE_CLASSIFIER", namespaceClassifier))
+	switch namespaceClassifier {
+	case classifierOff, classifierKeywords, classifierModel:
+	default:
+		configProblem("NAMESPACE_CLASSIFIER: unknown classifier %q", namespaceClassifier)
+		namespaceClassifier = classifierOff
+	}
+	if kb := currentKnowledge(); len(kb.Namespaces) > 0 {
+		slog.Info("Context namespaces", "namespaces", kb.Namespaces, "classifier", namespaceClassifier)
+	}
+}
+
+// namespaceOf returns the namespace of a context file, which is its
+// top-level directory: context/sponsors/tiers.md is in sponsors. Files
+// directly in the context directory are shared.
+func namespaceOf(name string) string {
+	dir, _, ok := strings.Cut(name, "/")
+	if !ok || !validNamespace(dir) {
+		return ""
+	}
+	return dir
+}
+
+// validNamespace reports whether ns is made of lowercase letters, digits,
+// "-" and "_".
+func validNamespace(ns string) bool {
+	if ns == "" {
+		return false
+	}
+	for _, r := range ns {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// indexNamespaces fills in the namespaces of kb, the context text scoped to
+// each of them and the keyword index used to classify questions.
+func indexNamespaces(kb *KnowledgeBase) {
+	byNamespace := map[string][]Document{}
+	for _, doc := range kb.Documents {
+		if doc.Namespace != "" {
+			byNamespace[doc.Namespace] = append(byNamespace[doc.Namespace], doc)
+		}
+	}
+	if len(byNamespace) == 0 {
+		return
+	}
+
+	kb.namespaceText = map[string]string{}
+	for ns := range byNamespace {
+		kb.Namespaces = append(kb.Namespaces, ns)
+		var scoped []Document
+		for _, doc := range kb.Documents {
+			if doc.Namespace == ns || doc.Namespace == "" {
+				scoped = append(scoped, doc)
+			}
+		}
+		kb.namespaceText[ns] = renderContext(scoped)
+	}
+	sort.Strings(kb.Namespaces)
+
+	// Each namespace is scored as one document named after it.
+	profiles := make([]Chunk, len(kb.Namespaces))
+	for i, ns := range kb.Namespaces {
+		var text strings.Builder
+		for _, doc := range byNamespace[ns] {
+			text.WriteString(doc.Name + "\n" + doc.Content + "\n")
+		}
+		profiles[i] = Chunk{Section: ns, Text: text.String()}
+	}
+	kb.namespaceIndex = newBM25Index(profiles)
+}
+
+// hasNamespace reports whether ns is one of the namespaces of kb.
+func (kb *KnowledgeBase) hasNamespace(ns string) bool {
+	_, ok := kb.namespaceText[ns]
+	return ok
+}
+
+// scopedText returns the context text for namespace ns, which is all of it
+// when ns is empty.
+func (kb *KnowledgeBase) scopedText(ns string) string {
+	if text, ok := kb.namespaceText[ns]; ok {
+		return text
+	}
+	return kb.Text
+}
+
+// classifyNamespace returns the namespace question should be answered
+// from, or "" to use the whole knowledge base. With fewer than two
+// namespaces there is nothing to choose between.
+func classifyNamespace(ctx context.Context, kb *KnowledgeBase, question string) string {
+	if namespaceClassifier == classifierOff || len(kb.Namespaces) < 2 {
+		return ""
+	}
+
+	var ns string
+	switch namespaceClassifier {
+	case classifierKeywords:
+		ns = kb.keywordNamespace(question)
+	case classifierModel:
+		ns = modelNamespace(ctx, kb, question)
+	}
+	if ns == "" {
+		namespaceRoutes.Add("none", 1)
+	} else {
+		namespaceRoutes.Add(ns, 1)
+	}
+	return ns
+}
+
+func (kb *KnowledgeBase) keywordNamespace(question string) string {
+	scores := kb.namespaceIndex.scores(question)
+	order := rank(scores, true)
+	switch {
+	case len(order) == 0:
+		return ""
+	case len(order) > 1 && scores[order[0]] < namespaceMargin*scores[order[1]]:
+		return ""
+	}
+	return kb.Namespaces[order[0]]
+}
+
+// modelNamespace asks the model to pick a namespace, describing each one by
+// its document names. Failures use the whole knowledge base.
+func modelNamespace(ctx context.Context, kb *KnowledgeBase, question string) string {
+	var topics strings.Builder
+	for _, ns := range kb.Namespaces {
+		var names []string
+		for _, doc := range kb.Documents {
+			if doc.Namespace == ns {
+				names = append(names, doc.Name)
+			}
+		}
+		fmt.Fprintf(&topics, "- %s: %s\n", ns, strings.Join(names, ", "))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, namespaceClassifyTimeout)
+	defer cancel()
+	reply, err := callModel(ctx, []ChatMessage{
+		{Role: "system", Content: fmt.Sprintf(namespacePrompt, topics.String())},
+		{Role: "user", Content: question},
+	}, 0, 10)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to classify question into a namespace", "err", err)
+		return ""
+	}
+	ns := strings.ToLower(strings.Trim(strings.TrimSpace(reply), "\"'`*. "))
+	if !kb.hasNamespace(ns) {
+		return ""
+	}
+	return ns
+}
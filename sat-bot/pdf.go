@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// The brochures, rulebooks and sponsor decks the content team receives are
+// read with github.com/ledongthuc/pdf. Scanned pages without a text layer
+// have no text to extract.
+
+var (
+	errPDFEncrypted = errors.New("encrypted PDFs are not supported")
+	errPDFNoText    = errors.New("no extractable text in PDF")
+)
+
+// pdfToText returns the text of a PDF, one paragraph per text line and a
+// blank line between pages.
+func pdfToText(data []byte) (text string, err error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, "\x00\t\r\n "), []byte("%PDF")) {
+		return "", errors.New("not a PDF file")
+	}
+	// The reader panics on some malformed files, and uploads are not to be
+	// trusted.
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", fmt.Errorf("invalid PDF: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if errors.Is(err, pdf.ErrInvalidPassword) {
+		return "", errPDFEncrypted
+	}
+	if err != nil {
+		return "", fmt.Errorf("invalid PDF: %v", err)
+	}
+
+	var pages []string
+	for i := 1; i <= reader.NumPage(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			// The page count is the file's word for it; stop at the last
+			// page there is.
+			break
+		}
+		if text := pageText(page.Content().Text); text != "" {
+			pages = append(pages, text)
+		}
+	}
+	if len(pages) == 0 {
+		return "", errPDFNoText
+	}
+	return strings.Join(pages, "\n\n"), nil
+}
+
+// pageText lays out the glyphs of a page in the order they are drawn,
+// starting a line where the baseline moves and putting a space where the
+// glyphs leave a gap.
+func pageText(glyphs []pdf.Text) string {
+	var b strings.Builder
+	for i, g := range glyphs {
+		if i > 0 {
+			prev := glyphs[i-1]
+			size := math.Max(prev.FontSize, 1)
+			switch {
+			case math.Abs(g.Y-prev.Y) > size/2:
+				b.WriteByte('\n')
+			case g.X-(prev.X+prev.W) > size*0.15:
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(g.S)
+	}
+	return cleanExtractedText(b.String())
+}
+
+// cleanExtractedText trims each line and drops empty ones.
+func cleanExtractedText(s string) string {
+	var lines []string
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.Join(strings.Fields(line), " "); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"expvar"
+	"regexp"
+)
+
+// defaultRollNumberPattern matches roll numbers such as 21BCE1234 and
+// 19CS10045: a two-digit year, a branch code and a serial number.
+const defaultRollNumberPattern = `(?i)\b\d{2}[a-z]{2,4}\d{3,5}\b`
+
+var (
+	emailPattern = regexp.MustCompile(`(?i)\b[a-z0-9._%+-]+@[a-z0-9.-]+\.[a-z]{2,}\b`)
+	// phoneCandidate finds runs of digits and separators; phoneNumber keeps
+	// the ones with as many digits as a phone number, so dates and prices
+	// are left alone.
+	phoneCandidate   = regexp.MustCompile(`\+?\(?\d[\d\s().-]{7,18}\d`)
+	rollNumberRegexp *regexp.Regexp
+
+	// redactPIIEnabled is false when PII_REDACTION is off.
+	redactPIIEnabled = true
+
+	piiRedactions = expvar.NewMap("pii_redactions")
+)
+
+// loadPIIConfig reads PII_REDACTION (true by default), which masks email
+// addresses, phone numbers and roll numbers in questions before they are
+// logged or stored, and PII_ROLL_NUMBER_PATTERN, the regular expression
+// matching the institute's roll numbers (empty turns that part off).
+func loadPIIConfig() {
+	redactPIIEnabled = getEnv("PII_REDACTION", "true") == "true"
+	rollNumberRegexp = nil
+	if pattern := getEnv("PII_ROLL_NUMBER_PATTERN", defaultRollNumberPattern); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			configProblem("PII_ROLL_NUMBER_PATTERN: %v", err)
+			re = regexp.MustCompile(defaultRollNumberPattern)
+		}
+		rollNumberRegexp = re
+	}
+}
+
+// redactPII masks the personal details in s for logs and stored records.
+// The model itself still sees the question as asked.
+func redactPII(s string) string {
+	if !redactPIIEnabled {
+		return s
+	}
+	s = emailPattern.ReplaceAllStringFunc(s, func(string) string {
+		piiRedactions.Add("email", 1)
+		return "[email]"
+	})
+	s = phoneCandidate.ReplaceAllStringFunc(s, func(m string) string {
+		digits := 0
+		for _, r := range m {
+			if r >= '0' && r <= '9' {
+				digits++
+			}
+		}
+		if digits < 10 || digits > 13 {
+			return m
+		}
+		piiRedactions.Add("phone", 1)
+		return "[phone]"
+	})
+	if rollNumberRegexp != nil {
+		s = rollNumberRegexp.ReplaceAllStringFunc(s, func(string) string {
+			piiRedactions.Add("roll_number", 1)
+			return "[roll number]"
+		})
+	}
+	return s
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRedactPII(t *testing.T) {
+	enabled, roll := redactPIIEnabled, rollNumberRegexp
+	t.Cleanup(func() { redactPIIEnabled, rollNumberRegexp = enabled, roll })
+	redactPIIEnabled, rollNumberRegexp = true, regexp.MustCompile(defaultRollNumberPattern)
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"email", "Mail me at Riya.S+fest@iitk.ac.in please", "Mail me at [email] please"},
+		{"phone with country code", "Call +91 98765 43210 tonight", "Call [phone] tonight"},
+		{"phone with dashes", "my number is 987-654-3210", "my number is [phone]"},
+		{"roll number", "I am 21BCE1234, can I enter?", "I am [roll number], can I enter?"},
+		{"lower case roll number", "roll no 19cs10045", "roll no [roll number]"},
+		{"date left alone", "Is the event on 14-11-2025?", "Is the event on 14-11-2025?"},
+		{"price left alone", "Tickets cost 1500 or 2500 rupees", "Tickets cost 1500 or 2500 rupees"},
+		{"too many digits", "order 12345678901234567", "order 12345678901234567"},
+		{"several", "a@b.co and 9876543210", "[email] and [phone]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactPII(tt.text); got != tt.want {
+				t.Errorf("redactPII(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactPIIDisabled(t *testing.T) {
+	enabled := redactPIIEnabled
+	t.Cleanup(func() { redactPIIEnabled = enabled })
+	redactPIIEnabled = false
+
+	const text = "Mail a@b.co or call 9876543210"
+	if got := redactPII(text); got != text {
+		t.Errorf("redactPII with PII_REDACTION off = %q, want it unchanged", got)
+	}
+}
+
+func TestRedactPIIWithoutRollNumbers(t *testing.T) {
+	enabled, roll := redactPIIEnabled, rollNumberRegexp
+	t.Cleanup(func() { redactPIIEnabled, rollNumberRegexp = enabled, roll })
+	redactPIIEnabled, rollNumberRegexp = true, nil
+
+	if got := redactPII("I am 21BCE1234"); got != "I am 21BCE1234" {
+		t.Errorf("redactPII without a roll number pattern = %q", got)
+	}
+}
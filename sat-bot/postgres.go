@@ -0,0 +1,38 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// pgMaxIdle is how many connections each pool keeps open between
+// statements.
+const pgMaxIdle = 4
+
+// openPostgres opens a pool of connections to the database at a
+// postgres:// URL, through pgx. Connections are made on first use. sslmode
+// may be any libpq accepts and is verify-full unless the URL or PGSSLMODE
+// says otherwise; as in libpq, prefer and require encrypt without checking
+// the server's certificate.
+func openPostgres(rawURL string) (*sql.DB, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") || u.Host == "" {
+		return nil, fmt.Errorf("not a postgres:// URL")
+	}
+	if query := u.Query(); query.Get("sslmode") == "" && os.Getenv("PGSSLMODE") == "" {
+		query.Set("sslmode", "verify-full")
+		u.RawQuery = query.Encode()
+	}
+	config, err := pgx.ParseConfig(u.String())
+	if err != nil {
+		return nil, err
+	}
+	db := stdlib.OpenDB(*config)
+	db.SetMaxIdleConns(pgMaxIdle)
+	return db, nil
+}
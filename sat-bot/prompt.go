@@ -0,0 +1,146 @@
+package main
+
+import (
+	_ "embed"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// defaultSystemTemplate is used when no system.tmpl is found in the prompt
+// directory.
+//
+//go:embed prompts/system.tmpl
+var defaultSystemTemplate string
+
+// PromptData holds the variables available to prompt templates.
+type PromptData struct {
+	FestName  string
+	Institute string
+	Edition   string
+	Dates     string
+	// Context is the knowledge injected into the prompt.
+	Context string
+}
+
+// promptTemplate is a template file that is parsed again whenever it changes
+// on disk, so the bot's persona can be edited without a rebuild or restart.
+// If the file is missing the built-in fallback is used, and if an edit is
+// broken the previous version stays in use.
+type promptTemplate struct {
+	path     string
+	fallback string
+
+	mu      sync.Mutex
+	tmpl    *template.Template
+	modTime time.Time
+}
+
+var (
+	promptVars     atomic.Pointer[PromptData]
+	systemTemplate atomic.Pointer[promptTemplate]
+)
+
+// currentPromptVars returns the prompt variables, without a context.
+func currentPromptVars() PromptData {
+	return *promptVars.Load()
+}
+
+// loadPromptConfig reads the prompt variables and PROMPT_DIR, the directory
+// holding the template files.
+func loadPromptConfig() {
+	vars, dir := readPromptConfig()
+	setPromptConfig(vars, dir)
+}
+
+func readPromptConfig() (PromptData, string) {
+	vars := PromptData{
+		FestName:  getEnv("FEST_NAME", "Saturnalia"),
+		Institute: getEnv("FEST_INSTITUTE", "the Thapar Institute of Engineering and Technology"),
+		Edition:   getEnv("FEST_EDITION", "golden jubilee"),
+		Dates:     getEnv("FEST_DATES", "14th to 16th November 2025"),
+	}
+	return vars, getEnv("PROMPT_DIR", "prompts")
+}
+
+// setPromptConfig puts vars in use, and the system template in dir, which
+// is read again so that it is checked against the new variables.
+func setPromptConfig(vars PromptData, dir string) {
+	promptVars.Store(&vars)
+	path := filepath.Join(dir, "system.tmpl")
+	if t := systemTemplate.Load(); t != nil && t.path == path {
+		t.mu.Lock()
+		t.modTime = time.Time{}
+		t.reload()
+		t.mu.Unlock()
+		return
+	}
+	systemTemplate.Store(newPromptTemplate(path, defaultSystemTemplate))
+}
+
+func newPromptTemplate(path, fallback string) *promptTemplate {
+	t := &promptTemplate{path: path, fallback: fallback}
+	t.tmpl = template.Must(template.New(filepath.Base(path)).Parse(fallback))
+	if _, err := os.Stat(path); err != nil {
+		slog.Info("Prompt template not found, using built-in default", "path", path)
+	}
+	t.reload()
+	return t
+}
+
+// reload parses the template file again if it changed since it was last read.
+func (t *promptTemplate) reload() {
+	info, err := os.Stat(t.path)
+	if err != nil || info.ModTime().Equal(t.modTime) {
+		return
+	}
+	t.modTime = info.ModTime()
+
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		slog.Error("Failed to read prompt template", "path", t.path, "err", err)
+		return
+	}
+	tmpl, err := template.New(filepath.Base(t.path)).Parse(string(data))
+	if err == nil {
+		// Catch references to unknown variables now rather than on every
+		// request.
+		err = tmpl.Execute(io.Discard, currentPromptVars())
+	}
+	if err != nil {
+		slog.Error("Invalid prompt template, keeping the previous version", "path", t.path, "err", err)
+		return
+	}
+	t.tmpl = tmpl
+	slog.Info("Loaded prompt template", "path", t.path)
+}
+
+// System renders the template as a system prompt with knowledge as its
+// context.
+func (t *promptTemplate) System(knowledge string) string {
+	data := currentPromptVars()
+	data.Context = knowledge
+	return t.Render(data)
+}
+
+// Render executes the current version of the template with data.
+func (t *promptTemplate) Render(data PromptData) string {
+	t.mu.Lock()
+	t.reload()
+	tmpl := t.tmpl
+	t.mu.Unlock()
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		slog.Error("Failed to render prompt template", "path", t.path, "err", err)
+		b.Reset()
+		template.Must(template.New("fallback").Parse(t.fallback)).Execute(&b, data)
+	}
+	return b.String()
+}
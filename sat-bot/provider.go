@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxUpstreamResponseSize caps how much of a provider response is read.
+const maxUpstreamResponseSize = 10 * 1024 * 1024
+
+var (
+	errMissingAPIKey  = errors.New("API key not configured for model provider")
+	errPrepareRequest = errors.New("Failed to prepare request")
+	errCreateRequest  = errors.New("Failed to create request")
+	errCallUpstream   = errors.New("Failed to call model provider")
+	errReadResponse   = errors.New("Failed to read response")
+	errEmptyResponse  = errors.New("Model provider returned an empty reply")
+	errParseResponse  = errors.New("Failed to parse response")
+)
+
+// UpstreamError is returned when a provider answers with a non-success
+// status.
+type UpstreamError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+	// RetryAfter is the delay requested by the provider, if any.
+	RetryAfter time.Duration
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("%s API error: status %d", e.Provider, e.StatusCode)
+}
+
+type CompletionRequest struct {
+	// Model overrides the provider's configured model when set.
+	Model       string
+	Messages    []ChatMessage
+	Temperature float64
+	MaxTokens   int
+	// TopP is sent only when non-zero.
+	TopP float64
+	Stop []string
+	// Tools the model may call instead of answering directly.
+	Tools []ToolSpec
+	// JSONMode asks for a reply that is a single JSON value, where the
+	// provider supports it.
+	JSONMode bool
+}
+
+// ToolSpec describes a tool to the model. Parameters is a JSON schema.
+type ToolSpec struct {
+	Name        string
+	Description string
+	Parameters  map[string]interface{}
+}
+
+// ToolCall is a model's request to run a tool, in the OpenAI wire format.
+// Arguments is a JSON object encoded as a string.
+type ToolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type CompletionResponse struct {
+	Content string
+	// Provider and Model identify who actually served the reply, which may
+	// differ from the first choice when a fallback was used.
+	Provider string
+	Model    string
+	Usage    Usage
+	// ToolCalls is set when the model wants tools run before it answers.
+	ToolCalls []ToolCall
+	// Data is the validated JSON reply when a response schema was requested.
+	Data json.RawMessage
+	// Variant tags the experiment variants that produced the reply, see
+	// variantTag.
+	Variant string
+	// InteractionID identifies the answer across the response, transcript,
+	// logs and traces, see startInteraction.
+	InteractionID string
+	// Cost is the estimated cost of the reply, nil when the model has no
+	// configured price.
+	Cost *CostEstimate
+	// Sources cites the retrieved context the reply was given.
+	Sources []Citation
+}
+
+// Provider is a chat completion backend.
+type Provider interface {
+	Name() string
+	// Complete returns the full reply to a request.
+	Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error)
+	// Stream delivers the reply incrementally to onDelta and returns the
+	// assembled response once the provider has finished. An error from
+	// onDelta aborts the stream.
+	Stream(ctx context.Context, req CompletionRequest, onDelta func(string) error) (*CompletionResponse, error)
+}
+
+// provider is the backend used for all model calls, selected by
+// LLM_FALLBACK_CHAIN or, when no chain is configured, LLM_PROVIDER (groq,
+// openai, anthropic, ollama or llamacpp).
+var provider Provider
+
+func loadProvider() {
+	unregisterHealthChecks("provider:")
+	if chain := getEnv("LLM_FALLBACK_CHAIN", ""); chain != "" {
+		fallback, err := parseFallbackChain(chain)
+		if err == nil {
+			provider = fallback
+			slog.Info("Using model provider", "provider", provider.Name())
+			return
+		}
+		configProblem("LLM_FALLBACK_CHAIN: %v", err)
+	}
+
+	name := strings.ToLower(getEnv("LLM_PROVIDER", ""))
+	if name == "" {
+		name = "groq"
+		if getEnv("GROQ_API_KEY", "") == "" {
+			// Without a Groq key, e.g. in local development or on the
+			// offline kiosk, use a local Ollama server instead.
+			name = "ollama"
+			slog.Warn("GROQ_API_KEY not set, falling back to local model provider")
+		}
+	}
+	p, err := newProvider(name)
+	if err != nil {
+		configProblem("LLM_PROVIDER: %v", err)
+		return
+	}
+	provider = p
+	slog.Info("Using model provider", "provider", provider.Name())
+}
+
+var (
+	builtProvidersMu sync.Mutex
+	// builtProviders are the providers newProvider returned, by name.
+	builtProviders = map[string]Provider{}
+)
+
+// newProvider returns the named provider with a timeout on each attempt and
+// retries for transient errors, behind a circuit breaker that counts each
+// retried call once, with its token usage metered and its calls counted
+// against the cap on concurrent model calls. Each provider is built once, so
+// the fallback chain and the model allowlist share its breaker.
+func newProvider(name string) (Provider, error) {
+	builtProvidersMu.Lock()
+	defer builtProvidersMu.Unlock()
+	if p, ok := builtProviders[name]; ok {
+		return p, nil
+	}
+	base, err := newBaseProvider(name)
+	if err != nil {
+		return nil, err
+	}
+	providerNames = append(providerNames, name)
+	if pp, ok := base.(pinger); ok {
+		registerHealthCheck("provider:"+name, pingCheck(pp))
+	}
+	p := withUpstreamLimit(&meteredProvider{withBreaker(withRetry(withTimeout(name, base))), defaultModel(base)})
+	builtProviders[name] = p
+	return p, nil
+}
+
+// defaultModel returns the model p calls when a request does not pick one.
+func defaultModel(p Provider) string {
+	switch p := p.(type) {
+	case *openAIProvider:
+		return p.model
+	case *anthropicProvider:
+		return p.model
+	case *ollamaProvider:
+		return p.model
+	}
+	return ""
+}
+
+// newBaseProvider returns the named provider. Its client has no overall
+// timeout, since streams may legitimately run long; calls are bounded by
+// their context instead, see withTimeout.
+func newBaseProvider(name string) (Provider, error) {
+	client := &http.Client{}
+
+	switch name {
+	case "groq":
+		return &openAIProvider{
+			name:    "groq",
+			baseURL: getEnv("GROQ_BASE_URL", "https://api.groq.com/openai/v1"),
+			keys:    newKeyPool("groq", getEnv("GROQ_API_KEY", "")),
+			model:   getEnv("GROQ_MODEL", "moonshotai/kimi-k2-instruct-0905"),
+			client:  client,
+		}, nil
+	case "openai":
+		return &openAIProvider{
+			name:    "openai",
+			baseURL: getEnv("OPENAI_BASE_URL", "https://api.openai.com/v1"),
+			keys:    newKeyPool("openai", getEnv("OPENAI_API_KEY", "")),
+			model:   getEnv("OPENAI_MODEL", "gpt-4o-mini"),
+			client:  client,
+		}, nil
+	case "anthropic":
+		return &anthropicProvider{
+			baseURL: getEnv("ANTHROPIC_BASE_URL", "https://api.anthropic.com/v1"),
+			keys:    newKeyPool("anthropic", getEnv("ANTHROPIC_API_KEY", "")),
+			model:   getEnv("ANTHROPIC_MODEL", "claude-3-5-haiku-latest"),
+			client:  client,
+		}, nil
+	case "ollama":
+		return &ollamaProvider{
+			baseURL: getEnv("OLLAMA_BASE_URL", "http://localhost:11434"),
+			model:   getEnv("OLLAMA_MODEL", "llama3.1"),
+			client:  client,
+		}, nil
+	case "llamacpp":
+		// llama-server listens on 8080 by default, which clashes with the bot,
+		// so expect it on 8081. It serves whichever model it was started
+		// with and only checks a key when run with --api-key.
+		p := &openAIProvider{
+			name:    "llamacpp",
+			baseURL: getEnv("LLAMACPP_BASE_URL", "http://localhost:8081/v1"),
+			model:   getEnv("LLAMACPP_MODEL", "local"),
+			client:  client,
+		}
+		if key := getEnv("LLAMACPP_API_KEY", ""); key != "" {
+			p.keys = newKeyPool("llamacpp", key)
+		}
+		return p, nil
+	}
+	return nil, fmt.Errorf("unknown provider %q", name)
+}
+
+// callModel sends messages to the configured provider and returns the reply
+// text. Returned errors carry user-facing messages or are *UpstreamError.
+func callModel(ctx context.Context, messages []ChatMessage, temperature float64, maxTokens int) (string, error) {
+	resp, err := provider.Complete(ctx, CompletionRequest{
+		Messages:    messages,
+		Temperature: temperature,
+		MaxTokens:   maxTokens,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.Content, nil
+}
+
+// postJSON sends body as JSON to url and returns the response. Non-success
+// statuses are returned as *UpstreamError with the response body closed.
+// The request runs in a client span that ends when the response headers
+// arrive, so a streamed body is timed by the caller's span instead.
+func postJSON(ctx context.Context, client *http.Client, providerName, url string, headers map[string]string, body interface{}) (*http.Response, error) {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return nil, errPrepareRequest
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, errCreateRequest
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	ctx, span := startSpan(ctx, "POST "+providerName, trace.SpanKindClient)
+	defer span.End()
+	span.SetAttributes(
+		attribute.String("http.request.method", "POST"),
+		attribute.String("server.address", req.URL.Host),
+		attribute.Int("http.request.body.size", len(jsonData)),
+	)
+	injectTraceparent(ctx, req.Header)
+	if id := requestIDFromContext(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Upstream request failed", "provider", providerName, "err", err)
+		setSpanError(span, err)
+		return nil, errCallUpstream
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamResponseSize))
+		slog.ErrorContext(ctx, "Upstream error", "provider", providerName, "status", resp.StatusCode, "body", string(data))
+		upstreamErr := &UpstreamError{
+			Provider:   providerName,
+			StatusCode: resp.StatusCode,
+			Body:       string(data),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+		setSpanError(span, upstreamErr)
+		return nil, upstreamErr
+	}
+	return resp, nil
+}
+
+// readJSON decodes a successful provider response into v.
+func readJSON(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxUpstreamResponseSize))
+	if err != nil {
+		return errReadResponse
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return errParseResponse
+	}
+	return nil
+}
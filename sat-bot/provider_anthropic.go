@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+const anthropicVersion = "2023-06-01"
+
+// anthropicProvider talks to the Anthropic Messages API.
+type anthropicProvider struct {
+	baseURL string
+	keys    *keyPool
+	model   string
+	client  *http.Client
+}
+
+type anthropicMessage struct {
+	Model   string                  `json:"model"`
+	Content []anthropicContentBlock `json:"content"`
+	Usage   anthropicUsage          `json:"usage"`
+}
+
+// anthropicContentBlock is a text, tool_use or tool_result block.
+type anthropicContentBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+}
+
+// anthropicChatMessage is a request message. Content is a string for plain
+// text, or a list of blocks for tool use and results.
+type anthropicChatMessage struct {
+	Role    string      `json:"role"`
+	Content interface{} `json:"content"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type anthropicEvent struct {
+	Type         string                 `json:"type"`
+	Message      *anthropicMessage      `json:"message"`
+	Index        int                    `json:"index"`
+	ContentBlock *anthropicContentBlock `json:"content_block"`
+	Delta        struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+	} `json:"delta"`
+	Usage *anthropicUsage `json:"usage"`
+}
+
+func (u anthropicUsage) toUsage() Usage {
+	return Usage{
+		PromptTokens:     u.InputTokens,
+		CompletionTokens: u.OutputTokens,
+		TotalTokens:      u.InputTokens + u.OutputTokens,
+	}
+}
+
+func (p *anthropicProvider) Name() string { return "anthropic" }
+
+func (b anthropicContentBlock) toolCall() ToolCall {
+	args := string(b.Input)
+	if args == "" {
+		args = "{}"
+	}
+	return ToolCall{ID: b.ID, Type: "function", Function: FunctionCall{Name: b.Name, Arguments: args}}
+}
+
+// requestBody converts the chat messages to the Messages API shape, where
+// system instructions are a top-level field rather than messages.
+func (p *anthropicProvider) requestBody(req CompletionRequest, stream bool) map[string]interface{} {
+	model := req.Model
+	if model == "" {
+		model = p.model
+	}
+
+	var system []string
+	messages := []anthropicChatMessage{}
+	for _, m := range req.Messages {
+		switch {
+		case m.Role == "system":
+			system = append(system, m.Content)
+		case m.Role == "tool":
+			// Tool results go back as a user message; results of several
+			// calls share one.
+			result := anthropicContentBlock{Type: "tool_result", ToolUseID: m.ToolCallID, Content: m.Content}
+			if n := len(messages); n > 0 && messages[n-1].Role == "user" {
+				if blocks, ok := messages[n-1].Content.([]anthropicContentBlock); ok {
+					messages[n-1].Content = append(blocks, result)
+					continue
+				}
+			}
+			messages = append(messages, anthropicChatMessage{Role: "user", Content: []anthropicContentBlock{result}})
+		case len(m.ToolCalls) > 0:
+			var blocks []anthropicContentBlock
+			if m.Content != "" {
+				blocks = append(blocks, anthropicContentBlock{Type: "text", Text: m.Content})
+			}
+			for _, call := range m.ToolCalls {
+				input := json.RawMessage(call.Function.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, anthropicContentBlock{Type: "tool_use", ID: call.ID, Name: call.Function.Name, Input: input})
+			}
+			messages = append(messages, anthropicChatMessage{Role: m.Role, Content: blocks})
+		default:
+			messages = append(messages, anthropicChatMessage{Role: m.Role, Content: m.Content})
+		}
+	}
+
+	body := map[string]interface{}{
+		"model":       model,
+		"messages":    messages,
+		"temperature": req.Temperature,
+		"max_tokens":  req.MaxTokens,
+	}
+	if len(system) > 0 {
+		body["system"] = strings.Join(system, "\n\n")
+	}
+	if req.TopP > 0 {
+		body["top_p"] = req.TopP
+	}
+	if len(req.Stop) > 0 {
+		body["stop_sequences"] = req.Stop
+	}
+	if len(req.Tools) > 0 {
+		tools := make([]map[string]interface{}, len(req.Tools))
+		for i, t := range req.Tools {
+			tools[i] = map[string]interface{}{
+				"name":         t.Name,
+				"description":  t.Description,
+				"input_schema": t.Parameters,
+			}
+		}
+		body["tools"] = tools
+	}
+	if stream {
+		body["stream"] = true
+	}
+	return body
+}
+
+func (p *anthropicProvider) post(ctx context.Context, body map[string]interface{}) (*http.Response, error) {
+	return p.keys.do(func(key string) (*http.Response, error) {
+		headers := map[string]string{
+			"x-api-key":         key,
+			"anthropic-version": anthropicVersion,
+		}
+		return postJSON(ctx, p.client, p.Name(), p.baseURL+"/messages", headers, body)
+	})
+}
+
+func (p *anthropicProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	resp, err := p.post(ctx, p.requestBody(req, false))
+	if err != nil {
+		return nil, err
+	}
+
+	var message anthropicMessage
+	if err := readJSON(resp, &message); err != nil {
+		return nil, err
+	}
+
+	var content strings.Builder
+	var calls []ToolCall
+	for _, block := range message.Content {
+		switch block.Type {
+		case "text":
+			content.WriteString(block.Text)
+		case "tool_use":
+			calls = append(calls, block.toolCall())
+		}
+	}
+	if content.Len() == 0 && len(calls) == 0 {
+		return nil, errEmptyResponse
+	}
+
+	return &CompletionResponse{
+		Content:   content.String(),
+		Provider:  p.Name(),
+		Model:     message.Model,
+		Usage:     message.Usage.toUsage(),
+		ToolCalls: calls,
+	}, nil
+}
+
+func (p *anthropicProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(string) error) (*CompletionResponse, error) {
+	resp, err := p.post(ctx, p.requestBody(req, true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &CompletionResponse{Provider: p.Name()}
+	var usage anthropicUsage
+	var content strings.Builder
+	toolBlocks := map[int]*anthropicContentBlock{}
+	var toolOrder []int
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxUpstreamResponseSize)
+stream:
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+
+		var event anthropicEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &event); err != nil {
+			return nil, errParseResponse
+		}
+
+		switch event.Type {
+		case "message_start":
+			if event.Message != nil {
+				result.Model = event.Message.Model
+				usage.InputTokens = event.Message.Usage.InputTokens
+			}
+		case "content_block_start":
+			if event.ContentBlock != nil && event.ContentBlock.Type == "tool_use" {
+				if len(toolBlocks) >= maxToolCalls {
+					return nil, errParseResponse
+				}
+				// The input arrives in input_json_delta fragments.
+				block := *event.ContentBlock
+				block.Input = nil
+				toolBlocks[event.Index] = &block
+				toolOrder = append(toolOrder, event.Index)
+			}
+		case "content_block_delta":
+			if event.Delta.Type == "input_json_delta" {
+				if block, ok := toolBlocks[event.Index]; ok {
+					block.Input = append(block.Input, event.Delta.PartialJSON...)
+				}
+				continue
+			}
+			if event.Delta.Type != "text_delta" || event.Delta.Text == "" {
+				continue
+			}
+			content.WriteString(event.Delta.Text)
+			if err := onDelta(event.Delta.Text); err != nil {
+				return nil, err
+			}
+		case "message_delta":
+			if event.Usage != nil {
+				usage.OutputTokens = event.Usage.OutputTokens
+			}
+		case "error":
+			return nil, errCallUpstream
+		case "message_stop":
+			break stream
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errReadResponse
+	}
+
+	for _, index := range toolOrder {
+		result.ToolCalls = append(result.ToolCalls, toolBlocks[index].toolCall())
+	}
+	result.Content = content.String()
+	result.Usage = usage.toUsage()
+	return result, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("Model provider temporarily unavailable")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// breakerProvider stops calling a provider after consecutive failures. While
+// open, calls fail immediately with errCircuitOpen; after openDuration a
+// single probe is let through (half-open) and its outcome closes or reopens
+// the circuit.
+type breakerProvider struct {
+	Provider
+	threshold    int
+	openDuration time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func withBreaker(p Provider) Provider {
+	threshold := getEnvInt("CIRCUIT_FAILURE_THRESHOLD", 5)
+	if threshold <= 0 {
+		return p
+	}
+	return &breakerProvider{
+		Provider:     p,
+		threshold:    threshold,
+		openDuration: getEnvDuration("CIRCUIT_OPEN_DURATION", 30*time.Second),
+	}
+}
+
+// isProviderFailure reports whether err says something about the provider's
+// health, as opposed to a bad request or the caller going away.
+func isProviderFailure(err error) bool {
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		return upstream.StatusCode == http.StatusTooManyRequests || upstream.StatusCode >= 500
+	}
+	return errors.Is(err, errCallUpstream)
+}
+
+// allow reports whether a call may go through, moving an open circuit to
+// half-open once its cool-down has passed.
+func (b *breakerProvider) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.openDuration {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		slog.Info("Circuit half-open, probing", "provider", b.Name())
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *breakerProvider) record(ctx context.Context, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasProbe := b.state == breakerHalfOpen
+	b.probing = false
+
+	switch {
+	case err == nil || (!isProviderFailure(err) && ctx.Err() == nil):
+		if b.state != breakerClosed {
+			slog.InfoContext(ctx, "Circuit closed", "provider", b.Name())
+		}
+		b.state = breakerClosed
+		b.failures = 0
+	case ctx.Err() != nil:
+		// The caller gave up; this says nothing about the provider. A
+		// cancelled probe leaves the circuit half-open for the next one.
+	default:
+		b.failures++
+		if wasProbe || b.failures >= b.threshold {
+			if b.state != breakerOpen {
+				slog.WarnContext(ctx, "Circuit opened", "provider", b.Name(), "failures", b.failures)
+			}
+			b.state = breakerOpen
+			b.openedAt = time.Now()
+		}
+	}
+}
+
+// State returns the current circuit state.
+func (b *breakerProvider) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *breakerProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	if !b.allow() {
+		return nil, errCircuitOpen
+	}
+	resp, err := b.Provider.Complete(ctx, req)
+	b.record(ctx, err)
+	return resp, err
+}
+
+func (b *breakerProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(string) error) (*CompletionResponse, error) {
+	if !b.allow() {
+		return nil, errCircuitOpen
+	}
+	resp, err := b.Provider.Stream(ctx, req, onDelta)
+	b.record(ctx, err)
+	return resp, err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBreakerProvider(t *testing.T) {
+	unavailable := &UpstreamError{Provider: "fake", StatusCode: http.StatusServiceUnavailable}
+	fake, calls := scriptedProvider(unavailable, errCallUpstream, unavailable, nil)
+	b := &breakerProvider{Provider: fake, threshold: 2, openDuration: 20 * time.Millisecond}
+	ctx := context.Background()
+
+	b.Complete(ctx, CompletionRequest{})
+	if b.State() != breakerClosed {
+		t.Fatalf("state after one failure = %v, want closed", b.State())
+	}
+	b.Complete(ctx, CompletionRequest{})
+	if b.State() != breakerOpen {
+		t.Fatalf("state after two failures = %v, want open", b.State())
+	}
+	if _, err := b.Complete(ctx, CompletionRequest{}); !errors.Is(err, errCircuitOpen) || *calls != 2 {
+		t.Fatalf("open circuit returned %v after %d calls, want errCircuitOpen without calling", err, *calls)
+	}
+
+	// A failed probe reopens the circuit at once; a successful one closes it.
+	time.Sleep(30 * time.Millisecond)
+	b.Complete(ctx, CompletionRequest{})
+	if b.State() != breakerOpen || *calls != 3 {
+		t.Fatalf("state after a failed probe = %v after %d calls, want open", b.State(), *calls)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := b.Complete(ctx, CompletionRequest{}); err != nil || b.State() != breakerClosed {
+		t.Fatalf("probe returned %v leaving the circuit %v, want it closed", err, b.State())
+	}
+}
+
+func TestBreakerProviderIgnoresRequestErrors(t *testing.T) {
+	badRequest := &UpstreamError{Provider: "fake", StatusCode: http.StatusBadRequest}
+	fake, _ := scriptedProvider(badRequest, badRequest, badRequest)
+	b := &breakerProvider{Provider: fake, threshold: 2, openDuration: time.Minute}
+	for i := 0; i < 3; i++ {
+		b.Complete(context.Background(), CompletionRequest{})
+	}
+	if b.State() != breakerClosed {
+		t.Errorf("state after bad requests = %v, want closed", b.State())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	fake, _ = scriptedProvider(context.Canceled, context.Canceled, context.Canceled)
+	b.Provider = fake
+	for i := 0; i < 3; i++ {
+		b.Complete(ctx, CompletionRequest{})
+	}
+	if b.State() != breakerClosed {
+		t.Errorf("state after cancelled calls = %v, want closed", b.State())
+	}
+}
+
+func TestBreakerProviderSingleProbe(t *testing.T) {
+	fake, _ := scriptedProvider()
+	b := &breakerProvider{Provider: fake, threshold: 1, openDuration: time.Millisecond, state: breakerOpen, openedAt: time.Now().Add(-time.Second)}
+	if !b.allow() {
+		t.Fatal("first call after the cool-down not let through")
+	}
+	if b.allow() {
+		t.Error("second call let through while the probe is in flight")
+	}
+}
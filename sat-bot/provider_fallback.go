@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+type fallbackEntry struct {
+	provider Provider
+	model    string
+}
+
+func (e fallbackEntry) String() string {
+	if e.model == "" {
+		return e.provider.Name()
+	}
+	return e.provider.Name() + ":" + e.model
+}
+
+// fallbackProvider tries an ordered list of provider/model pairs, moving on
+// to the next one when a call fails in a way another backend might not.
+type fallbackProvider struct {
+	entries []fallbackEntry
+}
+
+// parseFallbackChain builds a fallback provider from a comma-separated list
+// of provider[:model] entries, e.g.
+// "groq:moonshotai/kimi-k2-instruct-0905,groq:llama-3.3-70b-versatile,openai:gpt-4o-mini".
+// Entries without a model use the provider's configured model.
+func parseFallbackChain(chain string) (*fallbackProvider, error) {
+	fallback := &fallbackProvider{}
+
+	for _, item := range strings.Split(chain, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, model, _ := strings.Cut(item, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		p, err := newProvider(name)
+		if err != nil {
+			return nil, err
+		}
+		fallback.entries = append(fallback.entries, fallbackEntry{provider: p, model: strings.TrimSpace(model)})
+	}
+
+	if len(fallback.entries) == 0 {
+		return nil, fmt.Errorf("fallback chain %q has no entries", chain)
+	}
+	return fallback, nil
+}
+
+func (f *fallbackProvider) Name() string {
+	names := make([]string, len(f.entries))
+	for i, e := range f.entries {
+		names[i] = e.String()
+	}
+	return "fallback(" + strings.Join(names, " -> ") + ")"
+}
+
+// shouldFallback reports whether a failed call is worth retrying on the next
+// entry: rate limits, server errors, timeouts, connection failures and empty
+// replies. Errors caused by the request itself, or by the caller giving up,
+// are returned as is.
+func shouldFallback(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		return upstream.StatusCode == http.StatusTooManyRequests || upstream.StatusCode >= 500
+	}
+	return errors.Is(err, errCallUpstream) || errors.Is(err, errMissingAPIKey) ||
+		errors.Is(err, errEmptyResponse) || errors.Is(err, errCircuitOpen)
+}
+
+func (f *fallbackProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	var lastErr error
+	for i, e := range f.entries {
+		attempt := req
+		if e.model != "" {
+			attempt.Model = e.model
+		}
+
+		resp, err := e.provider.Complete(ctx, attempt)
+		if err == nil {
+			if i > 0 {
+				noteFallback(ctx, e, attempt, resp, i)
+			}
+			return resp, nil
+		}
+
+		lastErr = err
+		if !shouldFallback(ctx, err) {
+			return nil, err
+		}
+		slog.WarnContext(ctx, "Provider failed", "provider", e.String(), "err", err)
+	}
+	return nil, lastErr
+}
+
+// Stream falls back only while nothing has been sent to onDelta; once a reply
+// has started it cannot be swapped for another one.
+func (f *fallbackProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(string) error) (*CompletionResponse, error) {
+	var lastErr error
+	for i, e := range f.entries {
+		attempt := req
+		if e.model != "" {
+			attempt.Model = e.model
+		}
+
+		started := false
+		resp, err := e.provider.Stream(ctx, attempt, func(delta string) error {
+			started = true
+			return onDelta(delta)
+		})
+		if err == nil {
+			if i > 0 {
+				noteFallback(ctx, e, attempt, resp, i)
+			}
+			return resp, nil
+		}
+
+		lastErr = err
+		if started || !shouldFallback(ctx, err) {
+			return nil, err
+		}
+		slog.WarnContext(ctx, "Provider failed", "provider", e.String(), "err", err)
+	}
+	return nil, lastErr
+}
+
+// noteFallback records an answer served by entry e after the attempts
+// before it failed.
+func noteFallback(ctx context.Context, e fallbackEntry, req CompletionRequest, resp *CompletionResponse, failedAttempts int) {
+	slog.InfoContext(ctx, "Served by fallback", "provider", e.String(), "failed_attempts", failedAttempts)
+	// Keyed by the model asked for, like the usage of the calls themselves.
+	model := req.Model
+	if model == "" {
+		model = resp.Model
+	}
+	fallbackAnswers.WithLabelValues(resp.Provider, model).Inc()
+	if usage != nil {
+		usage.RecordFallback(resp.Provider, model)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// cutOffProvider streams a partial reply and then fails.
+type cutOffProvider struct{ *fakeProvider }
+
+func (p cutOffProvider) Stream(_ context.Context, _ CompletionRequest, onDelta func(string) error) (*CompletionResponse, error) {
+	onDelta("partial")
+	return nil, errCallUpstream
+}
+
+func TestShouldFallback(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"rate limit", context.Background(), &UpstreamError{StatusCode: http.StatusTooManyRequests}, true},
+		{"server error", context.Background(), &UpstreamError{StatusCode: http.StatusInternalServerError}, true},
+		{"bad request", context.Background(), &UpstreamError{StatusCode: http.StatusBadRequest}, false},
+		{"bad key", context.Background(), &UpstreamError{StatusCode: http.StatusUnauthorized}, false},
+		{"connection failure", context.Background(), errCallUpstream, true},
+		{"timeout", context.Background(), errUpstreamTimeout, true},
+		{"no API key", context.Background(), errMissingAPIKey, true},
+		{"empty reply", context.Background(), errEmptyResponse, true},
+		{"circuit open", context.Background(), errCircuitOpen, true},
+		{"prompt too long", context.Background(), errPromptTooLong, false},
+		{"caller gave up", cancelled, errCallUpstream, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldFallback(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("shouldFallback(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFallbackProvider(t *testing.T) {
+	var asked []string
+	answering := func(name string, err error) *fakeProvider {
+		return &fakeProvider{name: name, complete: func(_ context.Context, req CompletionRequest) (*CompletionResponse, error) {
+			asked = append(asked, name+":"+req.Model)
+			if err != nil {
+				return nil, err
+			}
+			return &CompletionResponse{Content: "from " + name, Provider: name, Model: req.Model}, nil
+		}}
+	}
+
+	tests := []struct {
+		name      string
+		entries   []fallbackEntry
+		want      string
+		wantErr   error
+		wantAsked int
+	}{
+		{
+			name: "first entry answers",
+			entries: []fallbackEntry{
+				{provider: answering("groq", nil), model: "kimi"},
+				{provider: answering("openai", nil)},
+			},
+			want: "from groq", wantAsked: 1,
+		},
+		{
+			name: "falls back past rate limits and outages",
+			entries: []fallbackEntry{
+				{provider: answering("groq", &UpstreamError{Provider: "groq", StatusCode: http.StatusTooManyRequests}), model: "kimi"},
+				{provider: answering("groq", errCircuitOpen), model: "llama"},
+				{provider: answering("openai", nil), model: "gpt-4o-mini"},
+			},
+			want: "from openai", wantAsked: 3,
+		},
+		{
+			name: "request errors are returned as is",
+			entries: []fallbackEntry{
+				{provider: answering("groq", &UpstreamError{Provider: "groq", StatusCode: http.StatusBadRequest})},
+				{provider: answering("openai", nil)},
+			},
+			wantErr: &UpstreamError{}, wantAsked: 1,
+		},
+		{
+			name: "every entry fails",
+			entries: []fallbackEntry{
+				{provider: answering("groq", errCallUpstream)},
+				{provider: answering("openai", errEmptyResponse)},
+			},
+			wantErr: errEmptyResponse, wantAsked: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			asked = nil
+			f := &fallbackProvider{entries: tt.entries}
+			resp, err := f.Complete(context.Background(), CompletionRequest{Model: "default"})
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil || resp.Content != tt.want {
+					t.Errorf("Complete() = %+v, %v, want %q", resp, err, tt.want)
+				}
+			case *UpstreamError:
+				if !errors.As(err, &want) {
+					t.Errorf("Complete() error = %v, want the provider's", err)
+				}
+			default:
+				if !errors.Is(err, want) {
+					t.Errorf("Complete() error = %v, want the last entry's %v", err, want)
+				}
+			}
+			if len(asked) != tt.wantAsked {
+				t.Errorf("asked %q, want %d entries", asked, tt.wantAsked)
+			}
+			for i, a := range asked {
+				if e := tt.entries[i]; e.model != "" && a != e.String() {
+					t.Errorf("entry %d asked as %q, want %q", i, a, e.String())
+				}
+			}
+		})
+	}
+}
+
+func TestFallbackProviderStream(t *testing.T) {
+	failing := &fakeProvider{name: "groq", complete: func(context.Context, CompletionRequest) (*CompletionResponse, error) {
+		return nil, errCallUpstream
+	}}
+	answering, calls := scriptedProvider()
+
+	f := &fallbackProvider{entries: []fallbackEntry{{provider: failing}, {provider: answering}}}
+	resp, err := f.Stream(context.Background(), CompletionRequest{}, func(string) error { return nil })
+	if err != nil || resp.Content != "ok" || *calls != 1 {
+		t.Errorf("Stream() = %+v, %v, want the second entry's answer", resp, err)
+	}
+
+	f = &fallbackProvider{entries: []fallbackEntry{{provider: cutOffProvider{failing}}, {provider: answering}}}
+	var deltas []string
+	if _, err := f.Stream(context.Background(), CompletionRequest{}, func(d string) error {
+		deltas = append(deltas, d)
+		return nil
+	}); !errors.Is(err, errCallUpstream) || *calls != 1 || len(deltas) != 1 {
+		t.Errorf("Stream() error = %v with deltas %q, want no fallback once the reply started", err, deltas)
+	}
+}
+
+func TestFallbackProviderName(t *testing.T) {
+	f := &fallbackProvider{entries: []fallbackEntry{
+		{provider: &fakeProvider{name: "groq"}, model: "kimi"},
+		{provider: &fakeProvider{name: "openai"}},
+	}}
+	if got, want := f.Name(), "fallback(groq:kimi -> openai)"; got != want {
+		t.Errorf("Name() = %q, want %q", got, want)
+	}
+}
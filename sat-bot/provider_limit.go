@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+var errOverloaded = errors.New("The assistant is busy right now, please try again in a few seconds")
+
+// upstreamLimiter caps the model calls in flight across all providers. A
+// call over the cap waits up to wait for a slot, with at most queue calls
+// waiting; the rest are shed with errOverloaded instead of piling up.
+type upstreamLimiter struct {
+	slots      chan struct{}
+	queue      int64
+	wait       time.Duration
+	retryAfter time.Duration
+
+	waiting atomic.Int64
+}
+
+var (
+	// upstreamSlots is nil when calls are not capped.
+	upstreamSlots *upstreamLimiter
+
+	upstreamShed = expvar.NewInt("upstream_shed")
+)
+
+func init() {
+	expvar.Publish("upstream_in_flight", expvar.Func(func() any {
+		if upstreamSlots == nil {
+			return 0
+		}
+		return len(upstreamSlots.slots)
+	}))
+	expvar.Publish("upstream_queued", expvar.Func(func() any {
+		if upstreamSlots == nil {
+			return 0
+		}
+		return upstreamSlots.waiting.Load()
+	}))
+}
+
+// loadUpstreamLimit reads MAX_CONCURRENT_UPSTREAM, the model calls allowed
+// in flight at once (64 by default, 0 turns the cap off);
+// UPSTREAM_QUEUE_SIZE, how many more may wait for a slot (twice the cap by
+// default); UPSTREAM_QUEUE_TIMEOUT, how long they wait (2s); and
+// UPSTREAM_RETRY_AFTER, the Retry-After sent with the 503 for calls shed
+// (5s). It must run before the providers are created.
+func loadUpstreamLimit() {
+	limit := getEnvInt("MAX_CONCURRENT_UPSTREAM", 64)
+	if limit <= 0 {
+		upstreamSlots = nil
+		return
+	}
+	queue := getEnvInt("UPSTREAM_QUEUE_SIZE", 2*limit)
+	if queue < 0 {
+		configProblem("UPSTREAM_QUEUE_SIZE: must not be negative")
+		queue = 2 * limit
+	}
+	upstreamSlots = &upstreamLimiter{
+		slots:      make(chan struct{}, limit),
+		queue:      int64(queue),
+		wait:       getEnvDuration("UPSTREAM_QUEUE_TIMEOUT", 2*time.Second),
+		retryAfter: getEnvDuration("UPSTREAM_RETRY_AFTER", 5*time.Second),
+	}
+	slog.Info("Capping concurrent model calls", "limit", limit, "queue", queue, "queue_timeout", upstreamSlots.wait)
+}
+
+// acquire takes a slot, waiting for one if the queue has room, and returns
+// the function that gives it back.
+func (l *upstreamLimiter) acquire(ctx context.Context) (func(), error) {
+	release := func() { <-l.slots }
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	start := time.Now()
+	defer func() { addQueueWait(ctx, time.Since(start)) }()
+
+	if l.waiting.Add(1) > l.queue {
+		l.waiting.Add(-1)
+		upstreamShed.Add(1)
+		return nil, errOverloaded
+	}
+	defer l.waiting.Add(-1)
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		upstreamShed.Add(1)
+		return nil, errOverloaded
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// limitedProvider takes a slot from upstreamSlots for each call.
+type limitedProvider struct {
+	Provider
+	limiter *upstreamLimiter
+}
+
+func withUpstreamLimit(p Provider) Provider {
+	if upstreamSlots == nil {
+		return p
+	}
+	return &limitedProvider{Provider: p, limiter: upstreamSlots}
+}
+
+func (p *limitedProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	release, err := p.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return p.Provider.Complete(ctx, req)
+}
+
+func (p *limitedProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(string) error) (*CompletionResponse, error) {
+	release, err := p.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return p.Provider.Stream(ctx, req, onDelta)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ollamaProvider talks to a local Ollama server's chat API.
+type ollamaProvider struct {
+	baseURL string
+	model   string
+	client  *http.Client
+}
+
+// ollamaMessage is a chat message as Ollama expects it, with tool call
+// arguments as JSON objects rather than strings.
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaChatResponse struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	Error           string        `json:"error"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+}
+
+func (r *ollamaChatResponse) usage() Usage {
+	return Usage{
+		PromptTokens:     r.PromptEvalCount,
+		CompletionTokens: r.EvalCount,
+		TotalTokens:      r.PromptEvalCount + r.EvalCount,
+	}
+}
+
+func (p *ollamaProvider) Name() string { return "ollama" }
+
+func toOllamaMessages(messages []ChatMessage) []ollamaMessage {
+	out := make([]ollamaMessage, len(messages))
+	for i, m := range messages {
+		out[i] = ollamaMessage{Role: m.Role, Content: m.Content}
+		for _, call := range m.ToolCalls {
+			var c ollamaToolCall
+			c.Function.Name = call.Function.Name
+			c.Function.Arguments = json.RawMessage(call.Function.Arguments)
+			if !json.Valid(c.Function.Arguments) {
+				c.Function.Arguments = json.RawMessage("{}")
+			}
+			out[i].ToolCalls = append(out[i].ToolCalls, c)
+		}
+	}
+	return out
+}
+
+// toolCalls converts Ollama's tool calls, which have no IDs, to the OpenAI
+// shape used elsewhere.
+func (m ollamaMessage) toolCalls() []ToolCall {
+	var calls []ToolCall
+	for i, c := range m.ToolCalls {
+		calls = append(calls, ToolCall{
+			ID:   fmt.Sprintf("call_%d", i),
+			Type: "function",
+			Function: FunctionCall{
+				Name:      c.Function.Name,
+				Arguments: string(c.Function.Arguments),
+			},
+		})
+	}
+	return calls
+}
+
+func (p *ollamaProvider) requestBody(req CompletionRequest, stream bool) map[string]interface{} {
+	model := req.Model
+	if model == "" {
+		model = p.model
+	}
+	options := map[string]interface{}{
+		"temperature": req.Temperature,
+		"num_predict": req.MaxTokens,
+	}
+	if req.TopP > 0 {
+		options["top_p"] = req.TopP
+	}
+	if len(req.Stop) > 0 {
+		options["stop"] = req.Stop
+	}
+	body := map[string]interface{}{
+		"model":    model,
+		"messages": toOllamaMessages(req.Messages),
+		"stream":   stream,
+		"options":  options,
+	}
+	if len(req.Tools) > 0 {
+		body["tools"] = functionTools(req.Tools)
+	}
+	if req.JSONMode {
+		body["format"] = "json"
+	}
+	return body
+}
+
+func (p *ollamaProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	resp, err := postJSON(ctx, p.client, p.Name(), p.baseURL+"/api/chat", nil, p.requestBody(req, false))
+	if err != nil {
+		return nil, err
+	}
+
+	var chat ollamaChatResponse
+	if err := readJSON(resp, &chat); err != nil {
+		return nil, err
+	}
+	calls := chat.Message.toolCalls()
+	if chat.Error != "" {
+		return nil, errCallUpstream
+	}
+	if chat.Message.Content == "" && len(calls) == 0 {
+		return nil, errEmptyResponse
+	}
+
+	return &CompletionResponse{
+		Content:   chat.Message.Content,
+		Provider:  p.Name(),
+		Model:     chat.Model,
+		Usage:     chat.usage(),
+		ToolCalls: calls,
+	}, nil
+}
+
+// Stream reads Ollama's newline-delimited JSON stream.
+func (p *ollamaProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(string) error) (*CompletionResponse, error) {
+	resp, err := postJSON(ctx, p.client, p.Name(), p.baseURL+"/api/chat", nil, p.requestBody(req, true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &CompletionResponse{Provider: p.Name()}
+	var content strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxUpstreamResponseSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var chunk ollamaChatResponse
+		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
+			return nil, errParseResponse
+		}
+		if chunk.Error != "" {
+			return nil, errCallUpstream
+		}
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		result.ToolCalls = append(result.ToolCalls, chunk.Message.toolCalls()...)
+		if delta := chunk.Message.Content; delta != "" {
+			content.WriteString(delta)
+			if err := onDelta(delta); err != nil {
+				return nil, err
+			}
+		}
+		if chunk.Done {
+			result.Usage = chunk.usage()
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errReadResponse
+	}
+
+	for i := range result.ToolCalls {
+		result.ToolCalls[i].ID = fmt.Sprintf("call_%d", i)
+	}
+	result.Content = content.String()
+	return result, nil
+}
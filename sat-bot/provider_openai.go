@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// openAIProvider talks to OpenAI-compatible chat completion APIs, which
+// covers Groq, OpenAI and llama.cpp's server.
+type openAIProvider struct {
+	name    string
+	baseURL string
+	// keys is nil for local servers that do not check API keys.
+	keys   *keyPool
+	model  string
+	client *http.Client
+}
+
+type ChatCompletion struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Message struct {
+			Content   string     `json:"content"`
+			ToolCalls []ToolCall `json:"tool_calls"`
+		} `json:"message"`
+	} `json:"choices"`
+	Usage Usage `json:"usage"`
+}
+
+type chatCompletionChunk struct {
+	Model   string `json:"model"`
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+			// ToolCalls arrive in fragments; the first one for an index
+			// carries the ID and name, later ones more of the arguments.
+			ToolCalls []struct {
+				Index int `json:"index"`
+				ToolCall
+			} `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"`
+	// Groq reports usage of streamed requests here.
+	XGroq *struct {
+		Usage *Usage `json:"usage"`
+	} `json:"x_groq"`
+}
+
+func (p *openAIProvider) Name() string { return p.name }
+
+func (p *openAIProvider) requestBody(req CompletionRequest, stream bool) map[string]interface{} {
+	model := req.Model
+	if model == "" {
+		model = p.model
+	}
+	body := map[string]interface{}{
+		"messages":    req.Messages,
+		"model":       model,
+		"temperature": req.Temperature,
+		"max_tokens":  req.MaxTokens,
+	}
+	if req.TopP > 0 {
+		body["top_p"] = req.TopP
+	}
+	if len(req.Stop) > 0 {
+		body["stop"] = req.Stop
+	}
+	if len(req.Tools) > 0 {
+		body["tools"] = functionTools(req.Tools)
+	}
+	if req.JSONMode {
+		body["response_format"] = map[string]string{"type": "json_object"}
+	}
+	if stream {
+		body["stream"] = true
+	}
+	return body
+}
+
+func (p *openAIProvider) post(ctx context.Context, body map[string]interface{}) (*http.Response, error) {
+	if p.keys == nil {
+		return postJSON(ctx, p.client, p.name, p.baseURL+"/chat/completions", nil, body)
+	}
+	return p.keys.do(func(key string) (*http.Response, error) {
+		headers := map[string]string{"Authorization": fmt.Sprintf("Bearer %s", key)}
+		return postJSON(ctx, p.client, p.name, p.baseURL+"/chat/completions", headers, body)
+	})
+}
+
+func (p *openAIProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	resp, err := p.post(ctx, p.requestBody(req, false))
+	if err != nil {
+		return nil, err
+	}
+
+	var chatCompletion ChatCompletion
+	if err := readJSON(resp, &chatCompletion); err != nil {
+		return nil, err
+	}
+	if len(chatCompletion.Choices) == 0 {
+		return nil, errEmptyResponse
+	}
+
+	message := chatCompletion.Choices[0].Message
+	return &CompletionResponse{
+		Content:   message.Content,
+		Provider:  p.name,
+		Model:     chatCompletion.Model,
+		Usage:     chatCompletion.Usage,
+		ToolCalls: message.ToolCalls,
+	}, nil
+}
+
+func (p *openAIProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(string) error) (*CompletionResponse, error) {
+	resp, err := p.post(ctx, p.requestBody(req, true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &CompletionResponse{Provider: p.name}
+	var content strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxUpstreamResponseSize)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk chatCompletionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, errParseResponse
+		}
+		if chunk.Model != "" {
+			result.Model = chunk.Model
+		}
+		if chunk.Usage != nil {
+			result.Usage = *chunk.Usage
+		} else if chunk.XGroq != nil && chunk.XGroq.Usage != nil {
+			result.Usage = *chunk.XGroq.Usage
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		for _, call := range chunk.Choices[0].Delta.ToolCalls {
+			if call.Index < 0 || call.Index >= maxToolCalls {
+				return nil, errParseResponse
+			}
+			for len(result.ToolCalls) <= call.Index {
+				result.ToolCalls = append(result.ToolCalls, ToolCall{Type: "function"})
+			}
+			c := &result.ToolCalls[call.Index]
+			if call.ID != "" {
+				c.ID = call.ID
+			}
+			c.Function.Name += call.Function.Name
+			c.Function.Arguments += call.Function.Arguments
+		}
+		if chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+
+		delta := chunk.Choices[0].Delta.Content
+		content.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errReadResponse
+	}
+
+	result.Content = content.String()
+	return result, nil
+}
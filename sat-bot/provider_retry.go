@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retryProvider retries transient failures of a single provider with
+// exponential backoff and full jitter, honoring Retry-After when the
+// provider sends one. Retries never wait past the request's deadline.
+type retryProvider struct {
+	Provider
+	maxRetries int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+func withRetry(p Provider) Provider {
+	maxRetries := getEnvInt("UPSTREAM_MAX_RETRIES", 2)
+	if maxRetries <= 0 {
+		return p
+	}
+	return &retryProvider{
+		Provider:   p,
+		maxRetries: maxRetries,
+		baseDelay:  getEnvDuration("UPSTREAM_RETRY_BASE_DELAY", 250*time.Millisecond),
+		maxDelay:   getEnvDuration("UPSTREAM_RETRY_MAX_DELAY", 4*time.Second),
+	}
+}
+
+// isTransient reports whether a failed call may succeed if repeated.
+func isTransient(err error) bool {
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) {
+		switch upstream.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	return errors.Is(err, errCallUpstream)
+}
+
+// backoff returns how long to wait before retry number attempt (starting at
+// zero).
+func (p *retryProvider) backoff(attempt int, err error) time.Duration {
+	var upstream *UpstreamError
+	if errors.As(err, &upstream) && upstream.RetryAfter > 0 {
+		return upstream.RetryAfter
+	}
+
+	ceiling := p.baseDelay << attempt
+	if ceiling <= 0 || ceiling > p.maxDelay {
+		ceiling = p.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// wait sleeps for delay unless it is longer than the provider's maximum
+// backoff, would run past the context's deadline, or the context is done
+// first. It reports whether the caller should retry.
+func (p *retryProvider) wait(ctx context.Context, delay time.Duration) bool {
+	if delay > p.maxDelay {
+		return false
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= delay {
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (p *retryProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := p.Provider.Complete(ctx, req)
+		if err == nil || attempt >= p.maxRetries || !isTransient(err) {
+			return resp, err
+		}
+
+		delay := p.backoff(attempt, err)
+		slog.WarnContext(ctx, "Retrying model call", "provider", p.Name(), "delay", delay, "err", err)
+		if !p.wait(ctx, delay) {
+			return nil, err
+		}
+	}
+}
+
+// Stream retries only failures that happen before any delta was delivered.
+func (p *retryProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(string) error) (*CompletionResponse, error) {
+	for attempt := 0; ; attempt++ {
+		started := false
+		resp, err := p.Provider.Stream(ctx, req, func(delta string) error {
+			started = true
+			return onDelta(delta)
+		})
+		if err == nil || started || attempt >= p.maxRetries || !isTransient(err) {
+			return resp, err
+		}
+
+		delay := p.backoff(attempt, err)
+		slog.WarnContext(ctx, "Retrying model call", "provider", p.Name(), "delay", delay, "err", err)
+		if !p.wait(ctx, delay) {
+			return nil, err
+		}
+	}
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as an
+// HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
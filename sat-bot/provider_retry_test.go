@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// scriptedProvider fails its calls with errs in turn, a nil entry or the end
+// of the list meaning success, and counts the calls made.
+func scriptedProvider(errs ...error) (*fakeProvider, *int) {
+	calls := 0
+	return &fakeProvider{name: "fake", complete: func(context.Context, CompletionRequest) (*CompletionResponse, error) {
+		calls++
+		if calls <= len(errs) && errs[calls-1] != nil {
+			return nil, errs[calls-1]
+		}
+		return &CompletionResponse{Content: "ok", Provider: "fake"}, nil
+	}}, &calls
+}
+
+func TestRetryProvider(t *testing.T) {
+	unavailable := &UpstreamError{Provider: "fake", StatusCode: http.StatusServiceUnavailable}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{"success", nil, 1, false},
+		{"transient then success", []error{unavailable, errCallUpstream}, 3, false},
+		{"gives up after the retries", []error{unavailable, unavailable, unavailable, unavailable}, 3, true},
+		{"bad request", []error{&UpstreamError{Provider: "fake", StatusCode: http.StatusBadRequest}}, 1, true},
+		{"empty reply", []error{errEmptyResponse}, 1, true},
+		{"retry after too long", []error{&UpstreamError{Provider: "fake", StatusCode: http.StatusTooManyRequests, RetryAfter: time.Minute}}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake, calls := scriptedProvider(tt.errs...)
+			p := &retryProvider{Provider: fake, maxRetries: 2, baseDelay: time.Millisecond, maxDelay: 10 * time.Millisecond}
+			resp, err := p.Complete(context.Background(), CompletionRequest{})
+			if (err != nil) != tt.wantErr || (err == nil && resp.Content != "ok") {
+				t.Errorf("Complete() = %+v, %v", resp, err)
+			}
+			if *calls != tt.wantCalls {
+				t.Errorf("made %d calls, want %d", *calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryProviderStopsAtDeadline(t *testing.T) {
+	unavailable := &UpstreamError{Provider: "fake", StatusCode: http.StatusServiceUnavailable, RetryAfter: 50 * time.Millisecond}
+	fake, calls := scriptedProvider(unavailable)
+	p := &retryProvider{Provider: fake, maxRetries: 2, baseDelay: time.Millisecond, maxDelay: time.Second}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := p.Complete(ctx, CompletionRequest{}); !errors.As(err, new(*UpstreamError)) {
+		t.Errorf("Complete() error = %v, want the provider's", err)
+	}
+	if *calls != 1 {
+		t.Errorf("made %d calls, want no retry past the deadline", *calls)
+	}
+}
+
+func TestRetryProviderStream(t *testing.T) {
+	fake, calls := scriptedProvider(errCallUpstream)
+	p := &retryProvider{Provider: fake, maxRetries: 2, baseDelay: time.Millisecond, maxDelay: 10 * time.Millisecond}
+	var deltas []string
+	resp, err := p.Stream(context.Background(), CompletionRequest{}, func(delta string) error {
+		deltas = append(deltas, delta)
+		return nil
+	})
+	if err != nil || resp.Content != "ok" || *calls != 2 || len(deltas) != 1 {
+		t.Errorf("Stream() = %+v, %v after %d calls with deltas %q", resp, err, *calls, deltas)
+	}
+}
+
+func TestRetryProviderBackoff(t *testing.T) {
+	p := &retryProvider{baseDelay: 10 * time.Millisecond, maxDelay: 40 * time.Millisecond}
+	for attempt := 0; attempt < 5; attempt++ {
+		ceiling := min(p.baseDelay<<attempt, p.maxDelay)
+		if d := p.backoff(attempt, errCallUpstream); d < 0 || d > ceiling {
+			t.Errorf("backoff(%d) = %v, want at most %v", attempt, d, ceiling)
+		}
+	}
+	if d := p.backoff(0, &UpstreamError{StatusCode: http.StatusTooManyRequests, RetryAfter: 3 * time.Second}); d != 3*time.Second {
+		t.Errorf("backoff with Retry-After = %v, want 3s", d)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("7"); d != 7*time.Second {
+		t.Errorf("parseRetryAfter(7) = %v", d)
+	}
+	if d := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)); d <= 50*time.Second || d > time.Minute {
+		t.Errorf("parseRetryAfter(date) = %v, want about a minute", d)
+	}
+	for _, v := range []string{"", "soon", "-3", "Mon, 01 Jan 2001 00:00:00 GMT"} {
+		if d := parseRetryAfter(v); d != 0 {
+			t.Errorf("parseRetryAfter(%q) = %v, want 0", v, d)
+		}
+	}
+}
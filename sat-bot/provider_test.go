@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProvidersRejectEmptyReplies(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    error
+		provide func(baseURL string) Provider
+	}{
+		{
+			name: "openai without choices",
+			body: `{"model":"m","choices":[]}`,
+			want: errEmptyResponse,
+			provide: func(baseURL string) Provider {
+				return &openAIProvider{name: "openai", baseURL: baseURL, keys: newKeyPool("openai", "k"), client: http.DefaultClient}
+			},
+		},
+		{
+			name: "anthropic without content",
+			body: `{"model":"m","content":[]}`,
+			want: errEmptyResponse,
+			provide: func(baseURL string) Provider {
+				return &anthropicProvider{baseURL: baseURL, keys: newKeyPool("anthropic", "k"), client: http.DefaultClient}
+			},
+		},
+		{
+			name: "ollama without content",
+			body: `{"model":"m","message":{"role":"assistant","content":""}}`,
+			want: errEmptyResponse,
+			provide: func(baseURL string) Provider {
+				return &ollamaProvider{baseURL: baseURL, client: http.DefaultClient}
+			},
+		},
+		{
+			name: "ollama error",
+			body: `{"error":"model not loaded"}`,
+			want: errCallUpstream,
+			provide: func(baseURL string) Provider {
+				return &ollamaProvider{baseURL: baseURL, client: http.DefaultClient}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			resp, err := tt.provide(srv.URL).Complete(context.Background(), CompletionRequest{Messages: []ChatMessage{{Role: "user", Content: "hi"}}})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Complete() = %+v, %v, want %v", resp, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// errUpstreamTimeout is a call that ran out of its own time while the
+// request still had some left. It counts as a failed call, so it is retried
+// and falls back like a connection error.
+var errUpstreamTimeout = fmt.Errorf("%w: timed out", errCallUpstream)
+
+// timeoutProvider bounds each call to a provider. Complete must finish within
+// timeout; a stream may take longer but is cut off if no delta arrives for
+// timeout. Either way the call never outlives the request's own deadline.
+type timeoutProvider struct {
+	Provider
+	timeout time.Duration
+}
+
+// withTimeout applies <NAME>_TIMEOUT, or UPSTREAM_TIMEOUT for providers
+// without their own setting.
+func withTimeout(name string, p Provider) Provider {
+	timeout := getEnvDuration(strings.ToUpper(name)+"_TIMEOUT", getEnvDuration("UPSTREAM_TIMEOUT", 10*time.Second))
+	if timeout <= 0 {
+		return p
+	}
+	return &timeoutProvider{Provider: p, timeout: timeout}
+}
+
+// timeoutError reports a call cut short by the provider timeout as
+// errUpstreamTimeout, and one cut short by the request deadline as
+// context.DeadlineExceeded.
+func timeoutError(parent, ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil {
+		return err
+	}
+	if errors.Is(parent.Err(), context.DeadlineExceeded) {
+		return context.DeadlineExceeded
+	}
+	if parent.Err() == nil {
+		return errUpstreamTimeout
+	}
+	return err
+}
+
+func (p *timeoutProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	callCtx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	resp, err := p.Provider.Complete(callCtx, req)
+	return resp, timeoutError(ctx, callCtx, err)
+}
+
+func (p *timeoutProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(string) error) (*CompletionResponse, error) {
+	callCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idle := time.AfterFunc(p.timeout, cancel)
+	defer idle.Stop()
+
+	resp, err := p.Provider.Stream(callCtx, req, func(delta string) error {
+		idle.Reset(p.timeout)
+		return onDelta(delta)
+	})
+	return resp, timeoutError(ctx, callCtx, err)
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const qualityJudgePrompt = `You review the answers SatBot, the assistant of the Saturnalia fest, gave to attendees.
+Judge the answer below against the event information only: is it correct, complete and supported by it?
+Score it from 1 to 5: 5 is correct, complete and fully supported; 3 is partly right or missing something that matters; 1 is wrong, made up or unhelpful. An answer that rightly says the information does not cover the question scores 4.
+Set grounded to false when the answer states something the event information does not support. Give the main reason in one sentence.`
+
+const (
+	// qualityKnowledgeTokens bounds the knowledge given to the judge.
+	qualityKnowledgeTokens = 2000
+	// maxQualityLowest is how many of the worst answers a report lists.
+	maxQualityLowest = 10
+)
+
+// qualitySchema is the reply the judge has to give.
+var qualitySchema = map[string]interface{}{
+	"type":     "object",
+	"required": []interface{}{"score", "grounded", "reason"},
+	"properties": map[string]interface{}{
+		"score":    map[string]interface{}{"type": "integer", "minimum": 1.0, "maximum": 5.0},
+		"grounded": map[string]interface{}{"type": "boolean"},
+		"reason":   map[string]interface{}{"type": "string"},
+	},
+}
+
+// QualityScore is the judge's verdict on an answer.
+type QualityScore struct {
+	// Score is from 1, wrong, to 5, correct and complete.
+	Score int `json:"score"`
+	// Grounded is false when the answer says what the knowledge base does
+	// not support.
+	Grounded bool   `json:"grounded"`
+	Reason   string `json:"reason,omitempty"`
+	// Judge is the model that scored the answer.
+	Judge    string    `json:"judge,omitempty"`
+	JudgedAt time.Time `json:"judged_at"`
+}
+
+// QualityRegression is a model and experiment variant whose answers scored
+// lower lately than before.
+type QualityRegression struct {
+	Model          string  `json:"model"`
+	Variant        string  `json:"variant,omitempty"`
+	BaselineScore  float64 `json:"baseline_score"`
+	BaselineJudged int     `json:"baseline_judged"`
+	RecentScore    float64 `json:"recent_score"`
+	RecentJudged   int     `json:"recent_judged"`
+}
+
+// QualityRun is the outcome of one pass of the judge.
+type QualityRun struct {
+	At          time.Time           `json:"at"`
+	Judged      int                 `json:"judged"`
+	Failed      int                 `json:"failed"`
+	Regressions []QualityRegression `json:"regressions"`
+}
+
+// QualityGroup sums up the scores of a model and experiment variant.
+type QualityGroup struct {
+	Model        string  `json:"model"`
+	Variant      string  `json:"variant,omitempty"`
+	Judged       int     `json:"judged"`
+	AvgScore     float64 `json:"avg_score"`
+	GroundedRate float64 `json:"grounded_rate"`
+}
+
+type QualityReport struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Judged int       `json:"judged"`
+	// AvgScore and GroundedRate are null when nothing was judged.
+	AvgScore     *float64       `json:"avg_score"`
+	GroundedRate *float64       `json:"grounded_rate"`
+	Groups       []QualityGroup `json:"groups"`
+	// Lowest are the worst scored answers, worst first.
+	Lowest []Interaction `json:"lowest"`
+	// LastRun is the judge's latest pass, with the regressions it found.
+	LastRun *QualityRun `json:"last_run"`
+}
+
+// qualityJudge has a model score a sample of the stored answers against
+// the knowledge base, in the background, keeping the score with each
+// interaction. After each pass it compares the scores of the latest
+// regressionWindow with those of the baselineWindow before it, for each
+// model and experiment variant, so that a prompt or model change that made
+// answers worse shows up, on the upstream alert webhook when there is one.
+type qualityJudge struct {
+	sampleRate       float64
+	interval         time.Duration
+	lookback         time.Duration
+	maxPerRun        int
+	model            string
+	regressionWindow time.Duration
+	baselineWindow   time.Duration
+	regressionDrop   float64
+	minJudged        int
+
+	// running serializes the passes, which call the model.
+	running sync.Mutex
+	mu      sync.Mutex
+	lastRun *QualityRun
+	// alerted holds the regressions already alerted on, by model and
+	// variant, until they recover.
+	alerted map[string]bool
+}
+
+// quality is nil when answers are not scored.
+var quality *qualityJudge
+
+// loadQuality reads QUALITY_SAMPLE_RATE, the share of answers scored (0, the
+// default, scores none); QUALITY_INTERVAL, how often the judge runs (1h);
+// QUALITY_LOOKBACK, how far back it looks for answers to score (24h);
+// QUALITY_MAX_PER_RUN, how many it scores at most per run (50);
+// QUALITY_JUDGE_MODEL, the model judging, the provider's own by default;
+// QUALITY_REGRESSION_WINDOW, the recent span compared (24h), with
+// QUALITY_BASELINE_WINDOW, the span before it compared against (168h);
+// QUALITY_REGRESSION_DROP, the fall in the average score that is a
+// regression (0.5); and QUALITY_MIN_JUDGED, the scores each span needs
+// before comparing (10). It needs the interactions to be stored.
+func loadQuality() {
+	rate := getEnvFloat("QUALITY_SAMPLE_RATE", 0)
+	if rate < 0 || rate > 1 {
+		configProblem("QUALITY_SAMPLE_RATE: must be between 0 and 1")
+		return
+	}
+	if rate == 0 {
+		return
+	}
+	if interactions == nil {
+		configProblem("QUALITY_SAMPLE_RATE: answers can only be scored when INTERACTION_STORE keeps them")
+		return
+	}
+	q := &qualityJudge{
+		sampleRate:       rate,
+		interval:         getEnvDuration("QUALITY_INTERVAL", time.Hour),
+		lookback:         getEnvDuration("QUALITY_LOOKBACK", 24*time.Hour),
+		maxPerRun:        getEnvInt("QUALITY_MAX_PER_RUN", 50),
+		model:            getEnv("QUALITY_JUDGE_MODEL", ""),
+		regressionWindow: getEnvDuration("QUALITY_REGRESSION_WINDOW", 24*time.Hour),
+		baselineWindow:   getEnvDuration("QUALITY_BASELINE_WINDOW", 7*24*time.Hour),
+		regressionDrop:   getEnvFloat("QUALITY_REGRESSION_DROP", 0.5),
+		minJudged:        max(getEnvInt("QUALITY_MIN_JUDGED", 10), 1),
+		alerted:          map[string]bool{},
+	}
+	if q.interval <= 0 || q.lookback <= 0 || q.maxPerRun < 1 {
+		configProblem("QUALITY_INTERVAL, QUALITY_LOOKBACK or QUALITY_MAX_PER_RUN: must be positive")
+		return
+	}
+	if q.regressionWindow <= 0 || q.baselineWindow <= 0 || q.regressionDrop <= 0 {
+		configProblem("QUALITY_REGRESSION_WINDOW, QUALITY_BASELINE_WINDOW or QUALITY_REGRESSION_DROP: must be positive")
+		return
+	}
+	quality = q
+	slog.Info("Scoring answer quality", "sample_rate", rate, "interval", q.interval.String(), "judge_model", q.model)
+	go q.loop()
+}
+
+func (q *qualityJudge) loop() {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := q.Run(context.Background()); err != nil {
+			slog.Error("Failed to score answer quality", "err", err)
+		}
+	}
+}
+
+// sampled picks the answers to score from their ID, so every run and
+// replica agrees on them.
+func (q *qualityJudge) sampled(id string) bool {
+	if q.sampleRate >= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return float64(h.Sum32()) < q.sampleRate*math.MaxUint32
+}
+
+// Run scores the sampled answers of the lookback not scored yet, oldest
+// first, then looks for regressions.
+func (q *qualityJudge) Run(ctx context.Context) (QualityRun, error) {
+	q.running.Lock()
+	defer q.running.Unlock()
+
+	now := time.Now().UTC()
+	since := now.Add(-max(q.lookback, q.regressionWindow+q.baselineWindow))
+	listCtx, cancel := context.WithTimeout(ctx, interactionStoreTimeout)
+	found, err := interactions.List(listCtx, InteractionFilter{Since: since})
+	cancel()
+	if err != nil {
+		return QualityRun{}, err
+	}
+
+	run := QualityRun{At: now}
+	lookback := now.Add(-q.lookback)
+	for n := range found {
+		i := &found[n]
+		if run.Judged+run.Failed >= q.maxPerRun {
+			break
+		}
+		if i.Quality != nil || i.Time.Before(lookback) || !judgeable(*i) || !q.sampled(i.ID) {
+			continue
+		}
+		score, err := q.judge(ctx, *i)
+		if err == nil {
+			saveCtx, cancel := context.WithTimeout(ctx, interactionStoreTimeout)
+			err = interactions.SaveQuality(saveCtx, i.ID, score)
+			cancel()
+		}
+		if err != nil {
+			run.Failed++
+			slog.Error("Failed to score answer", "interaction_id", i.ID, "err", err)
+			continue
+		}
+		i.Quality = &score
+		run.Judged++
+	}
+
+	run.Regressions = qualityRegressions(found, now.Add(-q.regressionWindow), now.Add(-q.regressionWindow-q.baselineWindow), q.regressionDrop, q.minJudged)
+	q.alert(run.Regressions)
+	q.mu.Lock()
+	q.lastRun = &run
+	q.mu.Unlock()
+	slog.Info("Scored answer quality", "judged", run.Judged, "failed", run.Failed, "regressions", len(run.Regressions))
+	return run, nil
+}
+
+// judgeable reports whether i is a model's answer worth scoring; failures
+// and canned answers are not.
+func judgeable(i Interaction) bool {
+	switch i.Provider {
+	case "faq", "circuit-breaker", "guard":
+		return false
+	}
+	return i.Error == "" && strings.TrimSpace(i.Answer) != "" && strings.TrimSpace(i.Question) != ""
+}
+
+// judge asks the model to score an answer against the knowledge retrieved
+// for its question.
+func (q *qualityJudge) judge(ctx context.Context, i Interaction) (QualityScore, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	selection := retrieveKnowledge(ctx, i.Question, "")
+	prompt := fmt.Sprintf("Event information:\n%s\n\nQuestion: %s\n\nAnswer: %s", selection.fit(qualityKnowledgeTokens), i.Question, i.Answer)
+	answer, err := completeStructured(ctx, provider, CompletionRequest{
+		Model: q.model,
+		Messages: []ChatMessage{
+			{Role: "system", Content: qualityJudgePrompt + "\n" + schemaInstruction(qualitySchema)},
+			{Role: "user", Content: prompt},
+		},
+		Temperature: 0,
+		MaxTokens:   200,
+	}, qualitySchema)
+	if err != nil {
+		return QualityScore{}, err
+	}
+	var verdict struct {
+		Score    int    `json:"score"`
+		Grounded bool   `json:"grounded"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.Unmarshal(answer.Data, &verdict); err != nil {
+		return QualityScore{}, err
+	}
+	return QualityScore{
+		Score:    verdict.Score,
+		Grounded: verdict.Grounded,
+		Reason:   strings.TrimSpace(verdict.Reason),
+		Judge:    answer.Model,
+		JudgedAt: time.Now().UTC(),
+	}, nil
+}
+
+// qualityGroups sums up the scored interactions of found by model and
+// variant, most judged first.
+func qualityGroups(found []Interaction) []QualityGroup {
+	byKey := map[string]*QualityGroup{}
+	var groups []*QualityGroup
+	for _, i := range found {
+		if i.Quality == nil {
+			continue
+		}
+		key := i.Model + "\x00" + i.Variant
+		g := byKey[key]
+		if g == nil {
+			g = &QualityGroup{Model: i.Model, Variant: i.Variant}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		g.Judged++
+		g.AvgScore += float64(i.Quality.Score)
+		if i.Quality.Grounded {
+			g.GroundedRate++
+		}
+	}
+	out := make([]QualityGroup, len(groups))
+	for n, g := range groups {
+		g.AvgScore /= float64(g.Judged)
+		g.GroundedRate /= float64(g.Judged)
+		out[n] = *g
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Judged > out[j].Judged })
+	return out
+}
+
+// qualityRegressions compares, for each model and variant, the scores from
+// split on with those from baseline to split, and returns those whose
+// average fell by drop or more, with at least minJudged scores on each side.
+func qualityRegressions(found []Interaction, split, baseline time.Time, drop float64, minJudged int) []QualityRegression {
+	var before, after []Interaction
+	for _, i := range found {
+		switch {
+		case i.Time.Before(baseline):
+		case i.Time.Before(split):
+			before = append(before, i)
+		default:
+			after = append(after, i)
+		}
+	}
+	baselines := map[string]QualityGroup{}
+	for _, g := range qualityGroups(before) {
+		baselines[g.Model+"\x00"+g.Variant] = g
+	}
+	regressions := []QualityRegression{}
+	for _, recent := range qualityGroups(after) {
+		base, ok := baselines[recent.Model+"\x00"+recent.Variant]
+		if !ok || base.Judged < minJudged || recent.Judged < minJudged || base.AvgScore-recent.AvgScore < drop {
+			continue
+		}
+		regressions = append(regressions, QualityRegression{
+			Model:          recent.Model,
+			Variant:        recent.Variant,
+			BaselineScore:  base.AvgScore,
+			BaselineJudged: base.Judged,
+			RecentScore:    recent.AvgScore,
+			RecentJudged:   recent.Judged,
+		})
+	}
+	return regressions
+}
+
+// alert reports the regressions not alerted on yet, and forgets those that
+// recovered so they are reported again if they come back.
+func (q *qualityJudge) alert(regressions []QualityRegression) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	current := map[string]bool{}
+	for _, r := range regressions {
+		key := r.Model + "\x00" + r.Variant
+		current[key] = true
+		if q.alerted[key] {
+			continue
+		}
+		name := r.Model
+		if r.Variant != "" {
+			name += " (" + r.Variant + ")"
+		}
+		message := fmt.Sprintf(":chart_with_downwards_trend: SatBot: answers of %s score %.1f lately, down from %.1f, over %d and %d judged answers.",
+			name, r.RecentScore, r.BaselineScore, r.RecentJudged, r.BaselineJudged)
+		slog.Warn("Answer quality regressed",
+			"model", r.Model,
+			"variant", r.Variant,
+			"recent_score", r.RecentScore,
+			"baseline_score", r.BaselineScore,
+		)
+		if alerts != nil {
+			if err := alerts.send(message); err != nil {
+				slog.Error("Failed to send alert", "err", err)
+			}
+		}
+	}
+	q.alerted = current
+}
+
+func (q *qualityJudge) LastRun() *QualityRun {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.lastRun
+}
+
+// qualityHandler reports the judge's scores over the range: their average
+// and share grounded, overall and by model and variant, the worst scored
+// answers, and the latest run with its regressions.
+func qualityHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, found, ok := analyticsInteractions(w, r)
+	if !ok {
+		return
+	}
+	report := QualityReport{From: from, To: to, Groups: qualityGroups(found), Lowest: []Interaction{}}
+	if quality != nil {
+		report.LastRun = quality.LastRun()
+	}
+	var total, grounded float64
+	for _, i := range found {
+		if i.Quality == nil {
+			continue
+		}
+		report.Judged++
+		total += float64(i.Quality.Score)
+		if i.Quality.Grounded {
+			grounded++
+		}
+		report.Lowest = append(report.Lowest, i)
+	}
+	if report.Judged > 0 {
+		avg, rate := total/float64(report.Judged), grounded/float64(report.Judged)
+		report.AvgScore, report.GroundedRate = &avg, &rate
+	}
+	sort.SliceStable(report.Lowest, func(i, j int) bool { return report.Lowest[i].Quality.Score < report.Lowest[j].Quality.Score })
+	if len(report.Lowest) > maxQualityLowest {
+		report.Lowest = report.Lowest[:maxQualityLowest]
+	}
+	if report.Groups == nil {
+		report.Groups = []QualityGroup{}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
+
+// runQualityHandler runs the judge now, which calls the model once per
+// answer scored, and returns the outcome.
+func runQualityHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if quality == nil {
+		w.WriteHeader(http.StatusConflict)
+		writeErrorBody(w, ErrorResponse{Error: "Answers are not scored, see QUALITY_SAMPLE_RATE"})
+		return
+	}
+	run, err := quality.Run(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to score answer quality", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Could not score answers"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(run)
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultTrustedProxies are the addresses whose X-Forwarded-For is believed
+// when TRUSTED_PROXIES is not set: loopback only. Private ranges are not
+// trusted by default, since any other host or container on the network
+// could then claim to be the proxy and name any client it likes.
+const defaultTrustedProxies = "127.0.0.0/8,::1/128"
+
+var (
+	trustedProxies []netip.Prefix
+
+	// rateLimitRedis holds the buckets of every limit when
+	// RATE_LIMIT_REDIS_URL is set.
+	rateLimitRedis *redis.Client
+
+	// The chat rate limits; a limiter's Get is nil when the limit is off,
+	// and unsignedLimiter's when request signing is.
+	ipLimiter       = &limiterSlot{name: "ip", prefix: "RATE_LIMIT", limit: rateLimitSetting{30, 10}}
+	sessionLimiter  = &limiterSlot{name: "session", prefix: "RATE_LIMIT_SESSION", limit: rateLimitSetting{0, 5}}
+	apiKeyLimiter   = &limiterSlot{name: "key", prefix: "RATE_LIMIT_API_KEY", limit: rateLimitSetting{0, 60}}
+	unsignedLimiter = &limiterSlot{name: "unsigned", prefix: "RATE_LIMIT_UNSIGNED", limit: rateLimitSetting{6, 3}}
+	chatLimiters    = []*limiterSlot{ipLimiter, sessionLimiter, apiKeyLimiter, unsignedLimiter}
+
+	rateLimited = expvar.NewMap("rate_limited")
+)
+
+// RateLimiter decides whether the client identified by key may make another
+// request, and if not how long it has to wait.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string) (bool, time.Duration, error)
+}
+
+// loadRateLimitConfig reads the chat rate limits, each a sustained number of
+// requests per minute and how many of them may be made at once:
+// RATE_LIMIT_PER_MINUTE and RATE_LIMIT_BURST per client IP (30 and 10 by
+// default), RATE_LIMIT_SESSION_PER_MINUTE and RATE_LIMIT_SESSION_BURST per
+// conversation, and RATE_LIMIT_API_KEY_PER_MINUTE and
+// RATE_LIMIT_API_KEY_BURST per API key. A rate of 0 turns a limit off, as the
+// last two are by default. With request signing on, RATE_LIMIT_UNSIGNED_*
+// (6 and 3) also limit each IP's unsigned requests.
+//
+// Limits are counted by each instance unless RATE_LIMIT_REDIS_URL points to
+// a Redis server shared by all replicas. TRUSTED_PROXIES lists the
+// comma-separated addresses or CIDR ranges of the proxies whose
+// X-Forwarded-For names the client, loopback by default. Behind a proxy
+// that connects from elsewhere, such as a load balancer or an ingress in
+// another container, operators must list its addresses, or every request
+// is counted against the proxy's own IP.
+func loadRateLimitConfig() {
+	trustedProxies = nil
+	for _, s := range strings.Split(getEnv("TRUSTED_PROXIES", defaultTrustedProxies), ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				configProblem("TRUSTED_PROXIES: %v", err)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		trustedProxies = append(trustedProxies, prefix.Masked())
+	}
+
+	if url := getEnv("RATE_LIMIT_REDIS_URL", ""); url != "" {
+		client, err := openRedis(url)
+		if err != nil {
+			configProblem("RATE_LIMIT_REDIS_URL: %v", err)
+		} else {
+			rateLimitRedis = client
+			registerHealthCheck("redis", pingCheck(redisPinger{client}))
+			whenConfigValid(func() {
+				ctx, cancel := context.WithTimeout(context.Background(), redisConnectTimeout)
+				defer cancel()
+				if err := client.Ping(ctx).Err(); err != nil {
+					slog.Warn("Redis at RATE_LIMIT_REDIS_URL is unreachable, limiting per instance until it is back", "err", err)
+				}
+			})
+		}
+	}
+
+	limits, err := readRateLimits()
+	if err != nil {
+		configProblem("%v", err)
+		return
+	}
+	setRateLimits(limits)
+}
+
+// rateLimitSetting is a sustained number of requests per minute and how
+// many of them may be made at once; either at 0 turns the limit off.
+type rateLimitSetting struct {
+	PerMinute float64
+	Burst     int
+}
+
+func (l rateLimitSetting) off() bool {
+	return l.PerMinute == 0 || l.Burst == 0
+}
+
+func (l rateLimitSetting) String() string {
+	if l.off() {
+		return "off"
+	}
+	return fmt.Sprintf("%g a minute, bursts of %d", l.PerMinute, l.Burst)
+}
+
+// limiterSlot holds the limiter of one chat rate limit, name, set by
+// prefix+"_PER_MINUTE" and prefix+"_BURST" and replaced when the settings
+// are reloaded.
+type limiterSlot struct {
+	name, prefix string
+	// limit is the default.
+	limit rateLimitSetting
+
+	current atomic.Pointer[installedLimiter]
+}
+
+type installedLimiter struct {
+	limit   rateLimitSetting
+	limiter RateLimiter
+	local   *rateLimiter
+	stop    chan struct{}
+}
+
+// Get returns the limiter in use, nil when the limit is off.
+func (s *limiterSlot) Get() RateLimiter {
+	if l := s.current.Load(); l != nil {
+		return l.limiter
+	}
+	return nil
+}
+
+// inUse returns the limit in use, zero when it is off.
+func (s *limiterSlot) inUse() rateLimitSetting {
+	if l := s.current.Load(); l != nil {
+		return l.limit
+	}
+	return rateLimitSetting{}
+}
+
+// read returns the limit the settings ask for.
+func (s *limiterSlot) read() (rateLimitSetting, error) {
+	limit := rateLimitSetting{
+		PerMinute: getEnvFloat(s.prefix+"_PER_MINUTE", s.limit.PerMinute),
+		Burst:     getEnvInt(s.prefix+"_BURST", s.limit.Burst),
+	}
+	if limit.PerMinute < 0 || limit.Burst < 0 {
+		return limit, fmt.Errorf("%s_PER_MINUTE or %s_BURST: must not be negative", s.prefix, s.prefix)
+	}
+	return limit, nil
+}
+
+// set puts a limiter for limit in use, unless it already is. The buckets
+// counted on this instance carry over, so changing a limit does not let
+// every client start again with a full burst.
+func (s *limiterSlot) set(limit rateLimitSetting) {
+	old := s.current.Load()
+	if old == nil && limit.off() || old != nil && old.limit == limit {
+		return
+	}
+	var next *installedLimiter
+	if !limit.off() {
+		local := newRateLimiter(limit.PerMinute/60, float64(limit.Burst))
+		if old != nil {
+			old.local.mu.Lock()
+			for key, b := range old.local.buckets {
+				bucket := *b
+				local.buckets[key] = &bucket
+			}
+			old.local.mu.Unlock()
+		}
+		next = &installedLimiter{limit: limit, limiter: local, local: local, stop: make(chan struct{})}
+		go local.janitor(time.Minute, next.stop)
+		where := "on this instance"
+		if rateLimitRedis != nil {
+			next.limiter = &redisLimiter{client: rateLimitRedis, name: s.name, rate: limit.PerMinute / 60, burst: float64(limit.Burst), fallback: local}
+			where = "in Redis"
+		}
+		slog.Info("Rate limiting chat", "per_minute", limit.PerMinute, "per", s.name, "burst", limit.Burst, "counted", where)
+	} else {
+		slog.Info("Not rate limiting chat", "per", s.name)
+	}
+	s.current.Store(next)
+	if old != nil {
+		close(old.stop)
+	}
+}
+
+// rateLimits are the chat rate limits the settings ask for, by limiter.
+type rateLimits map[*limiterSlot]rateLimitSetting
+
+// readRateLimits reads every chat rate limit, the unsigned one off unless
+// request signing is on.
+func readRateLimits() (rateLimits, error) {
+	limits := rateLimits{}
+	for _, s := range chatLimiters {
+		if s == unsignedLimiter && signer == nil {
+			limits[s] = rateLimitSetting{}
+			continue
+		}
+		limit, err := s.read()
+		if err != nil {
+			return nil, err
+		}
+		limits[s] = limit
+	}
+	return limits, nil
+}
+
+func setRateLimits(limits rateLimits) {
+	for _, s := range chatLimiters {
+		s.set(limits[s])
+	}
+}
+
+// clientIP returns the address of the client that made r. Behind trusted
+// proxies it is the rightmost X-Forwarded-For entry not added by one of
+// them; entries further left were written by the client and can be forged.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return host
+	}
+	addr = addr.Unmap()
+
+	if !trustedProxy(addr) {
+		return addr.String()
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		addr = hop.Unmap()
+		if !trustedProxy(addr) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+func trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// rateLimiter is a set of token buckets in memory, one per key, refilled at
+// rate tokens a second up to burst.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: burst, buckets: map[string]*tokenBucket{}}
+}
+
+// Allow takes a token from key's bucket. When it is empty it reports how
+// long until the next token.
+func (l *rateLimiter) Allow(_ context.Context, key string) (bool, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), nil
+	}
+	b.tokens--
+	return true, 0, nil
+}
+
+// janitor drops the buckets that have refilled, which lose nothing by
+// starting over, until stop is closed.
+func (l *rateLimiter) janitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		l.mu.Lock()
+		for key, b := range l.buckets {
+			if b.tokens+time.Since(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// redisTokenBucket is the token bucket of rateLimiter run atomically in
+// Redis on the server's clock, so every replica takes from the same bucket.
+// The key expires once the bucket has refilled.
+var redisTokenBucket = redis.NewScript(`
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(b[1]) or burst
+local last = tonumber(b[2]) or now
+tokens = math.min(burst, tokens + (now - last) / 1000 * rate)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+return {allowed, wait}`)
+
+// redisLimiter keeps its buckets in Redis, under satbot:ratelimit:<name>:
+// keys. While Redis is unreachable requests are counted by fallback, so the
+// limit still holds per instance; that is logged when it starts and ends,
+// not on every request.
+type redisLimiter struct {
+	client   *redis.Client
+	name     string
+	rate     float64
+	burst    float64
+	fallback *rateLimiter
+	// down is whether the last request was counted by fallback.
+	down atomic.Bool
+}
+
+func (l *redisLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	result, err := redisTokenBucket.Run(ctx, l.client, []string{"satbot:ratelimit:" + l.name + ":" + key}, l.rate, l.burst).Int64Slice()
+	if err == nil && len(result) != 2 {
+		err = fmt.Errorf("unexpected reply %v", result)
+	}
+	if err == nil {
+		if l.down.CompareAndSwap(true, false) {
+			slog.Info("Rate limit store is back, counting in Redis again", "per", l.name)
+		}
+		return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+	}
+	if l.down.CompareAndSwap(false, true) {
+		slog.ErrorContext(ctx, "Rate limit store failed, counting on this instance", "per", l.name, "err", err)
+	}
+	return l.fallback.Allow(ctx, key)
+}
+
+// allowRequest takes a request from key's allowance in limiter and reports
+// whether it may go ahead, answering 429 with a Retry-After when it may not.
+// Admins are not limited.
+func allowRequest(w http.ResponseWriter, r *http.Request, limiter RateLimiter, name, key string) bool {
+	if limiter == nil || key == "" || isAdmin(r) {
+		return true
+	}
+	ok, wait, err := limiter.Allow(r.Context(), key)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Rate limit store failed, counting on this instance", "err", err)
+	}
+	if ok {
+		return true
+	}
+
+	rateLimited.Add(name, 1)
+	reportAbuse(r, abuseRateLimited)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	w.WriteHeader(http.StatusTooManyRequests)
+	writeErrorBody(w, ErrorResponse{Error: "Too many requests, please slow down", Code: "rate_limited"})
+	return false
+}
+
+// rateLimit rejects clients that send chat requests faster than the per-IP
+// limit allows, or than the unsigned limit when their requests are not
+// signed.
+func rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if allowRequest(w, r, ipLimiter.Get(), "ip", clientIP(r)) && checkSignature(w, r) {
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst float64
+		// requests are made at once; want is which are allowed.
+		requests int
+		want     []bool
+	}{
+		{"within burst", 1, 3, 3, []bool{true, true, true}},
+		{"over burst", 1, 3, 5, []bool{true, true, true, false, false}},
+		{"burst of one", 0.5, 1, 2, []bool{true, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimiter(tt.rate, tt.burst)
+			for i := range tt.requests {
+				ok, wait, err := l.Allow(context.Background(), "203.0.113.7")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok != tt.want[i] {
+					t.Fatalf("request %d allowed = %v, want %v", i+1, ok, tt.want[i])
+				}
+				maxWait := time.Duration(float64(time.Second) / tt.rate)
+				if !ok && (wait <= 0 || wait > maxWait) {
+					t.Errorf("request %d told to wait %v, want up to %v", i+1, wait, maxWait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterKeysAndRefill(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	ctx := context.Background()
+	for range 2 {
+		l.Allow(ctx, "a")
+	}
+	if ok, _, _ := l.Allow(ctx, "a"); ok {
+		t.Fatal("a allowed past its burst")
+	}
+	if ok, _, _ := l.Allow(ctx, "b"); !ok {
+		t.Error("b limited by the requests of a")
+	}
+
+	// Two seconds later a has two tokens again, and no more.
+	l.mu.Lock()
+	l.buckets["a"].last = l.buckets["a"].last.Add(-2 * time.Second)
+	l.mu.Unlock()
+	for i := range 2 {
+		if ok, _, _ := l.Allow(ctx, "a"); !ok {
+			t.Fatalf("refilled request %d limited", i+1)
+		}
+	}
+	if ok, _, _ := l.Allow(ctx, "a"); ok {
+		t.Error("bucket refilled past its burst")
+	}
+}
+
+func TestRedisLimiterFallsBack(t *testing.T) {
+	// Nothing listens on port 1, so every request is counted locally.
+	client, err := openRedis("redis://127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &redisLimiter{client: client, name: "ip", rate: 1, burst: 2, fallback: newRateLimiter(1, 2)}
+	want := []bool{true, true, false}
+	for i, w := range want {
+		ok, _, err := l.Allow(context.Background(), "203.0.113.7")
+		if err != nil {
+			t.Fatalf("request %d: %v, want the fallback to answer", i+1, err)
+		}
+		if ok != w {
+			t.Fatalf("request %d allowed = %v, want %v", i+1, ok, w)
+		}
+	}
+	if !l.down.Load() {
+		t.Error("limiter not marked down while Redis is unreachable")
+	}
+}
+
+func TestRedisLimiterShared(t *testing.T) {
+	server := miniredis.RunT(t)
+	client, err := openRedis("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two replicas take from the same bucket.
+	replicas := []*redisLimiter{
+		{client: client, name: "ip", rate: 1, burst: 2, fallback: newRateLimiter(1, 2)},
+		{client: client, name: "ip", rate: 1, burst: 2, fallback: newRateLimiter(1, 2)},
+	}
+	ctx := context.Background()
+	want := []bool{true, true, false}
+	for i, w := range want {
+		ok, wait, err := replicas[i%2].Allow(ctx, "203.0.113.7")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != w {
+			t.Fatalf("request %d allowed = %v, want %v", i+1, ok, w)
+		}
+		if !ok && (wait <= 0 || wait > time.Second) {
+			t.Errorf("request %d told to wait %v, want up to 1s", i+1, wait)
+		}
+	}
+	if !server.Exists("satbot:ratelimit:ip:203.0.113.7") {
+		t.Error("bucket not kept under its key")
+	}
+	if ok, _, _ := replicas[0].Allow(ctx, "198.51.100.1"); !ok {
+		t.Error("another client limited by the requests of the first")
+	}
+
+	server.Close()
+	if ok, _, err := replicas[0].Allow(ctx, "203.0.113.7"); err != nil || !ok {
+		t.Errorf("with Redis down allowed = %v, %v, want the fallback's fresh bucket", ok, err)
+	}
+	if !replicas[0].down.Load() {
+		t.Error("limiter not marked down")
+	}
+	if err := server.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := replicas[0].Allow(ctx, "203.0.113.7"); err != nil || ok {
+		t.Errorf("with Redis back allowed = %v, %v, want the shared bucket, still empty", ok, err)
+	}
+	if replicas[0].down.Load() {
+		t.Error("limiter still marked down with Redis back")
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	t.Setenv("ADMIN_API_KEY", "admin-secret")
+	ctx := context.Background()
+	l := newRateLimiter(1, 1)
+	l.Allow(ctx, "visitor")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/chat", nil)
+	if allowRequest(w, r, l, "ip", "visitor") {
+		t.Fatal("request allowed past the limit")
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("got %d with Retry-After %q, want 429 with 1", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	r.Header.Set("X-Admin-Key", "admin-secret")
+	if !allowRequest(httptest.NewRecorder(), r, l, "ip", "visitor") {
+		t.Error("admin request limited")
+	}
+	if !allowRequest(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/chat", nil), nil, "ip", "visitor") {
+		t.Error("request limited without a limiter")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies := trustedProxies
+	t.Cleanup(func() { trustedProxies = proxies })
+
+	tests := []struct {
+		name    string
+		trusted string
+		remote  string
+		forward string
+		want    string
+	}{
+		{"loopback proxy", "", "127.0.0.1:5000", "203.0.113.7", "203.0.113.7"},
+		{"private network not trusted by default", "", "10.0.0.5:5000", "203.0.113.7", "10.0.0.5"},
+		{"listed proxy", "10.0.0.0/8", "10.0.0.5:5000", "203.0.113.7", "203.0.113.7"},
+		{"chain of listed proxies", "10.0.0.0/8,192.0.2.1", "10.0.0.5:5000", "203.0.113.7, 192.0.2.1", "203.0.113.7"},
+		{"spoofed hop before the proxy", "10.0.0.0/8", "10.0.0.5:5000", "198.51.100.1, 203.0.113.7", "203.0.113.7"},
+		{"direct client", "", "203.0.113.7:5000", "198.51.100.1", "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tt.trusted)
+			if problems := collectConfigProblems(loadRateLimitConfig); len(problems) > 0 {
+				t.Fatal(problems)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/chat", nil)
+			r.RemoteAddr = tt.remote
+			r.Header.Set("X-Forwarded-For", tt.forward)
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisMaxIdle        = 8
+	redisConnectTimeout = 5 * time.Second
+)
+
+func init() {
+	redis.SetLogger(redisLogger{})
+}
+
+// redisLogger sends the driver's own messages, such as every failed dial,
+// to the debug log; callers report the failures that matter once.
+type redisLogger struct{}
+
+func (redisLogger) Printf(ctx context.Context, format string, v ...any) {
+	slog.DebugContext(ctx, "Redis client", "message", fmt.Sprintf(format, v...))
+}
+
+// openRedis parses a redis:// or rediss:// URL, with an optional password
+// and database number as in redis://:password@host:6379/0. Connections are
+// made on first use. Failed commands are not retried, since callers fall
+// back rather than wait.
+func openRedis(rawURL string) (*redis.Client, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	opts.DialTimeout = redisConnectTimeout
+	opts.DialerRetries = 1
+	opts.MaxRetries = -1
+	opts.MaxIdleConns = redisMaxIdle
+	return redis.NewClient(opts), nil
+}
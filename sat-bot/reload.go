@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// settingsReloadMu serializes settings reloads, from SIGHUP and the admin
+// API.
+var settingsReloadMu sync.Mutex
+
+// ReloadResult is what reloading the settings did.
+type ReloadResult struct {
+	// Changed are the groups of settings put in use: cors, prompt,
+	// generation and rate_limits.
+	Changed []string `json:"changed"`
+	// Restart are the settings of the configuration file that changed but
+	// only apply once the bot is restarted.
+	Restart []string `json:"restart,omitempty"`
+	// Error and Problems say why nothing was reloaded, the current settings
+	// staying in use.
+	Error    string   `json:"error,omitempty"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// reloadSettings reads the configuration file and the environment again
+// and puts in use the settings safe to change while the bot runs: the
+// prompt variables and PROMPT_DIR, whose template is read again, the CORS
+// origins, the chat rate limits and the generation parameters. Requests in
+// flight finish with the settings they started with, and the rate limits
+// keep counting the requests already made. When a setting is invalid
+// nothing changes. It also returns the changes as - and + lines, for the
+// audit log.
+func reloadSettings(reason string) (ReloadResult, string) {
+	settingsReloadMu.Lock()
+	defer settingsReloadMu.Unlock()
+
+	path, values, err := readSettings()
+	if err != nil {
+		result := ReloadResult{Changed: []string{}, Error: "Invalid configuration file", Problems: []string{err.Error()}}
+		slog.Error("Settings reload failed, keeping the current ones", "reason", reason, "problems", result.Problems)
+		return result, ""
+	}
+	oldPath, oldValues := settings.replace(path, values)
+
+	var (
+		origins []string
+		vars    PromptData
+		dir     string
+		params  GenerationParams
+		limits  rateLimits
+	)
+	var problems []string
+	reloadable := settings.watch(func() {
+		problems = collectConfigProblems(func() {
+			origins = readCORSConfig()
+			vars, dir = readPromptConfig()
+			var err error
+			if params, err = readGenerationConfig(); err != nil {
+				configProblem("Generation parameters: %v", err)
+			}
+			if limits, err = readRateLimits(); err != nil {
+				configProblem("%v", err)
+			}
+		})
+	})
+	problems = append(problems, originProblems(origins)...)
+	if len(problems) > 0 {
+		settings.replace(oldPath, oldValues)
+		slog.Error("Settings reload failed, keeping the current ones", "reason", reason, "problems", problems)
+		return ReloadResult{Changed: []string{}, Error: "Invalid configuration", Problems: problems}, ""
+	}
+
+	result := ReloadResult{Changed: []string{}}
+	var diff strings.Builder
+	changed := func(group, name string, old, new any) bool {
+		if reflect.DeepEqual(old, new) {
+			return false
+		}
+		if !slices.Contains(result.Changed, group) {
+			result.Changed = append(result.Changed, group)
+		}
+		fmt.Fprintf(&diff, "- %s: %v\n+ %s: %v\n", name, old, name, new)
+		return true
+	}
+
+	if changed("cors", "CORS origins", *allowedOrigins.Load(), origins) {
+		allowedOrigins.Store(&origins)
+	}
+	// The template is read again either way, for an edit to be checked now.
+	changed("prompt", "prompt", promptSettings(currentPromptVars(), filepath.Dir(systemTemplate.Load().path)), promptSettings(vars, filepath.Clean(dir)))
+	setPromptConfig(vars, dir)
+	if changed("generation", "generation parameters", currentGeneration(), params) {
+		generation.Store(&params)
+	}
+	for _, s := range chatLimiters {
+		limit := limits[s]
+		if limit.off() {
+			limit = rateLimitSetting{}
+		}
+		if changed("rate_limits", s.name+" rate limit", s.inUse(), limit) {
+			s.set(limit)
+		}
+	}
+
+	for key, value := range values {
+		if oldValues[key] != value && !reloadable[key] && !lazySettings[key] {
+			result.Restart = append(result.Restart, key)
+		}
+	}
+	for key := range oldValues {
+		if _, ok := values[key]; !ok && !reloadable[key] && !lazySettings[key] {
+			result.Restart = append(result.Restart, key)
+		}
+	}
+	sort.Strings(result.Restart)
+	if len(result.Restart) > 0 {
+		slog.Warn("Changed settings only apply after a restart", "reason", reason, "settings", result.Restart)
+	}
+	slog.Info("Settings reloaded", "reason", reason, "changed", result.Changed)
+	return result, diff.String()
+}
+
+// promptSettings is how the prompt settings read in the audit log.
+func promptSettings(vars PromptData, dir string) string {
+	return fmt.Sprintf("fest %q, institute %q, edition %q, dates %q, directory %q", vars.FestName, vars.Institute, vars.Edition, vars.Dates, dir)
+}
+
+// reloadSettingsHandler reloads the settings, see reloadSettings, and
+// returns what changed, or 422 with the problems found.
+func reloadSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	result, diff := reloadSettings("admin request")
+	auditChange(r, diff)
+	if result.Error != "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(result)
+}
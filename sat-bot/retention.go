@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// retentionPolicy is how long what visitors asked is kept: the stored
+// interactions with their feedback, and the knowledge gaps. Aggregates that
+// hold no questions, such as the daily usage counters and the metrics, are
+// not purged.
+type retentionPolicy struct {
+	period   time.Duration
+	interval time.Duration
+	dryRun   bool
+}
+
+var retention retentionPolicy
+
+type RetentionReport struct {
+	// Before is the cutoff; what was recorded earlier is purged.
+	Before        time.Time `json:"before"`
+	DryRun        bool      `json:"dry_run"`
+	Interactions  int       `json:"interactions"`
+	KnowledgeGaps int       `json:"knowledge_gaps"`
+}
+
+// loadRetention reads RETENTION_PERIOD, how long questions and answers are
+// kept, such as 2160h for 90 days (0, the default, keeps them);
+// RETENTION_INTERVAL, how often the purge runs (1h); and RETENTION_DRY_RUN,
+// which only logs what the purge would delete.
+func loadRetention() {
+	retention = retentionPolicy{
+		period:   getEnvDuration("RETENTION_PERIOD", 0),
+		interval: getEnvDuration("RETENTION_INTERVAL", time.Hour),
+		dryRun:   getEnv("RETENTION_DRY_RUN", "false") == "true",
+	}
+	if retention.period < 0 {
+		configProblem("RETENTION_PERIOD: must not be negative")
+		retention.period = 0
+	}
+	if retention.period == 0 {
+		return
+	}
+	if retention.interval <= 0 {
+		configProblem("RETENTION_INTERVAL: must be positive")
+		retention.interval = time.Hour
+	}
+	slog.Info("Purging old questions", "period", retention.period.String(), "dry_run", retention.dryRun)
+	go retention.loop()
+}
+
+func (p retentionPolicy) loop() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		report, err := p.purge(context.Background(), p.dryRun)
+		if err == nil && !report.DryRun && report.purged() {
+			recordAudit("retention", "purge", "", report.diff())
+		}
+		<-ticker.C
+	}
+}
+
+// purge deletes what is older than the retention period, or with dryRun
+// only counts it, and logs the outcome.
+func (p retentionPolicy) purge(ctx context.Context, dryRun bool) (RetentionReport, error) {
+	report := RetentionReport{Before: time.Now().Add(-p.period).UTC(), DryRun: dryRun}
+	if gaps != nil {
+		report.KnowledgeGaps = gaps.Purge(report.Before, dryRun)
+	}
+	if interactions != nil {
+		ctx, cancel := context.WithTimeout(ctx, interactionStoreTimeout)
+		defer cancel()
+		filter := InteractionFilter{Until: report.Before}
+		var err error
+		if dryRun {
+			var found []Interaction
+			found, err = interactions.List(ctx, filter)
+			report.Interactions = len(found)
+		} else {
+			report.Interactions, err = interactions.Delete(ctx, filter)
+		}
+		if err != nil {
+			slog.Error("Failed to purge interactions", "before", report.Before, "dry_run", dryRun, "err", err)
+			return report, err
+		}
+	}
+	if report.purged() {
+		msg := "Purged old questions"
+		if dryRun {
+			msg = "Would purge old questions"
+		}
+		slog.Info(msg,
+			"before", report.Before,
+			"dry_run", dryRun,
+			"interactions", report.Interactions,
+			"knowledge_gaps", report.KnowledgeGaps,
+		)
+	}
+	return report, nil
+}
+
+func (r RetentionReport) purged() bool {
+	return r.Interactions > 0 || r.KnowledgeGaps > 0
+}
+
+// diff is the audit entry of a purge.
+func (r RetentionReport) diff() string {
+	return fmt.Sprintf("- %d interactions and %d knowledge gaps before %s\n", r.Interactions, r.KnowledgeGaps, r.Before.Format(time.RFC3339))
+}
+
+// retentionPurgeHandler runs the purge now. dry_run=true, or
+// RETENTION_DRY_RUN, only reports what it would delete.
+func retentionPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if retention.period == 0 {
+		w.WriteHeader(http.StatusConflict)
+		writeErrorBody(w, ErrorResponse{Error: "No retention period is set, see RETENTION_PERIOD"})
+		return
+	}
+	report, err := retention.purge(r.Context(), retention.dryRun || r.URL.Query().Get("dry_run") == "true")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to purge interactions"})
+		return
+	}
+	if !report.DryRun {
+		auditChange(r, report.diff())
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
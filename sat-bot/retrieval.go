@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Citation names a piece of the knowledge base an answer was based on.
+type Citation struct {
+	Document string `json:"document"`
+	Section  string `json:"section,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// retrievalIndex holds the chunks of one knowledge base snapshot, with a
+// keyword index and, once they have been embedded, their vectors.
+type retrievalIndex struct {
+	fingerprint string
+	chunks      []Chunk
+	bm25        *bm25Index
+	vectors     [][]float32
+}
+
+// Retrieval modes. In auto mode vectors are used when embeddings are
+// configured and the full context is sent otherwise.
+const (
+	retrievalAuto   = "auto"
+	retrievalVector = "vector"
+	retrievalBM25   = "bm25"
+	retrievalHybrid = "hybrid"
+	retrievalOff    = "off"
+)
+
+const (
+	// embedBatchSize is how many chunks are sent per embeddings request.
+	embedBatchSize = 64
+	// indexBuildTimeout bounds embedding the whole knowledge base.
+	indexBuildTimeout = 2 * time.Minute
+	// rrfK damps reciprocal rank fusion so that one ranking's top result
+	// cannot outweigh agreement between both rankings further down.
+	rrfK = 60
+)
+
+var (
+	// retrievalTopK is how many chunks are injected into a prompt; 0 sends
+	// the whole knowledge base instead.
+	retrievalTopK = 6
+	// retrievalMode is the resolved mode: vector, bm25, hybrid or off.
+	retrievalMode = retrievalOff
+
+	index atomic.Pointer[retrievalIndex]
+
+	retrievalQueries   expvar.Int
+	retrievalFallbacks expvar.Int
+)
+
+func init() {
+	expvar.Publish("retrieval", expvar.Func(func() any {
+		chunks, embedded := 0, false
+		if idx := index.Load(); idx != nil {
+			chunks = len(idx.chunks)
+			embedded = idx.vectors != nil
+		}
+		return map[string]any{
+			"enabled":   retrievalEnabled(),
+			"mode":      retrievalMode,
+			"chunks":    chunks,
+			"embedded":  embedded,
+			"queries":   retrievalQueries.Value(),
+			"fallbacks": retrievalFallbacks.Value(),
+		}
+	}))
+}
+
+// loadRetrievalConfig reads RETRIEVAL_MODE, RETRIEVAL_TOP_K and the chunking
+// settings and indexes the knowledge base. The bm25 mode ranks chunks by
+// keywords and needs no embeddings; vector and hybrid need them.
+func loadRetrievalConfig() {
+	retrievalTopK = getEnvInt("RETRIEVAL_TOP_K", retrievalTopK)
+	loadChunkConfig()
+
+	mode := strings.ToLower(getEnv("RETRIEVAL_MODE", retrievalAuto))
+	switch mode {
+	case retrievalAuto:
+		mode = retrievalOff
+		if embeddings != nil {
+			mode = retrievalVector
+		}
+	case retrievalVector, retrievalHybrid:
+		if embeddings == nil {
+			configProblem("RETRIEVAL_MODE: %s needs EMBEDDINGS_BASE_URL", mode)
+			mode = retrievalOff
+		}
+	case retrievalBM25, retrievalOff:
+	default:
+		configProblem("RETRIEVAL_MODE: unknown mode %q", mode)
+		mode = retrievalOff
+	}
+	retrievalMode = mode
+	if !retrievalEnabled() {
+		return
+	}
+	slog.Info("Retrieving context chunks for each question", "top_k", retrievalTopK, "mode", retrievalMode)
+	// Vectors are fetched from the embeddings API.
+	whenConfigValid(func() { rebuildIndex(currentKnowledge()) })
+}
+
+func retrievalEnabled() bool {
+	return retrievalMode != retrievalOff && retrievalTopK > 0 && chunkTokens > 0
+}
+
+// usesVectors reports whether the current mode ranks chunks by embeddings.
+func usesVectors() bool {
+	return retrievalMode == retrievalVector || retrievalMode == retrievalHybrid
+}
+
+// rebuildIndex chunks kb and builds its keyword index straight away, which
+// is cheap, then embeds the chunks in the background if the mode uses
+// vectors. Until the vectors are ready, and if embedding fails, questions
+// are ranked by keywords alone.
+func rebuildIndex(kb *KnowledgeBase) {
+	if !retrievalEnabled() || kb == nil {
+		return
+	}
+
+	idx := newRetrievalIndex(kb)
+	index.Store(idx)
+	if !usesVectors() {
+		slog.Info("Indexed context chunks for retrieval", "chunks", len(idx.chunks))
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), indexBuildTimeout)
+		defer cancel()
+
+		vectors, err := embedChunks(ctx, idx.chunks)
+		if err != nil {
+			slog.Error("Failed to embed context for retrieval", "err", err)
+			return
+		}
+		// A newer snapshot may have been loaded while this one was embedded.
+		if current := index.Load(); current == nil || current.fingerprint != idx.fingerprint {
+			return
+		}
+		embedded := *idx
+		embedded.vectors = vectors
+		index.Store(&embedded)
+		slog.Info("Indexed context chunks for retrieval", "chunks", len(idx.chunks))
+	}()
+}
+
+// newRetrievalIndex chunks kb and builds the keyword index of the chunks.
+func newRetrievalIndex(kb *KnowledgeBase) *retrievalIndex {
+	idx := &retrievalIndex{fingerprint: kb.fingerprint}
+	for _, doc := range kb.Documents {
+		idx.chunks = append(idx.chunks, chunkDocument(doc)...)
+	}
+	idx.bm25 = newBM25Index(idx.chunks)
+	return idx
+}
+
+// embedChunks returns a vector per chunk. Vectors found in the vector store
+// are reused and the rest are embedded and saved to it; a store that fails
+// only costs the embeddings it would have saved.
+func embedChunks(ctx context.Context, chunks []Chunk) ([][]float32, error) {
+	keys := make([]string, len(chunks))
+	texts := make([]string, len(chunks))
+	for i, c := range chunks {
+		texts[i] = c.Label() + "\n" + c.Text
+		keys[i] = vectorKey(embeddings.model, texts[i])
+	}
+
+	stored := map[string][]float32{}
+	if vectorStore != nil {
+		lookupCtx, cancel := context.WithTimeout(ctx, vectorStoreTimeout)
+		found, err := vectorStore.Lookup(lookupCtx, keys)
+		cancel()
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to look up stored embeddings", "err", err)
+		} else {
+			stored = found
+		}
+	}
+
+	var missing []int
+	for i, key := range keys {
+		if _, ok := stored[key]; !ok {
+			missing = append(missing, i)
+		}
+	}
+	fresh := map[string][]float32{}
+	for start := 0; start < len(missing); start += embedBatchSize {
+		batch := missing[start:min(start+embedBatchSize, len(missing))]
+		batchTexts := make([]string, len(batch))
+		for j, i := range batch {
+			batchTexts[j] = texts[i]
+		}
+		vectors, err := embeddings.Embed(ctx, batchTexts)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range batch {
+			fresh[keys[i]] = vectors[j]
+		}
+	}
+
+	if vectorStore != nil && len(fresh) > 0 {
+		saveCtx, cancel := context.WithTimeout(ctx, vectorStoreTimeout)
+		if err := vectorStore.Save(saveCtx, fresh); err != nil {
+			slog.ErrorContext(ctx, "Failed to store embeddings", "err", err)
+		}
+		cancel()
+	}
+	if vectorStore != nil {
+		slog.InfoContext(ctx, "Embedded context chunks", "reused", len(chunks)-len(missing), "embedded", len(missing))
+	}
+
+	result := make([][]float32, len(chunks))
+	for i, key := range keys {
+		if v, ok := stored[key]; ok {
+			result[i] = v
+		} else {
+			result[i] = fresh[key]
+		}
+	}
+	return result, nil
+}
+
+// retrieveKnowledge selects the context to inject for question: the chunks
+// of namespace most relevant to it, best first. An empty namespace leaves
+// the choice to the classifier. It selects the full context of the
+// namespace when retrieval is off, the index is not ready for the current
+// snapshot, or nothing in it matches the question. Vector ranking falls back
+// to keywords when the question cannot be embedded in time.
+func retrieveKnowledge(ctx context.Context, question, namespace string) *contextSelection {
+	kb := currentKnowledge()
+	if namespace == "" {
+		namespace = classifyNamespace(ctx, kb, question)
+	}
+	full := &contextSelection{kb: kb, namespace: namespace, question: question, text: kb.scopedText(namespace)}
+	if !retrievalEnabled() {
+		return full
+	}
+	idx := index.Load()
+	if idx == nil || idx.fingerprint != kb.fingerprint || len(idx.chunks) == 0 {
+		retrievalFallbacks.Add(1)
+		return full
+	}
+
+	var vector []float32
+	if usesVectors() && idx.vectors != nil {
+		ctx, cancel := context.WithTimeout(ctx, semanticLookupTimeout)
+		defer cancel()
+		vectors, err := embeddings.Embed(ctx, []string{question})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to embed question for retrieval", "err", err)
+		} else {
+			vector = vectors[0]
+		}
+	}
+	full.vector = vector
+	selection := &contextSelection{kb: kb, namespace: namespace, question: question, vector: vector}
+	var chunks []Chunk
+	if vector != nil {
+		ranking := idx.within(idx.vectorRanking(vector), namespace)
+		if len(ranking) > 0 {
+			selection.similarity = cosine(vector, idx.vectors[ranking[0]])
+		}
+		if retrievalMode == retrievalHybrid {
+			chunks = idx.fuse(ranking, idx.within(idx.keywordRanking(question), namespace), retrievalTopK)
+		} else {
+			chunks = idx.pick(ranking, retrievalTopK)
+		}
+	} else {
+		chunks = idx.pick(idx.within(idx.keywordRanking(question), namespace), retrievalTopK)
+	}
+	if len(chunks) == 0 {
+		retrievalFallbacks.Add(1)
+		full.unmatched = true
+		return full
+	}
+	if usesVectors() && vector == nil {
+		retrievalFallbacks.Add(1)
+	}
+	retrievalQueries.Add(1)
+	selection.text, selection.chunks = renderChunks(chunks), chunks
+	return selection
+}
+
+// citations lists the sections chunks came from, once each, in order.
+func citations(chunks []Chunk) []Citation {
+	var result []Citation
+	seen := map[Citation]bool{}
+	for _, c := range chunks {
+		cite := Citation{Document: c.Source, Section: c.Section, URL: c.URL}
+		if !seen[cite] {
+			seen[cite] = true
+			result = append(result, cite)
+		}
+	}
+	return result
+}
+
+// vectorRanking returns chunk positions by similarity to vector, best first.
+func (idx *retrievalIndex) vectorRanking(vector []float32) []int {
+	scores := make([]float64, len(idx.chunks))
+	for i := range idx.chunks {
+		scores[i] = cosine(vector, idx.vectors[i])
+	}
+	return rank(scores, false)
+}
+
+// keywordRanking returns the positions of chunks sharing a keyword with
+// question, best BM25 score first.
+func (idx *retrievalIndex) keywordRanking(question string) []int {
+	return rank(idx.bm25.scores(question), true)
+}
+
+// within keeps the positions in order of chunks in namespace ns or shared
+// by all namespaces. An empty ns keeps them all.
+func (idx *retrievalIndex) within(order []int, ns string) []int {
+	if ns == "" {
+		return order
+	}
+	kept := order[:0]
+	for _, i := range order {
+		if c := idx.chunks[i]; c.Namespace == ns || c.Namespace == "" {
+			kept = append(kept, i)
+		}
+	}
+	return kept
+}
+
+// rank orders positions by descending score, keeping ties in document
+// order. With matchOnly, chunks scoring zero are left out.
+func rank(scores []float64, matchOnly bool) []int {
+	order := make([]int, 0, len(scores))
+	for i, s := range scores {
+		if !matchOnly || s > 0 {
+			order = append(order, i)
+		}
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+	return order
+}
+
+// fuse merges two rankings by reciprocal rank fusion, which needs no
+// calibration between cosine and BM25 scores, and returns the top k chunks.
+func (idx *retrievalIndex) fuse(a, b []int, k int) []Chunk {
+	scores := make([]float64, len(idx.chunks))
+	for _, ranking := range [][]int{a, b} {
+		for r, i := range ranking {
+			scores[i] += 1 / float64(rrfK+r+1)
+		}
+	}
+	return idx.pick(rank(scores, true), k)
+}
+
+// pick returns the chunks at the first k positions of order.
+func (idx *retrievalIndex) pick(order []int, k int) []Chunk {
+	k = min(k, len(order))
+	chunks := make([]Chunk, k)
+	for i, j := range order[:k] {
+		chunks[i] = idx.chunks[j]
+	}
+	return chunks
+}
+
+// renderChunks formats retrieved chunks like renderContext does documents.
+func renderChunks(chunks []Chunk) string {
+	parts := make([]string, len(chunks))
+	for i, c := range chunks {
+		parts[i] = c.Label() + "\n" + c.Text
+	}
+	return strings.Join(parts, "\n\n")
+}
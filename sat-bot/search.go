@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSearchLimit is how many matches a search returns by default.
+const defaultSearchLimit = 50
+
+type InteractionSearchResponse struct {
+	From *time.Time `json:"from,omitempty"`
+	To   *time.Time `json:"to,omitempty"`
+	// Total is how many interactions matched, of which the latest are
+	// listed, newest first.
+	Total        int           `json:"total"`
+	Interactions []Interaction `json:"interactions"`
+}
+
+// interactionSearch is what a search keeps on top of the store's filter.
+type interactionSearch struct {
+	terms []string
+	// errors is "true" to keep the failed questions, "false" the answered
+	// ones, or empty for both.
+	errors string
+	// rating is up, down, none for the unrated ones, or empty for all.
+	rating string
+}
+
+// searchInteractionsHandler finds stored questions and answers for
+// moderators, newest first. q holds the words, or "quoted phrases", that
+// must all appear in the question, the answer or the feedback comment,
+// whatever their case; questions and answers are stored with personal
+// details masked, so an email address or phone number does not match. The
+// range is open unless from, to or last are given, and session_id keeps one
+// conversation, error=true or false those that failed or not, rating=up,
+// down or none those rated so, and limit caps the matches listed (50).
+func searchInteractionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	fail := func(status int, message string) {
+		w.WriteHeader(status)
+		writeErrorBody(w, ErrorResponse{Error: message})
+	}
+	q := r.URL.Query()
+	search := interactionSearch{terms: searchTerms(q.Get("q")), errors: q.Get("error"), rating: q.Get("rating")}
+	if search.errors != "" && search.errors != "true" && search.errors != "false" {
+		fail(http.StatusBadRequest, "error must be true or false")
+		return
+	}
+	switch search.rating {
+	case "", ratingUp, ratingDown, "none":
+	default:
+		fail(http.StatusBadRequest, "rating must be up, down or none")
+		return
+	}
+	limit := defaultSearchLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			fail(http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+	if interactions == nil {
+		fail(http.StatusServiceUnavailable, "Interactions are not stored, see INTERACTION_STORE")
+		return
+	}
+	filter, err := parseExportRange(r)
+	if err != nil {
+		fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	if id := strings.TrimSpace(q.Get("session_id")); id != "" {
+		filter.SessionIDs = []string{id}
+	}
+	found, err := interactions.List(r.Context(), filter)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list interactions", "err", err)
+		fail(http.StatusInternalServerError, "Could not read interactions")
+		return
+	}
+
+	resp := InteractionSearchResponse{Interactions: []Interaction{}}
+	if !filter.Since.IsZero() {
+		resp.From = &filter.Since
+	}
+	if !filter.Until.IsZero() {
+		resp.To = &filter.Until
+	}
+	for n := len(found) - 1; n >= 0; n-- {
+		if !search.match(found[n]) {
+			continue
+		}
+		resp.Total++
+		if len(resp.Interactions) < limit {
+			resp.Interactions = append(resp.Interactions, found[n])
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s interactionSearch) match(i Interaction) bool {
+	if s.errors != "" && (i.Error != "") != (s.errors == "true") {
+		return false
+	}
+	switch s.rating {
+	case "none":
+		if i.Feedback != nil {
+			return false
+		}
+	case ratingUp, ratingDown:
+		if i.Feedback == nil || i.Feedback.Rating != s.rating {
+			return false
+		}
+	}
+	if len(s.terms) == 0 {
+		return true
+	}
+	text := strings.ToLower(i.Question + "\n" + i.Answer)
+	if i.Feedback != nil {
+		text += "\n" + strings.ToLower(i.Feedback.Comment)
+	}
+	for _, term := range s.terms {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchTerms splits a query into lowercased words, keeping "quoted
+// phrases" whole.
+func searchTerms(query string) []string {
+	var terms []string
+	for n, part := range strings.Split(strings.ToLower(query), `"`) {
+		if n%2 == 1 {
+			if phrase := strings.Join(strings.Fields(part), " "); phrase != "" {
+				terms = append(terms, phrase)
+			}
+			continue
+		}
+		terms = append(terms, strings.Fields(part)...)
+	}
+	return terms
+}
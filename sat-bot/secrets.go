@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	vault "github.com/hashicorp/vault/api"
+)
+
+// secretsBackend fetches the secrets SatBot is configured with as
+// environment variable names and values.
+type secretsBackend interface {
+	Fetch(ctx context.Context) (map[string]string, error)
+}
+
+// loadSecrets reads SECRETS_BACKEND, vault or aws, and fetches the secret at
+// SECRETS_PATH from it: a Vault KV path such as secret/data/satbot, or an AWS
+// Secrets Manager secret ID or ARN holding a JSON object. Each field is set
+// as an environment variable, overriding .env, so GROQ_API_KEY and the other
+// settings can live in the backend. Secrets are fetched again every
+// SECRETS_REFRESH_INTERVAL (15m by default, 0 disables it); provider API keys
+// and settings read per request, such as ADMIN_API_KEY, pick up new values.
+// It must run before the loaders reading those settings, which is also
+// before validateConfig, so the problems found so far, this backend's
+// settings included, are reported before it is reached.
+//
+// Vault is reached at VAULT_ADDR with VAULT_TOKEN, or by logging in with
+// VAULT_ROLE_ID and VAULT_SECRET_ID through AppRole; VAULT_NAMESPACE is sent
+// when set, and the client's other VAULT_* variables, such as VAULT_CACERT,
+// apply. AWS uses the region in AWS_REGION and the SDK's default credential
+// chain: AWS_ACCESS_KEY_ID and the other variables, the shared config
+// files, the ECS task role or the EC2 instance role through IMDSv2.
+func loadSecrets() {
+	var backend secretsBackend
+	switch kind := strings.ToLower(getEnv("SECRETS_BACKEND", "")); kind {
+	case "":
+		return
+	case "vault":
+		addr := getEnv("VAULT_ADDR", "")
+		v := &vaultBackend{
+			token:    getEnv("VAULT_TOKEN", ""),
+			roleID:   getEnv("VAULT_ROLE_ID", ""),
+			secretID: getEnv("VAULT_SECRET_ID", ""),
+			path:     strings.Trim(getEnv("SECRETS_PATH", ""), "/"),
+		}
+		if addr == "" || v.path == "" || (v.token == "" && v.roleID == "") {
+			configProblem("SECRETS_BACKEND=vault: needs VAULT_ADDR, SECRETS_PATH and VAULT_TOKEN or VAULT_ROLE_ID")
+		} else if err := v.connect(addr, getEnv("VAULT_NAMESPACE", "")); err != nil {
+			configProblem("SECRETS_BACKEND=vault: %v", err)
+		}
+		backend = v
+	case "aws":
+		region := getEnv("AWS_REGION", getEnv("AWS_DEFAULT_REGION", ""))
+		a := &awsSecretsBackend{secretID: getEnv("SECRETS_PATH", "")}
+		if region == "" || a.secretID == "" {
+			configProblem("SECRETS_BACKEND=aws: needs AWS_REGION and SECRETS_PATH")
+		} else if err := a.connect(region, getEnv("AWS_ENDPOINT_URL", "")); err != nil {
+			configProblem("SECRETS_BACKEND=aws: %v", err)
+		}
+		backend = a
+	default:
+		configProblem("SECRETS_BACKEND: unknown backend %q", kind)
+	}
+	exitOnConfigProblems()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	secrets, err := backend.Fetch(ctx)
+	if err != nil {
+		log.Fatalf("Failed to fetch secrets from %s: %v", getEnv("SECRETS_BACKEND", ""), err)
+	}
+	applySecrets(secrets)
+	slog.Info("Loaded secrets", "count", len(secrets), "backend", getEnv("SECRETS_BACKEND", ""))
+
+	if interval := getEnvDuration("SECRETS_REFRESH_INTERVAL", 15*time.Minute); interval > 0 {
+		go refreshSecrets(backend, interval)
+	}
+}
+
+// applySecrets sets secrets as environment variables and returns the names
+// of those that changed.
+func applySecrets(secrets map[string]string) []string {
+	var changed []string
+	for name, value := range secrets {
+		if os.Getenv(name) != value {
+			os.Setenv(name, value)
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func refreshSecrets(backend secretsBackend, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		secrets, err := backend.Fetch(ctx)
+		cancel()
+		if err != nil {
+			slog.Error("Failed to refresh secrets, keeping the current ones", "err", err)
+			continue
+		}
+		if changed := applySecrets(secrets); len(changed) > 0 {
+			// Only names are logged, never values.
+			slog.Info("Secrets changed", "names", changed)
+			refreshKeyPools()
+		}
+	}
+}
+
+// secretFields converts the fields of a secret to strings, leaving strings
+// as they are and encoding anything else as JSON.
+func secretFields(data map[string]any) map[string]string {
+	secrets := make(map[string]string, len(data))
+	for name, value := range data {
+		if s, ok := value.(string); ok {
+			secrets[name] = s
+		} else {
+			raw, _ := json.Marshal(value)
+			secrets[name] = string(raw)
+		}
+	}
+	return secrets
+}
+
+// vaultBackend reads a secret from HashiCorp Vault's KV engine, version 1
+// or 2.
+type vaultBackend struct {
+	client   *vault.Client
+	token    string
+	roleID   string
+	secretID string
+	path     string
+}
+
+func (v *vaultBackend) connect(addr, namespace string) error {
+	config := vault.DefaultConfig()
+	config.Address = addr
+	config.Timeout = 15 * time.Second
+	client, err := vault.NewClient(config)
+	if err != nil {
+		return err
+	}
+	client.SetNamespace(namespace)
+	v.client = client
+	return nil
+}
+
+func (v *vaultBackend) Fetch(ctx context.Context) (map[string]string, error) {
+	token := v.token
+	if v.roleID != "" {
+		var err error
+		if token, err = v.login(ctx); err != nil {
+			return nil, fmt.Errorf("approle login: %v", err)
+		}
+	}
+
+	// The client is only used by one fetch at a time, at startup and then
+	// from refreshSecrets.
+	v.client.SetToken(token)
+	secret, err := v.client.Logical().ReadWithContext(ctx, v.path)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("no secret at %s", v.path)
+	}
+
+	// KV version 2 nests the secret in data.data, next to its metadata.
+	if nested, ok := secret.Data["data"].(map[string]any); ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return secretFields(nested), nil
+		}
+	}
+	return secretFields(secret.Data), nil
+}
+
+// login exchanges the AppRole credentials for a token. A fresh token is
+// taken on every fetch, so its TTL only has to cover one.
+func (v *vaultBackend) login(ctx context.Context) (string, error) {
+	v.client.ClearToken()
+	secret, err := v.client.Logical().WriteWithContext(ctx, "auth/approle/login", map[string]any{
+		"role_id":   v.roleID,
+		"secret_id": v.secretID,
+	})
+	if err != nil {
+		return "", err
+	}
+	if secret == nil || secret.Auth == nil || secret.Auth.ClientToken == "" {
+		return "", errors.New("no client token in response")
+	}
+	return secret.Auth.ClientToken, nil
+}
+
+// awsSecretsBackend reads a JSON secret from AWS Secrets Manager.
+type awsSecretsBackend struct {
+	client   *secretsmanager.Client
+	secretID string
+}
+
+// connect prepares the client for region, at endpoint when it is set. Static
+// credentials are taken from the settings, so they can live in CONFIG_FILE;
+// without them the SDK's default chain looks for some.
+func (a *awsSecretsBackend) connect(region, endpoint string) error {
+	opts := []func(*awsconfig.LoadOptions) error{awsconfig.WithRegion(region)}
+	if id := getEnv("AWS_ACCESS_KEY_ID", ""); id != "" {
+		opts = append(opts, awsconfig.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			id, getEnv("AWS_SECRET_ACCESS_KEY", ""), getEnv("AWS_SESSION_TOKEN", ""))))
+	}
+	config, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+	a.client = secretsmanager.NewFromConfig(config, func(o *secretsmanager.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+	})
+	return nil
+}
+
+func (a *awsSecretsBackend) Fetch(ctx context.Context) (map[string]string, error) {
+	out, err := a.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(a.secretID)})
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]any
+	if err := json.Unmarshal([]byte(aws.ToString(out.SecretString)), &data); err != nil {
+		return nil, fmt.Errorf("secret %s is not a JSON object", a.secretID)
+	}
+	return secretFields(data), nil
+}
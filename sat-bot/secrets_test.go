@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVaultBackendFetch(t *testing.T) {
+	tests := []struct {
+		name     string
+		backend  *vaultBackend
+		response map[string]any
+	}{
+		{
+			name:     "KV version 1 with a token",
+			backend:  &vaultBackend{token: "root-token", path: "secret/satbot"},
+			response: map[string]any{"data": map[string]any{"GROQ_API_KEY": "gsk-1", "RATE_LIMIT": 5}},
+		},
+		{
+			name:    "KV version 2 through AppRole",
+			backend: &vaultBackend{roleID: "role", secretID: "secret", path: "secret/data/satbot"},
+			response: map[string]any{"data": map[string]any{
+				"data":     map[string]any{"GROQ_API_KEY": "gsk-1", "RATE_LIMIT": 5},
+				"metadata": map[string]any{"version": 3},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("X-Vault-Namespace") != "fest" {
+					t.Errorf("%s sent namespace %q", r.URL.Path, r.Header.Get("X-Vault-Namespace"))
+				}
+				switch r.URL.Path {
+				case "/v1/auth/approle/login":
+					var body map[string]string
+					json.NewDecoder(r.Body).Decode(&body)
+					if body["role_id"] != "role" || body["secret_id"] != "secret" {
+						t.Errorf("logged in with %v", body)
+					}
+					json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"client_token": "approle-token"}})
+				case "/v1/" + tt.backend.path:
+					want := tt.backend.token
+					if want == "" {
+						want = "approle-token"
+					}
+					if got := r.Header.Get("X-Vault-Token"); got != want {
+						t.Errorf("read with token %q, want %q", got, want)
+					}
+					json.NewEncoder(w).Encode(tt.response)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			if err := tt.backend.connect(server.URL, "fest"); err != nil {
+				t.Fatal(err)
+			}
+			got, err := tt.backend.Fetch(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[string]string{"GROQ_API_KEY": "gsk-1", "RATE_LIMIT": "5"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("Fetch = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestVaultBackendMissingSecret(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	v := &vaultBackend{token: "root-token", path: "secret/data/satbot"}
+	if err := v.connect(server.URL, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Fetch(context.Background()); err == nil {
+		t.Error("Fetch found a secret Vault does not have")
+	}
+}
+
+func TestAWSSecretsBackendFetch(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret-key")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+	tests := []struct {
+		name    string
+		secret  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "JSON object", secret: `{"GROQ_API_KEY":"gsk-1","RATE_LIMIT":5}`, want: map[string]string{"GROQ_API_KEY": "gsk-1", "RATE_LIMIT": "5"}},
+		{name: "not an object", secret: "gsk-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if target := r.Header.Get("X-Amz-Target"); target != "secretsmanager.GetSecretValue" {
+					t.Errorf("called %q", target)
+				}
+				if auth := r.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+					!strings.Contains(auth, "/eu-west-1/secretsmanager/aws4_request") {
+					t.Errorf("signed with %q", auth)
+				}
+				body, _ := io.ReadAll(r.Body)
+				if !strings.Contains(string(body), `"SecretId":"satbot/prod"`) {
+					t.Errorf("asked for %s", body)
+				}
+				w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+				json.NewEncoder(w).Encode(map[string]string{"Name": "satbot/prod", "SecretString": tt.secret})
+			}))
+			defer server.Close()
+
+			a := &awsSecretsBackend{secretID: "satbot/prod"}
+			if err := a.connect("eu-west-1", server.URL); err != nil {
+				t.Fatal(err)
+			}
+			got, err := a.Fetch(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Fetch = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Fetch = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/getsentry/sentry-go"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// sentryEnabled is set when errors are reported to Sentry. Events are sent
+// in the background by the SDK's transport, which drops them when its
+// buffer is full, so a failing Sentry never slows requests down.
+var sentryEnabled bool
+
+var (
+	errorReports = expvar.NewMap("error_reports")
+	panics       = expvar.NewInt("panics")
+)
+
+// sentryHeaders are the request headers sent with events. Anything that
+// could carry a credential is left out.
+var sentryHeaders = []string{"Content-Type", "Origin", "Referer", "User-Agent", requestIDHeader}
+
+const requestContextKey contextKey = "request"
+
+// loadSentryConfig reads SENTRY_DSN, the project to report panics and
+// upstream failures to, reporting being off when it is unset;
+// SENTRY_ENVIRONMENT, defaulting to APP_ENV or production; and
+// SENTRY_RELEASE, the version events are tagged with, defaulting to the
+// build's.
+func loadSentryConfig() {
+	dsn := getEnv("SENTRY_DSN", "")
+	if dsn == "" {
+		return
+	}
+	parsed, err := sentry.NewDsn(dsn)
+	if err != nil {
+		configProblem("SENTRY_DSN: %v", err)
+		return
+	}
+	environment := getEnv("SENTRY_ENVIRONMENT", getEnv("APP_ENV", "production"))
+	if err := sentry.Init(sentry.ClientOptions{
+		Dsn:         dsn,
+		Environment: environment,
+		Release:     getEnv("SENTRY_RELEASE", buildInfo.Version),
+	}); err != nil {
+		configProblem("SENTRY_DSN: %v", err)
+		return
+	}
+	sentryEnabled = true
+	slog.Info("Reporting errors to Sentry", "host", parsed.GetHost(), "project", parsed.GetProjectID(), "environment", environment)
+}
+
+// captureEvent reports an exception of the given type and value, with the
+// stack of the caller and the request, session and trace of ctx when it has
+// them. kind counts it in the error_reports expvar.
+func captureEvent(ctx context.Context, level sentry.Level, typ, value, kind string, tags map[string]string) {
+	e := sentry.NewEvent()
+	e.Level = level
+	e.Logger = "satbot"
+	e.Exception = []sentry.Exception{{Type: typ, Value: value, Stacktrace: sentry.NewStacktrace()}}
+	for k, v := range tags {
+		e.Tags[k] = v
+	}
+	if l, ok := ctx.Value(requestLogContextKey).(*requestLog); ok {
+		e.Tags["request_id"] = l.id
+		l.mu.Lock()
+		if l.sessionID != "" {
+			e.Tags["session_id"] = l.sessionID
+		}
+		if l.interactionID != "" {
+			e.Tags["interaction_id"] = l.interactionID
+		}
+		l.mu.Unlock()
+	}
+	if r, ok := ctx.Value(requestContextKey).(*http.Request); ok {
+		req := &sentry.Request{
+			Method:      r.Method,
+			URL:         r.URL.Path,
+			QueryString: r.URL.RawQuery,
+			Headers:     map[string]string{},
+		}
+		for _, name := range sentryHeaders {
+			if v := r.Header.Get(name); v != "" {
+				req.Headers[name] = v
+			}
+		}
+		e.Request = req
+		e.User = sentry.User{IPAddress: clientIP(r)}
+		e.Tags["route"] = routeName(r)
+	}
+
+	hub := sentry.CurrentHub().Clone()
+	// The scope sets the event's trace, so the span of ctx goes there.
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		hub.Scope().SetPropagationContext(sentry.PropagationContext{
+			TraceID: sentry.TraceID(sc.TraceID()),
+			SpanID:  sentry.SpanID(sc.SpanID()),
+		})
+	}
+	if hub.CaptureEvent(e) != nil {
+		errorReports.Add(kind, 1)
+	} else {
+		errorReports.Add("dropped", 1)
+	}
+}
+
+// reportUpstreamFailure reports a model call that failed on the provider's
+// side, after retries. Failures of our own making, such as shed calls or
+// clients going away, are not reported.
+func reportUpstreamFailure(ctx context.Context, provider string, err error) {
+	if !sentryEnabled || !isUpstreamFailure(err) {
+		return
+	}
+	_, code, _ := classifyError(err)
+	captureEvent(ctx, sentry.LevelError, fmt.Sprintf("%T", err), err.Error(), "upstream",
+		map[string]string{"provider": provider, "code": code})
+}
+
+// recoverMiddleware turns a panic in a handler into a 500, logging it with
+// its stack and reporting it to Sentry, so one bad request cannot take the
+// process down.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), requestContextKey, r))
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec)
+			}
+			panics.Add(1)
+			slog.ErrorContext(r.Context(), "Handler panicked", "panic", fmt.Sprint(rec), "stack", string(debug.Stack()))
+			if sentryEnabled {
+				captureEvent(r.Context(), sentry.LevelFatal, "panic", fmt.Sprint(rec), "panic", nil)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			writeErrorBody(w, ErrorResponse{Error: "Internal server error", Code: "internal_error"})
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
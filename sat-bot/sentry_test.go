@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// useSentryTransport reports events to the returned transport for the test.
+func useSentryTransport(t *testing.T) *sentry.MockTransport {
+	t.Helper()
+	transport := &sentry.MockTransport{}
+	if err := sentry.Init(sentry.ClientOptions{Dsn: "https://key@sentry.example/42", Transport: transport}); err != nil {
+		t.Fatal(err)
+	}
+	sentryEnabled = true
+	t.Cleanup(func() {
+		sentry.CurrentHub().BindClient(nil)
+		sentryEnabled = false
+	})
+	return transport
+}
+
+func TestRecoverMiddlewareReportsPanics(t *testing.T) {
+	transport := useSentryTransport(t)
+	router := mux.NewRouter()
+	router.Use(recoverMiddleware)
+	router.HandleFunc("/v1/faq/{id}", func(http.ResponseWriter, *http.Request) {
+		panic("nil map")
+	})
+
+	traceID := trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36}
+	spanID := trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7}
+	r := httptest.NewRequest(http.MethodGet, "/v1/faq/7?lang=en", nil)
+	r = r.WithContext(trace.ContextWithSpanContext(r.Context(), trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID})))
+	r.Header.Set("User-Agent", "test")
+	r.Header.Set("X-Admin-Key", "admin-secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	events := transport.Events()
+	if len(events) != 1 {
+		t.Fatalf("reported %d events, want 1", len(events))
+	}
+	e := events[0]
+	if e.Level != sentry.LevelFatal || len(e.Exception) != 1 || e.Exception[0].Value != "nil map" || e.Exception[0].Stacktrace == nil {
+		t.Errorf("event %v with exception %+v, want a fatal panic with its stack", e.Level, e.Exception)
+	}
+	if e.Tags["route"] != "/v1/faq/{id}" || e.Request == nil || e.Request.QueryString != "lang=en" {
+		t.Errorf("tags %v and request %+v, want the route and query", e.Tags, e.Request)
+	}
+	if _, ok := e.Request.Headers["X-Admin-Key"]; ok || e.Request.Headers["User-Agent"] != "test" {
+		t.Errorf("sent headers %v, want only the safe ones", e.Request.Headers)
+	}
+	if got := e.Contexts["trace"]["trace_id"]; fmt.Sprint(got) != traceID.String() {
+		t.Errorf("trace context %v, want trace %s", e.Contexts["trace"], traceID)
+	}
+}
+
+func TestReportUpstreamFailure(t *testing.T) {
+	transport := useSentryTransport(t)
+	r := httptest.NewRequest(http.MethodPost, "/chat", nil)
+	reportUpstreamFailure(r.Context(), "groq", &UpstreamError{Provider: "groq", StatusCode: http.StatusBadGateway})
+	reportUpstreamFailure(r.Context(), "groq", context.Canceled)
+
+	events := transport.Events()
+	if len(events) != 1 {
+		t.Fatalf("reported %d events, want only the provider's failure", len(events))
+	}
+	if e := events[0]; e.Level != sentry.LevelError || e.Tags["provider"] != "groq" || e.Exception[0].Type != "*main.UpstreamError" {
+		t.Errorf("event %v with tags %v and exception %+v", e.Level, e.Tags, e.Exception)
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"expvar"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type ChatMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+	// ToolCalls are the tools an assistant message asked to run, and
+	// ToolCallID ties a "tool" message to the call it answers. They only
+	// appear within a single request, never in session history.
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+// TranscriptEntry is one message of a session as it was exchanged, kept even
+// after it has been folded into the summary.
+type TranscriptEntry struct {
+	ID       string `json:"id"`
+	Role     string `json:"role"`
+	Content  string `json:"content"`
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+	// Variant tags the experiment variants that produced an answer.
+	Variant string `json:"variant,omitempty"`
+	// InteractionID of an answer, as returned to the client.
+	InteractionID string `json:"interaction_id,omitempty"`
+	// EstimatedCost of generating an answer, when its model is priced.
+	EstimatedCost float64 `json:"estimated_cost,omitempty"`
+	// Feedback is the visitor's rating of an answer, see feedbackHandler.
+	Feedback  *Feedback `json:"feedback,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func answerEntry(answer *CompletionResponse, at time.Time) TranscriptEntry {
+	entry := TranscriptEntry{
+		ID:            newID(),
+		Role:          "assistant",
+		Content:       answer.Content,
+		Provider:      answer.Provider,
+		Model:         answer.Model,
+		Variant:       answer.Variant,
+		CreatedAt:     at,
+		InteractionID: answer.InteractionID,
+	}
+	if answer.Cost != nil {
+		entry.EstimatedCost = answer.Cost.Amount
+	}
+	return entry
+}
+
+// Session holds the running conversation for one visitor. History is what is
+// sent to the model and Summary carries a condensed version of turns that
+// were folded out of it; Transcript is the complete record.
+type Session struct {
+	mu sync.Mutex
+
+	ID string
+	// VisitorID is the anonymous visitor the session belongs to. It is set
+	// at creation and never changes.
+	VisitorID string
+	// UserID is the logged-in attendee last seen chatting in the session,
+	// if any.
+	UserID     string
+	Title      string
+	Summary    string
+	History    []ChatMessage
+	Transcript []TranscriptEntry
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+
+	titlePending   bool
+	summaryPending bool
+}
+
+// userTurns counts the questions in the transcript. The caller must hold s.mu.
+func (s *Session) userTurns() int {
+	n := 0
+	for _, entry := range s.Transcript {
+		if entry.Role == "user" {
+			n++
+		}
+	}
+	return n
+}
+
+// AddTurn records a user question and the assistant's answer. The caller must
+// hold s.mu.
+func (s *Session) AddTurn(question string, answer *CompletionResponse, at time.Time) {
+	s.History = append(s.History,
+		ChatMessage{Role: "user", Content: question},
+		ChatMessage{Role: "assistant", Content: answer.Content},
+	)
+	s.Transcript = append(s.Transcript,
+		TranscriptEntry{ID: newID(), Role: "user", Content: question, CreatedAt: at},
+		answerEntry(answer, at),
+	)
+	s.UpdatedAt = at
+}
+
+// LastTurn returns the most recent question when the transcript ends with a
+// complete question/answer turn. The caller must hold s.mu.
+func (s *Session) LastTurn() (string, bool) {
+	n := len(s.Transcript)
+	if n < 2 || s.Transcript[n-2].Role != "user" || s.Transcript[n-1].Role != "assistant" {
+		return "", false
+	}
+	return s.Transcript[n-2].Content, true
+}
+
+// LastQuestionID returns the transcript ID of the most recent user message.
+// The caller must hold s.mu.
+func (s *Session) LastQuestionID() string {
+	for i := len(s.Transcript) - 1; i >= 0; i-- {
+		if s.Transcript[i].Role == "user" {
+			return s.Transcript[i].ID
+		}
+	}
+	return ""
+}
+
+// historyBeforeLastTurn returns History without its final question/answer
+// pair. The caller must hold s.mu.
+func (s *Session) historyBeforeLastTurn() []ChatMessage {
+	n := len(s.History)
+	if n >= 2 && s.History[n-2].Role == "user" && s.History[n-1].Role == "assistant" {
+		return s.History[:n-2]
+	}
+	return s.History
+}
+
+// ReplaceLastAnswer swaps the answer of the final turn for a regenerated one.
+// The caller must hold s.mu and have checked LastTurn.
+func (s *Session) ReplaceLastAnswer(answer *CompletionResponse, at time.Time) {
+	if n := len(s.History); n > 0 && s.History[n-1].Role == "assistant" {
+		s.History[n-1].Content = answer.Content
+	}
+	s.Transcript[len(s.Transcript)-1] = answerEntry(answer, at)
+	s.UpdatedAt = at
+}
+
+// transcriptIndex returns the position of the transcript entry with the given
+// ID, or -1. The caller must hold s.mu.
+func (s *Session) transcriptIndex(id string) int {
+	for i, entry := range s.Transcript {
+		if entry.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// historyBefore rebuilds the model history from the transcript entries
+// preceding index i. The caller must hold s.mu.
+func (s *Session) historyBefore(i int) []ChatMessage {
+	history := make([]ChatMessage, 0, i)
+	for _, entry := range s.Transcript[:i] {
+		history = append(history, ChatMessage{Role: entry.Role, Content: entry.Content})
+	}
+	return history
+}
+
+// contextBefore returns the summary and history that preceded the transcript
+// entry at index i. When the entry is still in History, the summary only
+// covers turns before it and is kept; when it was folded into the summary,
+// the summary describes turns after it, so the history is rebuilt from the
+// transcript instead. The caller must hold s.mu.
+func (s *Session) contextBefore(i int) (string, []ChatMessage) {
+	folded := len(s.Transcript) - len(s.History)
+	if s.Summary != "" && i >= folded {
+		return s.Summary, slices.Clone(s.History[:i-folded])
+	}
+	return "", s.historyBefore(i)
+}
+
+// ReplayFrom discards the transcript from the user message at index i onwards
+// and records the edited question, keeping the message ID, with its new
+// answer, on the context returned by contextBefore. The caller must hold
+// s.mu.
+func (s *Session) ReplayFrom(i int, question string, answer *CompletionResponse, at time.Time) {
+	id := s.Transcript[i].ID
+	s.Summary, s.History = s.contextBefore(i)
+	s.Transcript = s.Transcript[:i]
+	s.AddTurn(question, answer, at)
+	s.Transcript[i].ID = id
+}
+
+type SessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	// byVisitor maps a visitor to their most recent session.
+	byVisitor map[string]string
+	// idleTTL is how long a session may go without activity before it is
+	// discarded. Zero keeps sessions forever.
+	idleTTL time.Duration
+}
+
+var sessions = NewSessionStore()
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{sessions: make(map[string]*Session), byVisitor: make(map[string]string)}
+}
+
+func init() {
+	expvar.Publish("sessions_active", expvar.Func(func() any { return sessions.Count() }))
+	metricsFactory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "satbot_sessions_active",
+		Help: "Sessions held in memory, not yet expired.",
+	}, func() float64 { return float64(sessions.Count()) })
+}
+
+func loadSessionConfig() {
+	sessions.mu.Lock()
+	sessions.idleTTL = getEnvDuration("SESSION_IDLE_TTL", 30*time.Minute)
+	sessions.mu.Unlock()
+}
+
+// Count returns the number of sessions currently held.
+func (s *SessionStore) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// expired reports whether the session has been idle for longer than the
+// store's TTL. Sessions that are locked are serving a request and never
+// expire. The caller must hold s.mu.
+func (s *SessionStore) expired(session *Session, now time.Time) bool {
+	if s.idleTTL <= 0 || !session.mu.TryLock() {
+		return false
+	}
+	defer session.mu.Unlock()
+	return now.Sub(session.UpdatedAt) > s.idleTTL
+}
+
+// DeleteExpired removes idle sessions and returns how many were removed.
+func (s *SessionStore) DeleteExpired() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for _, session := range s.sessions {
+		if s.expired(session, now) {
+			s.remove(session)
+			removed++
+		}
+	}
+	return removed
+}
+
+// StartJanitor periodically reclaims idle sessions in the background.
+func (s *SessionStore) StartJanitor(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if removed := s.DeleteExpired(); removed > 0 {
+				slog.Info("Removed idle sessions", "removed", removed, "active", s.Count())
+			}
+		}
+	}()
+}
+
+// remove deletes a session and its visitor index entry. The caller must hold
+// s.mu.
+func (s *SessionStore) remove(session *Session) {
+	delete(s.sessions, session.ID)
+	if session.VisitorID != "" && s.byVisitor[session.VisitorID] == session.ID {
+		delete(s.byVisitor, session.VisitorID)
+	}
+}
+
+// ownedBy reports whether visitorID may use the session. Sessions created
+// without a visitor are open to anyone holding their ID.
+func (session *Session) ownedBy(visitorID string) bool {
+	return session.VisitorID == "" || session.VisitorID == visitorID
+}
+
+// GetOrCreate returns the session with the given ID for the visitor. With an
+// empty ID the visitor's most recent session is resumed. A new session is
+// created when there is nothing to resume or the ID is unknown, expired or
+// belongs to another visitor.
+func (s *SessionStore) GetOrCreate(id, visitorID string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if id == "" && visitorID != "" {
+		id = s.byVisitor[visitorID]
+	}
+	if id != "" {
+		if session, ok := s.sessions[id]; ok {
+			switch {
+			case s.expired(session, now):
+				s.remove(session)
+			case session.ownedBy(visitorID):
+				return session
+			default:
+				id = ""
+			}
+		}
+	}
+	if id == "" {
+		id = newID()
+	}
+
+	session := &Session{ID: id, VisitorID: visitorID, CreatedAt: now, UpdatedAt: now}
+	s.sessions[id] = session
+	if visitorID != "" {
+		s.byVisitor[visitorID] = id
+	}
+	return session
+}
+
+// ListByVisitor returns the visitor's sessions, most recently active first.
+func (s *SessionStore) ListByVisitor(visitorID string) []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var list []*Session
+	for _, session := range s.sessions {
+		if session.VisitorID == visitorID && visitorID != "" && !s.expired(session, now) {
+			list = append(list, session)
+		}
+	}
+	return list
+}
+
+// DeleteOwned removes the sessions last used by userID or belonging to
+// visitorID, either of which may be empty, and returns their IDs. A session
+// serving a request is removed once the request is done.
+func (s *SessionStore) DeleteOwned(userID, visitorID string) []string {
+	s.mu.Lock()
+	all := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		all = append(all, session)
+	}
+	s.mu.Unlock()
+
+	var owned []*Session
+	for _, session := range all {
+		session.mu.Lock()
+		if (userID != "" && session.UserID == userID) || (visitorID != "" && session.VisitorID == visitorID) {
+			owned = append(owned, session)
+		}
+		session.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	removed := []string{}
+	for _, session := range owned {
+		if s.sessions[session.ID] == session {
+			s.remove(session)
+		}
+		removed = append(removed, session.ID)
+	}
+	return removed
+}
+
+// Get returns the session with the given ID if it exists and the visitor may
+// use it.
+func (s *SessionStore) Get(id, visitorID string) (*Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	if s.expired(session, time.Now()) {
+		s.remove(session)
+		return nil, false
+	}
+	if !session.ownedBy(visitorID) {
+		return nil, false
+	}
+	return session, true
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return hex.EncodeToString([]byte(time.Now().Format(time.RFC3339Nano)))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// sessionTurnBuckets are the turn counts the sessions report groups
+// conversations by, the last one open-ended.
+var sessionTurnBuckets = []struct {
+	label string
+	min   int
+}{
+	{"1", 1}, {"2", 2}, {"3-5", 3}, {"6-10", 6}, {"11+", 11},
+}
+
+type SessionAnalytics struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Sessions counts the conversations with a question in the range, of
+	// which Ongoing may still go on: their last question is more recent
+	// than SESSION_IDLE_TTL. Abandonment only counts the others.
+	Sessions int `json:"sessions"`
+	Ongoing  int `json:"ongoing"`
+	// Turns are the questions asked per session.
+	AvgTurns    float64      `json:"avg_turns"`
+	MedianTurns int          `json:"median_turns"`
+	P95Turns    int          `json:"p95_turns"`
+	TurnBuckets []TurnBucket `json:"turn_buckets"`
+	// SingleTurnRate is the share of sessions that asked one question only.
+	SingleTurnRate float64 `json:"single_turn_rate"`
+	// Durations are from the first question to the last answer, in seconds.
+	AvgDurationSeconds    float64 `json:"avg_duration_seconds"`
+	MedianDurationSeconds float64 `json:"median_duration_seconds"`
+	P95DurationSeconds    float64 `json:"p95_duration_seconds"`
+	// AfterError is about the sessions where a question failed, and
+	// AfterBadAnswer those where an answer did not answer the question or
+	// was rated down.
+	AfterError     SessionAbandonment `json:"after_error"`
+	AfterBadAnswer SessionAbandonment `json:"after_bad_answer"`
+}
+
+type TurnBucket struct {
+	Turns    string `json:"turns"`
+	Sessions int    `json:"sessions"`
+}
+
+// SessionAbandonment counts the ended sessions that went through a failure,
+// and those of them that ended on it, without asking again.
+type SessionAbandonment struct {
+	Sessions  int `json:"sessions"`
+	Abandoned int `json:"abandoned"`
+	// Rate is the share abandoned, null without such sessions.
+	Rate *float64 `json:"rate"`
+}
+
+func (a *SessionAbandonment) add(hit, abandoned bool) {
+	if !hit {
+		return
+	}
+	a.Sessions++
+	if abandoned {
+		a.Abandoned++
+	}
+	rate := float64(a.Abandoned) / float64(a.Sessions)
+	a.Rate = &rate
+}
+
+// sessionAnalyticsHandler tells whether visitors hold conversations or give
+// up: the questions asked per session and how long sessions last, and how
+// often a session ended right after a failed question or a bad answer. A
+// session is only seen through its questions in the range, so one that
+// started before it counts from its first question in it.
+func sessionAnalyticsHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, found, ok := analyticsInteractions(w, r)
+	if !ok {
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(summarizeSessions(from, to, found, sessionIdleTTL()))
+}
+
+func sessionIdleTTL() time.Duration {
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	return sessions.idleTTL
+}
+
+// summarizeSessions groups found, oldest first, by session. Sessions whose
+// last question is within idleTTL of now are taken to be ongoing.
+func summarizeSessions(from, to time.Time, found []Interaction, idleTTL time.Duration) SessionAnalytics {
+	bySession := map[string][]Interaction{}
+	var order []string
+	for _, i := range found {
+		if _, ok := bySession[i.SessionID]; !ok {
+			order = append(order, i.SessionID)
+		}
+		bySession[i.SessionID] = append(bySession[i.SessionID], i)
+	}
+
+	report := SessionAnalytics{From: from, To: to, Sessions: len(order), TurnBuckets: make([]TurnBucket, len(sessionTurnBuckets))}
+	for n, b := range sessionTurnBuckets {
+		report.TurnBuckets[n].Turns = b.label
+	}
+	if len(order) == 0 {
+		return report
+	}
+	ongoingSince := time.Now().Add(-idleTTL)
+	turns := make([]int, 0, len(order))
+	durations := make([]float64, 0, len(order))
+	var totalTurns int
+	var totalDuration, singleTurn float64
+	for _, id := range order {
+		asked := bySession[id]
+		first, last := asked[0], asked[len(asked)-1]
+		turns = append(turns, len(asked))
+		totalTurns += len(asked)
+		if len(asked) == 1 {
+			singleTurn++
+		}
+		for n := len(sessionTurnBuckets) - 1; n >= 0; n-- {
+			if len(asked) >= sessionTurnBuckets[n].min {
+				report.TurnBuckets[n].Sessions++
+				break
+			}
+		}
+		duration := last.Time.Add(time.Duration(last.LatencyMS) * time.Millisecond).Sub(first.Time).Seconds()
+		durations = append(durations, duration)
+		totalDuration += duration
+
+		if idleTTL > 0 && last.Time.After(ongoingSince) {
+			report.Ongoing++
+			continue
+		}
+		var failed, badAnswer bool
+		for _, i := range asked {
+			failed = failed || i.Error != ""
+			badAnswer = badAnswer || badSessionAnswer(i)
+		}
+		report.AfterError.add(failed, last.Error != "")
+		report.AfterBadAnswer.add(badAnswer, badSessionAnswer(last))
+	}
+
+	sort.Ints(turns)
+	sort.Float64s(durations)
+	count := len(order)
+	report.AvgTurns = float64(totalTurns) / float64(count)
+	report.MedianTurns = turns[(count-1)/2]
+	report.P95Turns = turns[(count*95-1)/100]
+	report.SingleTurnRate = singleTurn / float64(count)
+	report.AvgDurationSeconds = totalDuration / float64(count)
+	report.MedianDurationSeconds = durations[(count-1)/2]
+	report.P95DurationSeconds = durations[(count*95-1)/100]
+	return report
+}
+
+// badSessionAnswer reports whether i was answered without answering the
+// question, or rated down.
+func badSessionAnswer(i Interaction) bool {
+	if i.Error != "" {
+		return false
+	}
+	return i.Unanswered != "" || (i.Feedback != nil && i.Feedback.Rating == ratingDown)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// slowRequestThreshold is how long a request may take before it is logged
+// with its timing breakdown; zero turns the log off.
+var slowRequestThreshold = 10 * time.Second
+
+// requestTimings adds up where a request spent its time. The phases can
+// overlap: a streamed answer is written while the upstream call is still
+// running.
+type requestTimings struct {
+	// parse is spent reading the request body, including waiting on a slow
+	// client.
+	parse atomic.Int64
+	// queue is spent waiting for a slot under MAX_CONCURRENT_UPSTREAM.
+	queue atomic.Int64
+	// upstream is spent in model calls, retries and the parsing of their
+	// replies included.
+	upstream      atomic.Int64
+	upstreamCalls atomic.Int64
+	// write is spent writing and flushing the response.
+	write atomic.Int64
+}
+
+const requestTimingsContextKey contextKey = "request_timings"
+
+// loadSlowRequestConfig reads SLOW_REQUEST_THRESHOLD, the duration past
+// which a request is logged as slow (10s by default, 0 turns it off).
+func loadSlowRequestConfig() {
+	slowRequestThreshold = getEnvDuration("SLOW_REQUEST_THRESHOLD", slowRequestThreshold)
+}
+
+func timingsFromContext(ctx context.Context) *requestTimings {
+	t, _ := ctx.Value(requestTimingsContextKey).(*requestTimings)
+	return t
+}
+
+// addQueueWait records time spent waiting for an upstream slot.
+func addQueueWait(ctx context.Context, d time.Duration) {
+	if t := timingsFromContext(ctx); t != nil {
+		t.queue.Add(int64(d))
+	}
+}
+
+// addUpstreamCall records a finished model call.
+func addUpstreamCall(ctx context.Context, d time.Duration) {
+	if t := timingsFromContext(ctx); t != nil {
+		t.upstream.Add(int64(d))
+		t.upstreamCalls.Add(1)
+	}
+}
+
+// timedBody times the reads of a request body.
+type timedBody struct {
+	io.ReadCloser
+	spent *atomic.Int64
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := b.ReadCloser.Read(p)
+	b.spent.Add(int64(time.Since(start)))
+	return n, err
+}
+
+// timedWriter times the writes and flushes of a response. It unwraps to the
+// original writer like statusRecorder does.
+type timedWriter struct {
+	http.ResponseWriter
+	spent *atomic.Int64
+}
+
+func (w *timedWriter) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := w.ResponseWriter.Write(b)
+	w.spent.Add(int64(time.Since(start)))
+	return n, err
+}
+
+// FlushError is what http.ResponseController looks for, so the flushes of
+// streamed answers are timed too.
+func (w *timedWriter) FlushError() error {
+	start := time.Now()
+	err := http.NewResponseController(w.ResponseWriter).Flush()
+	w.spent.Add(int64(time.Since(start)))
+	return err
+}
+
+func (w *timedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// slowRequestMiddleware logs a warning for each request that takes longer
+// than SLOW_REQUEST_THRESHOLD, with how long it spent reading the body,
+// queued for a model call, in model calls and writing the response, and
+// what is left over, such as retrieval.
+func slowRequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slowRequestThreshold <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		t := &requestTimings{}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &timedBody{ReadCloser: r.Body, spent: &t.parse}
+		}
+		rec := &statusRecorder{ResponseWriter: &timedWriter{ResponseWriter: w, spent: &t.write}}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestTimingsContextKey, t)))
+
+		total := time.Since(start)
+		if total < slowRequestThreshold {
+			return
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		parse, queue := time.Duration(t.parse.Load()), time.Duration(t.queue.Load())
+		upstream, write := time.Duration(t.upstream.Load()), time.Duration(t.write.Load())
+		other := max(total-parse-queue-upstream-write, 0)
+		slog.WarnContext(r.Context(), "Slow request",
+			"method", r.Method,
+			"route", routeName(r),
+			"status", rec.status,
+			"duration_ms", total.Milliseconds(),
+			"parse_ms", parse.Milliseconds(),
+			"queue_ms", queue.Milliseconds(),
+			"upstream_ms", upstream.Milliseconds(),
+			"upstream_calls", t.upstreamCalls.Load(),
+			"write_ms", write.Milliseconds(),
+			"other_ms", other.Milliseconds(),
+			"threshold_ms", slowRequestThreshold.Milliseconds(),
+		)
+	})
+}
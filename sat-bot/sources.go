@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSourceSize caps how much of a remote source is read.
+const maxSourceSize = 5 * 1024 * 1024
+
+// RemoteSource is a web page or published Google Sheet merged into the
+// knowledge base as a document called Name.
+type RemoteSource struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Type is "html", "text" or "sheet". When empty it is guessed from the
+	// URL and the response's content type.
+	Type string `json:"type,omitempty"`
+	// Namespace puts the source's content in a namespace; by default it is
+	// shared by all of them.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// SourceStatus reports how the last syncs of a remote source went.
+type SourceStatus struct {
+	Name        string     `json:"name"`
+	URL         string     `json:"url"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	// LastError is the error of the last attempt, empty if it succeeded.
+	LastError string `json:"last_error,omitempty"`
+	// Size is the length of the text currently in use.
+	Size int `json:"size"`
+}
+
+type SourcesResponse struct {
+	Schedule string         `json:"schedule,omitempty"`
+	NextSync *time.Time     `json:"next_sync,omitempty"`
+	Sources  []SourceStatus `json:"sources"`
+}
+
+var (
+	remoteSources []RemoteSource
+	sourceClient  = &http.Client{Timeout: 15 * time.Second}
+
+	// remoteDocs holds the last successfully fetched version of each
+	// source, so a failed fetch keeps serving what the bot already knew.
+	remoteMu     sync.Mutex
+	remoteDocs   = map[string]Document{}
+	sourceStatus = map[string]*SourceStatus{}
+	syncSpec     string
+	nextSync     time.Time
+
+	// syncMu keeps scheduled and manual syncs from overlapping.
+	syncMu sync.Mutex
+)
+
+// loadSources reads the remote sources listed in CONTEXT_SOURCES_FILE
+// (sources.json by default, optional) and fetches them once the settings
+// are checked, adding them to the knowledge base loadContext read.
+func loadSources() {
+	path := getEnv("CONTEXT_SOURCES_FILE", "sources.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to read context sources", "path", path, "err", err)
+		}
+		return
+	}
+
+	var loaded []RemoteSource
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		configProblem("%s: %v", path, err)
+		return
+	}
+	seen := map[string]bool{}
+	for _, s := range loaded {
+		switch {
+		case s.Name == "" || s.URL == "":
+			configProblem("%s: every source needs a name and a url", path)
+		case seen[s.Name]:
+			configProblem("%s: duplicate source %q", path, s.Name)
+		case s.Namespace != "" && !validNamespace(s.Namespace):
+			configProblem("%s: source %q has invalid namespace %q", path, s.Name, s.Namespace)
+		case s.Type != "" && s.Type != "html" && s.Type != "text" && s.Type != "sheet":
+			configProblem("%s: source %q has unknown type %q", path, s.Name, s.Type)
+		default:
+			seen[s.Name] = true
+			continue
+		}
+		return
+	}
+	remoteSources = loaded
+	for _, s := range remoteSources {
+		sourceStatus[s.Name] = &SourceStatus{Name: s.Name, URL: s.URL}
+	}
+
+	whenConfigValid(func() { syncSources(context.Background(), "startup") })
+}
+
+// fetchSources fetches every remote source concurrently and reports whether
+// any content changed. Sources that fail keep their previous content.
+func fetchSources(ctx context.Context) (changed bool) {
+	var wg sync.WaitGroup
+	for _, s := range remoteSources {
+		wg.Add(1)
+		go func(s RemoteSource) {
+			defer wg.Done()
+			doc, err := fetchSource(ctx, s)
+			now := time.Now()
+
+			remoteMu.Lock()
+			defer remoteMu.Unlock()
+			status := sourceStatus[s.Name]
+			status.LastAttempt = &now
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to fetch context source", "source", s.Name, "err", err)
+				status.LastError = err.Error()
+				return
+			}
+			status.LastSuccess = &now
+			status.LastError = ""
+			status.Size = len(doc.Content)
+			if old, ok := remoteDocs[s.Name]; !ok || old.Content != doc.Content {
+				remoteDocs[s.Name] = doc
+				changed = true
+			}
+		}(s)
+	}
+	wg.Wait()
+	return changed
+}
+
+// syncSources fetches the remote sources again and reloads the knowledge
+// base if any of them changed.
+func syncSources(ctx context.Context, reason string) {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+	if fetchSources(ctx) {
+		logContextReload(reason)
+	}
+}
+
+// watchSources re-syncs the remote sources on the schedule in
+// CONTEXT_SOURCES_SYNC, either an interval such as "15m" (the default) or a
+// cron expression such as "*/10 8-22 * * *". "0" disables it.
+func watchSources() {
+	if len(remoteSources) == 0 {
+		return
+	}
+	spec := getEnv("CONTEXT_SOURCES_SYNC", "15m")
+	if spec == "0" {
+		return
+	}
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		configProblem("CONTEXT_SOURCES_SYNC: %v", err)
+		return
+	}
+	remoteMu.Lock()
+	syncSpec = spec
+	remoteMu.Unlock()
+	slog.Info("Syncing remote context sources", "sources", len(remoteSources), "schedule", spec)
+
+	go func() {
+		for {
+			next := sched.Next(time.Now())
+			if next.IsZero() {
+				slog.Warn("Schedule never runs again, stopping remote source sync", "schedule", spec)
+				return
+			}
+			remoteMu.Lock()
+			nextSync = next
+			remoteMu.Unlock()
+
+			time.Sleep(time.Until(next))
+			syncSources(context.Background(), "scheduled source sync")
+		}
+	}()
+}
+
+func sourcesResponse() SourcesResponse {
+	remoteMu.Lock()
+	defer remoteMu.Unlock()
+
+	resp := SourcesResponse{Schedule: syncSpec, Sources: []SourceStatus{}}
+	if !nextSync.IsZero() {
+		next := nextSync
+		resp.NextSync = &next
+	}
+	for _, s := range remoteSources {
+		resp.Sources = append(resp.Sources, *sourceStatus[s.Name])
+	}
+	return resp
+}
+
+// sourcesHandler reports the sync status of each remote source.
+func sourcesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(sourcesResponse())
+}
+
+// syncSourcesHandler syncs the remote sources now, for when organizers have
+// just published a change, and reports the result.
+func syncSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	syncSources(r.Context(), "manual source sync")
+	sourcesHandler(w, r)
+}
+
+// remoteDocuments returns the fetched sources sorted by name.
+func remoteDocuments() []Document {
+	remoteMu.Lock()
+	defer remoteMu.Unlock()
+
+	docs := make([]Document, 0, len(remoteDocs))
+	for _, doc := range remoteDocs {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].Name < docs[j].Name })
+	return docs
+}
+
+func fetchSource(ctx context.Context, s RemoteSource) (Document, error) {
+	kind := s.Type
+	target := s.URL
+	if kind == "sheet" || (kind == "" && isGoogleSheet(target)) {
+		kind = "sheet"
+		target = sheetCSVURL(target)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return Document{}, err
+	}
+	req.Header.Set("User-Agent", "SatBot/1.0")
+	resp, err := sourceClient.Do(req)
+	if err != nil {
+		return Document{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Document{}, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSourceSize))
+	if err != nil {
+		return Document{}, err
+	}
+
+	if kind == "" {
+		kind = "text"
+		if strings.Contains(resp.Header.Get("Content-Type"), "html") {
+			kind = "html"
+		}
+	}
+	var text string
+	switch kind {
+	case "sheet":
+		text, err = csvToText(body)
+		if err != nil {
+			return Document{}, fmt.Errorf("not a CSV sheet: %v", err)
+		}
+	case "html":
+		text = htmlToText(string(body))
+	default:
+		text = string(body)
+	}
+
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return Document{}, fmt.Errorf("no text content")
+	}
+	return Document{Name: s.Name, Content: text, URL: s.URL, Namespace: s.Namespace}, nil
+}
+
+func isGoogleSheet(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Host == "docs.google.com" && strings.HasPrefix(u.Path, "/spreadsheets/")
+}
+
+// sheetCSVURL turns the link to a Google Sheet, as copied from the browser or
+// from "Publish to the web", into its CSV export URL, keeping the selected
+// tab. Links that already ask for CSV are returned unchanged.
+func sheetCSVURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || !isGoogleSheet(rawURL) {
+		return rawURL
+	}
+	q := u.Query()
+	if q.Get("output") == "csv" || q.Get("format") == "csv" {
+		return rawURL
+	}
+
+	gid := q.Get("gid")
+	if g, ok := strings.CutPrefix(u.Fragment, "gid="); ok && gid == "" {
+		gid = g
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	out := url.Values{}
+	if gid != "" {
+		out.Set("gid", gid)
+	}
+	if len(parts) >= 4 && parts[1] == "d" && parts[2] == "e" {
+		// Published sheet: /spreadsheets/d/e/<id>/pubhtml
+		out.Set("output", "csv")
+		u.Path = "/" + strings.Join(parts[:4], "/") + "/pub"
+	} else if len(parts) >= 3 && parts[1] == "d" {
+		// Shared sheet: /spreadsheets/d/<id>/edit
+		out.Set("format", "csv")
+		u.Path = "/" + strings.Join(parts[:3], "/") + "/export"
+	} else {
+		return rawURL
+	}
+	u.RawQuery = out.Encode()
+	u.Fragment = ""
+	return u.String()
+}
+
+// csvToText renders a sheet with a header row as one line per row of
+// "Header: value" pairs, which models read more reliably than raw CSV.
+func csvToText(data []byte) (string, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	rows, err := r.ReadAll()
+	if err != nil {
+		return "", err
+	}
+	if len(rows) < 2 {
+		return "", nil
+	}
+
+	header := rows[0]
+	var b strings.Builder
+	for _, row := range rows[1:] {
+		var fields []string
+		for i, value := range row {
+			value = strings.TrimSpace(value)
+			if value == "" {
+				continue
+			}
+			if i < len(header) && strings.TrimSpace(header[i]) != "" {
+				value = strings.TrimSpace(header[i]) + ": " + value
+			}
+			fields = append(fields, value)
+		}
+		if len(fields) > 0 {
+			b.WriteString("- " + strings.Join(fields, "; ") + "\n")
+		}
+	}
+	return b.String(), nil
+}
+
+var (
+	htmlSkipped = regexp.MustCompile(`(?is)<(script|style|noscript|svg|template|head|nav)\b.*?</(script|style|noscript|svg|template|head|nav)\s*>`)
+	htmlComment = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlHeading = regexp.MustCompile(`(?i)<h([1-6])\b[^>]*>`)
+	htmlItem    = regexp.MustCompile(`(?i)<(li|tr)\b[^>]*>`)
+	htmlBlock   = regexp.MustCompile(`(?i)</?(p|div|br|hr|h[1-6]|ul|ol|table|section|article|header|footer|main|aside|blockquote|pre|dl|dt|dd|figure|figcaption|form)\b[^>]*>`)
+	htmlCell    = regexp.MustCompile(`(?i)</t[dh]\s*>`)
+	htmlTag     = regexp.MustCompile(`(?s)<[^>]*>`)
+	spaceRun    = regexp.MustCompile(`[ \t\r\f\v]+`)
+	blankLines  = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText extracts the readable text of a page. Headings become Markdown
+// headings and list items bullets, so the chunker can still find the
+// page's structure.
+func htmlToText(page string) string {
+	page = htmlComment.ReplaceAllString(page, "")
+	page = htmlSkipped.ReplaceAllString(page, "")
+	page = htmlHeading.ReplaceAllStringFunc(page, func(tag string) string {
+		level := htmlHeading.FindStringSubmatch(tag)[1]
+		return "\n\n" + strings.Repeat("#", int(level[0]-'0')) + " "
+	})
+	page = htmlItem.ReplaceAllStringFunc(page, func(tag string) string {
+		if strings.EqualFold(tag[1:3], "tr") {
+			return "\n"
+		}
+		return "\n- "
+	})
+	page = htmlCell.ReplaceAllString(page, " | ")
+	page = htmlBlock.ReplaceAllString(page, "\n")
+	page = htmlTag.ReplaceAllString(page, "")
+	page = html.UnescapeString(page)
+
+	lines := strings.Split(page, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(spaceRun.ReplaceAllString(line, " "))
+		line = strings.TrimSuffix(line, " |")
+		lines[i] = line
+	}
+	return blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StatusResponse is the public summary a status banner is built from.
+// SuccessRate and P95LatencyMS are null until the window has enough
+// answers to judge.
+type StatusResponse struct {
+	Status        string   `json:"status"`
+	Mode          string   `json:"mode"`
+	Message       string   `json:"message"`
+	SuccessRate   *float64 `json:"success_rate"`
+	P95LatencyMS  *int64   `json:"p95_latency_ms"`
+	Requests      int      `json:"requests"`
+	WindowSeconds int      `json:"window_seconds"`
+	UpdatedAt     string   `json:"updated_at"`
+}
+
+// availability keeps the outcome of the answers given over a sliding
+// window, as the users saw them rather than per provider.
+type availability struct {
+	window   time.Duration
+	minCount int
+	slowP95  time.Duration
+
+	mu           sync.Mutex
+	answers      []upstreamCall
+	lastFallback time.Time
+	lastOverload time.Time
+	recentPeriod time.Duration
+}
+
+var recentAnswers = &availability{
+	window:       15 * time.Minute,
+	minCount:     5,
+	slowP95:      20 * time.Second,
+	recentPeriod: time.Minute,
+}
+
+// loadStatusConfig reads STATUS_WINDOW, the span /status reports on (15m by
+// default); STATUS_MIN_REQUESTS, the answers needed in it before the success
+// rate and latency are judged (5); and STATUS_SLOW_P95, the 95th percentile
+// latency past which the bot is reported as degraded (20s).
+func loadStatusConfig() {
+	if window := getEnvDuration("STATUS_WINDOW", recentAnswers.window); window > 0 {
+		recentAnswers.window = window
+	} else {
+		configProblem("STATUS_WINDOW: must be positive")
+	}
+	recentAnswers.minCount = max(getEnvInt("STATUS_MIN_REQUESTS", recentAnswers.minCount), 1)
+	recentAnswers.slowP95 = getEnvDuration("STATUS_SLOW_P95", recentAnswers.slowP95)
+}
+
+// recordAnswer adds a finished answer to the window. Failures of the
+// client's making, such as bad requests or going away, are left out, while
+// the canned reply served with every circuit open counts as a failure since
+// the question went unanswered.
+func recordAnswer(answer *CompletionResponse, responseTime time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	failed := false
+	if err != nil {
+		httpStatus, _, _ := classifyError(err)
+		if httpStatus < 500 && httpStatus != http.StatusTooManyRequests {
+			return
+		}
+		failed = true
+	}
+	now := time.Now()
+	recentAnswers.mu.Lock()
+	defer recentAnswers.mu.Unlock()
+	switch {
+	case errors.Is(err, errCircuitOpen) || (answer != nil && answer.Provider == "circuit-breaker"):
+		recentAnswers.lastFallback = now
+		failed = true
+	case errors.Is(err, errOverloaded):
+		recentAnswers.lastOverload = now
+	}
+	recentAnswers.answers = append(recentAnswers.answers, upstreamCall{at: now, duration: responseTime, failed: failed})
+	recentAnswers.pruneLocked(now)
+}
+
+func (a *availability) pruneLocked(now time.Time) {
+	kept := a.answers[:0]
+	for _, c := range a.answers {
+		if now.Sub(c.at) <= a.window {
+			kept = append(kept, c)
+		}
+	}
+	a.answers = kept
+}
+
+// mode names what the bot is doing differently from usual, most severe
+// first, with the message shown to visitors.
+func (a *availability) modeLocked(now time.Time) (mode, message string) {
+	switch {
+	case usage.BudgetExhausted() && usage.budgetAction != "degrade":
+		return "paused", "SatBot has reached today's limit and is only answering common questions."
+	case now.Sub(a.lastFallback) <= a.recentPeriod:
+		return "saved_answers_only", "SatBot's AI provider is unavailable, so it is serving saved answers to common questions."
+	case usage.BudgetExhausted():
+		return "short_answers", "SatBot is giving shorter answers than usual."
+	case now.Sub(a.lastOverload) <= a.recentPeriod:
+		return "busy", "SatBot is very busy, so some questions may need to be asked again."
+	}
+	return "normal", "SatBot is answering normally."
+}
+
+func (a *availability) snapshot() StatusResponse {
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pruneLocked(now)
+	mode, message := a.modeLocked(now)
+	resp := StatusResponse{
+		Status:        "operational",
+		Mode:          mode,
+		Message:       message,
+		Requests:      len(a.answers),
+		WindowSeconds: int(a.window.Seconds()),
+		UpdatedAt:     now.UTC().Format(time.RFC3339),
+	}
+	if mode != "normal" {
+		resp.Status = "degraded"
+	}
+	if mode == "paused" {
+		resp.Status = "outage"
+	}
+	if len(a.answers) < a.minCount {
+		return resp
+	}
+
+	failed := 0
+	durations := make([]time.Duration, 0, len(a.answers))
+	for _, c := range a.answers {
+		if c.failed {
+			failed++
+		} else {
+			durations = append(durations, c.duration)
+		}
+	}
+	rate := 1 - float64(failed)/float64(len(a.answers))
+	resp.SuccessRate = &rate
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		p95 := durations[(len(durations)*95-1)/100]
+		ms := p95.Milliseconds()
+		resp.P95LatencyMS = &ms
+		if a.slowP95 > 0 && p95 >= a.slowP95 && resp.Status == "operational" {
+			resp.Status = "degraded"
+		}
+	}
+	switch {
+	case rate < 0.5:
+		resp.Status = "outage"
+		if mode == "normal" {
+			resp.Message = "SatBot is having trouble answering questions right now."
+		}
+	case rate < 0.9 && resp.Status == "operational":
+		resp.Status = "degraded"
+	}
+	if resp.Status == "degraded" && mode == "normal" {
+		resp.Message = "SatBot is slower or less reliable than usual."
+	}
+	return resp
+}
+
+// statusHandler reports how the bot has been doing recently for the
+// website's status banner: "operational", "degraded" or "outage", the
+// share of answers that succeeded and their 95th percentile latency over
+// STATUS_WINDOW, and the degradation mode in force, if any. Unlike
+// /health/deep it is public and never calls out to the providers.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	resp := recentAnswers.snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=15")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// streamWriteTimeout is how long a single event may take to write. The
+// server's WriteTimeout covers whole responses, which would cut long streams
+// short, so the deadline is pushed out before each event instead.
+const streamWriteTimeout = 15 * time.Second
+
+type StreamDelta struct {
+	Content string `json:"content"`
+}
+
+// writeSSE writes one server-sent event and flushes it to the client.
+func writeSSE(w http.ResponseWriter, rc *http.ResponseController, event string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// streamAnswer relays the provider's reply as server-sent events: "delta"
+// events carry pieces of the answer as they arrive, followed by a single
+// "done" event with the usual ChatResponse, or an "error" event. The done
+// event carries the final answer, which output moderation may have changed
+// from what the deltas spelled out. The caller must hold session.mu.
+func streamAnswer(w http.ResponseWriter, r *http.Request, session *Session, question string, opts AnswerOptions) {
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	opts.OnDelta = func(delta string) error {
+		if err := writeSSE(w, rc, "delta", StreamDelta{Content: delta}); err != nil {
+			return err
+		}
+		return r.Context().Err()
+	}
+
+	answer, responseTime, err := generateAnswer(r, session.Summary, session.History, question, opts)
+	if err != nil {
+		_, resp := chatError(err)
+		resp.RequestID = w.Header().Get(requestIDHeader)
+		writeSSE(w, rc, "error", resp)
+		storeInteraction(r, session, question, nil, 0, err)
+		return
+	}
+
+	session.AddTurn(question, answer, time.Now().UTC())
+	maybeGenerateTitle(session)
+	maybeSummarizeSession(session)
+	logInteraction(r.Context(), question, session.UserID, answer, responseTime)
+	storeInteraction(r, session, question, answer, responseTime, nil)
+
+	response := ChatResponse{
+		Response:      answer.Content,
+		ResponseTime:  fmt.Sprintf("%.4f seconds", responseTime.Seconds()),
+		SessionID:     session.ID,
+		MessageID:     session.LastQuestionID(),
+		InteractionID: answer.InteractionID,
+		Sources:       answer.Sources,
+	}
+	if costInResponse {
+		response.Cost = answer.Cost
+	}
+	writeSSE(w, rc, "done", response)
+}
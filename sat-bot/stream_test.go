@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type sseEvent struct {
+	event, data string
+}
+
+// readSSE splits a server-sent event stream into its events.
+func readSSE(t *testing.T, body string) []sseEvent {
+	t.Helper()
+	var events []sseEvent
+	var e sseEvent
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			events = append(events, e)
+			e = sseEvent{}
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		default:
+			t.Fatalf("unexpected line %q", line)
+		}
+	}
+	return events
+}
+
+func TestStreamAnswer(t *testing.T) {
+	useChatDefaults(t)
+	p, _ := recordingProvider()
+	useProvider(t, p)
+	session := sessionWithTurns("one")
+	session.Title = "Test conversation"
+
+	w := httptest.NewRecorder()
+	session.mu.Lock()
+	streamAnswer(w, httptest.NewRequest(http.MethodPost, "/chat", nil), session, "two", AnswerOptions{})
+	session.mu.Unlock()
+
+	if ct := w.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	events := readSSE(t, w.Body.String())
+	if len(events) != 2 || events[0].event != "delta" || events[1].event != "done" {
+		t.Fatalf("events %+v, want a delta and done", events)
+	}
+	var delta StreamDelta
+	if err := json.Unmarshal([]byte(events[0].data), &delta); err != nil || delta.Content != "new answer" {
+		t.Errorf("delta %q: %v", events[0].data, err)
+	}
+	var done ChatResponse
+	if err := json.Unmarshal([]byte(events[1].data), &done); err != nil || done.Response != "new answer" || done.SessionID != "s" {
+		t.Errorf("done %q: %v", events[1].data, err)
+	}
+	if n := len(session.Transcript); n != 4 || session.Transcript[n-1].Content != "new answer" {
+		t.Errorf("transcript of %d entries, want the streamed answer added", n)
+	}
+}
+
+func TestStreamAnswerError(t *testing.T) {
+	useChatDefaults(t)
+	useProvider(t, &fakeProvider{name: "fake", complete: func(context.Context, CompletionRequest) (*CompletionResponse, error) {
+		return nil, &UpstreamError{Provider: "fake", StatusCode: http.StatusTooManyRequests}
+	}})
+	session := sessionWithTurns("one")
+	session.Title = "Test conversation"
+
+	w := httptest.NewRecorder()
+	session.mu.Lock()
+	streamAnswer(w, httptest.NewRequest(http.MethodPost, "/chat", nil), session, "two", AnswerOptions{})
+	session.mu.Unlock()
+
+	events := readSSE(t, w.Body.String())
+	if len(events) != 1 || events[0].event != "error" {
+		t.Fatalf("events %+v, want a single error", events)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal([]byte(events[0].data), &resp); err != nil || resp.Code != "rate_limited" {
+		t.Errorf("error %q: %v", events[0].data, err)
+	}
+	if len(session.Transcript) != 2 {
+		t.Errorf("failed answer added to the transcript")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+var (
+	errInvalidSchema           = errors.New("response_schema must be a JSON schema object")
+	errInvalidStructuredOutput = errors.New("Model did not return JSON matching the response schema")
+)
+
+// structuredOutputRetries is how many times a reply that does not match the
+// response schema is sent back to the model for correction.
+var structuredOutputRetries = 2
+
+func loadStructuredConfig() {
+	structuredOutputRetries = getEnvInt("STRUCTURED_OUTPUT_RETRIES", structuredOutputRetries)
+}
+
+// parseResponseSchema checks that raw is a JSON object usable as a schema.
+func parseResponseSchema(raw json.RawMessage) (map[string]interface{}, error) {
+	var schema map[string]interface{}
+	if err := json.Unmarshal(raw, &schema); err != nil || schema == nil {
+		return nil, errInvalidSchema
+	}
+	return schema, nil
+}
+
+// schemaInstruction tells the model to reply with JSON only.
+func schemaInstruction(schema map[string]interface{}) string {
+	data, _ := json.Marshal(schema)
+	return "Reply with a single JSON value and nothing else: no prose and no code fences. It must conform to this JSON schema:\n" + string(data)
+}
+
+// completeStructured asks for a reply matching schema and returns it with
+// Data set to the parsed JSON. Malformed replies are sent back with the
+// validation error for the model to correct, up to structuredOutputRetries
+// times.
+func completeStructured(ctx context.Context, p Provider, req CompletionRequest, schema map[string]interface{}) (*CompletionResponse, error) {
+	req.JSONMode = true
+	var total Usage
+	for attempt := 0; ; attempt++ {
+		answer, err := completeWithTools(ctx, p, req, nil)
+		if err != nil {
+			return nil, err
+		}
+		total.PromptTokens += answer.Usage.PromptTokens
+		total.CompletionTokens += answer.Usage.CompletionTokens
+		total.TotalTokens += answer.Usage.TotalTokens
+
+		data, err := parseStructured(answer.Content, schema)
+		if err == nil {
+			answer.Content = string(data)
+			answer.Data = data
+			answer.Usage = total
+			return answer, nil
+		}
+		if attempt >= structuredOutputRetries {
+			return nil, errInvalidStructuredOutput
+		}
+
+		req.Messages = append(req.Messages,
+			ChatMessage{Role: "assistant", Content: answer.Content},
+			ChatMessage{Role: "user", Content: fmt.Sprintf("That reply is invalid: %v. Reply again with only the corrected JSON.", err)},
+		)
+	}
+}
+
+// parseStructured extracts the JSON value from a reply, tolerating code
+// fences around it, and validates it against schema.
+func parseStructured(content string, schema map[string]interface{}) (json.RawMessage, error) {
+	content = strings.TrimSpace(content)
+	if body, ok := strings.CutPrefix(content, "```"); ok {
+		body = strings.TrimPrefix(body, "json")
+		content = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(body), "```"))
+	}
+
+	var value interface{}
+	if err := json.Unmarshal([]byte(content), &value); err != nil {
+		return nil, fmt.Errorf("not valid JSON (%v)", err)
+	}
+	if err := validateSchema(value, schema, "$"); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// validateSchema checks value against the commonly used subset of JSON
+// schema: type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, minimum, maximum, minLength and maxLength.
+// Other keywords are ignored.
+func validateSchema(value interface{}, schema map[string]interface{}, path string) error {
+	if t, ok := schema["type"]; ok && !matchesType(value, t) {
+		return fmt.Errorf("%s should be of type %v", path, t)
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s should be one of %v", path, enum)
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, value) {
+		return fmt.Errorf("%s should be %v", path, c)
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := schema["properties"].(map[string]interface{})
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if s, ok := name.(string); ok {
+					if _, present := v[s]; !present {
+						return fmt.Errorf("%s is missing required property %q", path, s)
+					}
+				}
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			sub, ok := properties[k].(map[string]interface{})
+			if !ok {
+				if extra, isBool := schema["additionalProperties"].(bool); isBool && !extra {
+					return fmt.Errorf("%s has unexpected property %q", path, k)
+				}
+				if sub, ok = schema["additionalProperties"].(map[string]interface{}); !ok {
+					continue
+				}
+			}
+			if err := validateSchema(v[k], sub, path+"."+k); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if n, ok := schema["minItems"].(float64); ok && float64(len(v)) < n {
+			return fmt.Errorf("%s should have at least %v items", path, n)
+		}
+		if n, ok := schema["maxItems"].(float64); ok && float64(len(v)) > n {
+			return fmt.Errorf("%s should have at most %v items", path, n)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateSchema(item, items, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case float64:
+		if n, ok := schema["minimum"].(float64); ok && v < n {
+			return fmt.Errorf("%s should be at least %v", path, n)
+		}
+		if n, ok := schema["maximum"].(float64); ok && v > n {
+			return fmt.Errorf("%s should be at most %v", path, n)
+		}
+	case string:
+		length := float64(len([]rune(v)))
+		if n, ok := schema["minLength"].(float64); ok && length < n {
+			return fmt.Errorf("%s should be at least %v characters", path, n)
+		}
+		if n, ok := schema["maxLength"].(float64); ok && length > n {
+			return fmt.Errorf("%s should be at most %v characters", path, n)
+		}
+	}
+	return nil
+}
+
+// matchesType reports whether value has the schema type t, which is a type
+// name or a list of them.
+func matchesType(value interface{}, t interface{}) bool {
+	if types, ok := t.([]interface{}); ok {
+		for _, t := range types {
+			if matchesType(value, t) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch t {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+func jsonEqual(a, b interface{}) bool {
+	x, err1 := json.Marshal(a)
+	y, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && string(x) == string(y)
+}
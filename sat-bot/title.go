@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+const titlePrompt = `Write a short title (at most six words) for this conversation with SatBot, the Saturnalia fest assistant.
+Reply with the title only, without quotes or trailing punctuation.`
+
+// titleMaxLength is counted in characters, not bytes.
+const titleMaxLength = 80
+
+// maybeGenerateTitle starts titling the session in the background once it
+// reaches its second turn. The caller must hold session.mu.
+func maybeGenerateTitle(session *Session) {
+	if session.Title != "" || session.titlePending || session.userTurns() < 2 {
+		return
+	}
+	session.titlePending = true
+
+	var transcript strings.Builder
+	for _, entry := range session.Transcript {
+		fmt.Fprintf(&transcript, "%s: %s\n", entry.Role, entry.Content)
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+
+		title, err := callModel(ctx, []ChatMessage{
+			{Role: "system", Content: titlePrompt},
+			{Role: "user", Content: transcript.String()},
+		}, 0.3, 20)
+
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		session.titlePending = false
+		if err != nil {
+			slog.Error("Failed to generate title", "session_id", session.ID, "err", err)
+			return
+		}
+		session.Title = cleanTitle(title)
+	}()
+}
+
+func cleanTitle(title string) string {
+	title = strings.TrimSpace(strings.SplitN(strings.TrimSpace(title), "\n", 2)[0])
+	title = strings.Trim(title, "\"'`*# ")
+	title = strings.TrimRight(title, ".!?")
+	if runes := []rune(title); len(runes) > titleMaxLength {
+		title = strings.TrimSpace(string(runes[:titleMaxLength]))
+	}
+	return title
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCleanTitle(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		want  string
+	}{
+		{"plain", "Pronite tickets", "Pronite tickets"},
+		{"quoted with punctuation", `"Pronite tickets?"`, "Pronite tickets"},
+		{"markdown heading", "## Hackathon rules\nSome explanation", "Hackathon rules"},
+		{"long ASCII", strings.Repeat("a", 100), strings.Repeat("a", titleMaxLength)},
+		{"long multibyte", strings.Repeat("é", 100), strings.Repeat("é", titleMaxLength)},
+		{"long Devanagari", strings.Repeat("सैटर्नलिया ", 20), strings.TrimSpace(string([]rune(strings.Repeat("सैटर्नलिया ", 20))[:titleMaxLength]))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := cleanTitle(tt.title)
+			if got != tt.want {
+				t.Errorf("cleanTitle() = %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("cleanTitle() = %q, not valid UTF-8", got)
+			}
+		})
+	}
+}
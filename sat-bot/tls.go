@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+var (
+	// certManager gets and renews certificates from Let's Encrypt; it is nil
+	// when TLS is off and the server speaks plain HTTP on PORT.
+	certManager *autocert.Manager
+	tlsPort     = "443"
+	httpPort    = "80"
+)
+
+// loadTLSConfig reads TLS_DOMAINS, the comma-separated domains to serve over
+// HTTPS with certificates from Let's Encrypt; empty leaves TLS to a reverse
+// proxy. Certificates are kept in TLS_CACHE_DIR (tls-cache by default) and
+// registered to TLS_EMAIL. HTTPS is served on TLS_PORT (443), and HTTP_PORT
+// (80) answers the ACME challenges and redirects everything else to HTTPS.
+// ACME_DIRECTORY_URL switches to another CA, such as the Let's Encrypt
+// staging one.
+func loadTLSConfig() {
+	var domains []string
+	for _, domain := range strings.Split(getEnv("TLS_DOMAINS", ""), ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) == 0 {
+		return
+	}
+	tlsPort = getEnv("TLS_PORT", tlsPort)
+	httpPort = getEnv("HTTP_PORT", httpPort)
+
+	certManager = &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(getEnv("TLS_CACHE_DIR", "tls-cache")),
+		Email:      getEnv("TLS_EMAIL", ""),
+	}
+	if url := getEnv("ACME_DIRECTORY_URL", ""); url != "" {
+		certManager.Client = &acme.Client{DirectoryURL: url}
+	}
+	slog.Info("Serving HTTPS", "port", tlsPort, "domains", domains)
+}
+
+// serve runs server until it fails, over HTTPS with a redirect listener
+// when TLS is on, in which case server listens on TLS_PORT.
+func serve(server *http.Server) error {
+	if certManager == nil {
+		return server.ListenAndServe()
+	}
+
+	redirect := &http.Server{
+		Addr:         ":" + httpPort,
+		Handler:      certManager.HTTPHandler(http.HandlerFunc(redirectToHTTPS)),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+	go func() {
+		if err := redirect.ListenAndServe(); err != nil {
+			log.Fatalf("HTTP redirect listener failed: %v", err)
+		}
+	}()
+
+	server.TLSConfig = certManager.TLSConfig()
+	server.TLSConfig.MinVersion = tls.VersionTLS12
+	return server.ListenAndServeTLS("", "")
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL over HTTPS.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if tlsPort != "443" {
+		host = net.JoinHostPort(host, tlsPort)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
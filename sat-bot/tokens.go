@@ -0,0 +1,220 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Per-message overhead of the chat format (role markers and separators) and
+// the priming tokens added for the assistant reply, as counted by tiktoken.
+const tokensPerMessage = 3
+const tokensReplyPriming = 3
+
+var (
+	// modelContextWindow is the total number of tokens the model accepts for
+	// prompt and completion combined.
+	modelContextWindow = 16384
+	// minCompletionTokens is the smallest reply budget worth sending a
+	// request for.
+	minCompletionTokens = 64
+	// contextTokenLimit caps the knowledge in each prompt below what the
+	// context window leaves room for. 0 leaves only the window.
+	contextTokenLimit = 0
+)
+
+func loadTokenConfig() {
+	modelContextWindow = getEnvInt("MODEL_CONTEXT_WINDOW", modelContextWindow)
+	minCompletionTokens = getEnvInt("MIN_COMPLETION_TOKENS", minCompletionTokens)
+	contextTokenLimit = getEnvInt("CONTEXT_TOKEN_LIMIT", contextTokenLimit)
+}
+
+// estimateTokens approximates the number of cl100k/o200k tokens in s. It
+// splits text the way tiktoken's pre-tokenizer does (words with their
+// leading space, digit groups of up to three, punctuation runs) and charges
+// long words and non-Latin scripts extra, which keeps the estimate within a
+// few percent of the real encoder for English prose and errs high otherwise.
+func estimateTokens(s string) int {
+	tokens := 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == ' ' && i+size < len(s) && isWordRune(s[i+size:]):
+			// A single leading space merges into the following word.
+			i += size
+		case unicode.IsSpace(r):
+			j := i
+			for j < len(s) {
+				r2, n := utf8.DecodeRuneInString(s[j:])
+				if !unicode.IsSpace(r2) {
+					break
+				}
+				j += n
+			}
+			tokens++
+			i = j
+		case unicode.IsLetter(r) && r < utf8.RuneSelf:
+			j := i
+			for j < len(s) && s[j] < utf8.RuneSelf && unicode.IsLetter(rune(s[j])) {
+				j++
+			}
+			tokens += wordTokens(j - i)
+			i = j
+		case unicode.IsDigit(r):
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			tokens += (j - i + 2) / 3
+			i = j
+		case r >= utf8.RuneSelf:
+			// Non-ASCII letters and symbols usually cost about one token
+			// per rune.
+			tokens++
+			i += size
+		default:
+			j := i
+			for j < len(s) && s[j] < utf8.RuneSelf && unicode.IsPunct(rune(s[j])) {
+				j++
+			}
+			if j == i {
+				j = i + size
+			}
+			tokens += (j - i + 1) / 2
+			i = j
+		}
+	}
+	return tokens
+}
+
+func isWordRune(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// wordTokens estimates the tokens for an ASCII word of n letters. Common
+// words up to seven letters are a single token; longer ones split into
+// roughly four-letter pieces.
+func wordTokens(n int) int {
+	if n <= 7 {
+		return 1
+	}
+	return (n + 3) / 4
+}
+
+func messageTokens(m ChatMessage) int {
+	tokens := tokensPerMessage + estimateTokens(m.Role) + estimateTokens(m.Content)
+	for _, call := range m.ToolCalls {
+		tokens += estimateTokens(call.Function.Name) + estimateTokens(call.Function.Arguments)
+	}
+	return tokens
+}
+
+func messagesTokens(messages []ChatMessage) int {
+	total := tokensReplyPriming
+	for _, m := range messages {
+		total += messageTokens(m)
+	}
+	return total
+}
+
+// PromptParts are the pieces assembled into a chat request, in the order they
+// are sent. Knowledge is injected into the system prompt via SystemPrompt.
+// FitKnowledge, when set, shrinks Knowledge to a token limit in place of
+// cutting it off at that limit.
+type PromptParts struct {
+	SystemPrompt func(knowledge string) string
+	Knowledge    string
+	FitKnowledge func(limit int) string
+	Extra        []ChatMessage
+	History      []ChatMessage
+	User         ChatMessage
+}
+
+// fitContextWindow assembles the messages for a request so that the prompt
+// plus the reply fit in modelContextWindow, and returns them together with
+// the max_tokens to request, which is at most maxCompletion. The system
+// prompt instructions, extra system messages and the user turn are always
+// kept. The remaining room is shared between knowledge and history: history
+// may use up to half of it, keeping the newest whole messages, knowledge is
+// fitted to what is left and to contextTokenLimit, and any room knowledge
+// does not need goes back to older history. The result depends only on the
+// inputs, so identical requests are trimmed identically. ok is false when
+// not even the fixed parts fit.
+func fitContextWindow(parts PromptParts, maxCompletion int) (messages []ChatMessage, maxTokens int, ok bool) {
+	base := []ChatMessage{{Role: "system", Content: parts.SystemPrompt("")}}
+	base = append(base, parts.Extra...)
+	base = append(base, parts.User)
+
+	available := modelContextWindow - minCompletionTokens - messagesTokens(base)
+	if available < 0 {
+		return nil, 0, false
+	}
+
+	historyBudget := available / 2
+	keep := 0
+	used := 0
+	for i := len(parts.History) - 1; i >= 0; i-- {
+		cost := messageTokens(parts.History[i])
+		if used+cost > historyBudget {
+			break
+		}
+		used += cost
+		keep++
+	}
+
+	limit := available - used
+	if contextTokenLimit > 0 && contextTokenLimit < limit {
+		limit = contextTokenLimit
+	}
+	var knowledge string
+	if parts.FitKnowledge != nil {
+		knowledge = parts.FitKnowledge(limit)
+	} else {
+		knowledge = truncateToTokens(parts.Knowledge, limit)
+	}
+	used += estimateTokens(knowledge)
+
+	for i := len(parts.History) - keep - 1; i >= 0; i-- {
+		cost := messageTokens(parts.History[i])
+		if used+cost > available {
+			break
+		}
+		used += cost
+		keep++
+	}
+
+	messages = []ChatMessage{{Role: "system", Content: parts.SystemPrompt(knowledge)}}
+	messages = append(messages, parts.Extra...)
+	messages = append(messages, parts.History[len(parts.History)-keep:]...)
+	messages = append(messages, parts.User)
+
+	maxTokens = modelContextWindow - messagesTokens(messages)
+	if maxTokens > maxCompletion {
+		maxTokens = maxCompletion
+	}
+	return messages, maxTokens, true
+}
+
+// truncateToTokens returns the longest prefix of s made of whole lines whose
+// estimated size is within limit tokens.
+func truncateToTokens(s string, limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+	if estimateTokens(s) <= limit {
+		return s
+	}
+
+	var b strings.Builder
+	used := 0
+	for _, line := range strings.SplitAfter(s, "\n") {
+		cost := estimateTokens(line)
+		if used+cost > limit {
+			break
+		}
+		used += cost
+		b.WriteString(line)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want int
+	}{
+		{"empty", "", 0},
+		{"word", "hello", 1},
+		{"leading space merges", "hello world", 2},
+		{"space run", "a  b", 3},
+		{"long word", "internationalization", 5},
+		{"digit groups", "12345", 2},
+		{"punctuation run", "!!!", 2},
+		{"non-ASCII rune", "héllo", 3},
+		{"sentence", "When is the fest?", 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimateTokens(tt.text); got != tt.want {
+				t.Errorf("estimateTokens(%q) = %d, want %d", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFitContextWindow(t *testing.T) {
+	window, limit := modelContextWindow, contextTokenLimit
+	t.Cleanup(func() { modelContextWindow, contextTokenLimit = window, limit })
+
+	// The system prompt without knowledge, the user turn and the reply
+	// priming take 15 tokens; "user" turns 5 and "assistant" turns 7.
+	history := []ChatMessage{
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: "hi"},
+		{Role: "user", Content: "hi"},
+		{Role: "assistant", Content: "hi"},
+	}
+	tests := []struct {
+		name         string
+		window       int
+		limit        int
+		knowledge    string
+		wantOK       bool
+		wantHistory  int
+		wantSystem   string
+		wantMaxToken int
+	}{
+		{
+			name:   "everything fits",
+			window: 1000, knowledge: "Fest dates.",
+			wantOK: true, wantHistory: 4, wantSystem: "Rules.\nFest dates.", wantMaxToken: 200,
+		},
+		{
+			// 20 tokens of room: the newest turn fits in the history's
+			// half, and older ones take the room the knowledge left.
+			name:   "history trimmed to the newest turns",
+			window: 99,
+			wantOK: true, wantHistory: 3, wantSystem: "Rules.\n", wantMaxToken: 65,
+		},
+		{
+			name:   "knowledge capped by contextTokenLimit",
+			window: 1000, limit: 2, knowledge: "one\ntwo\nthree",
+			wantOK: true, wantHistory: 4, wantSystem: "Rules.\none", wantMaxToken: 200,
+		},
+		{
+			name:   "fixed parts do not fit",
+			window: 50,
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modelContextWindow, contextTokenLimit = tt.window, tt.limit
+			parts := PromptParts{
+				SystemPrompt: func(knowledge string) string { return "Rules.\n" + knowledge },
+				Knowledge:    tt.knowledge,
+				History:      history,
+				User:         ChatMessage{Role: "user", Content: "hi"},
+			}
+			messages, maxTokens, ok := fitContextWindow(parts, 200)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := messages[0].Content; got != tt.wantSystem {
+				t.Errorf("system prompt = %q, want %q", got, tt.wantSystem)
+			}
+			if got := len(messages) - 2; got != tt.wantHistory {
+				t.Errorf("kept %d history messages, want %d", got, tt.wantHistory)
+			}
+			kept := messages[1 : len(messages)-1]
+			for i, m := range kept {
+				if want := history[len(history)-len(kept)+i]; m.Role != want.Role || m.Content != want.Content {
+					t.Errorf("history message %d = %+v, not the newest ones", i, m)
+				}
+			}
+			if maxTokens != tt.wantMaxToken {
+				t.Errorf("maxTokens = %d, want %d", maxTokens, tt.wantMaxToken)
+			}
+			if total := messagesTokens(messages) + maxTokens; total > tt.window {
+				t.Errorf("prompt and reply take %d tokens, over the window of %d", total, tt.window)
+			}
+		})
+	}
+}
+
+func TestTruncateToTokens(t *testing.T) {
+	tests := []struct {
+		text  string
+		limit int
+		want  string
+	}{
+		{"one\ntwo\nthree", 100, "one\ntwo\nthree"},
+		{"one\ntwo\nthree", 4, "one\ntwo"},
+		{"one\ntwo\nthree", 1, ""},
+		{"one", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := truncateToTokens(tt.text, tt.limit); got != tt.want {
+			t.Errorf("truncateToTokens(%q, %d) = %q, want %q", tt.text, tt.limit, got, tt.want)
+		}
+	}
+	if got := truncateToTokens(strings.Repeat("word\n", 10), 6); estimateTokens(got) > 6 {
+		t.Errorf("truncated text %q is over the limit", got)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// maxToolCalls caps the tool calls accepted from a single model reply.
+const maxToolCalls = 16
+
+// maxToolResultTokens caps the size of a tool result sent to the model.
+const maxToolResultTokens = 1000
+
+// maxToolRounds is how many times the model may call tools for one question
+// before it has to answer with what it has.
+var maxToolRounds = 3
+
+// FestEvent is one entry of the events file that the tools answer from.
+type FestEvent struct {
+	Name            string `json:"name"`
+	Category        string `json:"category,omitempty"`
+	Date            string `json:"date"`
+	Start           string `json:"start,omitempty"`
+	End             string `json:"end,omitempty"`
+	Venue           string `json:"venue,omitempty"`
+	RegistrationURL string `json:"registration_url,omitempty"`
+}
+
+// Tool is a Go function the model can call. Run receives the arguments the
+// model sent and returns a value that is sent back as JSON.
+type Tool struct {
+	Spec ToolSpec
+	Run  func(args json.RawMessage) (interface{}, error)
+}
+
+var (
+	festEvents []FestEvent
+	// tools is empty when no events file is loaded, which turns tool
+	// calling off.
+	tools = map[string]*Tool{}
+	// toolSpecs lists the registered tools in a stable order.
+	toolSpecs []ToolSpec
+)
+
+// loadTools reads the events from EVENTS_FILE (events.json by default), a
+// JSON array of FestEvent, and registers the tools that answer from them.
+// TOOL_MAX_ROUNDS limits the calls per question; 0 disables tools.
+func loadTools() {
+	maxToolRounds = getEnvInt("TOOL_MAX_ROUNDS", maxToolRounds)
+	if maxToolRounds <= 0 {
+		return
+	}
+
+	path := getEnv("EVENTS_FILE", "events.json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Failed to read events", "path", path, "err", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &festEvents); err != nil {
+		slog.Error("Failed to parse events, tools disabled", "path", path, "err", err)
+		return
+	}
+
+	eventParam := map[string]interface{}{
+		"type":        "string",
+		"description": "Name or part of the name of the event, e.g. \"Ruhaniyat\"",
+	}
+	registerTool(&Tool{
+		Spec: ToolSpec{
+			Name:        "get_event_schedule",
+			Description: "Get the date, start and end time and venue of fest events. Filter by event name, category or date; with no filters returns the full schedule.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"event":    eventParam,
+					"category": map[string]interface{}{"type": "string", "description": "Event category, e.g. \"cultural\" or \"technical\""},
+					"date":     map[string]interface{}{"type": "string", "description": "Date as written in the schedule, e.g. \"14 November\""},
+				},
+			},
+		},
+		Run: getEventSchedule,
+	})
+	registerTool(&Tool{
+		Spec: ToolSpec{
+			Name:        "get_venue",
+			Description: "Get where an event takes place.",
+			Parameters: map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{"event": eventParam},
+				"required":   []string{"event"},
+			},
+		},
+		Run: func(args json.RawMessage) (interface{}, error) {
+			return eventField(args, func(e FestEvent) (string, string) { return "venue", e.Venue })
+		},
+	})
+	registerTool(&Tool{
+		Spec: ToolSpec{
+			Name:        "get_registration_link",
+			Description: "Get the registration link for an event.",
+			Parameters: map[string]interface{}{
+				"type":       "object",
+				"properties": map[string]interface{}{"event": eventParam},
+				"required":   []string{"event"},
+			},
+		},
+		Run: func(args json.RawMessage) (interface{}, error) {
+			return eventField(args, func(e FestEvent) (string, string) { return "registration_url", e.RegistrationURL })
+		},
+	})
+	slog.Info("Loaded events, tools enabled", "events", len(festEvents), "path", path)
+}
+
+func registerTool(t *Tool) {
+	tools[t.Spec.Name] = t
+	toolSpecs = append(toolSpecs, t.Spec)
+}
+
+// functionTools renders tool specs in the OpenAI "function" tool format,
+// which Ollama uses as well.
+func functionTools(specs []ToolSpec) []map[string]interface{} {
+	out := make([]map[string]interface{}, len(specs))
+	for i, t := range specs {
+		out[i] = map[string]interface{}{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name":        t.Name,
+				"description": t.Description,
+				"parameters":  t.Parameters,
+			},
+		}
+	}
+	return out
+}
+
+// runTool executes a tool call and returns the result to send back to the
+// model. Failures are reported to the model rather than to the user, so it
+// can recover or answer without the tool.
+func runTool(call ToolCall) string {
+	var result interface{}
+	tool, ok := tools[call.Function.Name]
+	if !ok {
+		result = map[string]string{"error": fmt.Sprintf("unknown tool %q", call.Function.Name)}
+	} else {
+		args := json.RawMessage(call.Function.Arguments)
+		if len(args) == 0 {
+			args = json.RawMessage("{}")
+		}
+		value, err := tool.Run(args)
+		if err != nil {
+			slog.Error("Tool failed", "tool", call.Function.Name, "err", err)
+			value = map[string]string{"error": err.Error()}
+		}
+		result = value
+	}
+
+	// One field per line, so long results can be cut at line boundaries.
+	data, err := json.MarshalIndent(result, "", "")
+	if err != nil {
+		return `{"error":"tool result could not be encoded"}`
+	}
+	return string(data)
+}
+
+type eventQuery struct {
+	Event    string `json:"event"`
+	Category string `json:"category"`
+	Date     string `json:"date"`
+}
+
+func (q eventQuery) matches(e FestEvent) bool {
+	contains := func(s, sub string) bool {
+		return sub == "" || strings.Contains(strings.ToLower(s), strings.ToLower(strings.TrimSpace(sub)))
+	}
+	return contains(e.Name, q.Event) && contains(e.Category, q.Category) && contains(e.Date, q.Date)
+}
+
+func findEvents(q eventQuery) []FestEvent {
+	matches := []FestEvent{}
+	for _, e := range festEvents {
+		if q.matches(e) {
+			matches = append(matches, e)
+		}
+	}
+	return matches
+}
+
+func getEventSchedule(args json.RawMessage) (interface{}, error) {
+	var q eventQuery
+	if err := json.Unmarshal(args, &q); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+	events := findEvents(q)
+	if len(events) == 0 {
+		return map[string]string{"error": "no matching events in the schedule"}, nil
+	}
+	return map[string]interface{}{"events": events}, nil
+}
+
+// eventField looks up a single detail of the events matching the "event"
+// argument.
+func eventField(args json.RawMessage, field func(FestEvent) (name, value string)) (interface{}, error) {
+	var q eventQuery
+	if err := json.Unmarshal(args, &q); err != nil {
+		return nil, fmt.Errorf("invalid arguments: %v", err)
+	}
+	if strings.TrimSpace(q.Event) == "" {
+		return nil, fmt.Errorf("event is required")
+	}
+
+	results := []map[string]string{}
+	for _, e := range findEvents(eventQuery{Event: q.Event}) {
+		name, value := field(e)
+		if value == "" {
+			value = "not listed"
+		}
+		results = append(results, map[string]string{"event": e.Name, name: value})
+	}
+	if len(results) == 0 {
+		return map[string]string{"error": "no matching events in the schedule"}, nil
+	}
+	return map[string]interface{}{"events": results}, nil
+}
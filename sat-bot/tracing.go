@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	traceBatchSize     = 512
+	traceQueueSize     = 4096
+	traceFlushInterval = 5 * time.Second
+)
+
+// tracing is set when spans are exported. Until loadTracingConfig installs
+// a provider exporting them, the global provider is a no-op and spans cost
+// nothing.
+var tracing bool
+
+// loadTracingConfig reads the standard OpenTelemetry variables:
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT, or OTEL_EXPORTER_OTLP_ENDPOINT with
+// /v1/traces appended, is where spans are sent, tracing being off when
+// neither is set; OTEL_EXPORTER_OTLP_HEADERS are comma-separated key=value
+// headers for the collector; OTEL_SERVICE_NAME names the service (satbot);
+// and OTEL_TRACES_SAMPLER_ARG is the share of new traces recorded (1 by
+// default). Traces started upstream keep the caller's sampling decision.
+// Spans are sent in batches over the http/protobuf protocol; when the queue
+// is full they are dropped rather than slowing requests down.
+func loadTracingConfig() {
+	endpoint := getEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	if endpoint == "" {
+		if base := getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""); base != "" {
+			endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return
+	}
+	if protocol := getEnv("OTEL_EXPORTER_OTLP_PROTOCOL", "http/protobuf"); protocol != "http/protobuf" {
+		configProblem("OTEL_EXPORTER_OTLP_PROTOCOL: only http/protobuf is supported, not %q", protocol)
+		return
+	}
+	ratio := getEnvFloat("OTEL_TRACES_SAMPLER_ARG", 1)
+	if ratio < 0 || ratio > 1 {
+		configProblem("OTEL_TRACES_SAMPLER_ARG: must be between 0 and 1")
+		return
+	}
+
+	headers := map[string]string{}
+	for _, pair := range strings.Split(getEnv("OTEL_EXPORTER_OTLP_HEADERS", ""), ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok && strings.TrimSpace(k) != "" {
+			headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	exporter, err := otlptracehttp.New(context.Background(),
+		otlptracehttp.WithEndpointURL(endpoint),
+		otlptracehttp.WithHeaders(headers),
+		otlptracehttp.WithTimeout(10*time.Second),
+	)
+	if err != nil {
+		configProblem("OTEL_EXPORTER_OTLP_ENDPOINT: %v", err)
+		return
+	}
+
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Error("Tracing error", "err", err)
+	}))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithMaxQueueSize(traceQueueSize),
+			sdktrace.WithMaxExportBatchSize(traceBatchSize),
+			sdktrace.WithBatchTimeout(traceFlushInterval),
+		),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", getEnv("OTEL_SERVICE_NAME", "satbot")),
+			attribute.String("service.version", buildInfo.Version),
+		)),
+	))
+	tracing = true
+	slog.Info("Exporting traces", "endpoint", endpoint, "sample_ratio", ratio)
+}
+
+// startSpan starts a span as a child of the one in ctx, or as the root of a
+// new trace, and returns the context carrying it.
+func startSpan(ctx context.Context, name string, kind trace.SpanKind) (context.Context, trace.Span) {
+	opts := []trace.SpanStartOption{trace.WithSpanKind(kind)}
+	if id := interactionIDFromContext(ctx); id != "" {
+		opts = append(opts, trace.WithAttributes(attribute.String("satbot.interaction_id", id)))
+	}
+	return otel.Tracer("satbot").Start(ctx, name, opts...)
+}
+
+// setSpanError marks s as failed with err, if err is not nil.
+func setSpanError(s trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	s.RecordError(err)
+	s.SetStatus(codes.Error, err.Error())
+}
+
+// injectTraceparent adds the traceparent of the span in ctx to h, so the
+// callee can continue the trace.
+func injectTraceparent(ctx context.Context, h http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(h))
+}
+
+// traceIDFromContext returns the hex ID of the trace in ctx, or an empty
+// string.
+func traceIDFromContext(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// tracingMiddleware runs each request in a server span named after its
+// route, continuing the trace in its traceparent header if it has one.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tracing {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route := routeName(r)
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, s := startSpan(ctx, r.Method+" "+route, trace.SpanKindServer)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.SetAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+			attribute.Int("http.response.status_code", rec.status),
+			attribute.String("client.address", clientIP(r)),
+			attribute.String("user_agent.original", r.UserAgent()),
+		)
+		if rec.status >= 500 {
+			s.SetStatus(codes.Error, fmt.Sprintf("status %d", rec.status))
+		}
+		s.End()
+	})
+}
+
+// endModelSpan records the outcome of a model call on s and ends it.
+func endModelSpan(s trace.Span, req CompletionRequest, resp *CompletionResponse, err error) {
+	if req.Model != "" {
+		s.SetAttributes(attribute.String("gen_ai.request.model", req.Model))
+	}
+	if err != nil {
+		setSpanError(s, err)
+	} else {
+		s.SetAttributes(
+			attribute.String("gen_ai.system", resp.Provider),
+			attribute.String("gen_ai.response.model", resp.Model),
+			attribute.Int("gen_ai.usage.input_tokens", resp.Usage.PromptTokens),
+			attribute.Int("gen_ai.usage.output_tokens", resp.Usage.CompletionTokens),
+		)
+	}
+	s.End()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// useSpanRecorder exports spans to the returned exporter for the test.
+func useSpanRecorder(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	oldPropagator, oldTracing := otel.GetTextMapPropagator(), tracing
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracing = true
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(oldPropagator)
+		tracing = oldTracing
+	})
+	return exporter
+}
+
+func spanAttr(s tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range s.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	exporter := useSpanRecorder(t)
+	var handlerTrace string
+	router := mux.NewRouter()
+	router.Use(tracingMiddleware)
+	router.HandleFunc("/v1/conversations/{id}", func(w http.ResponseWriter, r *http.Request) {
+		handlerTrace = traceIDFromContext(r.Context())
+		ctx, s := startSpan(r.Context(), "complete fake", trace.SpanKindInternal)
+		endModelSpan(s, CompletionRequest{Model: "m"}, nil, errCallUpstream)
+		injected := http.Header{}
+		injectTraceparent(ctx, injected)
+		if injected.Get("traceparent") == "" {
+			t.Error("no traceparent sent on")
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	r := httptest.NewRequest(http.MethodGet, "/v1/conversations/abc", nil)
+	r.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	model, server := spans[0], spans[1]
+	if server.Name != "GET /v1/conversations/{id}" || server.SpanKind != trace.SpanKindServer {
+		t.Errorf("server span %q of kind %v", server.Name, server.SpanKind)
+	}
+	if got := server.SpanContext.TraceID().String(); got != traceID || handlerTrace != traceID {
+		t.Errorf("trace %s, seen by the handler as %s, want the caller's %s", got, handlerTrace, traceID)
+	}
+	if got := server.Parent.SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("server span parent %s, want the caller's span", got)
+	}
+	if got := spanAttr(server, "http.response.status_code").AsInt64(); got != http.StatusBadGateway {
+		t.Errorf("status code attribute %d", got)
+	}
+	if server.Status.Code != codes.Error {
+		t.Errorf("server span status %v, want an error", server.Status.Code)
+	}
+	if model.Parent.SpanID() != server.SpanContext.SpanID() || model.Status.Code != codes.Error {
+		t.Errorf("model span parent %s with status %v, want a failed child of the server span", model.Parent.SpanID(), model.Status.Code)
+	}
+	if got := spanAttr(model, "gen_ai.request.model").AsString(); got != "m" {
+		t.Errorf("model attribute %q", got)
+	}
+}
+
+func TestTracingOff(t *testing.T) {
+	ctx, s := startSpan(context.Background(), "complete fake", trace.SpanKindInternal)
+	s.End()
+	if id := traceIDFromContext(ctx); id != "" {
+		t.Errorf("trace ID %q with tracing off", id)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gapOffTopic marks a question the bot declined as outside what it covers.
+const gapOffTopic = "off_topic"
+
+// defaultOffTopicPhrases are what the model tends to say when it declines a
+// question as unrelated to the fest, lowercased.
+var defaultOffTopicPhrases = []string{
+	"i can only discuss", "i can only help with", "i can only answer",
+	"i can only assist", "i'm only able to", "i am only able to",
+	"outside the scope", "outside my scope", "not related to",
+	"unrelated to", "can't help with that", "cannot help with that",
+}
+
+var offTopicPhrases = defaultOffTopicPhrases
+
+type UnansweredReport struct {
+	From  time.Time `json:"from"`
+	To    time.Time `json:"to"`
+	Total int       `json:"total"`
+	// Reasons counts the questions by reason, off_topic or no_answer.
+	Reasons map[string]int `json:"reasons"`
+	Groups  []GapGroup     `json:"groups"`
+}
+
+// loadUnansweredConfig reads OFF_TOPIC_PHRASES, the "|"-separated phrases
+// that mark an answer as declining the question as off topic. The phrases
+// that mark it as not knowing are the knowledge gaps' GAP_PHRASES.
+func loadUnansweredConfig() {
+	if phrases := getEnv("OFF_TOPIC_PHRASES", ""); phrases != "" {
+		offTopicPhrases = strings.Split(strings.ToLower(phrases), "|")
+	}
+}
+
+// unansweredReason tells why answer did not answer its question: gapOffTopic
+// when it declined it as outside the bot's scope, gapNoAnswer when it said it
+// did not know, or "" for an answer. Canned answers are taken as answers.
+func unansweredReason(answer *CompletionResponse) string {
+	switch answer.Provider {
+	case "faq", "circuit-breaker", "guard":
+		return ""
+	}
+	text := strings.ToLower(strings.ReplaceAll(answer.Content, "’", "'"))
+	for _, phrase := range offTopicPhrases {
+		if phrase != "" && strings.Contains(text, phrase) {
+			return gapOffTopic
+		}
+	}
+	if gaps != nil && gaps.saysUnknown(answer.Content) {
+		return gapNoAnswer
+	}
+	return ""
+}
+
+// unansweredHandler reports the questions over the range that were declined
+// as off topic or answered with not knowing, grouped by similar wording and
+// most asked first, so organizers can see what visitors want beyond the
+// bot's scope. reason keeps only off_topic or no_answer, and limit caps the
+// number of groups.
+func unansweredHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	reason := q.Get("reason")
+	if reason != "" && reason != gapOffTopic && reason != gapNoAnswer {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		writeErrorBody(w, ErrorResponse{Error: "reason must be off_topic or no_answer"})
+		return
+	}
+	limit := 0
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			writeErrorBody(w, ErrorResponse{Error: "limit must be a positive number"})
+			return
+		}
+		limit = n
+	}
+	from, to, found, ok := analyticsInteractions(w, r)
+	if !ok {
+		return
+	}
+
+	report := UnansweredReport{From: from, To: to, Reasons: map[string]int{}}
+	var groups []*GapGroup
+	for n := len(found) - 1; n >= 0; n-- {
+		i := found[n]
+		question := strings.TrimSpace(i.Question)
+		if i.Unanswered == "" || question == "" || (reason != "" && i.Unanswered != reason) {
+			continue
+		}
+		report.Total++
+		report.Reasons[i.Unanswered]++
+		terms := termSet(question)
+		var group *GapGroup
+		for _, g := range groups {
+			if similarGaps(g, KnowledgeGap{Question: question}, terms) {
+				group = g
+				break
+			}
+		}
+		if group == nil {
+			group = &GapGroup{Question: question, Reasons: map[string]int{}, LastSeen: i.Time, terms: terms}
+			groups = append(groups, group)
+		}
+		group.Count++
+		group.Reasons[i.Unanswered]++
+		group.FirstSeen = i.Time
+		if len(group.Examples) < maxGapExamples && !containsFold(group.Examples, question) {
+			group.Examples = append(group.Examples, question)
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool { return groups[i].Count > groups[j].Count })
+	if limit > 0 && len(groups) > limit {
+		groups = groups[:limit]
+	}
+	report.Groups = make([]GapGroup, len(groups))
+	for i, g := range groups {
+		report.Groups[i] = *g
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(report)
+}
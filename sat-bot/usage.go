@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// usageRetentionDays is how many days of counters are kept.
+const usageRetentionDays = 60
+
+var errTokenBudgetExhausted = errors.New("Daily token budget exhausted, please try again tomorrow")
+
+type DailyUsage struct {
+	Date             string `json:"date"`
+	Requests         int64  `json:"requests"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+	TotalTokens      int64  `json:"total_tokens"`
+	// EstimatedCost covers the calls to models with a configured price.
+	EstimatedCost float64 `json:"estimated_cost"`
+	// Models breaks the day down by "provider/model".
+	Models map[string]ModelUsage `json:"models,omitempty"`
+}
+
+// ModelUsage counts the calls to one model of one provider. Calls include
+// the failed ones, and TotalLatencyMS divided by Calls is their average
+// latency. Fallbacks are the answers it served after an earlier entry of
+// the fallback chain failed.
+type ModelUsage struct {
+	Provider         string  `json:"provider"`
+	Model            string  `json:"model"`
+	Calls            int64   `json:"calls"`
+	Failures         int64   `json:"failures"`
+	Fallbacks        int64   `json:"fallbacks"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	TotalLatencyMS   int64   `json:"total_latency_ms"`
+	EstimatedCost    float64 `json:"estimated_cost"`
+}
+
+// clone copies d, so the copy can be read without holding the lock.
+func (d *DailyUsage) clone() DailyUsage {
+	c := *d
+	if d.Models != nil {
+		c.Models = make(map[string]ModelUsage, len(d.Models))
+		for k, v := range d.Models {
+			c.Models[k] = v
+		}
+	}
+	return c
+}
+
+// UsageTracker accumulates provider token usage per calendar day in the
+// configured timezone and enforces an optional daily budget. Counters are
+// flushed to a JSON file so a restart does not reset the budget.
+type UsageTracker struct {
+	mu       sync.Mutex
+	path     string
+	location *time.Location
+	days     map[string]*DailyUsage
+	dirty    bool
+
+	// dailyBudget is the total tokens allowed per day; zero is unlimited.
+	dailyBudget int64
+	// budgetAction is "refuse" to reject chats once the budget is spent or
+	// "degrade" to keep answering with degradedMaxTokens.
+	budgetAction      string
+	degradedMaxTokens int
+}
+
+var usage *UsageTracker
+
+func init() {
+	expvar.Publish("token_usage_today", expvar.Func(func() any {
+		if usage == nil {
+			return nil
+		}
+		return usage.Today()
+	}))
+}
+
+func loadUsage() {
+	location, err := time.LoadLocation(getEnv("USAGE_TIMEZONE", "Asia/Kolkata"))
+	if err != nil {
+		slog.Warn("Invalid USAGE_TIMEZONE, using UTC", "err", err)
+		location = time.UTC
+	}
+
+	usage = &UsageTracker{
+		path:              getEnv("USAGE_FILE", "usage.json"),
+		location:          location,
+		days:              make(map[string]*DailyUsage),
+		dailyBudget:       int64(getEnvInt("DAILY_TOKEN_BUDGET", 0)),
+		budgetAction:      getEnv("TOKEN_BUDGET_ACTION", "refuse"),
+		degradedMaxTokens: getEnvInt("TOKEN_BUDGET_DEGRADED_MAX_TOKENS", 150),
+	}
+
+	data, err := os.ReadFile(usage.path)
+	if err == nil {
+		var days []*DailyUsage
+		if err := json.Unmarshal(data, &days); err != nil {
+			slog.Error("Failed to parse usage file", "path", usage.path, "err", err)
+		}
+		for _, day := range days {
+			usage.days[day.Date] = day
+		}
+	} else if !os.IsNotExist(err) {
+		slog.Error("Failed to read usage file", "path", usage.path, "err", err)
+	}
+
+	go usage.flushLoop(10 * time.Second)
+}
+
+func (u *UsageTracker) today() string {
+	return time.Now().In(u.location).Format("2006-01-02")
+}
+
+// Record adds one call to provider's model, failed when err is set, with
+// the usage and estimated cost of a successful one.
+func (u *UsageTracker) Record(provider, model string, resp *CompletionResponse, cost float64, latency time.Duration, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	day := u.dayLocked()
+	m := day.Models[provider+"/"+model]
+	m.Provider, m.Model = provider, model
+	m.Calls++
+	m.TotalLatencyMS += latency.Milliseconds()
+	if err != nil {
+		m.Failures++
+	} else {
+		used := resp.Usage
+		day.Requests++
+		day.PromptTokens += int64(used.PromptTokens)
+		day.CompletionTokens += int64(used.CompletionTokens)
+		day.TotalTokens += int64(used.TotalTokens)
+		day.EstimatedCost += cost
+		m.PromptTokens += int64(used.PromptTokens)
+		m.CompletionTokens += int64(used.CompletionTokens)
+		m.EstimatedCost += cost
+	}
+	day.Models[provider+"/"+model] = m
+	u.dirty = true
+}
+
+// RecordFallback counts an answer served by a later entry of the fallback
+// chain.
+func (u *UsageTracker) RecordFallback(provider, model string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	day := u.dayLocked()
+	m := day.Models[provider+"/"+model]
+	m.Provider, m.Model = provider, model
+	m.Fallbacks++
+	day.Models[provider+"/"+model] = m
+	u.dirty = true
+}
+
+// dayLocked returns today's counters, creating them. The caller must hold
+// u.mu.
+func (u *UsageTracker) dayLocked() *DailyUsage {
+	date := u.today()
+	day, ok := u.days[date]
+	if !ok {
+		day = &DailyUsage{Date: date}
+		u.days[date] = day
+		u.prune()
+	}
+	if day.Models == nil {
+		day.Models = make(map[string]ModelUsage)
+	}
+	return day
+}
+
+// prune drops days beyond the retention window. The caller must hold u.mu.
+func (u *UsageTracker) prune() {
+	cutoff := time.Now().In(u.location).AddDate(0, 0, -usageRetentionDays).Format("2006-01-02")
+	for date := range u.days {
+		if date < cutoff {
+			delete(u.days, date)
+		}
+	}
+}
+
+func (u *UsageTracker) Today() DailyUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	date := u.today()
+	if day, ok := u.days[date]; ok {
+		return day.clone()
+	}
+	return DailyUsage{Date: date}
+}
+
+// Days returns the retained counters, oldest first.
+func (u *UsageTracker) Days() []DailyUsage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	days := make([]DailyUsage, 0, len(u.days))
+	for _, day := range u.days {
+		days = append(days, day.clone())
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	return days
+}
+
+// BudgetExhausted reports whether today's usage has reached the budget.
+func (u *UsageTracker) BudgetExhausted() bool {
+	return u.dailyBudget > 0 && u.Today().TotalTokens >= u.dailyBudget
+}
+
+// applyBudget adjusts a chat request for the daily budget, returning
+// errTokenBudgetExhausted when it must be refused.
+func (u *UsageTracker) applyBudget(opts *AnswerOptions) error {
+	if !u.BudgetExhausted() {
+		return nil
+	}
+	if u.budgetAction == "degrade" {
+		if opts.MaxTokens > u.degradedMaxTokens {
+			opts.MaxTokens = u.degradedMaxTokens
+		}
+		return nil
+	}
+	return errTokenBudgetExhausted
+}
+
+func (u *UsageTracker) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := u.Flush(); err != nil {
+			slog.Error("Failed to save usage", "path", u.path, "err", err)
+		}
+	}
+}
+
+// Flush writes the counters to disk if they changed since the last flush.
+func (u *UsageTracker) Flush() error {
+	u.mu.Lock()
+	if !u.dirty {
+		u.mu.Unlock()
+		return nil
+	}
+	days := make([]*DailyUsage, 0, len(u.days))
+	for _, day := range u.days {
+		copied := day.clone()
+		days = append(days, &copied)
+	}
+	u.dirty = false
+	u.mu.Unlock()
+
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	data, err := json.MarshalIndent(days, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(u.path), ".usage-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), u.path)
+}
+
+// meteredProvider records the token usage and cost of every successful call,
+// and the duration and outcome of every call in the metrics, the usage
+// counters and a span. Provider failures are reported to Sentry. model is
+// the provider's default, used for calls that do not pick one.
+type meteredProvider struct {
+	Provider
+	model string
+}
+
+func (m *meteredProvider) Complete(ctx context.Context, req CompletionRequest) (*CompletionResponse, error) {
+	start := time.Now()
+	ctx, s := startSpan(ctx, "complete "+m.Name(), trace.SpanKindInternal)
+	resp, err := m.Provider.Complete(ctx, req)
+	endModelSpan(s, req, resp, err)
+	m.observe(ctx, start, req, resp, err)
+	return resp, err
+}
+
+func (m *meteredProvider) Stream(ctx context.Context, req CompletionRequest, onDelta func(string) error) (*CompletionResponse, error) {
+	start := time.Now()
+	ctx, s := startSpan(ctx, "stream "+m.Name(), trace.SpanKindInternal)
+	first := true
+	resp, err := m.Provider.Stream(ctx, req, func(delta string) error {
+		if first {
+			first = false
+			s.SetAttributes(attribute.Int64("gen_ai.response.time_to_first_token_ms", time.Since(start).Milliseconds()))
+		}
+		return onDelta(delta)
+	})
+	endModelSpan(s, req, resp, err)
+	m.observe(ctx, start, req, resp, err)
+	return resp, err
+}
+
+func (m *meteredProvider) observe(ctx context.Context, start time.Time, req CompletionRequest, resp *CompletionResponse, err error) {
+	model := req.Model
+	if model == "" {
+		model = m.model
+	}
+	observeUpstream(m.Name(), model, start, resp, err)
+	addUpstreamCall(ctx, time.Since(start))
+	reportUpstreamFailure(ctx, m.Name(), err)
+	if usage == nil || errors.Is(err, context.Canceled) {
+		return
+	}
+	var cost float64
+	if err == nil {
+		cost, _ = estimateCost(resp.Provider, resp.Model, resp.Usage)
+	}
+	usage.Record(m.Name(), model, resp, cost, time.Since(start), err)
+}
+
+type UsageResponse struct {
+	Today       DailyUsage   `json:"today"`
+	DailyBudget int64        `json:"daily_budget"`
+	Exhausted   bool         `json:"budget_exhausted"`
+	Currency    string       `json:"currency"`
+	Days        []DailyUsage `json:"days"`
+	// Models totals each model over the retained days, busiest first.
+	Models []ModelUsage `json:"models"`
+}
+
+func totalModelUsage(days []DailyUsage) []ModelUsage {
+	totals := map[string]ModelUsage{}
+	for _, day := range days {
+		for key, m := range day.Models {
+			t := totals[key]
+			t.Provider, t.Model = m.Provider, m.Model
+			t.Calls += m.Calls
+			t.Failures += m.Failures
+			t.Fallbacks += m.Fallbacks
+			t.PromptTokens += m.PromptTokens
+			t.CompletionTokens += m.CompletionTokens
+			t.TotalLatencyMS += m.TotalLatencyMS
+			t.EstimatedCost += m.EstimatedCost
+			totals[key] = t
+		}
+	}
+	models := make([]ModelUsage, 0, len(totals))
+	for _, key := range sortedKeys(totals) {
+		models = append(models, totals[key])
+	}
+	sort.SliceStable(models, func(i, j int) bool { return models[i].Calls > models[j].Calls })
+	return models
+}
+
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	days := usage.Days()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(UsageResponse{
+		Today:       usage.Today(),
+		DailyBudget: usage.dailyBudget,
+		Exhausted:   usage.BudgetExhausted(),
+		Currency:    pricingCurrency,
+		Days:        days,
+		Models:      totalModelUsage(days),
+	})
+}
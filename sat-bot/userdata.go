@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// UserDataDeletion counts what a deletion request removed.
+type UserDataDeletion struct {
+	Conversations int `json:"conversations"`
+	Memories      int `json:"memories"`
+	Interactions  int `json:"interactions"`
+}
+
+// eraseUserData removes the conversations of a logged-in attendee, userID,
+// or of an anonymous visitor, visitorID, with the interactions stored from
+// them and their feedback, and the attendee's memory. Interactions still
+// queued are saved first, for none to be stored after. Stored interactions
+// carry the user but not the visitor, so those of a visitor's sessions that
+// have already expired cannot be found.
+func eraseUserData(ctx context.Context, userID, visitorID string) (UserDataDeletion, error) {
+	sessionIDs := sessions.DeleteOwned(userID, visitorID)
+	deletion := UserDataDeletion{Conversations: len(sessionIDs)}
+
+	if userID != "" {
+		n, err := memories.Forget(userID)
+		if err != nil {
+			return deletion, fmt.Errorf("memory: %w", err)
+		}
+		deletion.Memories = n
+	}
+
+	if interactions == nil {
+		return deletion, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, interactionStoreTimeout)
+	defer cancel()
+	if err := interactionQueue.flush(ctx); err != nil {
+		return deletion, fmt.Errorf("interactions: %w", err)
+	}
+	// A zero filter matches everything, so each is only used when set.
+	var filters []InteractionFilter
+	if userID != "" {
+		filters = append(filters, InteractionFilter{UserID: userID})
+	}
+	if len(sessionIDs) > 0 {
+		filters = append(filters, InteractionFilter{SessionIDs: sessionIDs})
+	}
+	for _, filter := range filters {
+		n, err := interactions.Delete(ctx, filter)
+		deletion.Interactions += n
+		if err != nil {
+			return deletion, fmt.Errorf("interactions: %w", err)
+		}
+	}
+	return deletion, nil
+}
+
+// deleteUserDataHandler erases what is stored about the attendee {id}, to
+// honor a deletion request. Attendees may call it for themselves when logged
+// in as {id}; anyone else needs the admin key.
+func deleteUserDataHandler(w http.ResponseWriter, r *http.Request) {
+	userID := mux.Vars(r)["id"]
+	if userIDFromRequest(r) == userID {
+		writeUserDataDeletion(w, r, userID, "")
+		return
+	}
+	requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		if deletion, ok := writeUserDataDeletion(w, r, userID, ""); ok {
+			auditChange(r, fmt.Sprintf("- %d conversations, %d memories and %d interactions\n", deletion.Conversations, deletion.Memories, deletion.Interactions))
+		}
+	})(w, r)
+}
+
+// deleteMyDataHandler erases the calling visitor's conversations and, when
+// they are logged in, everything stored about the attendee too. It needs no
+// account, so anonymous visitors can remove what they asked; visitorMiddleware
+// gives every caller a visitor ID.
+func deleteMyDataHandler(w http.ResponseWriter, r *http.Request) {
+	writeUserDataDeletion(w, r, userIDFromRequest(r), visitorIDFromContext(r.Context()))
+}
+
+func writeUserDataDeletion(w http.ResponseWriter, r *http.Request, userID, visitorID string) (UserDataDeletion, bool) {
+	w.Header().Set("Content-Type", "application/json")
+	deletion, err := eraseUserData(r.Context(), userID, visitorID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to delete user data", "user", userID, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to delete all data, try again"})
+		return deletion, false
+	}
+	slog.InfoContext(r.Context(), "Deleted user data",
+		"user", userID,
+		"conversations", deletion.Conversations,
+		"memories", deletion.Memories,
+		"interactions", deletion.Interactions,
+	)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(deletion)
+	return deletion, true
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestEraseUserData(t *testing.T) {
+	store := &memoryInteractionStore{}
+	useInteractionWriter(t, store, 100, 50, time.Hour)
+	oldMemories := memories
+	memories = NewMemoryStore(filepath.Join(t.TempDir(), "memory.json"))
+	t.Cleanup(func() { memories = oldMemories })
+	if err := memories.SetOptIn("ana", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memories.Add("ana", "Vegetarian"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*Session{
+		{ID: "erase-ana", UserID: "ana"},
+		{ID: "erase-visitor", VisitorID: "v1"},
+		{ID: "erase-other", UserID: "bo", VisitorID: "v2"},
+	} {
+		useSession(t, s)
+	}
+	ctx := context.Background()
+	store.Save(ctx, []Interaction{
+		{ID: "1", SessionID: "expired", UserID: "ana"},
+		{ID: "2", SessionID: "erase-other", UserID: "bo"},
+	})
+	// Still queued when the deletion starts, so it must be saved and then
+	// deleted rather than stored afterwards.
+	interactionQueue.enqueue(Interaction{ID: "3", SessionID: "erase-visitor"})
+	interactionQueue.enqueue(Interaction{ID: "4", SessionID: "erase-ana", UserID: "ana"})
+
+	deletion, err := eraseUserData(ctx, "ana", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (UserDataDeletion{Conversations: 2, Memories: 1, Interactions: 3}); deletion != want {
+		t.Errorf("eraseUserData() = %+v, want %+v", deletion, want)
+	}
+	if err := interactionQueue.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	left, _ := store.List(ctx, InteractionFilter{})
+	if len(left) != 1 || left[0].ID != "2" {
+		t.Errorf("interactions left %+v, want only the other user's", left)
+	}
+	if mem := memories.Get("ana"); mem.OptIn || len(mem.Facts) > 0 {
+		t.Errorf("memory left %+v", mem)
+	}
+	sessions.mu.Lock()
+	var ids []string
+	for id := range sessions.sessions {
+		ids = append(ids, id)
+	}
+	sessions.mu.Unlock()
+	if slices.Contains(ids, "erase-ana") || slices.Contains(ids, "erase-visitor") || !slices.Contains(ids, "erase-other") {
+		t.Errorf("sessions left %v, want only the other user's", ids)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configProblems collects what is wrong with the settings while they are
+// loaded, for validateConfig to report them all at once rather than the
+// first one alone.
+var configProblems struct {
+	mu   sync.Mutex
+	list []string
+	// done is set once the startup checks ran; later problems, from
+	// settings read when needed, are only logged.
+	done bool
+	// reloading collects the problems found while the settings are
+	// reloaded, see collectConfigProblems.
+	reloading *[]string
+	// connect is what the loaders left for once the settings are checked,
+	// see whenConfigValid.
+	connect []func()
+}
+
+// configProblem records a problem with the settings, to fail startup with.
+func configProblem(format string, args ...any) {
+	problem := fmt.Sprintf(format, args...)
+	configProblems.mu.Lock()
+	defer configProblems.mu.Unlock()
+	if list := configProblems.reloading; list != nil {
+		if !slices.Contains(*list, problem) {
+			*list = append(*list, problem)
+		}
+		return
+	}
+	if configProblems.done {
+		slog.Warn("Invalid setting, using the default", "problem", problem)
+		return
+	}
+	if !slices.Contains(configProblems.list, problem) {
+		configProblems.list = append(configProblems.list, problem)
+	}
+}
+
+// whenConfigValid runs connect, which reaches another service, such as a
+// database to prepare or a key set to fetch, once validateConfig found
+// nothing wrong with the settings; a deployment with a typo then fails
+// before anything is contacted. It runs connect at once after that.
+func whenConfigValid(connect func()) {
+	configProblems.mu.Lock()
+	if !configProblems.done {
+		configProblems.connect = append(configProblems.connect, connect)
+		configProblems.mu.Unlock()
+		return
+	}
+	configProblems.mu.Unlock()
+	connect()
+}
+
+// providerNames are the model providers created at startup, see
+// newProvider.
+var providerNames []string
+
+// providerKeyVars are the settings holding the API keys of the providers
+// that cannot work without one.
+var providerKeyVars = map[string]string{
+	"groq":      "GROQ_API_KEY",
+	"openai":    "OPENAI_API_KEY",
+	"anthropic": "ANTHROPIC_API_KEY",
+}
+
+// validateConfig checks the settings once everything is loaded, and exits
+// listing every problem found, with those recorded while loading, so a
+// deployment is fixed in one go instead of failing on the first question.
+// Only then does it run what the loaders left for whenConfigValid.
+func validateConfig() {
+	checkProviderConfig()
+	checkContextDir()
+	checkOrigins()
+	checkTimeouts()
+	if port := getEnv("PORT", "8080"); !validPort(port) {
+		configProblem("PORT: %q is not a port number", port)
+	}
+	exitOnConfigProblems()
+
+	configProblems.mu.Lock()
+	configProblems.done = true
+	connect := configProblems.connect
+	configProblems.connect = nil
+	configProblems.mu.Unlock()
+	for _, f := range connect {
+		f()
+	}
+}
+
+// exitOnConfigProblems exits listing the problems recorded so far, if any.
+func exitOnConfigProblems() {
+	configProblems.mu.Lock()
+	problems := configProblems.list
+	configProblems.mu.Unlock()
+	if len(problems) == 0 {
+		return
+	}
+	// The logs may be JSON, so the list is also written out plainly for
+	// whoever started the bot.
+	slog.Error("Invalid configuration", "problems", problems)
+	fmt.Fprintf(os.Stderr, "Invalid configuration, fix these and start again:\n  - %s\n", strings.Join(problems, "\n  - "))
+	os.Exit(1)
+}
+
+// collectConfigProblems runs read and returns the problems with the
+// settings it found, rather than logging them and using the defaults.
+func collectConfigProblems(read func()) []string {
+	var problems []string
+	configProblems.mu.Lock()
+	configProblems.reloading = &problems
+	configProblems.mu.Unlock()
+	read()
+	configProblems.mu.Lock()
+	defer configProblems.mu.Unlock()
+	configProblems.reloading = nil
+	return problems
+}
+
+func checkProviderConfig() {
+	keyPoolsMu.Lock()
+	defer keyPoolsMu.Unlock()
+	for _, name := range providerNames {
+		env, ok := providerKeyVars[name]
+		if !ok {
+			continue
+		}
+		pool := keyPools[name]
+		pool.mu.Lock()
+		missing := len(pool.keys) == 0
+		pool.mu.Unlock()
+		if missing {
+			configProblem("%s is not set, so every call to %s would fail: set it, or pick another provider with LLM_PROVIDER, such as ollama for a local model", env, name)
+		}
+	}
+}
+
+// checkContextDir checks that the knowledge base can be read. A missing
+// directory is only a problem when CONTEXT_DIR names it; by default, a single
+// context.txt or remote sources may be used instead.
+func checkContextDir() {
+	info, err := os.Stat(contextDir)
+	switch {
+	case os.IsNotExist(err):
+		if getEnv("CONTEXT_DIR", "") != "" {
+			configProblem("CONTEXT_DIR: %s does not exist", contextDir)
+		}
+	case err != nil:
+		configProblem("CONTEXT_DIR: %v", err)
+	case !info.IsDir():
+		configProblem("CONTEXT_DIR: %s is not a directory", contextDir)
+	default:
+		if _, err := os.ReadDir(contextDir); err != nil {
+			configProblem("CONTEXT_DIR: %s cannot be read: %v", contextDir, err)
+		}
+	}
+}
+
+// checkOrigins checks the CORS origins.
+func checkOrigins() {
+	for _, problem := range originProblems(*allowedOrigins.Load()) {
+		configProblem("%s", problem)
+	}
+}
+
+// originProblems returns what is wrong with origins, which must be a scheme
+// and a host, with an optional port and no path, as browsers send them.
+func originProblems(origins []string) []string {
+	var problems []string
+	for _, origin := range origins {
+		if origin == "*" {
+			continue
+		}
+		rest := origin
+		if scheme, host, ok := strings.Cut(origin, "://"); ok {
+			if scheme != "http" && scheme != "https" {
+				problems = append(problems, fmt.Sprintf("CORS_ALLOWED_ORIGINS: %q should use http or https", origin))
+				continue
+			}
+			rest = host
+		}
+		host, port := rest, ""
+		if h, p, err := net.SplitHostPort(rest); err == nil {
+			host, port = h, p
+		}
+		host = strings.TrimPrefix(host, "*.")
+		switch {
+		case strings.ContainsAny(host, "/?#*@ "):
+			problems = append(problems, fmt.Sprintf("CORS_ALLOWED_ORIGINS: %q is not an origin, which is a scheme and a host such as https://saturnalia.in, without a path", origin))
+		case host == "":
+			problems = append(problems, fmt.Sprintf("CORS_ALLOWED_ORIGINS: %q has no host", origin))
+		case port != "" && !validPort(port):
+			problems = append(problems, fmt.Sprintf("CORS_ALLOWED_ORIGINS: %q has an invalid port", origin))
+		}
+	}
+	return problems
+}
+
+// checkTimeouts checks that the timeouts leave each other room: a model call
+// must be able to time out, and be retried, before the answer deadline cuts
+// the request short.
+func checkTimeouts() {
+	deadline := serverWriteTimeout - answerDeadlineMargin
+	if deadline <= 0 {
+		configProblem("SERVER_WRITE_TIMEOUT: %s leaves no time to answer, it must be over %s", serverWriteTimeout, answerDeadlineMargin)
+		return
+	}
+	for _, name := range providerNames {
+		env := strings.ToUpper(name) + "_TIMEOUT"
+		if getEnv(env, "") == "" {
+			env = "UPSTREAM_TIMEOUT"
+		}
+		timeout := getEnvDuration(env, 10*time.Second)
+		if timeout > 0 && timeout >= deadline {
+			configProblem("%s: %s for %s is not shorter than the %s SERVER_WRITE_TIMEOUT leaves to answer, so slow calls are cut off instead of timing out and being retried", env, timeout, name, deadline)
+		}
+	}
+	if probe := getEnvDuration("HEALTH_PROBE_TIMEOUT", 3*time.Second); probe >= serverWriteTimeout {
+		configProblem("HEALTH_PROBE_TIMEOUT: %s is not shorter than SERVER_WRITE_TIMEOUT (%s), so a slow dependency fails /health/deep instead of being reported", probe, serverWriteTimeout)
+	}
+}
+
+func validPort(s string) bool {
+	n, err := strconv.Atoi(s)
+	return err == nil && n > 0 && n < 65536
+}
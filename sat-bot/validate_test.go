@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadersRecordProblems(t *testing.T) {
+	slots, params := upstreamSlots, generation.Load()
+	bytes, chars, tokens := maxRequestBytes, maxMessageChars, maxMessageTokens
+	guard := injectionGuard
+	t.Cleanup(func() {
+		upstreamSlots = slots
+		generation.Store(params)
+		maxRequestBytes, maxMessageChars, maxMessageTokens = bytes, chars, tokens
+		injectionGuard = guard
+	})
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		load func()
+		want string
+		// kept checks that the loader fell back to a usable setting.
+		kept func() bool
+	}{
+		{
+			name: "upstream queue",
+			env:  map[string]string{"MAX_CONCURRENT_UPSTREAM": "4", "UPSTREAM_QUEUE_SIZE": "-1"},
+			load: loadUpstreamLimit,
+			want: "UPSTREAM_QUEUE_SIZE: must not be negative",
+			kept: func() bool { return upstreamSlots != nil && upstreamSlots.queue == 8 },
+		},
+		{
+			name: "generation parameters",
+			env:  map[string]string{"GEN_TEMPERATURE": "5"},
+			load: loadGenerationConfig,
+			want: "Generation parameters: Temperature must be between 0 and 2",
+			kept: func() bool { return reflect.DeepEqual(currentGeneration(), defaultGeneration) },
+		},
+		{
+			name: "message limits",
+			env:  map[string]string{"MAX_REQUEST_BYTES": "0"},
+			load: loadLimitConfig,
+			want: "MAX_REQUEST_BYTES, MAX_MESSAGE_CHARS or MAX_MESSAGE_TOKENS: must be positive",
+			kept: func() bool { return maxRequestBytes == bytes },
+		},
+		{
+			name: "injection guard",
+			env:  map[string]string{"INJECTION_GUARD": "shout"},
+			load: loadInjectionConfig,
+			want: `INJECTION_GUARD: unknown mode "shout"`,
+			kept: func() bool { return injectionGuard == guard },
+		},
+		{
+			name: "not a number",
+			env:  map[string]string{"MAX_CONCURRENT_UPSTREAM": "many"},
+			load: loadUpstreamLimit,
+			want: `MAX_CONCURRENT_UPSTREAM: "many" is not an integer`,
+			kept: func() bool { return upstreamSlots != nil && cap(upstreamSlots.slots) == 64 },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			problems := collectConfigProblems(tt.load)
+			if !reflect.DeepEqual(problems, []string{tt.want}) {
+				t.Errorf("problems = %q, want %q", problems, tt.want)
+			}
+			if !tt.kept() {
+				t.Error("loader did not fall back to a usable setting")
+			}
+		})
+	}
+}
+
+// TestValidateConfig runs validateConfig in a child process, since it exits
+// when a setting is wrong.
+func TestValidateConfig(t *testing.T) {
+	if os.Getenv("SATBOT_VALIDATE_CHILD") == "1" {
+		loadCORSConfig()
+		loadUpstreamLimit()
+		whenConfigValid(func() { fmt.Println("connected") })
+		validateConfig()
+		whenConfigValid(func() { fmt.Println("connected after") })
+		return
+	}
+
+	tests := []struct {
+		name     string
+		env      []string
+		wantExit bool
+		want     []string
+		notWant  []string
+	}{
+		{
+			name: "valid",
+			want: []string{"connected\nconnected after"},
+		},
+		{
+			name:     "every problem listed",
+			env:      []string{"UPSTREAM_QUEUE_SIZE=-1", "PORT=99999", "CORS_ALLOWED_ORIGINS=https://saturnalia.in/chat"},
+			wantExit: true,
+			want: []string{
+				"UPSTREAM_QUEUE_SIZE: must not be negative",
+				`PORT: "99999" is not a port number`,
+				`CORS_ALLOWED_ORIGINS: "https://saturnalia.in/chat" is not an origin`,
+			},
+			notWant: []string{"connected"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestValidateConfig$")
+			cmd.Env = append(os.Environ(), "SATBOT_VALIDATE_CHILD=1", "CONFIG_FILE=", "CONTEXT_DIR=")
+			cmd.Env = append(cmd.Env, tt.env...)
+			out, err := cmd.CombinedOutput()
+			if exited := err != nil; exited != tt.wantExit {
+				t.Fatalf("exited = %v (%v), want %v:\n%s", exited, err, tt.wantExit, out)
+			}
+			for _, s := range tt.want {
+				if !strings.Contains(string(out), s) {
+					t.Errorf("output lacks %q:\n%s", s, out)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(string(out), s) {
+					t.Errorf("output has %q:\n%s", s, out)
+				}
+			}
+		})
+	}
+}
+
+func TestOriginProblems(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   string
+	}{
+		{"https://saturnalia.in", ""},
+		{"https://*.saturnalia.in", ""},
+		{"http://localhost:3000", ""},
+		{"*", ""},
+		{"ftp://saturnalia.in", "should use http or https"},
+		{"https://saturnalia.in/", "is not an origin"},
+		{"https://", "has no host"},
+		{"https://saturnalia.in:99999", "has an invalid port"},
+	}
+	for _, tt := range tests {
+		problems := originProblems([]string{tt.origin})
+		switch {
+		case tt.want == "" && len(problems) > 0:
+			t.Errorf("%q: %q, want no problem", tt.origin, problems)
+		case tt.want != "" && (len(problems) != 1 || !strings.Contains(problems[0], tt.want)):
+			t.Errorf("%q: %q, want one containing %q", tt.origin, problems, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VectorStore keeps chunk embeddings across restarts, keyed by a hash of
+// the embeddings model and the embedded text, so that only new or changed
+// chunks are sent to the embeddings API. A shared store lets replicas reuse
+// each other's embeddings.
+type VectorStore interface {
+	// Lookup returns the stored vectors among keys. Missing keys are left
+	// out of the result.
+	Lookup(ctx context.Context, keys []string) (map[string][]float32, error)
+	// Save stores vectors by key.
+	Save(ctx context.Context, vectors map[string][]float32) error
+}
+
+// vectorStoreTimeout bounds each lookup or save.
+const vectorStoreTimeout = 30 * time.Second
+
+// vectorStore is nil when embeddings are only kept in memory.
+var vectorStore VectorStore
+
+// loadVectorStore reads VECTOR_STORE: empty keeps embeddings in memory,
+// file stores them in VECTOR_STORE_PATH (embeddings.json by default) and
+// postgres in the pgvector database at VECTOR_STORE_URL.
+func loadVectorStore() {
+	switch kind := getEnv("VECTOR_STORE", ""); kind {
+	case "", "memory":
+	case "file":
+		path := getEnv("VECTOR_STORE_PATH", "embeddings.json")
+		store, err := newFileVectorStore(path)
+		if err != nil {
+			configProblem("VECTOR_STORE_PATH: %v", err)
+			return
+		}
+		vectorStore = store
+		slog.Info("Storing embeddings", "path", path)
+	case "postgres", "pgvector":
+		db, err := openPostgres(getEnv("VECTOR_STORE_URL", ""))
+		if err != nil {
+			configProblem("VECTOR_STORE_URL: %v", err)
+			return
+		}
+		store := &pgVectorStore{db: db}
+		whenConfigValid(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), vectorStoreTimeout)
+			defer cancel()
+			if err := store.migrate(ctx); err != nil {
+				log.Fatalf("Failed to prepare the pgvector store: %v", err)
+			}
+		})
+		vectorStore = store
+		registerHealthCheck("vector_store", pingCheck(sqlPinger{db}))
+		slog.Info("Storing embeddings in pgvector")
+	default:
+		configProblem("VECTOR_STORE: unknown store %q", kind)
+	}
+}
+
+// vectorKey identifies the embedding of text by the model that made it.
+func vectorKey(model, text string) string {
+	sum := sha256.Sum256([]byte(model + "\x00" + text))
+	return hex.EncodeToString(sum[:])
+}
+
+// fileVectorStore keeps every vector in one JSON file, rewritten on save.
+// It suits a single instance; replicas should share a pgvector store.
+type fileVectorStore struct {
+	path    string
+	mu      sync.Mutex
+	vectors map[string][]float32
+}
+
+func newFileVectorStore(path string) (*fileVectorStore, error) {
+	store := &fileVectorStore{path: path, vectors: map[string][]float32{}}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.vectors); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return store, nil
+}
+
+func (s *fileVectorStore) Lookup(_ context.Context, keys []string) (map[string][]float32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found := map[string][]float32{}
+	for _, key := range keys {
+		if v, ok := s.vectors[key]; ok {
+			found[key] = v
+		}
+	}
+	return found, nil
+}
+
+func (s *fileVectorStore) Save(_ context.Context, vectors map[string][]float32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, v := range vectors {
+		s.vectors[key] = v
+	}
+	data, err := json.Marshal(s.vectors)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// pgVectorStore keeps vectors in a PostgreSQL table with the pgvector
+// extension.
+type pgVectorStore struct {
+	db *sql.DB
+}
+
+const pgVectorSchema = `
+CREATE EXTENSION IF NOT EXISTS vector;
+CREATE TABLE IF NOT EXISTS satbot_embeddings (
+	key        TEXT PRIMARY KEY,
+	embedding  vector NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);`
+
+func (s *pgVectorStore) migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, pgVectorSchema)
+	return err
+}
+
+func (s *pgVectorStore) Lookup(ctx context.Context, keys []string) (map[string][]float32, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT key, embedding::text FROM satbot_embeddings WHERE key = ANY($1::text[])`, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	found := make(map[string][]float32, len(keys))
+	for rows.Next() {
+		var key, embedding string
+		if err := rows.Scan(&key, &embedding); err != nil {
+			return nil, err
+		}
+		v, err := parseVector(embedding)
+		if err != nil {
+			return nil, fmt.Errorf("embedding %s: %v", key, err)
+		}
+		found[key] = v
+	}
+	return found, rows.Err()
+}
+
+func (s *pgVectorStore) Save(ctx context.Context, vectors map[string][]float32) error {
+	keys := make([]string, 0, len(vectors))
+	values := make([]string, 0, len(vectors))
+	for key, v := range vectors {
+		keys = append(keys, key)
+		values = append(values, formatVector(v))
+	}
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO satbot_embeddings (key, embedding)
+		SELECT k, e::vector FROM unnest($1::text[], $2::text[]) AS t(k, e)
+		ON CONFLICT (key) DO NOTHING`,
+		keys, values)
+	return err
+}
+
+// formatVector writes v in pgvector's text format, [1,2,3].
+func formatVector(v []float32) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, x := range v {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(float64(x), 'g', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+func parseVector(s string) ([]float32, error) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.Split(s, ",")
+	v := make([]float32, len(fields))
+	for i, f := range fields {
+		x, err := strconv.ParseFloat(strings.TrimSpace(f), 32)
+		if err != nil {
+			return nil, err
+		}
+		v[i] = float32(x)
+	}
+	return v, nil
+}
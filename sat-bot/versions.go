@@ -0,0 +1,555 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Versions of the context directory are kept in CONTEXT_HISTORY_DIR as a
+// manifest per version under versions/ and the file contents under
+// objects/, named by their SHA-256 so unchanged files are stored once.
+// Remote sources are not versioned; they come back on the next sync.
+
+// ContextVersion describes one snapshot of the context directory.
+type ContextVersion struct {
+	ID        string            `json:"id"`
+	CreatedAt time.Time         `json:"created_at"`
+	Reason    string            `json:"reason"`
+	Files     []VersionedFile   `json:"files"`
+	byName    map[string]string `json:"-"`
+}
+
+type VersionedFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// VersionSummary is a version as listed, without its files.
+type VersionSummary struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Reason    string    `json:"reason"`
+	Documents int       `json:"documents"`
+	Current   bool      `json:"current"`
+}
+
+// DocumentDiff is how one document differs between two versions. Diff is
+// a unified diff of the documents' text.
+type DocumentDiff struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Diff   string `json:"diff,omitempty"`
+}
+
+// maxDiffLines bounds the size of documents that get a line diff.
+const maxDiffLines = 2000
+
+var (
+	errVersionNotFound = errors.New("Version not found")
+
+	// historyDir is empty when versioning is disabled.
+	historyDir   = "context-history"
+	historyLimit = 50
+)
+
+// loadContextHistory reads CONTEXT_HISTORY_DIR (empty disables versioning)
+// and CONTEXT_HISTORY_LIMIT, the number of versions kept. It must run
+// before loadContext so that the version in use at startup is recorded.
+func loadContextHistory() {
+	historyDir = getEnv("CONTEXT_HISTORY_DIR", historyDir)
+	historyLimit = getEnvInt("CONTEXT_HISTORY_LIMIT", historyLimit)
+	if historyLimit < 1 {
+		historyLimit = 1
+	}
+}
+
+func versionPath(id string) string {
+	return filepath.Join(historyDir, "versions", id+".json")
+}
+
+func objectPath(sum string) string {
+	return filepath.Join(historyDir, "objects", sum)
+}
+
+// snapshotContext records the files in the context directory as a new
+// version unless they match the latest one. It is called with reloadMu
+// held.
+func snapshotContext(reason string) error {
+	if historyDir == "" {
+		return nil
+	}
+
+	version := &ContextVersion{CreatedAt: time.Now().UTC(), Reason: reason}
+	err := walkDocuments(contextDir, func(path, name string, info fs.FileInfo) error {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		sum := hex.EncodeToString(hash[:])
+		if _, err := os.Stat(objectPath(sum)); os.IsNotExist(err) {
+			if err := writeFileAtomic(objectPath(sum), data); err != nil {
+				return err
+			}
+		}
+		version.Files = append(version.Files, VersionedFile{Name: name, Size: info.Size(), SHA256: sum})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sort.Slice(version.Files, func(i, j int) bool { return version.Files[i].Name < version.Files[j].Name })
+
+	versions, err := listVersions()
+	if err != nil {
+		return err
+	}
+	if n := len(versions); n > 0 && sameFiles(versions[n-1].Files, version.Files) {
+		return nil
+	}
+
+	version.ID = version.CreatedAt.Format("20060102-150405.000")
+	data, err := json.MarshalIndent(version, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(versionPath(version.ID), data); err != nil {
+		return err
+	}
+	return pruneVersions(append(versions, version))
+}
+
+func sameFiles(a, b []VersionedFile) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// listVersions returns all versions, oldest first.
+func listVersions() ([]*ContextVersion, error) {
+	entries, err := os.ReadDir(filepath.Join(historyDir, "versions"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []*ContextVersion
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || strings.HasPrefix(id, ".") {
+			continue
+		}
+		v, err := readVersion(id)
+		if err != nil {
+			slog.Warn("Skipping unreadable context version", "version", id, "err", err)
+			continue
+		}
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].ID < versions[j].ID })
+	return versions, nil
+}
+
+func readVersion(id string) (*ContextVersion, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return nil, errVersionNotFound
+	}
+	data, err := os.ReadFile(versionPath(id))
+	if os.IsNotExist(err) {
+		return nil, errVersionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var v ContextVersion
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	v.byName = map[string]string{}
+	for _, f := range v.Files {
+		v.byName[f.Name] = f.SHA256
+	}
+	return &v, nil
+}
+
+// pruneVersions deletes the oldest versions beyond historyLimit and the
+// objects no remaining version uses.
+func pruneVersions(versions []*ContextVersion) error {
+	if len(versions) <= historyLimit {
+		return nil
+	}
+	for _, v := range versions[:len(versions)-historyLimit] {
+		if err := os.Remove(versionPath(v.ID)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	used := map[string]bool{}
+	for _, v := range versions[len(versions)-historyLimit:] {
+		for _, f := range v.Files {
+			used[f.SHA256] = true
+		}
+	}
+	objects, err := os.ReadDir(filepath.Join(historyDir, "objects"))
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if !used[o.Name()] {
+			os.Remove(filepath.Join(historyDir, "objects", o.Name()))
+		}
+	}
+	return nil
+}
+
+// versionText returns the text of a document in a version, as the
+// knowledge base would see it.
+func versionText(v *ContextVersion, name string) (string, error) {
+	data, err := os.ReadFile(objectPath(v.byName[name]))
+	if err != nil {
+		return "", err
+	}
+	return documentText(name, data)
+}
+
+// diffVersions compares two versions document by document.
+func diffVersions(from, to *ContextVersion) ([]DocumentDiff, error) {
+	names := map[string]bool{}
+	for name := range from.byName {
+		names[name] = true
+	}
+	for name := range to.byName {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	diffs := []DocumentDiff{}
+	for _, name := range sorted {
+		oldSum, inFrom := from.byName[name]
+		newSum, inTo := to.byName[name]
+		if oldSum == newSum {
+			continue
+		}
+
+		var oldText, newText string
+		var err error
+		if inFrom {
+			if oldText, err = versionText(from, name); err != nil {
+				return nil, fmt.Errorf("%s in %s: %v", name, from.ID, err)
+			}
+		}
+		if inTo {
+			if newText, err = versionText(to, name); err != nil {
+				return nil, fmt.Errorf("%s in %s: %v", name, to.ID, err)
+			}
+		}
+
+		d := DocumentDiff{Name: name, Status: "modified"}
+		switch {
+		case !inFrom:
+			d.Status = "added"
+		case !inTo:
+			d.Status = "removed"
+		}
+		d.Diff = unifiedDiff(oldText, newText)
+		diffs = append(diffs, d)
+	}
+	return diffs, nil
+}
+
+// unifiedDiff returns the changed lines between a and b as unified diff
+// hunks with two lines of context.
+func unifiedDiff(a, b string) string {
+	if a == b {
+		return ""
+	}
+	var x, y []string
+	if a != "" {
+		x = strings.Split(a, "\n")
+	}
+	if b != "" {
+		y = strings.Split(b, "\n")
+	}
+
+	// Common leading and trailing lines need no table.
+	pre := 0
+	for pre < len(x) && pre < len(y) && x[pre] == y[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(x)-pre && suf < len(y)-pre && x[len(x)-1-suf] == y[len(y)-1-suf] {
+		suf++
+	}
+	mx, my := x[pre:len(x)-suf], y[pre:len(y)-suf]
+	if len(mx) > maxDiffLines || len(my) > maxDiffLines {
+		return fmt.Sprintf("@@ %d lines changed, too large to diff @@\n", max(len(mx), len(my)))
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of mx[i:]
+	// and my[j:].
+	lcs := make([][]int32, len(mx)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(my)+1)
+	}
+	for i := len(mx) - 1; i >= 0; i-- {
+		for j := len(my) - 1; j >= 0; j-- {
+			if mx[i] == my[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	type line struct {
+		op   byte
+		text string
+	}
+	var lines []line
+	for _, l := range x[:pre] {
+		lines = append(lines, line{' ', l})
+	}
+	i, j := 0, 0
+	for i < len(mx) || j < len(my) {
+		switch {
+		case i < len(mx) && j < len(my) && mx[i] == my[j]:
+			lines = append(lines, line{' ', mx[i]})
+			i++
+			j++
+		case j < len(my) && (i == len(mx) || lcs[i][j+1] >= lcs[i+1][j]):
+			lines = append(lines, line{'+', my[j]})
+			j++
+		default:
+			lines = append(lines, line{'-', mx[i]})
+			i++
+		}
+	}
+	for _, l := range x[len(x)-suf:] {
+		lines = append(lines, line{' ', l})
+	}
+
+	// Group changes into hunks, keeping two lines of context around them.
+	const contextLines = 2
+	var out strings.Builder
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+		from := max(0, start-contextLines)
+		end := start
+		for k := start; k < len(lines); k++ {
+			if lines[k].op != ' ' {
+				end = k
+			} else if k-end > 2*contextLines {
+				break
+			}
+		}
+		to := min(len(lines), end+contextLines+1)
+
+		oldStart, newStart := 1, 1
+		for _, l := range lines[:from] {
+			if l.op != '+' {
+				oldStart++
+			}
+			if l.op != '-' {
+				newStart++
+			}
+		}
+		oldCount, newCount := 0, 0
+		for _, l := range lines[from:to] {
+			if l.op != '+' {
+				oldCount++
+			}
+			if l.op != '-' {
+				newCount++
+			}
+		}
+		// An empty side is numbered by the line before it, as in diff -u.
+		if oldCount == 0 {
+			oldStart--
+		}
+		if newCount == 0 {
+			newStart--
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, l := range lines[from:to] {
+			out.WriteByte(l.op)
+			out.WriteString(l.text)
+			out.WriteByte('\n')
+		}
+		start = to
+	}
+	return out.String()
+}
+
+// rollbackContext makes the context directory match version v, writing
+// changed files and deleting those the version does not have, then reloads
+// the knowledge base, which records the result as a new version.
+func rollbackContext(v *ContextVersion) error {
+	current := map[string]bool{}
+	err := walkDocuments(contextDir, func(_, name string, _ fs.FileInfo) error {
+		current[name] = true
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for _, f := range v.Files {
+		data, err := os.ReadFile(objectPath(f.SHA256))
+		if err != nil {
+			return fmt.Errorf("%s: %v", f.Name, err)
+		}
+		file := filepath.Join(contextDir, filepath.FromSlash(f.Name))
+		if existing, err := os.ReadFile(file); err == nil && string(existing) == string(data) {
+			continue
+		}
+		if err := writeFileAtomic(file, data); err != nil {
+			return err
+		}
+	}
+	for name := range current {
+		if _, ok := v.byName[name]; !ok {
+			if err := os.Remove(filepath.Join(contextDir, filepath.FromSlash(name))); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	logContextReload("rollback to version " + v.ID)
+	return nil
+}
+
+func versionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	versions, err := listVersions()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to list context versions", "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to list versions"})
+		return
+	}
+
+	result := []VersionSummary{}
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		result = append(result, VersionSummary{
+			ID:        v.ID,
+			CreatedAt: v.CreatedAt,
+			Reason:    v.Reason,
+			Documents: len(v.Files),
+			Current:   i == len(versions)-1,
+		})
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(result)
+}
+
+// versionFromRequest loads the version named by the {id} route variable,
+// writing the error response itself when it cannot.
+func versionFromRequest(w http.ResponseWriter, id string) (*ContextVersion, bool) {
+	v, err := readVersion(id)
+	switch {
+	case errors.Is(err, errVersionNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		writeErrorBody(w, ErrorResponse{Error: "Version not found"})
+		return nil, false
+	case err != nil:
+		slog.Error("Failed to read context version", "version", id, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to read version"})
+		return nil, false
+	}
+	return v, true
+}
+
+// versionDiffHandler shows what changed from version {id} to the version
+// given by ?to=, the latest one by default.
+func versionDiffHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	from, ok := versionFromRequest(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	toID := r.URL.Query().Get("to")
+	if toID == "" {
+		versions, err := listVersions()
+		if err != nil || len(versions) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			writeErrorBody(w, ErrorResponse{Error: "Failed to read version"})
+			return
+		}
+		toID = versions[len(versions)-1].ID
+	}
+	to, ok := versionFromRequest(w, toID)
+	if !ok {
+		return
+	}
+
+	diffs, err := diffVersions(from, to)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to diff context versions", "from", from.ID, "to", to.ID, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to diff versions"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":      from.ID,
+		"to":        to.ID,
+		"documents": diffs,
+	})
+}
+
+func rollbackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	v, ok := versionFromRequest(w, mux.Vars(r)["id"])
+	if !ok {
+		return
+	}
+	if versions, err := listVersions(); err == nil && len(versions) > 0 {
+		if diffs, err := diffVersions(versions[len(versions)-1], v); err == nil {
+			for _, d := range diffs {
+				auditChange(r, "--- "+d.Name+" ("+d.Status+")\n"+d.Diff)
+			}
+		}
+	}
+	if err := rollbackContext(v); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to roll back context", "version", v.ID, "err", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		writeErrorBody(w, ErrorResponse{Error: "Failed to roll back"})
+		return
+	}
+	slog.InfoContext(r.Context(), "Context rolled back", "version", v.ID)
+	versionsHandler(w, r)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const visitorCookieName = "satbot_visitor"
+const visitorHeaderName = "X-Visitor-Token"
+const visitorTokenMaxAge = 30 * 24 * time.Hour
+
+type contextKey string
+
+const visitorContextKey contextKey = "visitor"
+
+var visitorSecret []byte
+
+func loadVisitorConfig() {
+	if secret := getEnv("VISITOR_TOKEN_SECRET", ""); secret != "" {
+		visitorSecret = []byte(secret)
+		return
+	}
+
+	visitorSecret = make([]byte, 32)
+	if _, err := rand.Read(visitorSecret); err != nil {
+		log.Fatalf("Failed to generate visitor token secret: %v", err)
+	}
+	slog.Warn("VISITOR_TOKEN_SECRET not set, visitor tokens will not survive a restart")
+}
+
+func signVisitor(visitorID string) string {
+	mac := hmac.New(sha256.New, visitorSecret)
+	mac.Write([]byte(visitorID))
+	return visitorID + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyVisitorToken returns the visitor ID carried by a token, or an empty
+// string if the token is malformed or was not signed by this server.
+func verifyVisitorToken(token string) string {
+	visitorID, signature, ok := strings.Cut(token, ".")
+	if !ok || visitorID == "" {
+		return ""
+	}
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, visitorSecret)
+	mac.Write([]byte(visitorID))
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return ""
+	}
+	return visitorID
+}
+
+// visitorMiddleware identifies anonymous visitors by a signed token so a
+// reconnecting client resumes its conversation. The token is read from the
+// X-Visitor-Token header or the satbot_visitor cookie; visitors without a
+// valid one are issued a new token through both.
+func visitorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(visitorHeaderName)
+		if token == "" {
+			if cookie, err := r.Cookie(visitorCookieName); err == nil {
+				token = cookie.Value
+			}
+		}
+
+		visitorID := verifyVisitorToken(token)
+		if visitorID == "" {
+			visitorID = newID()
+			token = signVisitor(visitorID)
+			http.SetCookie(w, &http.Cookie{
+				Name:     visitorCookieName,
+				Value:    token,
+				Path:     "/",
+				MaxAge:   int(visitorTokenMaxAge.Seconds()),
+				HttpOnly: true,
+				Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		w.Header().Set(visitorHeaderName, token)
+
+		ctx := context.WithValue(r.Context(), visitorContextKey, visitorID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func visitorIDFromContext(ctx context.Context) string {
+	visitorID, _ := ctx.Value(visitorContextKey).(string)
+	return visitorID
+}